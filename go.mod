@@ -0,0 +1,3 @@
+module mini_redis
+
+go 1.21
@@ -1,26 +1,177 @@
 // web server that implements mini clone of redis: a service with REST APIs
 //   and 4 methods: PUT, GET, DELETE, COUNT
+// The same storage is also served over RESP2 on a TCP port (see mini_redis_resp.go),
+//   so redis-cli and regular Redis clients can talk to it
+
+// Build the server from its files, leaving out the tests that go build refuses
+//   to take as files, then run it
+// go build -o mini_redis $(ls mini_redis*.go | grep -v _test.go)
+// ./mini_redis -http :8082 -resp :6380
+// Its tests run with
+// go test mini_redis*.go
 
 // Test the server by using curl
 // curl -X PUT -d total_records=100 localhost:8082
 // curl -X PUT -d total_bytes=10000 localhost:8082
 // curl -X PUT -d something_else="hello, world" localhost:8082
 // curl -X PUT -d key1=value1 localhost:8082
+// curl -X PUT -d "expr=a=b=c" localhost:8082
+// curl -X PUT -H "Content-Type: application/json" -d '{"key":"key2","value":"value2"}' localhost:8082
+// curl -X PUT -H "Content-Type: image/jpeg" --data-binary @photo.jpg localhost:8082/keys/photo
+// curl -i localhost:8082/keys/key1
+// curl -X DELETE localhost:8082/keys/key1
 // curl -X GET -d "key1" localhost:8082
 // curl -X COUNT localhost:8082
-// curl -X COUNT -d "total" localhost:8082
+// curl -X COUNT -d "total*" localhost:8082
+// curl -X COUNT -d "total" "localhost:8082/?mode=prefix"
+// curl -X COUNT -d "^total_(bytes|records)$" "localhost:8082/?mode=regex"
+// curl "localhost:8082/scan?match=total*&count=100"
 // curl -X DELETE -d "key1" localhost:8082
 
+// Conditional writes: only if absent (NX), present (XX), equal to a value (IFEQ)
+//   or at a version (IFVERSION, the X-Version of reads); 412 when the condition fails
+// curl -X SET -H "Content-Type: application/json" -d '["leader","worker-1","NX","PX","10000"]' localhost:8082
+// curl -X SET -H "Content-Type: application/json" -d '["leader","worker-1","IFEQ","worker-1","PX","10000"]' localhost:8082
+// curl -X PUT -H "X-If-Version: 42" -d new localhost:8082/keys/key1
+
+// Other commands are sent with the command name as the method,
+//   and the body is either key, key=argument or a JSON array of arguments
+// curl -X INCR -d total_records localhost:8082
+// curl -X INCRBY -d total_bytes=512 localhost:8082
+// curl -X INCRBYFLOAT -d ratio=0.5 localhost:8082
+// curl -X APPEND -d "key1=, more" localhost:8082
+// curl -X INCRBY -H "Content-Type: application/json" -d '["total_bytes","-512"]' localhost:8082
+// curl -X RPUSH -d queue=job1 localhost:8082
+// curl -X LRANGE -H "Content-Type: application/json" -d '["queue","0","-1"]' localhost:8082
+// curl -X HSET -H "Content-Type: application/json" -d '["user:1","name","bob"]' localhost:8082
+// curl -X SADD -d tags=go localhost:8082
+// curl -X SMEMBERS -d tags localhost:8082
+// curl -X ZADD -H "Content-Type: application/json" -d '["board","42","alice"]' localhost:8082
+// curl -X ZRANGEBYSCORE -H "Content-Type: application/json" -d '["board","(10","+inf","LIMIT","0","10"]' localhost:8082
+
+// Transactions: every command applies or none does, and the batch is refused (409)
+//   if a watched key changed since it was read (version from the X-Version header)
+// curl -d '{"watch":{"key1":3},"commands":[["SET","key1","v"],["INCR","total_records"]]}' localhost:8082/multi
+
+// Publish/subscribe: subscribers get a Server-Sent Events stream
+// curl -N "localhost:8082/subscribe?channel=news&pattern=alerts.*"
+// curl -X PUBLISH -d "news=hello, world" localhost:8082
+
+// Expiration and change notifications: /watch long-polls (or streams with stream=1)
+//   the puts, deletes and expirations of keys with a prefix, from a revision on
+// curl -X PUT -d v "localhost:8082/keys/session:1?ttl=30s"
+// curl "localhost:8082/watch?prefix=config/&since=42"
+// curl -N "localhost:8082/watch?prefix=config/&stream=1"
+
+// Replication: a replica does a full sync from its primary, then follows its writes;
+//   it serves reads only until it is promoted (see mini_redis_replication.go)
+// ./mini_redis -http :8083 -resp :6381 -dbfile replica.gob -replicaof localhost:8082
+// curl -X POST localhost:8083/replication/promote
+
+// Sharding: a proxy spreads the keys over several instances with consistent hashing,
+//   fanning out the commands that cover all keys (see mini_redis_cluster.go)
+// ./mini_redis -http :8090 -resp :6390 -proxy localhost:6380,localhost:6381
+// curl -X POST -d localhost:6382 localhost:8090/cluster/nodes
+
+// Raft: a cluster of nodes agreeing on every write, which goes to the leader
+//   (see mini_redis_raft.go)
+// ./mini_redis -http :8082 -resp :6380 -raft localhost:8082,localhost:8083,localhost:8084 -raftid localhost:8082 -raftdir raft1
+// curl localhost:8082/raft/status
+
+// Logical databases: /db/{n} in front of any path, SELECT n over RESP (see mini_redis_db.go)
+// curl -X PUT -d key1=value1 localhost:8082/db/3/
+// curl -X COUNT localhost:8082/db/3/
+// curl -X FLUSHDB localhost:8082/db/3/
+
+// Authentication: a password for everyone, or users with permissions (see mini_redis_acl.go)
+// ./mini_redis -requirepass s3cret
+// ./mini_redis -acl users.acl
+// curl -u deploy:s3cret -X PUT -d config/a=1 localhost:8082
+// curl -H "Authorization: Bearer s3cret" -X GET -d key1 localhost:8082
+
+// Bulk writes and reads, and export/import of a whole database as JSON Lines or CSV
+//   (see mini_redis_bulk.go)
+// curl -X MSET -H "Content-Type: application/json" -d '["a","1","b","2"]' localhost:8082
+// curl -X MGET -H "Content-Type: application/json" -d '["a","b"]' localhost:8082
+// curl "localhost:8082/dump?format=csv" > data.csv
+// curl --data-binary @data.csv "localhost:8082/restore?format=csv"
+
+// Scripts: a read-modify-write run atomically on the server (see mini_redis_script.go)
+// curl -X EVAL -H "Content-Type: application/json" -d '["if call(\"GET\", KEYS[1]) == ARGV[1] then return call(\"DEL\", KEYS[1]) end return 0", "1", "lock", "token"]' localhost:8082
+
+// Locks: an owner token with a TTL, released only by its owner; waiters long-poll
+//   (see mini_redis_lock.go)
+// curl -X POST "localhost:8082/locks/deploy?ttl=30s&wait=10s"
+// curl -X DELETE -d <token> localhost:8082/locks/deploy
+
+// Streams: an append-only log read by consumer groups, with pending entries
+//   until they are acknowledged (see mini_redis_stream.go)
+// curl -X XADD -H "Content-Type: application/json" -d '["jobs","*","task","resize"]' localhost:8082
+// curl -X XREADGROUP -H "Content-Type: application/json" -d '["GROUP","workers","w1","BLOCK","5000","STREAMS","jobs",">"]' localhost:8082
+
+// Introspection: key counts per type, memory, ops/sec, hits and misses, and the
+//   commands slower than -slowlog (see mini_redis_info.go)
+// curl localhost:8082/info
+// curl localhost:8082/slowlog
+
+// Storage engines: the keys in memory with snapshots (the default), or in a B+tree
+//   page file that caches what it reads, for data larger than the memory
+//   (see mini_redis_store.go)
+// ./mini_redis -engine btree -dbfile data.btree -btree-cache 65536
+
+// Go programs can use the client package mini_redis/redisclient instead of hand-made requests,
+//   and people the command line client built on it
+// go run redis_cli.go -h localhost:8082
+
+// or by using redis-cli
+// redis-cli -p 6380 SET key1 value1
+// redis-cli -p 6380 KEYS 'total*'
+
 package main
 import (
+  "crypto/md5"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "flag"
+  "log"
   "net/http"
   "io/ioutil"
   "strconv"
   "strings"
-  "regexp"
+  "sync"
+  "time"
 )
 
-var storage = make(map[string]string)
+// a value in storage, Kind tells which field holds the data:
+//   "string" Str, "list" List, "hash" Hash, "set" Set, "zset" ZSet or "stream" Stream
+// Version is the revision of the last write to the key, revision being
+//   a counter bumped by every successful write command.
+// Expires is the expiration time in unix milliseconds, 0 for a persistent key.
+// A large string is held compressed in Packed instead of Str, read it with str()
+//   (see mini_redis_compress.go); ContentType is the one it was stored with.
+// (fields are exported so that snapshots can encode them, see mini_redis_persist.go)
+type Value struct {
+  Kind string
+  Version int64
+  Expires int64
+  Str string
+  Packed []byte
+  ContentType string
+  List []string
+  Hash map[string]string
+  Set map[string]bool
+  ZSet *ZSet
+  Stream *Stream
+  counted int64 // the size a memory store counted for it, see MemoryStore
+}
+
+// mu guards storage; every front-end (HTTP and RESP) goes through it.
+// storage is the store of the selected logical database (see mini_redis_db.go
+//   and mini_redis_store.go)
+var mu sync.Mutex
+var storage Store
+var revision int64
 
 func serve(w http.ResponseWriter, req *http.Request) {
   body, err := ioutil.ReadAll(req.Body)
@@ -31,32 +182,766 @@ func serve(w http.ResponseWriter, req *http.Request) {
   method := req.Method
   switch method {
   case "PUT":
-    data := strings.Split(string(body), "=")
-    storage[data[0]] = data[1]
+    key, value, err := parsePut(req, body)
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusBadRequest)
+      return
+    }
+    args := []string{"SET", key, value}
+    if !allowed(w, req, args) {
+      return
+    }
+    if err, ok := execute(dbOf(req), args).(error); ok {
+      writeHTTPReply(w, err)
+      return
+    }
     w.Write([]byte("OK"))
   case "GET":
-    w.Write([]byte(storage[string(body)]))
+    if !allowed(w, req, []string{"GET", string(body)}) {
+      return
+    }
+    mu.Lock()
+    selectDB(dbOf(req))
+    reply := call([]string{"GET", string(body)})
+    version := keyVersion(string(body))
+    mu.Unlock()
+    if err, ok := reply.(error); ok {
+      writeHTTPReply(w, err)
+      return
+    }
+    value, _ := reply.(string)
+    w.Header().Set("X-Version", strconv.FormatInt(version, 10))
+    w.Write([]byte(value))
   case "DELETE":
-    delete(storage,string(body))
+    if !allowed(w, req, []string{"DEL", string(body)}) {
+      return
+    }
+    if err, ok := execute(dbOf(req), []string{"DEL", string(body)}).(error); ok {
+      writeHTTPReply(w, err)
+      return
+    }
     w.Write([]byte("OK"))
   case "COUNT":
-    if len(body) == 0 {
-      w.Write([]byte(strconv.Itoa(len(storage))))
+    args := []string{"DBSIZE"}
+    if len(body) > 0 {
+      args = []string{"COUNT", string(body)}
+      if mode := req.URL.Query().Get("mode"); mode != "" {
+        args = append(args, "MODE", mode)
+      }
+    }
+    if allowed(w, req, args) {
+      writeHTTPReply(w, execute(dbOf(req), args))
+    }
+  default:
+    runCommand(w, req, body)
+  }
+}
+
+// runCommand runs any other command, named by the request method
+func runCommand(w http.ResponseWriter, req *http.Request, body []byte) {
+  if _, ok := commands[req.Method]; !ok {
+    http.Error(w, "unknown command " + req.Method, http.StatusMethodNotAllowed)
+    return
+  }
+  args := []string{req.Method}
+  if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+    var rest []string
+    if err := json.Unmarshal(body, &rest); err != nil {
+      http.Error(w, "body must be a JSON array of strings: " + err.Error(), http.StatusBadRequest)
+      return
+    }
+    args = append(args, rest...)
+  } else if len(body) > 0 {
+    if i := strings.IndexByte(string(body), '='); i >= 0 {
+      args = append(args, string(body[:i]), string(body[i+1:]))
     } else {
-      pattern := string(body) + ".*"
-      r, _ := regexp.Compile(pattern)
-      count := 0
-      for key := range storage {
-        if r.MatchString(key) {
-          count++
+      args = append(args, string(body))
+    }
+  }
+  if !allowed(w, req, args) {
+    return
+  }
+  reply := executeContext(req.Context(), dbOf(req), args)
+  if reply == nil && (req.Method == "XREAD" || req.Method == "XREADGROUP") {
+    reply = []interface{}{} // nothing arrived, a long poll ends empty
+  }
+  if reply == nil && req.Method == "SET" {
+    http.Error(w, "the condition of SET is not met", http.StatusPreconditionFailed)
+    return
+  }
+  if reply == nil && req.Method == "LOCK" {
+    http.Error(w, "the lock is held by another owner", http.StatusLocked)
+    return
+  }
+  writeHTTPReply(w, reply)
+}
+
+// writeHTTPReply renders a command reply: scalars as plain text, arrays as JSON,
+//   errors as 400 (409 for WRONGTYPE, 403 for READONLY and NOPERM, 401 for NOAUTH,
+//   412 for a failed watch, 503 for NOTLEADER)
+//   and a nil reply as 404
+func writeHTTPReply(w http.ResponseWriter, reply interface{}) {
+  switch v := reply.(type) {
+  case nil:
+    http.Error(w, "key not found", http.StatusNotFound)
+  case error:
+    if strings.HasPrefix(v.Error(), "WRONGTYPE") {
+      http.Error(w, v.Error(), http.StatusConflict)
+    } else if strings.HasPrefix(v.Error(), "READONLY") {
+      http.Error(w, v.Error(), http.StatusForbidden)
+    } else if strings.HasPrefix(v.Error(), "NOPERM") {
+      http.Error(w, v.Error(), http.StatusForbidden)
+    } else if strings.HasPrefix(v.Error(), "NOAUTH") || strings.HasPrefix(v.Error(), "WRONGPASS") {
+      unauthorized(w, v)
+    } else if strings.HasPrefix(v.Error(), "NOTLEADER") {
+      http.Error(w, v.Error(), http.StatusServiceUnavailable)
+    } else if v == errWatch {
+      http.Error(w, v.Error(), http.StatusPreconditionFailed)
+    } else {
+      http.Error(w, v.Error(), http.StatusBadRequest)
+    }
+  case Status:
+    w.Write([]byte(v))
+  case string:
+    w.Write([]byte(v))
+  case int:
+    w.Write([]byte(strconv.Itoa(v)))
+  case int64:
+    w.Write([]byte(strconv.FormatInt(v, 10)))
+  default:
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(v)
+  }
+}
+
+// parsePut extracts key and value from the body of a PUT request to "/".
+// A JSON body {"key": ..., "value": ...} is used when the Content-Type says so,
+//   otherwise the body is key=value split on the first '=' so values may contain '='.
+// Values that are not valid text should go through PUT /keys/{key} (see serveKey),
+//   which stores the raw body as is.
+func parsePut(req *http.Request, body []byte) (string, string, error) {
+  var key, value string
+  if strings.HasPrefix(req.Header.Get("Content-Type"), "application/json") {
+    var data struct {
+      Key *string `json:"key"`
+      Value *string `json:"value"`
+    }
+    if err := json.Unmarshal(body, &data); err != nil {
+      return "", "", errors.New("invalid JSON body: " + err.Error())
+    }
+    if data.Key == nil || data.Value == nil {
+      return "", "", errors.New("JSON body must have string fields \"key\" and \"value\"")
+    }
+    key, value = *data.Key, *data.Value
+  } else {
+    i := strings.IndexByte(string(body), '=')
+    if i < 0 {
+      return "", "", errors.New("body must be in the form key=value")
+    }
+    key, value = string(body[:i]), string(body[i+1:])
+  }
+  if key == "" {
+    return "", "", errors.New("key must not be empty")
+  }
+  return key, value, nil
+}
+
+// serveKey handles /keys/{key} where the key is taken from the URL path
+//   and the request body is the raw value.
+// GET, HEAD, PUT and DELETE are supported; missing keys give 404.
+// Every response carries an ETag derived from the value, and the
+//   If-Match / If-None-Match headers make PUT and DELETE conditional,
+//   so clients can do optimistic concurrency:
+//   curl -i localhost:8082/keys/key1                          => ETag: "..."
+//   curl -X PUT -H 'If-Match: "..."' -d new localhost:8082/keys/key1
+//   curl -X PUT -H 'If-None-Match: *' -d v localhost:8082/keys/key1   (create only)
+// The X-Version header is the version of the key (see VERSION), and an
+//   X-If-Version header makes PUT and DELETE conditional on it, 0 meaning
+//   that the key must not exist:
+//   curl -X PUT -H 'X-If-Version: 42' -d new localhost:8082/keys/key1
+// PUT also takes ?ttl=30s to make the key expire, and stores the Content-Type
+//   of the request, which GET and HEAD answer with (see mini_redis_compress.go).
+func serveKey(w http.ResponseWriter, req *http.Request) {
+  key := strings.TrimPrefix(req.URL.Path, "/keys/")
+  if key == "" {
+    http.Error(w, "key must not be empty", http.StatusBadRequest)
+    return
+  }
+  access := []string{"GET", key}
+  if req.Method == "PUT" {
+    access = []string{"SET", key, ""}
+  } else if req.Method == "DELETE" {
+    access = []string{"DEL", key}
+  }
+  if !allowed(w, req, access) {
+    return
+  }
+  if_version := req.Header.Get("X-If-Version")
+  if if_version != "" {
+    n, err := strconv.ParseInt(if_version, 10, 64)
+    if err != nil || n < 0 {
+      http.Error(w, "X-If-Version must be a version number", http.StatusBadRequest)
+      return
+    }
+    if_version = strconv.FormatInt(n, 10)
+  }
+  var body []byte
+  set := []string{"SET", key}
+  if req.Method == "PUT" {
+    var err error
+    body, err = ioutil.ReadAll(req.Body)
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusBadRequest)
+      return
+    }
+    set = append(set, string(body))
+    if content_type := req.Header.Get("Content-Type"); content_type != "" {
+      set = append(set, "CONTENTTYPE", content_type)
+    }
+    if ttl := req.URL.Query().Get("ttl"); ttl != "" {
+      d, err := time.ParseDuration(ttl)
+      if err != nil || d < time.Millisecond {
+        http.Error(w, "ttl must be a duration of at least 1ms", http.StatusBadRequest)
+        return
+      }
+      set = append(set, "PX", strconv.FormatInt(int64(d / time.Millisecond), 10))
+    }
+  }
+
+  // the precondition check and the update happen under the same lock,
+  //   or through the proxy, in a transaction watching the key on its node,
+  //   or in raft mode, with a log entry applied only if the key is unchanged
+  read, write := call, call
+  version := func() string { return strconv.FormatInt(keyVersion(key), 10) }
+  if cluster != nil {
+    s, err := cluster.openKey(key)
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusBadGateway)
+      return
+    }
+    defer s.close()
+    read, write = s.read, s.write
+    version = func() string {
+      if n, ok := s.read([]string{"VERSION", key}).(int64); ok {
+        return strconv.FormatInt(n, 10)
+      }
+      return ""
+    }
+  } else if raft != nil {
+    var watch map[string]int64
+    read = func(args []string) interface{} {
+      mu.Lock()
+      defer mu.Unlock()
+      selectDB(dbOf(req))
+      if req.Header.Get("If-Match") != "" || req.Header.Get("If-None-Match") != "" || if_version != "" {
+        watch = map[string]int64{key: keyVersion(key)}
+      }
+      return call(args)
+    }
+    write = func(args []string) interface{} {
+      return raftPropose(RaftEntry{Db: dbOf(req), Batch: [][]string{args}, Watch: watch})
+    }
+    version = func() string {
+      mu.Lock()
+      defer mu.Unlock()
+      selectDB(dbOf(req))
+      return strconv.FormatInt(keyVersion(key), 10)
+    }
+  } else {
+    mu.Lock()
+    defer mu.Unlock()
+    selectDB(dbOf(req))
+  }
+  reply := read([]string{"GET", key})
+  if err, ok := reply.(error); ok && req.Method != "PUT" {
+    http.Error(w, err.Error(), http.StatusConflict)
+    return
+  }
+  value, exists := reply.(string)
+  etag := ""
+  if exists {
+    etag = makeETag(value)
+  }
+  switch req.Method {
+  case "GET", "HEAD":
+    if !exists {
+      http.Error(w, "key not found", http.StatusNotFound)
+      return
+    }
+    w.Header().Set("ETag", etag)
+    if v := version(); v != "" {
+      w.Header().Set("X-Version", v)
+    }
+    if content_type, ok := read([]string{"CONTENTTYPE", key}).(string); ok {
+      w.Header().Set("Content-Type", content_type)
+    }
+    if status := checkPreconditions(req, etag, exists); status != 0 {
+      w.WriteHeader(status)
+      return
+    }
+    w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+    if req.Method == "GET" {
+      w.Write([]byte(value))
+    }
+  case "PUT":
+    if status := checkPreconditions(req, etag, exists); status != 0 || (if_version != "" && version() != if_version) {
+      http.Error(w, http.StatusText(http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+      return
+    }
+    if err, ok := write(set).(error); ok {
+      writeHTTPReply(w, err)
+      return
+    }
+    w.Header().Set("ETag", makeETag(string(body)))
+    if v := version(); v != "" {
+      w.Header().Set("X-Version", v)
+    }
+    if !exists {
+      w.WriteHeader(http.StatusCreated)
+    }
+    w.Write([]byte("OK"))
+  case "DELETE":
+    if !exists {
+      http.Error(w, "key not found", http.StatusNotFound)
+      return
+    }
+    if status := checkPreconditions(req, etag, exists); status != 0 || (if_version != "" && version() != if_version) {
+      http.Error(w, http.StatusText(http.StatusPreconditionFailed), http.StatusPreconditionFailed)
+      return
+    }
+    if err, ok := write([]string{"DEL", key}).(error); ok {
+      writeHTTPReply(w, err)
+      return
+    }
+    w.Write([]byte("OK"))
+  default:
+    w.Header().Set("Allow", "GET, HEAD, PUT, DELETE")
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+  }
+}
+
+func makeETag(value string) string {
+  sum := md5.Sum([]byte(value))
+  return "\"" + hex.EncodeToString(sum[:]) + "\""
+}
+
+// checkPreconditions evaluates If-Match and If-None-Match (RFC 7232) against the
+//   current ETag of the key, returning 0 when the request may proceed
+//   or the status code to answer with
+func checkPreconditions(req *http.Request, etag string, exists bool) int {
+  if h := req.Header.Get("If-Match"); h != "" {
+    if !exists || !etagListMatch(h, etag, false) {
+      return http.StatusPreconditionFailed
+    }
+  }
+  if h := req.Header.Get("If-None-Match"); h != "" {
+    if exists && etagListMatch(h, etag, true) {
+      if req.Method == "GET" || req.Method == "HEAD" {
+        return http.StatusNotModified
+      }
+      return http.StatusPreconditionFailed
+    }
+  }
+  return 0
+}
+
+// etagListMatch reports whether etag is in the comma separated list h, or h is "*".
+// Weak comparison ignores the W/ prefix, strong comparison never matches weak tags.
+func etagListMatch(h, etag string, weak bool) bool {
+  for _, tag := range strings.Split(h, ",") {
+    tag = strings.TrimSpace(tag)
+    if tag == "*" {
+      return true
+    }
+    if strings.HasPrefix(tag, "W/") {
+      if !weak {
+        continue
+      }
+      tag = tag[2:]
+    }
+    if tag == etag {
+      return true
+    }
+  }
+  return false
+}
+
+// serveScan pages through the keys: GET /scan?cursor=C&match=P&mode=M&count=N
+// It answers {"cursor": next, "keys": [...]}; start with cursor 0 and stop when
+//   the returned cursor is 0 again. A page starts from the cursor in the
+//   ordered index of the keys and looks at up to count keys (default 10), so
+//   it holds the lock for that long whatever the number of keys, and a long
+//   scan does not block writers. It may return fewer keys, or none, before the
+//   scan is over.
+func serveScan(w http.ResponseWriter, req *http.Request) {
+  query := req.URL.Query()
+  cursor := query.Get("cursor")
+  if cursor == "" {
+    cursor = "0"
+  }
+  count := 10
+  if query.Get("count") != "" {
+    n, err := strconv.Atoi(query.Get("count"))
+    if err != nil || n <= 0 {
+      http.Error(w, "count must be a positive integer", http.StatusBadRequest)
+      return
+    }
+    count = n
+  }
+  args := []string{"SCAN", cursor, "COUNT", strconv.Itoa(count)}
+  if query.Get("match") != "" {
+    args = append(args, "MATCH", query.Get("match"))
+  }
+  if query.Get("mode") != "" {
+    args = append(args, "MODE", query.Get("mode"))
+  }
+  if !allowed(w, req, args) {
+    return
+  }
+  reply := execute(dbOf(req), args)
+  if err, ok := reply.(error); ok {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  page := reply.([]interface{})
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(map[string]interface{}{"cursor": page[0], "keys": page[1]})
+}
+
+// serveMulti runs a batch of commands all-or-nothing: POST /multi with
+//   {"watch": {"key": version, ...}, "commands": [["SET", "a", "1"], ["INCR", "b"], ...]}
+// Versions come from the X-Version header of reads (0 for a missing key);
+//   if a watched key was written since, nothing is applied and 409 is returned.
+// On success the replies are returned as {"replies": [...]}.
+func serveMulti(w http.ResponseWriter, req *http.Request) {
+  if req.Method != "POST" {
+    w.Header().Set("Allow", "POST")
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+  var data struct {
+    Watch map[string]int64 `json:"watch"`
+    Commands [][]string `json:"commands"`
+  }
+  if err := json.NewDecoder(req.Body).Decode(&data); err != nil {
+    http.Error(w, "invalid JSON body: " + err.Error(), http.StatusBadRequest)
+    return
+  }
+  watch := []string{"WATCH"}
+  for key := range data.Watch {
+    watch = append(watch, key)
+  }
+  if !allowed(w, req, watch) {
+    return
+  }
+  for _, args := range data.Commands {
+    if len(args) > 0 && !allowed(w, req, args) {
+      return
+    }
+  }
+  replies, err := runTransaction(req.Context(), dbOf(req), data.Commands, data.Watch)
+  if err == errWatch {
+    http.Error(w, err.Error(), http.StatusConflict)
+    return
+  }
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(map[string]interface{}{"replies": replies})
+}
+
+// serveSubscribe streams published messages as Server-Sent Events:
+//   GET /subscribe?channel=news&pattern=alerts.*  (both can be repeated)
+// Each message is an event "message" whose data is
+//   {"channel": ..., "pattern": ..., "message": ...}; a client that does not keep up
+//   gets a final "dropped" event and the stream ends.
+func serveSubscribe(w http.ResponseWriter, req *http.Request) {
+  query := req.URL.Query()
+  channels, patterns := query["channel"], query["pattern"]
+  if len(channels) + len(patterns) == 0 {
+    http.Error(w, "at least one channel or pattern is required", http.StatusBadRequest)
+    return
+  }
+  if !allowed(w, req, []string{"SUBSCRIBE"}) {
+    return
+  }
+  flusher, ok := w.(http.Flusher)
+  if !ok {
+    http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+    return
+  }
+  sub := newSubscriber()
+  sub.subscribe(channels, false)
+  sub.subscribe(patterns, true)
+  defer sub.close()
+
+  w.Header().Set("Content-Type", "text/event-stream")
+  w.Header().Set("Cache-Control", "no-cache")
+  w.WriteHeader(http.StatusOK)
+  flusher.Flush()
+  keepalive := time.NewTicker(15 * time.Second)
+  defer keepalive.Stop()
+  for {
+    select {
+    case m := <-sub.messages:
+      data, _ := json.Marshal(m)
+      w.Write([]byte("event: message\ndata: " + string(data) + "\n\n"))
+      if len(sub.messages) == 0 {
+        flusher.Flush()
+      }
+    case <-sub.dropped:
+      w.Write([]byte("event: dropped\ndata: too slow\n\n"))
+      flusher.Flush()
+      return
+    case <-keepalive.C:
+      w.Write([]byte(": keepalive\n\n"))
+      flusher.Flush()
+    case <-req.Context().Done():
+      return
+    }
+  }
+}
+
+// serveWatch reports the changes to keys starting with a prefix:
+//   GET /watch?prefix=config/&since=REV&timeout=30s
+// As a long poll it waits until there are events after revision since (default:
+//   now) and answers {"revision": R, "events": [...]}, the events being empty on
+//   timeout; pass R as since in the next call to continue where this one stopped.
+// With stream=1 (or Accept: text/event-stream) the events are sent as Server-Sent
+//   Events with the revision as id, so EventSource resumes through Last-Event-ID.
+// When since is older than the kept history the answer is 410 Gone: the client
+//   has to read the keys again and watch from the revision in the answer.
+func serveWatch(w http.ResponseWriter, req *http.Request) {
+  query := req.URL.Query()
+  prefix := query.Get("prefix")
+  if !allowedPrefix(w, req, prefix) {
+    return
+  }
+  stream := query.Get("stream") == "1" || strings.Contains(req.Header.Get("Accept"), "text/event-stream")
+  since := int64(-1)
+  if s := query.Get("since"); s != "" || req.Header.Get("Last-Event-ID") != "" {
+    if s == "" {
+      s = req.Header.Get("Last-Event-ID")
+    }
+    n, err := strconv.ParseInt(s, 10, 64)
+    if err != nil || n < 0 {
+      http.Error(w, "since must be a revision number", http.StatusBadRequest)
+      return
+    }
+    since = n
+  }
+  timeout := 30 * time.Second
+  if s := query.Get("timeout"); s != "" {
+    d, err := time.ParseDuration(s)
+    if err != nil || d <= 0 || d > 5 * time.Minute {
+      http.Error(w, "timeout must be a duration up to 5m", http.StatusBadRequest)
+      return
+    }
+    timeout = d
+  }
+
+  mu.Lock()
+  current := revision
+  if since < 0 || since > current {
+    since = current
+  }
+  events, ok := eventsSince(dbOf(req), prefix, since)
+  var watcher *Watcher
+  if ok && (stream || len(events) == 0) {
+    watcher = newWatcher(dbOf(req), prefix)
+  }
+  mu.Unlock()
+  if !ok {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusGone)
+    json.NewEncoder(w).Encode(map[string]interface{}{"revision": current,
+      "error": "revision " + strconv.FormatInt(since, 10) + " is no longer in the history"})
+    return
+  }
+  if watcher != nil {
+    defer func() {
+      mu.Lock()
+      watcher.close()
+      mu.Unlock()
+    }()
+  }
+
+  if !stream {
+    if len(events) == 0 {
+      select {
+      case e := <-watcher.events:
+        // all the events of one write are queued together under mu
+        mu.Lock()
+        events = append(events, e)
+        for len(watcher.events) > 0 {
+          events = append(events, <-watcher.events)
         }
+        mu.Unlock()
+      case <-watcher.dropped:
+      case <-time.After(timeout):
+      case <-req.Context().Done():
+        return
+      }
+    }
+    if len(events) > 0 {
+      current = events[len(events)-1].Revision
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{"revision": current, "events": events})
+    return
+  }
+
+  flusher, ok := w.(http.Flusher)
+  if !ok {
+    http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+    return
+  }
+  w.Header().Set("Content-Type", "text/event-stream")
+  w.Header().Set("Cache-Control", "no-cache")
+  w.WriteHeader(http.StatusOK)
+  send := func(e Event) {
+    data, _ := json.Marshal(e)
+    w.Write([]byte("id: " + strconv.FormatInt(e.Revision, 10) + "\nevent: " + e.Type + "\ndata: " + string(data) + "\n\n"))
+  }
+  for _, e := range events {
+    send(e)
+  }
+  flusher.Flush()
+  keepalive := time.NewTicker(15 * time.Second)
+  defer keepalive.Stop()
+  for {
+    select {
+    case e := <-watcher.events:
+      send(e)
+      if len(watcher.events) == 0 {
+        flusher.Flush()
       }
-      w.Write([]byte(strconv.Itoa(count)))
+    case <-watcher.dropped:
+      w.Write([]byte("event: dropped\ndata: too slow\n\n"))
+      flusher.Flush()
+      return
+    case <-keepalive.C:
+      w.Write([]byte(": keepalive\n\n"))
+      flusher.Flush()
+    case <-req.Context().Done():
+      return
+    }
+  }
+}
+
+// local wraps the handlers that need the data of this instance,
+//   answering 501 on a proxy
+func local(handler http.HandlerFunc) http.HandlerFunc {
+  return func(w http.ResponseWriter, req *http.Request) {
+    if cluster != nil {
+      http.Error(w, "not available in proxy mode", http.StatusNotImplemented)
+      return
     }
+    handler(w, req)
   }
 }
 
+func check(e error) {
+    if e != nil {
+        panic(e)
+    }
+}
+
 func main() {
-  http.HandleFunc("/", serve)
-  http.ListenAndServe(":8082", nil)
+  http_addr := flag.String("http", ":8082", "address of the HTTP listener")
+  resp_addr := flag.String("resp", ":6380", "address of the RESP listener, empty to disable")
+  flag.StringVar(&dbfile, "dbfile", "dump.gob", "snapshot file, empty to disable persistence")
+  save_every := flag.Duration("save", time.Minute, "how often to snapshot storage when it changed")
+  flag.IntVar(&history_size, "history", history_size, "number of key change events kept for /watch")
+  replicaof := flag.String("replicaof", "", "HTTP address (host:port) of the primary to replicate")
+  flag.IntVar(&backlog_size, "backlog", backlog_size, "number of write commands kept for partial resync of replicas")
+  proxy := flag.String("proxy", "", "comma separated RESP addresses of the nodes to spread the keys over")
+  vnodes := flag.Int("vnodes", 160, "virtual nodes per node on the hash ring of the proxy")
+  members := flag.String("raft", "", "comma separated HTTP addresses of the members of a raft cluster")
+  raft_id := flag.String("raftid", "", "HTTP address of this node among the -raft members")
+  flag.StringVar(&raft_dir, "raftdir", "raft", "directory for the raft log and snapshot")
+  requirepass := flag.String("requirepass", "", "password clients must give (AUTH, or HTTP basic auth / bearer token)")
+  acl := flag.String("acl", "", "file with the users and their permissions")
+  flag.StringVar(&node_auth, "auth", "", "name:password this node uses with its primary, raft peers or proxied nodes")
+  n_databases := flag.Int("databases", 16, "number of logical databases")
+  flag.IntVar(&script_max_steps, "scriptsteps", script_max_steps, "steps a script may run before it is stopped")
+  flag.IntVar(&compress_threshold, "compress", compress_threshold, "strings of this many bytes or more are kept compressed, 0 to disable")
+  flag.DurationVar(&slowlog_threshold, "slowlog", slowlog_threshold, "commands running longer go to the slow log, negative to disable it")
+  flag.IntVar(&slowlog_max_len, "slowlog-len", slowlog_max_len, "number of commands kept in the slow log")
+  flag.StringVar(&engine, "engine", engine, "storage engine: memory (with snapshots in -dbfile) or btree (a page file in -dbfile)")
+  flag.IntVar(&btree_cache, "btree-cache", btree_cache, "pages of 8 KB the btree engine keeps in memory")
+  flag.Parse()
+
+  if *n_databases < 1 {
+    check(errors.New("-databases must be at least 1"))
+  }
+  initDatabases(*n_databases)
+  switch {
+  case engine == "memory":
+  case engine != "btree":
+    check(errors.New("-engine must be memory or btree"))
+  case dbfile == "":
+    check(errors.New("the btree engine needs a -dbfile"))
+  case *proxy != "" || *members != "":
+    check(errors.New("the btree engine is not available with -proxy or -raft"))
+  default:
+    max_key_len = btree_max_key
+  }
+
+  check(loadACL(*acl, *requirepass))
+
+  if *proxy != "" {
+    // the proxy keeps no data: no expiry, snapshots or replication
+    cluster = newCluster(strings.Split(*proxy, ","), *vnodes)
+    log.Println("proxy for", *proxy)
+  }
+  if *members != "" {
+    // the raft log and its snapshots take the place of -dbfile and -replicaof
+    check(startRaft(*raft_id, strings.Split(*members, ","), raft_dir))
+    dbfile, *replicaof = "", ""
+  }
+  if cluster == nil {
+    go sweepExpired(100 * time.Millisecond)
+  }
+  go sampleOps()
+  if dbfile != "" && cluster == nil {
+    if engine == "btree" {
+      check(loadBTrees())
+    } else {
+      check(loadSnapshot())
+    }
+    go saveLoop(*save_every)
+    go saveOnExit()
+  }
+  if *replicaof != "" && cluster == nil {
+    mu.Lock()
+    startReplication(*replicaof)
+    mu.Unlock()
+  }
+
+  if *resp_addr != "" {
+    go func() {
+      log.Fatal(listenRESP(*resp_addr))
+    }()
+  }
+  http.HandleFunc("/", withAuth(raftRedirect(serve)))
+  http.HandleFunc("/keys/", withAuth(raftRedirect(serveKey)))
+  http.HandleFunc("/scan", withAuth(serveScan))
+  http.HandleFunc("/multi", withAuth(local(raftRedirect(serveMulti))))
+  http.HandleFunc("/subscribe", withAuth(local(serveSubscribe)))
+  http.HandleFunc("/watch", withAuth(local(serveWatch)))
+  http.HandleFunc("/replication/sync", withAuth(local(serveSync)))
+  http.HandleFunc("/replication/promote", withAuth(local(servePromote)))
+  http.HandleFunc("/cluster/nodes", withAuth(serveClusterNodes))
+  http.HandleFunc("/raft/message", withAuth(serveRaftMessage))
+  http.HandleFunc("/raft/status", withAuth(serveRaftStatus))
+  http.HandleFunc("/dump", withAuth(local(serveDump)))
+  http.HandleFunc("/restore", withAuth(local(raftRedirect(serveRestore))))
+  http.HandleFunc("/locks/", withAuth(raftRedirect(serveLock)))
+  http.HandleFunc("/info", withAuth(serveInfo))
+  http.HandleFunc("/slowlog", withAuth(serveSlowlog))
+  http.HandleFunc("/db/", serveDB)
+  log.Fatal(http.ListenAndServe(*http_addr, nil))
 }
@@ -0,0 +1,458 @@
+// Authentication and access control of mini_redis.
+// With -requirepass, clients must give the password before running commands:
+//   AUTH password over RESP, and over HTTP either basic auth (user name
+//   "default" or empty) or an "Authorization: Bearer password" header.
+// With -acl file, named users are defined in the file, one per line, with
+//   Redis style rules applied from left to right:
+//     user <name> on|off >password #sha256-of-password nopass
+//       ~key-pattern allkeys +command -command +@category -@category allcommands
+//   e.g.  user default on nopass ~public/* +@read
+//         user deploy on >s3cret ~config/* +@read +@write
+//         user admin on >adm1n allkeys allcommands
+//   Key patterns are globs (see globMatch). Categories are @read, @write,
+//   @keyspace (commands that cover every key, like KEYS and SCAN, they need
+//   allkeys), @pubsub and @admin. A user name without a "user default" line
+//   in the file has to authenticate: AUTH name password, or basic auth.
+// MULTI/EXEC, PING and the like are always allowed, the commands queued in a
+//   transaction are checked one by one. ACL WHOAMI, ACL LIST and ACL LOAD
+//   (which reads the file again) are available over RESP.
+// -auth name:password are the credentials this node uses with the other
+//   nodes: its primary, its raft peers and the nodes behind a proxy.
+
+package main
+import (
+  "bufio"
+  "context"
+  "crypto/sha256"
+  "crypto/subtle"
+  "encoding/hex"
+  "errors"
+  "net/http"
+  "os"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+)
+
+type User struct {
+  name string
+  enabled bool
+  nopass bool
+  passwords []string // sha256 of the passwords, in hex
+  patterns []string // key globs
+  rules []string // +name, -name, +@category, -@category in the order given
+}
+
+// users is nil when authentication is off; acl_mu guards it as ACL LOAD replaces it
+var users map[string]*User
+var acl_mu sync.RWMutex
+var acl_file string
+var node_auth string // -auth name:password
+
+var errNoAuth = errors.New("NOAUTH Authentication required.")
+var errWrongPass = errors.New("WRONGPASS invalid username-password pair or user is disabled.")
+
+// commands that run on the connection and need no permission
+var connection_commands = map[string]bool{"AUTH": true, "QUIT": true, "PING": true, "ECHO": true,
+  "MULTI": true, "EXEC": true, "DISCARD": true, "UNWATCH": true, "SELECT": true}
+// what the HTTP endpoints for the other nodes count as, for @admin
+var admin_commands = map[string]bool{"ACL": true, "SYNC": true, "RAFT": true}
+var pubsub_commands = map[string]bool{"SUBSCRIBE": true, "PSUBSCRIBE": true, "UNSUBSCRIBE": true,
+  "PUNSUBSCRIBE": true, "PUBLISH": true}
+
+// loadACL sets up the users from -acl, or the default user from -requirepass
+func loadACL(file, requirepass string) error {
+  if file == "" {
+    if requirepass != "" {
+      acl_mu.Lock()
+      users = map[string]*User{"default": {name: "default", enabled: true,
+        passwords: []string{hashPassword(requirepass)}, patterns: []string{"*"}, rules: []string{"+@ALL"}}}
+      acl_mu.Unlock()
+    }
+    return nil
+  }
+  f, err := os.Open(file)
+  if err != nil {
+    return err
+  }
+  defer f.Close()
+  loaded := make(map[string]*User)
+  scanner := bufio.NewScanner(f)
+  for n := 1; scanner.Scan(); n++ {
+    fields := strings.Fields(scanner.Text())
+    if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+      continue
+    }
+    if fields[0] != "user" || len(fields) < 2 {
+      return errors.New(file + ":" + strconv.Itoa(n) + ": expected user <name> <rules>...")
+    }
+    u := &User{name: fields[1]}
+    for _, rule := range fields[2:] {
+      if err := u.apply(rule); err != nil {
+        return errors.New(file + ":" + strconv.Itoa(n) + ": " + err.Error())
+      }
+    }
+    loaded[u.name] = u
+  }
+  if err := scanner.Err(); err != nil {
+    return err
+  }
+  acl_mu.Lock()
+  users = loaded
+  acl_file = file
+  acl_mu.Unlock()
+  return nil
+}
+
+func hashPassword(password string) string {
+  sum := sha256.Sum256([]byte(password))
+  return hex.EncodeToString(sum[:])
+}
+
+func (u *User) apply(rule string) error {
+  switch {
+  case rule == "on":
+    u.enabled = true
+  case rule == "off":
+    u.enabled = false
+  case rule == "nopass":
+    u.nopass = true
+  case rule == "allkeys":
+    u.patterns = append(u.patterns, "*")
+  case rule == "allcommands":
+    u.rules = append(u.rules, "+@ALL")
+  case strings.HasPrefix(rule, ">"):
+    u.passwords = append(u.passwords, hashPassword(rule[1:]))
+  case strings.HasPrefix(rule, "#") && len(rule) == 65:
+    u.passwords = append(u.passwords, strings.ToLower(rule[1:]))
+  case strings.HasPrefix(rule, "~"):
+    u.patterns = append(u.patterns, rule[1:])
+  case strings.HasPrefix(rule, "+") || strings.HasPrefix(rule, "-"):
+    u.rules = append(u.rules, rule[:1] + strings.ToUpper(rule[1:]))
+  default:
+    return errors.New("unknown rule '" + rule + "'")
+  }
+  return nil
+}
+
+// authenticate returns the user the credentials are valid for
+func authenticate(name, password string) (*User, error) {
+  acl_mu.RLock()
+  defer acl_mu.RUnlock()
+  u, ok := users[name]
+  if !ok || !u.enabled {
+    return nil, errWrongPass
+  }
+  if u.nopass {
+    return u, nil
+  }
+  hash := hashPassword(password)
+  for _, p := range u.passwords {
+    if subtle.ConstantTimeCompare([]byte(p), []byte(hash)) == 1 {
+      return u, nil
+    }
+  }
+  return nil, errWrongPass
+}
+
+// lookupUser returns the current definition of an authenticated user; "" is
+//   the default user when it needs no password. nil means not authenticated.
+func lookupUser(name string) *User {
+  acl_mu.RLock()
+  defer acl_mu.RUnlock()
+  if name == "" {
+    if u, ok := users["default"]; ok && u.enabled && u.nopass {
+      return u
+    }
+    return nil
+  }
+  if u, ok := users[name]; ok && u.enabled {
+    return u
+  }
+  return nil
+}
+
+func inCategory(name, category string) bool {
+  switch category {
+  case "ALL":
+    return true
+  case "PUBSUB":
+    return pubsub_commands[name]
+  case "ADMIN":
+    if admin_commands[name] {
+      return true
+    }
+  }
+  cmd, ok := commands[name]
+  if !ok {
+    return false
+  }
+  switch category {
+  case "WRITE":
+    return cmd.has("write")
+  case "ADMIN":
+    return cmd.has("admin")
+  case "KEYSPACE":
+    return cmd.has("keyspace")
+  case "READ":
+    return !cmd.has("write") && !cmd.has("admin") && !pubsub_commands[name]
+  }
+  return false
+}
+
+// allows reports whether the user may run the command name
+func (u *User) allows(name string) bool {
+  allowed := false
+  for _, rule := range u.rules {
+    target := rule[1:]
+    if strings.HasPrefix(target, "@") && inCategory(name, target[1:]) || target == name {
+      allowed = rule[0] == '+'
+    }
+  }
+  return allowed
+}
+
+func (u *User) canAccess(key string) bool {
+  for _, pattern := range u.patterns {
+    if globMatch(pattern, key) {
+      return true
+    }
+  }
+  return false
+}
+
+// coversPrefix reports whether every key with the prefix is accessible,
+//   which takes a pattern that is a prefix followed by *
+func (u *User) coversPrefix(prefix string) bool {
+  for _, pattern := range u.patterns {
+    p := strings.TrimSuffix(pattern, "*")
+    if len(p) < len(pattern) && !strings.ContainsAny(p, "*?[\\") && strings.HasPrefix(prefix, p) {
+      return true
+    }
+  }
+  return false
+}
+
+// can checks that the user may run the command with these arguments
+func (u *User) can(args []string) error {
+  name := strings.ToUpper(args[0])
+  if connection_commands[name] {
+    return nil
+  }
+  if name != "WATCH" && !u.allows(name) {
+    return errors.New("NOPERM User " + u.name + " has no permissions to run the '" + strings.ToLower(name) + "' command")
+  }
+  var keys []string
+  if name == "WATCH" {
+    keys = args[1:]
+  } else if cmd, ok := commands[name]; ok {
+    if cmd.has("keyspace") && !u.coversPrefix("") {
+      return errors.New("NOPERM User " + u.name + " needs allkeys to run the '" + strings.ToLower(name) + "' command")
+    }
+    keys = cmd.keys(args)
+  }
+  for _, key := range keys {
+    if !u.canAccess(key) {
+      return errors.New("NOPERM User " + u.name + " has no permissions to access the '" + key + "' key")
+    }
+  }
+  return nil
+}
+
+// authEnabled reports whether clients have to authenticate; ACL LOAD may swap
+//   users at any time, so it is read under acl_mu
+func authEnabled() bool {
+  acl_mu.RLock()
+  defer acl_mu.RUnlock()
+  return users != nil
+}
+
+// checkAccess is can for a connection authenticated as name, nil when
+//   authentication is off
+func checkAccess(name string, args []string) error {
+  if !authEnabled() {
+    return nil
+  }
+  u := lookupUser(name)
+  if u == nil {
+    return errNoAuth
+  }
+  return u.can(args)
+}
+
+// AUTH [name] password, ACL WHOAMI|LIST|LOAD: run by dispatch for the connection
+func (c *Client) aclCommand(args []string) interface{} {
+  switch strings.ToUpper(args[0]) {
+  case "AUTH":
+    if len(args) != 2 && len(args) != 3 {
+      return errors.New("ERR wrong number of arguments for 'auth' command")
+    }
+    if !authEnabled() {
+      return errors.New("ERR AUTH called without any password configured for the default user")
+    }
+    name := "default"
+    if len(args) == 3 {
+      name = args[1]
+    }
+    u, err := authenticate(name, args[len(args)-1])
+    if err != nil {
+      return err
+    }
+    c.user = u.name
+    return Status("OK")
+  }
+  if len(args) != 2 {
+    return errors.New("ERR wrong number of arguments for 'acl' command")
+  }
+  switch strings.ToUpper(args[1]) {
+  case "WHOAMI":
+    if u := lookupUser(c.user); u != nil {
+      return u.name
+    }
+    return "default"
+  }
+  if u := lookupUser(c.user); authEnabled() && (u == nil || !u.allows("ACL")) {
+    return errors.New("NOPERM this user has no permissions to run the 'acl' command")
+  }
+  switch strings.ToUpper(args[1]) {
+  case "LIST":
+    acl_mu.RLock()
+    defer acl_mu.RUnlock()
+    list := []string{}
+    for _, name := range sortedUserNames() {
+      list = append(list, users[name].String())
+    }
+    return list
+  case "LOAD":
+    acl_mu.RLock()
+    file := acl_file
+    acl_mu.RUnlock()
+    if file == "" {
+      return errors.New("ERR This instance is not configured to use an ACL file")
+    }
+    if err := loadACL(file, ""); err != nil {
+      return errors.New("ERR " + err.Error())
+    }
+    return Status("OK")
+  }
+  return errors.New("ERR unknown subcommand '" + args[1] + "'")
+}
+
+// sortedUserNames lists the users; the caller holds acl_mu
+func sortedUserNames() []string {
+  names := []string{}
+  for name := range users {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  return names
+}
+
+// String gives the user back as a line of the ACL file, with hashed passwords
+func (u *User) String() string {
+  line := []string{"user", u.name, "off"}
+  if u.enabled {
+    line[2] = "on"
+  }
+  if u.nopass {
+    line = append(line, "nopass")
+  }
+  for _, p := range u.passwords {
+    line = append(line, "#" + p)
+  }
+  for _, pattern := range u.patterns {
+    line = append(line, "~" + pattern)
+  }
+  for _, rule := range u.rules {
+    line = append(line, strings.ToLower(rule))
+  }
+  return strings.Join(line, " ")
+}
+
+type userKey struct{}
+
+// caller is the user of the command running under mu, set by whoever takes mu
+//   for a client: the commands a script calls are checked against it
+var caller string
+
+// userOf returns the user a context was authenticated as, see withAuth
+func userOf(ctx context.Context) string {
+  name, _ := ctx.Value(userKey{}).(string)
+  return name
+}
+
+// withAuth authenticates HTTP requests with basic auth or a bearer token;
+//   the handlers check the permissions with allowed
+func withAuth(handler http.HandlerFunc) http.HandlerFunc {
+  return func(w http.ResponseWriter, req *http.Request) {
+    if !authEnabled() {
+      handler(w, req)
+      return
+    }
+    name := ""
+    if user, password, ok := req.BasicAuth(); ok {
+      if user == "" {
+        user = "default"
+      }
+      u, err := authenticate(user, password)
+      if err != nil {
+        unauthorized(w, err)
+        return
+      }
+      name = u.name
+    } else if token := req.Header.Get("Authorization"); strings.HasPrefix(token, "Bearer ") {
+      u, err := authenticate("default", strings.TrimPrefix(token, "Bearer "))
+      if err != nil {
+        unauthorized(w, err)
+        return
+      }
+      name = u.name
+    } else if lookupUser("") == nil {
+      unauthorized(w, errNoAuth)
+      return
+    }
+    handler(w, req.WithContext(context.WithValue(req.Context(), userKey{}, name)))
+  }
+}
+
+func unauthorized(w http.ResponseWriter, err error) {
+  w.Header().Set("WWW-Authenticate", `Basic realm="mini_redis"`)
+  http.Error(w, err.Error(), http.StatusUnauthorized)
+}
+
+// allowed checks the permission of the user of an HTTP request to run
+//   the command, answering 403 when it is not
+func allowed(w http.ResponseWriter, req *http.Request, args []string) bool {
+  name := userOf(req.Context())
+  if err := checkAccess(name, args); err != nil {
+    writeHTTPReply(w, err)
+    return false
+  }
+  return true
+}
+
+// allowedPrefix is allowed for the keys with a prefix, e.g. for /watch
+func allowedPrefix(w http.ResponseWriter, req *http.Request, prefix string) bool {
+  if !authEnabled() {
+    return true
+  }
+  name := userOf(req.Context())
+  u := lookupUser(name)
+  if u == nil {
+    writeHTTPReply(w, errNoAuth)
+    return false
+  }
+  if !u.allows("GET") || !u.coversPrefix(prefix) {
+    writeHTTPReply(w, errors.New("NOPERM User " + u.name + " has no permissions to read the keys under '" + prefix + "'"))
+    return false
+  }
+  return true
+}
+
+// setNodeAuth adds the -auth credentials to a request to another node
+func setNodeAuth(req *http.Request) {
+  if i := strings.IndexByte(node_auth, ':'); i >= 0 {
+    req.SetBasicAuth(node_auth[:i], node_auth[i+1:])
+  }
+}
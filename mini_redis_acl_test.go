@@ -0,0 +1,60 @@
+// Tests of access control: permissions by command and key, and ACL LOAD
+//   while clients are checked (run with -race).
+// go test -race -run ACL mini_redis*.go
+
+package main
+import (
+  "strings"
+  "sync"
+  "testing"
+)
+
+func TestACLPermissions(t *testing.T) {
+  withUsers(t, "user default on nopass ~public/* +@read\nuser deploy on >s3cret ~config/* +@read +@write\n")
+  tests := []struct {
+    user string
+    args []string
+    err string
+  }{
+    {"", []string{"GET", "public/a"}, ""},
+    {"", []string{"GET", "config/a"}, "NOPERM"},
+    {"", []string{"SET", "public/a", "1"}, "NOPERM"},
+    {"deploy", []string{"SET", "config/a", "1"}, ""},
+    {"deploy", []string{"KEYS", "*"}, "NOPERM"},
+    {"nobody", []string{"GET", "public/a"}, "NOAUTH"},
+  }
+  for _, test := range tests {
+    err := checkAccess(test.user, test.args)
+    if (err == nil) != (test.err == "") || (err != nil && !strings.HasPrefix(err.Error(), test.err)) {
+      t.Errorf("%q runs %q: %v, want %q", test.user, test.args, err, test.err)
+    }
+  }
+  if _, err := authenticate("deploy", "wrong"); err == nil {
+    t.Error("deploy authenticated with a wrong password")
+  }
+  if u, err := authenticate("deploy", "s3cret"); err != nil || u.name != "deploy" {
+    t.Errorf("authenticate(deploy): %v %v", u, err)
+  }
+}
+
+func TestACLLoadWhileChecking(t *testing.T) {
+  withUsers(t, "user default on nopass allkeys allcommands\n")
+  c := &Client{}
+  var wg sync.WaitGroup
+  for i := 0; i < 4; i++ {
+    wg.Add(1)
+    go func() {
+      defer wg.Done()
+      for j := 0; j < 200; j++ {
+        checkAccess("", []string{"GET", "k"})
+        c.aclCommand([]string{"ACL", "WHOAMI"})
+      }
+    }()
+  }
+  for j := 0; j < 50; j++ {
+    if reply := (&Client{user: ""}).aclCommand([]string{"ACL", "LOAD"}); reply != Status("OK") {
+      t.Fatalf("ACL LOAD: %v", reply)
+    }
+  }
+  wg.Wait()
+}
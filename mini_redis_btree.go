@@ -0,0 +1,859 @@
+// The btree storage engine of mini_redis (-engine btree, see mini_redis_store.go):
+//   the keys of a database in a B+tree in a page file, -dbfile for database 0
+//   and -dbfile.n for database n.
+// The file is made of btree_page_size pages: the header (page 0), the nodes of
+//   the tree, the overflow pages of values too large for a leaf and the free
+//   pages, chained from the header. Inner nodes hold the first key of every
+//   child but the first; leaves hold the keys with their expiration time and
+//   their value (see encodeValue), and are chained in key order, so a range of
+//   keys is read leaf after leaf.
+// The nodes read are cached, up to -btree-cache pages. Changed pages stay in
+//   memory until the next commit, every -save interval, on SAVE, at exit, or as
+//   soon as there are more than -btree-cache of them. A commit writes the pages
+//   to a journal next to the file first, then in place, so after a crash the
+//   file is as of the last commit, the journal being replayed if it is whole.
+// The keys of each type are counted when the file is opened, reading the type
+//   that starts every value, then as they are put and deleted.
+// Keys are limited to btree_max_key bytes. A leaf emptied by deletes stays in
+//   the tree and takes the keys of its range again; FLUSHDB frees every page.
+
+package main
+import (
+  "bufio"
+  "bytes"
+  "encoding/binary"
+  "encoding/gob"
+  "errors"
+  "hash/crc32"
+  "io"
+  "log"
+  "math"
+  "os"
+  "sort"
+  "strconv"
+  "time"
+)
+
+const btree_page_size = 8192
+const btree_max_key = 1024
+const btree_max_inline = 1024 // larger values go to overflow pages
+const btree_magic = "MRBTREE1"
+const journal_magic = "MRJOURNL"
+
+var btree_cache = 16384 // pages
+
+type pageID uint32
+
+type leafEntry struct {
+  expires int64
+  data []byte // the encoded value when it is in the leaf,
+  overflow pageID // else the first of its overflow pages
+  length int // and its length
+}
+
+type btreeNode struct {
+  leaf bool
+  keys []string
+  entries []leafEntry // of a leaf
+  children []pageID // of an inner node, one more than keys
+  next pageID // of a leaf, the next one in key order, 0 for the last
+}
+
+type BTree struct {
+  path string
+  file *os.File
+  root pageID
+  pages uint32 // in the file, with the header
+  free pageID // first free page, 0 for none
+  length int // number of keys
+  types map[string]int64 // keys of each type
+  revision int64 // at the last commit
+  changed bool // the header, since the last commit
+  nodes map[pageID]*btreeNode // cached
+  dirty map[pageID]bool // nodes changed since the last commit
+  raw map[pageID][]byte // overflow and free pages changed since the last commit
+  values map[string]*Value // given out since the last release
+}
+
+func openBTree(path string) (*BTree, error) {
+  f, err := os.OpenFile(path, os.O_RDWR | os.O_CREATE, 0644)
+  if err != nil {
+    return nil, err
+  }
+  t := &BTree{path: path, file: f}
+  t.reset()
+  if err := t.replayJournal(); err != nil {
+    f.Close()
+    return nil, err
+  }
+  info, err := f.Stat()
+  if err != nil {
+    f.Close()
+    return nil, err
+  }
+  if info.Size() == 0 {
+    return t, t.commit(0)
+  }
+  header := make([]byte, btree_page_size)
+  if _, err := f.ReadAt(header, 0); err != nil || string(header[:8]) != btree_magic {
+    f.Close()
+    return nil, errors.New(path + " is not a btree file of mini_redis")
+  }
+  if size := binary.LittleEndian.Uint32(header[8:]); size != btree_page_size {
+    f.Close()
+    return nil, errors.New(path + " has pages of " + strconv.Itoa(int(size)) + " bytes")
+  }
+  t.root = pageID(binary.LittleEndian.Uint32(header[12:]))
+  t.pages = binary.LittleEndian.Uint32(header[16:])
+  t.free = pageID(binary.LittleEndian.Uint32(header[20:]))
+  t.length = int(binary.LittleEndian.Uint64(header[24:]))
+  t.revision = int64(binary.LittleEndian.Uint64(header[32:]))
+  t.nodes, t.dirty, t.changed = make(map[pageID]*btreeNode), make(map[pageID]bool), false
+  t.countKinds()
+  return t, nil
+}
+
+// reset makes the tree a single empty leaf, its other pages are dropped at the commit
+func (t *BTree) reset() {
+  t.root, t.pages, t.free, t.length = 1, 2, 0, 0
+  t.nodes = map[pageID]*btreeNode{1: {leaf: true}}
+  t.dirty = map[pageID]bool{1: true}
+  t.raw = make(map[pageID][]byte)
+  t.values = make(map[string]*Value)
+  t.types = make(map[string]int64)
+  t.changed = true
+}
+
+// fail stops the server: a page file that can not be read or written would
+//   only give wrong answers
+func (t *BTree) fail(err error) {
+  log.Fatalf("mini_redis: %s: %v", t.path, err)
+}
+
+func (t *BTree) readPage(id pageID) []byte {
+  if page, ok := t.raw[id]; ok {
+    return page
+  }
+  page := make([]byte, btree_page_size)
+  if _, err := t.file.ReadAt(page, int64(id) * btree_page_size); err != nil {
+    t.fail(errors.New("page " + strconv.Itoa(int(id)) + ": " + err.Error()))
+  }
+  return page
+}
+
+func (t *BTree) node(id pageID) *btreeNode {
+  if n, ok := t.nodes[id]; ok {
+    return n
+  }
+  n, err := decodeNode(t.readPage(id))
+  if err != nil {
+    t.fail(errors.New("page " + strconv.Itoa(int(id)) + ": " + err.Error()))
+  }
+  t.nodes[id] = n
+  return n
+}
+
+// allocate returns a page for new data, a free one if there is any
+func (t *BTree) allocate() pageID {
+  t.changed = true
+  if t.free == 0 {
+    t.pages++
+    return pageID(t.pages - 1)
+  }
+  id := t.free
+  t.free = pageID(binary.LittleEndian.Uint32(t.readPage(id)))
+  delete(t.raw, id)
+  return id
+}
+
+func (t *BTree) freePage(id pageID) {
+  page := make([]byte, btree_page_size)
+  binary.LittleEndian.PutUint32(page, uint32(t.free))
+  t.raw[id] = page
+  delete(t.nodes, id)
+  delete(t.dirty, id)
+  t.free, t.changed = id, true
+}
+
+// writeOverflow puts data in a chain of overflow pages, each starting with
+//   the next one, and returns the first
+func (t *BTree) writeOverflow(data []byte) pageID {
+  var first pageID
+  var last []byte
+  for len(data) > 0 {
+    id := t.allocate()
+    page := make([]byte, btree_page_size)
+    data = data[copy(page[4:], data):]
+    t.raw[id] = page
+    if last == nil {
+      first = id
+    } else {
+      binary.LittleEndian.PutUint32(last, uint32(id))
+    }
+    last = page
+  }
+  return first
+}
+
+func (t *BTree) readOverflow(id pageID, length int) []byte {
+  data := make([]byte, 0, length)
+  for len(data) < length {
+    page := t.readPage(id)
+    n := length - len(data)
+    if n > btree_page_size - 4 {
+      n = btree_page_size - 4
+    }
+    data = append(data, page[4:4+n]...)
+    id = pageID(binary.LittleEndian.Uint32(page))
+  }
+  return data
+}
+
+// freeValue frees the overflow pages of an entry
+func (t *BTree) freeValue(e leafEntry) {
+  id := e.overflow
+  for left := e.length; id != 0 && left > 0; left -= btree_page_size - 4 {
+    next := pageID(binary.LittleEndian.Uint32(t.readPage(id)))
+    t.freePage(id)
+    id = next
+  }
+}
+
+// leafOf returns the leaf where key is or would be
+func (t *BTree) leafOf(key string) (pageID, *btreeNode) {
+  id := t.root
+  n := t.node(id)
+  for !n.leaf {
+    id = n.children[childIndex(n.keys, key)]
+    n = t.node(id)
+  }
+  return id, n
+}
+
+// childIndex returns which child of an inner node holds key
+func childIndex(keys []string, key string) int {
+  return sort.Search(len(keys), func(i int) bool { return keys[i] > key })
+}
+
+func (t *BTree) get(key string) (*Value, bool) {
+  if v, ok := t.values[key]; ok {
+    return v, true
+  }
+  _, n := t.leafOf(key)
+  i := sort.SearchStrings(n.keys, key)
+  if i == len(n.keys) || n.keys[i] != key {
+    return nil, false
+  }
+  e := n.entries[i]
+  data := e.data
+  if e.overflow != 0 {
+    data = t.readOverflow(e.overflow, e.length)
+  }
+  v, err := decodeValue(data)
+  if err != nil {
+    t.fail(errors.New("value of " + strconv.Quote(key) + ": " + err.Error()))
+  }
+  v.Expires = e.expires
+  // the same Value until release, so the changes of a command are not lost
+  t.values[key] = v
+  return v, true
+}
+
+func (t *BTree) put(key string, v *Value) {
+  if len(key) > btree_max_key {
+    log.Println("mini_redis: a key of", len(key), "bytes is too long for the btree engine, not stored")
+    return
+  }
+  t.values[key] = v
+  e := leafEntry{expires: v.Expires}
+  if data := encodeValue(v); len(data) > btree_max_inline {
+    e.overflow, e.length = t.writeOverflow(data), len(data)
+  } else {
+    e.data = data
+  }
+  sep, right, split := t.insert(t.root, key, e)
+  t.types[v.Kind]++
+  if split {
+    root := t.allocate()
+    t.nodes[root] = &btreeNode{keys: []string{sep}, children: []pageID{t.root, right}}
+    t.dirty[root] = true
+    t.root = root
+  }
+}
+
+// insert puts the entry in the subtree of node id; when the node had to be
+//   split it returns the first key of the new right node and its page
+func (t *BTree) insert(id pageID, key string, e leafEntry) (string, pageID, bool) {
+  n := t.node(id)
+  if n.leaf {
+    i := sort.SearchStrings(n.keys, key)
+    if i < len(n.keys) && n.keys[i] == key {
+      t.uncount(n.entries[i])
+      t.freeValue(n.entries[i])
+      n.entries[i] = e
+    } else {
+      n.keys = append(n.keys, "")
+      copy(n.keys[i+1:], n.keys[i:])
+      n.keys[i] = key
+      n.entries = append(n.entries, leafEntry{})
+      copy(n.entries[i+1:], n.entries[i:])
+      n.entries[i] = e
+      t.length++
+      t.changed = true
+    }
+  } else {
+    i := childIndex(n.keys, key)
+    sep, right, split := t.insert(n.children[i], key, e)
+    if !split {
+      return "", 0, false
+    }
+    n.keys = append(n.keys, "")
+    copy(n.keys[i+1:], n.keys[i:])
+    n.keys[i] = sep
+    n.children = append(n.children, 0)
+    copy(n.children[i+2:], n.children[i+1:])
+    n.children[i+1] = right
+  }
+  t.dirty[id] = true
+  if n.size() <= btree_page_size {
+    return "", 0, false
+  }
+  return t.split(n)
+}
+
+// split moves the upper part of a node that outgrew its page to a new node;
+//   a single insert makes it at most one entry too large, so both halves fit
+func (t *BTree) split(n *btreeNode) (string, pageID, bool) {
+  i := n.splitPoint()
+  id := t.allocate()
+  right := &btreeNode{leaf: n.leaf}
+  var sep string
+  if n.leaf {
+    right.keys = append([]string{}, n.keys[i:]...)
+    right.entries = append([]leafEntry{}, n.entries[i:]...)
+    n.keys, n.entries = n.keys[:i:i], n.entries[:i:i]
+    right.next, n.next = n.next, id
+    sep = right.keys[0]
+  } else {
+    // the middle key moves up to the parent
+    sep = n.keys[i]
+    right.keys = append([]string{}, n.keys[i+1:]...)
+    right.children = append([]pageID{}, n.children[i+1:]...)
+    n.keys, n.children = n.keys[:i:i], n.children[:i+1:i+1]
+  }
+  t.nodes[id] = right
+  t.dirty[id] = true
+  return sep, id, true
+}
+
+func (t *BTree) delete(key string) {
+  delete(t.values, key)
+  id, n := t.leafOf(key)
+  i := sort.SearchStrings(n.keys, key)
+  if i == len(n.keys) || n.keys[i] != key {
+    return
+  }
+  t.uncount(n.entries[i])
+  t.freeValue(n.entries[i])
+  n.keys = append(n.keys[:i], n.keys[i+1:]...)
+  n.entries = append(n.entries[:i], n.entries[i+1:]...)
+  t.dirty[id] = true
+  t.length--
+  t.changed = true
+}
+
+func (t *BTree) count() int {
+  return t.length
+}
+
+func (t *BTree) kinds() map[string]int64 {
+  return t.types
+}
+
+// entryKind returns the type of the value of an entry, which its encoding
+//   starts with, so only the first overflow page is read
+func (t *BTree) entryKind(e leafEntry) string {
+  data := e.data
+  if e.overflow != 0 {
+    data = t.readPage(e.overflow)[4:]
+  }
+  r := &byteReader{data: data}
+  return r.string()
+}
+
+func (t *BTree) uncount(e leafEntry) {
+  kind := t.entryKind(e)
+  if t.types[kind]--; t.types[kind] == 0 {
+    delete(t.types, kind)
+  }
+}
+
+// countKinds counts the keys of each type, leaf after leaf
+func (t *BTree) countKinds() {
+  _, n := t.leafOf("")
+  for {
+    for _, e := range n.entries {
+      t.types[t.entryKind(e)]++
+    }
+    if n.next == 0 {
+      return
+    }
+    n = t.node(n.next)
+    t.trim()
+  }
+}
+
+func (t *BTree) ascend(start string, fn func(key string, expires int64) bool) {
+  _, n := t.leafOf(start)
+  i := sort.SearchStrings(n.keys, start)
+  for {
+    for ; i < len(n.keys); i++ {
+      if !fn(n.keys[i], n.entries[i].expires) {
+        return
+      }
+    }
+    if n.next == 0 {
+      return
+    }
+    n, i = t.node(n.next), 0
+    t.trim() // n stays usable even if it is dropped from the cache
+  }
+}
+
+func (t *BTree) clear() {
+  t.reset()
+}
+
+func (t *BTree) release() {
+  if len(t.values) > 0 {
+    t.values = make(map[string]*Value)
+  }
+  t.trim()
+}
+
+// trim drops clean leaves from the cache when it is full; inner nodes are few
+//   and needed by every lookup, they stay
+func (t *BTree) trim() {
+  if len(t.nodes) <= btree_cache {
+    return
+  }
+  for id, n := range t.nodes {
+    if len(t.nodes) <= btree_cache * 3 / 4 {
+      break
+    }
+    if n.leaf && !t.dirty[id] && id != t.root {
+      delete(t.nodes, id)
+    }
+  }
+}
+
+// changedPages is the number of pages waiting for the next commit
+func (t *BTree) changedPages() int {
+  return len(t.dirty) + len(t.raw)
+}
+
+func (t *BTree) fileSize() int64 {
+  return int64(t.pages) * btree_page_size
+}
+
+// commit writes the changed pages and the header with the revision,
+//   through the journal (see the top of the file)
+func (t *BTree) commit(revision int64) error {
+  if t.changedPages() == 0 && !t.changed && revision == t.revision {
+    return nil
+  }
+  header := make([]byte, btree_page_size)
+  copy(header, btree_magic)
+  binary.LittleEndian.PutUint32(header[8:], btree_page_size)
+  binary.LittleEndian.PutUint32(header[12:], uint32(t.root))
+  binary.LittleEndian.PutUint32(header[16:], t.pages)
+  binary.LittleEndian.PutUint32(header[20:], uint32(t.free))
+  binary.LittleEndian.PutUint64(header[24:], uint64(t.length))
+  binary.LittleEndian.PutUint64(header[32:], uint64(revision))
+  pages := map[pageID][]byte{0: header}
+  for id, page := range t.raw {
+    pages[id] = page
+  }
+  for id := range t.dirty {
+    pages[id] = t.nodes[id].encode()
+  }
+  ids := make([]pageID, 0, len(pages))
+  for id := range pages {
+    ids = append(ids, id)
+  }
+  sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+  journal, err := os.Create(t.path + "-journal")
+  if err != nil {
+    return err
+  }
+  sum := crc32.NewIEEE()
+  w := bufio.NewWriter(io.MultiWriter(journal, sum))
+  w.WriteString(journal_magic)
+  for _, id := range ids {
+    binary.Write(w, binary.LittleEndian, uint32(id))
+    w.Write(pages[id])
+  }
+  err = w.Flush()
+  if err == nil {
+    err = binary.Write(journal, binary.LittleEndian, sum.Sum32())
+  }
+  if err == nil {
+    err = journal.Sync()
+  }
+  if journal.Close(); err != nil {
+    return err
+  }
+  if err := t.writePages(ids, pages); err != nil {
+    return err
+  }
+  os.Remove(t.path + "-journal")
+  t.dirty, t.raw = make(map[pageID]bool), make(map[pageID][]byte)
+  t.revision, t.changed = revision, false
+  return nil
+}
+
+// writePages writes pages in place and cuts the pages beyond the last one
+func (t *BTree) writePages(ids []pageID, pages map[pageID][]byte) error {
+  for _, id := range ids {
+    if _, err := t.file.WriteAt(pages[id], int64(id) * btree_page_size); err != nil {
+      return err
+    }
+  }
+  size := int64(binary.LittleEndian.Uint32(pages[0][16:])) * btree_page_size
+  if info, err := t.file.Stat(); err == nil && info.Size() > size {
+    if err := t.file.Truncate(size); err != nil {
+      return err
+    }
+  }
+  return t.file.Sync()
+}
+
+// replayJournal finishes the commit a crash interrupted, if its journal is whole
+func (t *BTree) replayJournal() error {
+  data, err := os.ReadFile(t.path + "-journal")
+  if os.IsNotExist(err) {
+    return nil
+  }
+  if err != nil {
+    return err
+  }
+  record := 4 + btree_page_size
+  body := len(data) - 4
+  if body >= len(journal_magic) + record && (body - len(journal_magic)) % record == 0 &&
+      string(data[:len(journal_magic)]) == journal_magic &&
+      crc32.ChecksumIEEE(data[:body]) == binary.LittleEndian.Uint32(data[body:]) {
+    pages := make(map[pageID][]byte)
+    var ids []pageID
+    for rest := data[len(journal_magic):body]; len(rest) > 0; rest = rest[record:] {
+      id := pageID(binary.LittleEndian.Uint32(rest))
+      pages[id] = rest[4:record]
+      ids = append(ids, id)
+    }
+    if pages[0] == nil {
+      return errors.New(t.path + "-journal has no header page")
+    }
+    if err := t.writePages(ids, pages); err != nil {
+      return err
+    }
+    log.Println("replayed the journal of", t.path)
+  }
+  return os.Remove(t.path + "-journal")
+}
+
+// size is the length of the encoded node
+func (n *btreeNode) size() int {
+  size := 7 // type, number of keys, next leaf or first child
+  for i := range n.keys {
+    size += n.entrySize(i)
+  }
+  return size
+}
+
+func (n *btreeNode) entrySize(i int) int {
+  var b [binary.MaxVarintLen64]byte
+  size := binary.PutUvarint(b[:], uint64(len(n.keys[i]))) + len(n.keys[i])
+  if !n.leaf {
+    return size + 4
+  }
+  e := n.entries[i]
+  size += binary.PutVarint(b[:], e.expires) + 1
+  if e.overflow != 0 {
+    return size + 4 + binary.PutUvarint(b[:], uint64(e.length))
+  }
+  return size + binary.PutUvarint(b[:], uint64(len(e.data))) + len(e.data)
+}
+
+// splitPoint returns where to split the node so both halves are about as large
+func (n *btreeNode) splitPoint() int {
+  total := n.size()
+  best, best_size, left := 1, total, 7
+  for i := 1; i < len(n.keys); i++ {
+    left += n.entrySize(i - 1)
+    larger := left
+    if total - left + 7 > larger {
+      larger = total - left + 7
+    }
+    if larger < best_size {
+      best, best_size = i, larger
+    }
+  }
+  return best
+}
+
+func (n *btreeNode) encode() []byte {
+  page := make([]byte, 7, btree_page_size)
+  page[0] = 2
+  first := uint32(0)
+  if n.leaf {
+    page[0], first = 1, uint32(n.next)
+  } else {
+    first = uint32(n.children[0])
+  }
+  binary.LittleEndian.PutUint16(page[1:], uint16(len(n.keys)))
+  binary.LittleEndian.PutUint32(page[3:], first)
+  for i, key := range n.keys {
+    page = appendString(page, key)
+    if !n.leaf {
+      page = binary.LittleEndian.AppendUint32(page, uint32(n.children[i+1]))
+      continue
+    }
+    e := n.entries[i]
+    page = binary.AppendVarint(page, e.expires)
+    if e.overflow != 0 {
+      page = append(page, 1)
+      page = binary.LittleEndian.AppendUint32(page, uint32(e.overflow))
+      page = binary.AppendUvarint(page, uint64(e.length))
+    } else {
+      page = append(page, 0)
+      page = appendString(page, string(e.data))
+    }
+  }
+  return page[:btree_page_size]
+}
+
+func decodeNode(page []byte) (*btreeNode, error) {
+  if page[0] != 1 && page[0] != 2 {
+    return nil, errors.New("not a node")
+  }
+  n := &btreeNode{leaf: page[0] == 1}
+  count := int(binary.LittleEndian.Uint16(page[1:]))
+  first := pageID(binary.LittleEndian.Uint32(page[3:]))
+  if n.leaf {
+    n.next = first
+  } else {
+    n.children = append(n.children, first)
+  }
+  r := &byteReader{data: page[7:]}
+  for i := 0; i < count && r.err == nil; i++ {
+    n.keys = append(n.keys, r.string())
+    if !n.leaf {
+      n.children = append(n.children, pageID(r.uint32()))
+      continue
+    }
+    e := leafEntry{expires: r.varint()}
+    if r.byte() == 1 {
+      e.overflow, e.length = pageID(r.uint32()), int(r.uvarint())
+    } else {
+      e.data = []byte(r.string())
+    }
+    n.entries = append(n.entries, e)
+  }
+  return n, r.err
+}
+
+// encodeValue encodes a value for a leaf, without its expiration time which
+//   the leaf keeps apart so the keys can be walked without decoding values
+func encodeValue(v *Value) []byte {
+  b := appendString(nil, v.Kind)
+  b = binary.AppendVarint(b, v.Version)
+  switch v.Kind {
+  case "string":
+    b = appendString(b, v.Str)
+    b = appendString(b, string(v.Packed))
+    b = appendString(b, v.ContentType)
+  case "list":
+    b = binary.AppendUvarint(b, uint64(len(v.List)))
+    for _, item := range v.List {
+      b = appendString(b, item)
+    }
+  case "hash":
+    b = binary.AppendUvarint(b, uint64(len(v.Hash)))
+    for field, value := range v.Hash {
+      b = appendString(appendString(b, field), value)
+    }
+  case "set":
+    b = binary.AppendUvarint(b, uint64(len(v.Set)))
+    for member := range v.Set {
+      b = appendString(b, member)
+    }
+  case "zset":
+    b = binary.AppendUvarint(b, uint64(len(v.ZSet.dict)))
+    for member, score := range v.ZSet.dict {
+      b = binary.LittleEndian.AppendUint64(appendString(b, member), math.Float64bits(score))
+    }
+  case "stream":
+    // streams are rare and large, gob is good enough for them
+    var buf bytes.Buffer
+    gob.NewEncoder(&buf).Encode(v.Stream)
+    b = appendString(b, buf.String())
+  }
+  return b
+}
+
+func decodeValue(data []byte) (*Value, error) {
+  r := &byteReader{data: data}
+  v := &Value{Kind: r.string(), Version: r.varint()}
+  switch v.Kind {
+  case "string":
+    v.Str = r.string()
+    if packed := r.string(); packed != "" {
+      v.Packed = []byte(packed)
+    }
+    v.ContentType = r.string()
+  case "list":
+    for n := r.uvarint(); n > 0 && r.err == nil; n-- {
+      v.List = append(v.List, r.string())
+    }
+  case "hash":
+    v.Hash = make(map[string]string)
+    for n := r.uvarint(); n > 0 && r.err == nil; n-- {
+      field := r.string()
+      v.Hash[field] = r.string()
+    }
+  case "set":
+    v.Set = make(map[string]bool)
+    for n := r.uvarint(); n > 0 && r.err == nil; n-- {
+      v.Set[r.string()] = true
+    }
+  case "zset":
+    v.ZSet = newZSet()
+    for n := r.uvarint(); n > 0 && r.err == nil; n-- {
+      member := r.string()
+      v.ZSet.add(math.Float64frombits(r.uint64()), member)
+    }
+  case "stream":
+    v.Stream = newStream()
+    if err := gob.NewDecoder(bytes.NewReader([]byte(r.string()))).Decode(v.Stream); err != nil && r.err == nil {
+      r.err = err
+    }
+  default:
+    if r.err == nil {
+      r.err = errors.New("unknown type " + strconv.Quote(v.Kind))
+    }
+  }
+  return v, r.err
+}
+
+func appendString(b []byte, s string) []byte {
+  return append(binary.AppendUvarint(b, uint64(len(s))), s...)
+}
+
+// byteReader reads what encode and encodeValue wrote; after an error it reads
+//   zeros and err tells what went wrong
+type byteReader struct {
+  data []byte
+  err error
+}
+
+func (r *byteReader) take(n int) []byte {
+  if r.err != nil || n < 0 || n > len(r.data) {
+    if r.err == nil {
+      r.err = errors.New("truncated data")
+    }
+    return make([]byte, n & 0xffff)
+  }
+  b := r.data[:n]
+  r.data = r.data[n:]
+  return b
+}
+
+func (r *byteReader) uvarint() uint64 {
+  n, size := binary.Uvarint(r.data)
+  if size <= 0 {
+    r.take(len(r.data) + 1)
+    return 0
+  }
+  r.data = r.data[size:]
+  return n
+}
+
+func (r *byteReader) varint() int64 {
+  n, size := binary.Varint(r.data)
+  if size <= 0 {
+    r.take(len(r.data) + 1)
+    return 0
+  }
+  r.data = r.data[size:]
+  return n
+}
+
+func (r *byteReader) string() string {
+  n := r.uvarint()
+  if n > uint64(len(r.data)) {
+    r.take(len(r.data) + 1)
+    return ""
+  }
+  return string(r.take(int(n)))
+}
+
+func (r *byteReader) byte() byte {
+  return r.take(1)[0]
+}
+
+func (r *byteReader) uint32() uint32 {
+  return binary.LittleEndian.Uint32(r.take(4))
+}
+
+func (r *byteReader) uint64() uint64 {
+  return binary.LittleEndian.Uint64(r.take(8))
+}
+
+// loadBTrees opens the page file of every database, at startup
+func loadBTrees() error {
+  var rev int64
+  for i, d := range databases {
+    t, err := openBTree(dbFile(i))
+    if err != nil {
+      return err
+    }
+    d.storage = t
+    d.expires = make(map[string]bool)
+    t.ascend("", func(key string, expires int64) bool {
+      if expires != 0 {
+        d.expires[key] = true
+      }
+      return true
+    })
+    if t.revision > rev {
+      rev = t.revision
+    }
+    if t.length > 0 {
+      log.Println("opened", dbFile(i), "with", t.length, "keys")
+    }
+  }
+  mu.Lock()
+  selectDB(db_index)
+  revision, compacted, backlog_floor = rev, rev, rev
+  mu.Unlock()
+  go commitLoop()
+  return nil
+}
+
+// commitLoop commits the databases with more changed pages than the cache
+//   holds, so a large import does not wait in memory for the next save
+func commitLoop() {
+  for range time.Tick(100 * time.Millisecond) {
+    mu.Lock()
+    for _, d := range databases {
+      if t, ok := d.storage.(*BTree); ok && t.changedPages() > btree_cache {
+        if err := t.commit(revision); err != nil {
+          log.Println("commit of", t.path, "failed:", err)
+        } else {
+          d.dirty = 0
+        }
+      }
+    }
+    mu.Unlock()
+  }
+}
@@ -0,0 +1,247 @@
+// Tests of the btree engine: splits keeping every key in order, values in
+//   overflow pages, reopening the file, the journal of an interrupted commit,
+//   and commands running on it.
+// go test -run BTree mini_redis*.go
+
+package main
+import (
+  "fmt"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+func btreeKey(i int) string {
+  return fmt.Sprintf("key:%05d", i)
+}
+
+// checkBTree checks that the tree holds the keys of want, in order, and their values
+func checkBTree(t *testing.T, tree *BTree, want map[string]string) {
+  t.Helper()
+  if tree.count() != len(want) {
+    t.Fatalf("%d keys, want %d", tree.count(), len(want))
+  }
+  if n := tree.kinds()["string"]; n != int64(len(want)) {
+    t.Fatalf("%d strings counted, want %d", n, len(want))
+  }
+  var keys []string
+  tree.ascend("", func(key string, expires int64) bool {
+    keys = append(keys, key)
+    return true
+  })
+  if len(keys) != len(want) {
+    t.Fatalf("ascend gave %d keys, want %d", len(keys), len(want))
+  }
+  for i, key := range keys {
+    if i > 0 && keys[i-1] >= key {
+      t.Fatalf("ascend gave %q after %q", key, keys[i-1])
+    }
+    v, ok := tree.get(key)
+    if !ok {
+      t.Fatalf("%q is missing", key)
+    }
+    if s, _ := v.str(); s != want[key] {
+      t.Fatalf("%q holds %d bytes, want %d", key, len(s), len(want[key]))
+    }
+  }
+  tree.release()
+}
+
+func TestBTreeSplitsAndReopen(t *testing.T) {
+  old := btree_cache
+  btree_cache = 8 // leaves are dropped from the cache and read again
+  defer func() { btree_cache = old }()
+  path := filepath.Join(t.TempDir(), "data.btree")
+  tree, err := openBTree(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  want := make(map[string]string)
+  // keys in an order that splits leaves in their middle and at their ends
+  for i := 0; i < 3000; i++ {
+    key := btreeKey(i * 7919 % 3000)
+    value := strings.Repeat("v", i % 200)
+    if i % 500 == 0 {
+      value = strings.Repeat(fmt.Sprint(i), 5000) // overflow pages
+    }
+    tree.put(key, newString(value, ""))
+    want[key] = value
+    if i % 100 == 0 {
+      tree.release()
+    }
+  }
+  tree.release()
+  if tree.node(tree.root).leaf {
+    t.Fatal("3000 keys fit in the root leaf, nothing was split")
+  }
+  checkBTree(t, tree, want)
+
+  var from []string
+  tree.ascend(btreeKey(2990), func(key string, expires int64) bool {
+    from = append(from, key)
+    return true
+  })
+  if len(from) != 10 || from[0] != btreeKey(2990) {
+    t.Fatalf("ascend from %s gave %v", btreeKey(2990), from)
+  }
+
+  for i := 0; i < 3000; i += 2 {
+    tree.delete(btreeKey(i))
+    delete(want, btreeKey(i))
+  }
+  if err := tree.commit(42); err != nil {
+    t.Fatal(err)
+  }
+  tree.file.Close()
+
+  if tree, err = openBTree(path); err != nil {
+    t.Fatal(err)
+  }
+  defer tree.file.Close()
+  if tree.revision != 42 {
+    t.Fatalf("revision %d after reopening, want 42", tree.revision)
+  }
+  checkBTree(t, tree, want)
+
+  // the pages freed by deletes are used again
+  pages := tree.pages
+  for i := 0; i < 3000; i += 2 {
+    tree.put(btreeKey(i), newString("again", ""))
+    want[btreeKey(i)] = "again"
+  }
+  tree.release()
+  if tree.pages > pages + pages / 2 {
+    t.Fatalf("the file grew from %d to %d pages", pages, tree.pages)
+  }
+  checkBTree(t, tree, want)
+
+  tree.clear()
+  if err := tree.commit(43); err != nil {
+    t.Fatal(err)
+  }
+  info, err := os.Stat(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if info.Size() != 2 * btree_page_size {
+    t.Fatalf("the file of an empty tree has %d bytes, want 2 pages", info.Size())
+  }
+}
+
+func TestBTreeJournal(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "data.btree")
+  tree, err := openBTree(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  committed := make(map[string]string)
+  for i := 0; i < 500; i++ {
+    tree.put(btreeKey(i), newString("before", ""))
+    committed[btreeKey(i)] = "before"
+  }
+  if err := tree.commit(1); err != nil {
+    t.Fatal(err)
+  }
+  changed := make(map[string]string)
+  for key := range committed {
+    changed[key] = "before"
+  }
+  for i := 0; i < 1000; i += 3 {
+    tree.put(btreeKey(i), newString("after", ""))
+    changed[btreeKey(i)] = "after"
+  }
+  tree.release()
+
+  // the journal is written, then writing the pages in place fails as in a crash
+  file := tree.file
+  if tree.file, err = os.Open(path); err != nil {
+    t.Fatal(err)
+  }
+  if err := tree.commit(2); err == nil {
+    t.Fatal("the commit to a read-only file did not fail")
+  }
+  tree.file.Close()
+  file.Close()
+  journal, err := os.ReadFile(path + "-journal")
+  if err != nil {
+    t.Fatal("no journal is left by the interrupted commit")
+  }
+
+  // a torn journal is dropped, the file is as of the last commit
+  if err := os.WriteFile(path + "-journal", journal[:len(journal) - 100], 0644); err != nil {
+    t.Fatal(err)
+  }
+  reopened, err := openBTree(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if reopened.revision != 1 {
+    t.Fatalf("revision %d with a torn journal, want 1", reopened.revision)
+  }
+  checkBTree(t, reopened, committed)
+  reopened.file.Close()
+  if _, err := os.Stat(path + "-journal"); !os.IsNotExist(err) {
+    t.Fatal("the torn journal is still there")
+  }
+
+  // a whole journal finishes the commit
+  if err := os.WriteFile(path + "-journal", journal, 0644); err != nil {
+    t.Fatal(err)
+  }
+  if reopened, err = openBTree(path); err != nil {
+    t.Fatal(err)
+  }
+  defer reopened.file.Close()
+  if reopened.revision != 2 {
+    t.Fatalf("revision %d after the replay, want 2", reopened.revision)
+  }
+  checkBTree(t, reopened, changed)
+}
+
+func TestBTreeCommands(t *testing.T) {
+  path := filepath.Join(t.TempDir(), "data.btree")
+  tree, err := openBTree(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  resetDatabases()
+  mu.Lock()
+  databases[0].storage = tree
+  selectDB(0)
+  mu.Unlock()
+  defer resetDatabases()
+  runSteps(t, 0, []step{
+    {[]string{"SET", "user:1", "a"}, Status("OK")},
+    {[]string{"SET", "user:2", "b"}, Status("OK")},
+    {[]string{"SET", "other", "c"}, Status("OK")},
+    {[]string{"RPUSH", "list", "x"}, 1},
+    {[]string{"RPUSH", "list", "y"}, 2}, // changed in place and put back
+    {[]string{"HSET", "hash", "f", "v"}, 1},
+    {[]string{"KEYS", "user:*"}, []string{"user:1", "user:2"}},
+    {[]string{"COUNT", "user:*"}, 2},
+    {[]string{"DEL", "other"}, 1},
+    {[]string{"DBSIZE"}, 4},
+  })
+  mu.Lock()
+  err = tree.commit(revision)
+  mu.Unlock()
+  if err != nil {
+    t.Fatal(err)
+  }
+  tree.file.Close()
+  if tree, err = openBTree(path); err != nil {
+    t.Fatal(err)
+  }
+  defer tree.file.Close()
+  mu.Lock()
+  databases[0].storage = tree
+  selectDB(0)
+  mu.Unlock()
+  runSteps(t, 0, []step{
+    {[]string{"LRANGE", "list", "0", "-1"}, []string{"x", "y"}},
+    {[]string{"HGET", "hash", "f"}, "v"},
+    {[]string{"GET", "user:2"}, "b"},
+    {[]string{"EXISTS", "other"}, 0},
+  })
+}
@@ -0,0 +1,389 @@
+// Bulk operations of mini_redis: MSET and MGET, and the export and import of
+//   a whole database over HTTP, to move data between environments or to load
+//   fixtures with one request instead of one per key.
+// GET /dump streams every key as a record, in key order:
+//   {"key": "k", "type": "string", "value": "v", "expires": 1700000000000}
+//   where value is a string, a list of strings for list and set, an object
+//   field -> value for hash and member -> score for zset, a list of
+//   [id, [field, value, ...]] entries for stream (without its consumer groups),
+//   and expires is a unix time in milliseconds, left out for persistent keys.
+//   A string has its "content_type" if it was stored with one, and a string
+//   that is not UTF-8 is in base64 with "encoding": "base64", as JSON would
+//   replace the bytes that are not.
+// With format=csv the records are rows of key,type,value,expires after a header,
+//   the value of a container being its JSON text (and strings going without
+//   their content type); ?match=P keeps the keys matching the glob pattern P.
+// POST /restore reads the same records (JSON Lines by default, format=csv
+//   for CSV) and writes them, replacing the keys that exist; they are applied in
+//   batches of restore_batch records, each batch as a transaction.
+// curl localhost:8082/dump > data.jsonl
+// curl --data-binary @data.jsonl localhost:8082/db/2/restore
+
+package main
+import (
+  "bufio"
+  "encoding/base64"
+  "encoding/csv"
+  "encoding/json"
+  "errors"
+  "io"
+  "net/http"
+  "sort"
+  "strconv"
+  "strings"
+  "unicode/utf8"
+)
+
+const restore_batch = 100
+
+type Record struct {
+  Key string `json:"key"`
+  Type string `json:"type"`
+  Value json.RawMessage `json:"value"`
+  Expires int64 `json:"expires,omitempty"`
+  ContentType string `json:"content_type,omitempty"`
+  Encoding string `json:"encoding,omitempty"`
+}
+
+func init() {
+  register("MSET", -3, "write", 1, -1, 2, cmdMset)
+  register("MGET", -2, "", 1, -1, 1, cmdMget)
+}
+
+// MSET key value [key value ...]
+func cmdMset(args []string) interface{} {
+  if len(args) % 2 != 1 {
+    return errors.New("ERR wrong number of arguments for 'mset' command")
+  }
+  for i := 1; i < len(args); i += 2 {
+    storage.put(args[i], newString(args[i+1], ""))
+  }
+  return Status("OK")
+}
+
+// MGET key [key ...]: nil for the keys that are missing or not strings
+func cmdMget(args []string) interface{} {
+  values := make([]interface{}, len(args) - 1)
+  for i, key := range args[1:] {
+    if v := get(key); v != nil && v.Kind == "string" {
+      s, err := v.str()
+      if err != nil {
+        return err
+      }
+      values[i] = s
+    }
+  }
+  return values
+}
+
+// recordOf returns the record of a key, the caller holds mu
+func recordOf(key string, v *Value) (Record, error) {
+  r := Record{Key: key, Type: v.Kind, Expires: v.Expires, ContentType: v.ContentType}
+  var value interface{}
+  switch v.Kind {
+  case "string":
+    s, err := v.str()
+    if err != nil {
+      return r, err
+    }
+    r.setText(s)
+    return r, nil
+  case "list":
+    value = v.List
+  case "hash":
+    value = v.Hash
+  case "set":
+    members := make([]string, 0, len(v.Set))
+    for member := range v.Set {
+      members = append(members, member)
+    }
+    sort.Strings(members)
+    value = members
+  case "zset":
+    // scores as text, since JSON has no infinity
+    scores := make(map[string]string, len(v.ZSet.dict))
+    for member, score := range v.ZSet.dict {
+      scores[member] = formatScore(score)
+    }
+    value = scores
+  case "stream":
+    value = entriesReply(v.Stream.Entries)
+  }
+  r.Value, _ = json.Marshal(value)
+  return r, nil
+}
+
+// setText sets the value of a string record, see the top of the file
+func (r *Record) setText(s string) {
+  r.Encoding = ""
+  if !utf8.ValidString(s) {
+    s, r.Encoding = base64.StdEncoding.EncodeToString([]byte(s)), "base64"
+  }
+  r.Value, _ = json.Marshal(s)
+}
+
+// text returns the value of a string record
+func (r *Record) text() (string, error) {
+  var s string
+  if err := json.Unmarshal(r.Value, &s); err != nil || r.Encoding == "" {
+    return s, err
+  }
+  if r.Encoding != "base64" {
+    return "", errors.New("unknown encoding '" + r.Encoding + "'")
+  }
+  data, err := base64.StdEncoding.DecodeString(s)
+  return string(data), err
+}
+
+// commands returns the commands that write the record
+func (r *Record) commands() ([][]string, error) {
+  if r.Key == "" {
+    return nil, errors.New("record without a key")
+  }
+  batch := [][]string{{"DEL", r.Key}}
+  var err error
+  switch r.Type {
+  case "string":
+    var s string
+    if s, err = r.text(); err == nil {
+      set := []string{"SET", r.Key, s}
+      if r.ContentType != "" {
+        set = append(set, "CONTENTTYPE", r.ContentType)
+      }
+      batch = append(batch, set)
+    }
+  case "list", "set":
+    var items []string
+    if err = json.Unmarshal(r.Value, &items); err == nil && len(items) > 0 {
+      name := "RPUSH"
+      if r.Type == "set" {
+        name = "SADD"
+      }
+      batch = append(batch, append([]string{name, r.Key}, items...))
+    }
+  case "hash", "zset":
+    var fields map[string]string
+    if err = json.Unmarshal(r.Value, &fields); err == nil && len(fields) > 0 {
+      args := []string{"HSET", r.Key}
+      for _, field := range sortedKeys(fields) {
+        if r.Type == "zset" {
+          args[0] = "ZADD"
+          args = append(args, fields[field], field)
+        } else {
+          args = append(args, field, fields[field])
+        }
+      }
+      batch = append(batch, args)
+    }
+  case "stream":
+    var entries [][]json.RawMessage
+    if err = json.Unmarshal(r.Value, &entries); err == nil {
+      for _, entry := range entries {
+        var id string
+        var fields []string
+        if len(entry) != 2 || json.Unmarshal(entry[0], &id) != nil || json.Unmarshal(entry[1], &fields) != nil {
+          err = errors.New("an entry must be [id, [field, value, ...]]")
+          break
+        }
+        batch = append(batch, append([]string{"XADD", r.Key, id}, fields...))
+      }
+    }
+  default:
+    return nil, errors.New("unknown type '" + r.Type + "' of key '" + r.Key + "'")
+  }
+  if err != nil {
+    return nil, errors.New("invalid value of key '" + r.Key + "': " + err.Error())
+  }
+  if r.Expires != 0 && len(batch) > 1 {
+    batch = append(batch, []string{"PEXPIREAT", r.Key, strconv.FormatInt(r.Expires, 10)})
+  }
+  return batch, nil
+}
+
+var csv_header = []string{"key", "type", "value", "expires"}
+
+// serveDump streams the keys of the database, a page of them per lock
+//   so writers are not blocked for the whole export
+func serveDump(w http.ResponseWriter, req *http.Request) {
+  query := req.URL.Query()
+  format := query.Get("format")
+  if format != "" && format != "jsonl" && format != "csv" {
+    http.Error(w, "format must be jsonl or csv", http.StatusBadRequest)
+    return
+  }
+  if !allowed(w, req, []string{"SCAN", "0"}) || !allowed(w, req, []string{"DUMP"}) {
+    return
+  }
+  prefix := keyPrefix("", query.Get("match"))
+  match, err := newMatcher("", query.Get("match"))
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  out := bufio.NewWriter(w)
+  var rows *csv.Writer
+  if format == "csv" {
+    w.Header().Set("Content-Type", "text/csv")
+    rows = csv.NewWriter(out)
+    rows.Write(csv_header)
+  } else {
+    w.Header().Set("Content-Type", "application/x-ndjson")
+  }
+  n := dbOf(req)
+  cursor := "0"
+  for {
+    mu.Lock()
+    selectDB(n)
+    next, keys, err := scanKeys(cursor, 1000, prefix, match)
+    records := make([]Record, 0, len(keys))
+    var damaged error
+    for _, key := range keys {
+      if v := get(key); v != nil {
+        r, err := recordOf(key, v)
+        if err != nil {
+          damaged = errors.New(key + ": " + err.Error())
+          break
+        }
+        records = append(records, r)
+      }
+    }
+    storage.release()
+    mu.Unlock()
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusBadRequest)
+      return
+    }
+    for _, r := range records {
+      if rows != nil {
+        value := string(r.Value)
+        if r.Type == "string" {
+          value, _ = r.text() // CSV takes any bytes
+        }
+        expires := ""
+        if r.Expires != 0 {
+          expires = strconv.FormatInt(r.Expires, 10)
+        }
+        rows.Write([]string{r.Key, r.Type, value, expires})
+      } else {
+        data, _ := json.Marshal(r)
+        out.Write(append(data, '\n'))
+      }
+    }
+    if damaged != nil {
+      // the records before it are sent, the error ends the dump so that it is
+      //   not taken for a whole one
+      if rows != nil {
+        rows.Flush()
+      }
+      out.Flush()
+      http.Error(w, damaged.Error(), http.StatusInternalServerError)
+      return
+    }
+    if cursor = next; cursor == "0" || req.Context().Err() != nil {
+      break
+    }
+  }
+  if rows != nil {
+    rows.Flush()
+  }
+  out.Flush()
+}
+
+// serveRestore writes the records of the request body, see the top of the file
+func serveRestore(w http.ResponseWriter, req *http.Request) {
+  if req.Method != "POST" && req.Method != "PUT" {
+    w.Header().Set("Allow", "POST, PUT")
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+  var next func() (*Record, error)
+  switch req.URL.Query().Get("format") {
+  case "", "jsonl":
+    lines := bufio.NewScanner(req.Body)
+    lines.Buffer(make([]byte, 64 * 1024), 512 * 1024 * 1024)
+    next = func() (*Record, error) {
+      for lines.Scan() {
+        if strings.TrimSpace(lines.Text()) == "" {
+          continue
+        }
+        var r Record
+        if err := json.Unmarshal(lines.Bytes(), &r); err != nil {
+          return nil, err
+        }
+        return &r, nil
+      }
+      if lines.Err() != nil {
+        return nil, lines.Err()
+      }
+      return nil, io.EOF
+    }
+  case "csv":
+    rows := csv.NewReader(req.Body)
+    rows.FieldsPerRecord = -1
+    next = func() (*Record, error) {
+      row, err := rows.Read()
+      if err == nil && row[0] == "key" && len(row) >= 2 && row[1] == "type" {
+        row, err = rows.Read() // the header
+      }
+      if err != nil {
+        return nil, err
+      }
+      if len(row) < 3 || len(row) > 4 {
+        return nil, errors.New("a row must be key,type,value[,expires]")
+      }
+      r := &Record{Key: row[0], Type: row[1], Value: json.RawMessage(row[2])}
+      if r.Type == "string" {
+        r.setText(row[2])
+      }
+      if len(row) == 4 && row[3] != "" {
+        if r.Expires, err = strconv.ParseInt(row[3], 10, 64); err != nil {
+          return nil, errors.New("expires must be a unix time in milliseconds")
+        }
+      }
+      return r, nil
+    }
+  default:
+    http.Error(w, "format must be jsonl or csv", http.StatusBadRequest)
+    return
+  }
+
+  n := dbOf(req)
+  read, restored := 0, 0
+  fail := func(err error) {
+    http.Error(w, err.Error() + " (" + strconv.Itoa(restored) + " records restored)", http.StatusBadRequest)
+  }
+  var batch [][]string
+  for {
+    r, err := next()
+    if err != nil && err != io.EOF {
+      fail(errors.New("record " + strconv.Itoa(read + 1) + ": " + err.Error()))
+      return
+    }
+    if r != nil {
+      read++
+      commands, err := r.commands()
+      if err != nil {
+        fail(errors.New("record " + strconv.Itoa(read) + ": " + err.Error()))
+        return
+      }
+      for _, args := range commands {
+        if !allowed(w, req, args) {
+          return
+        }
+      }
+      batch = append(batch, commands...)
+    }
+    if read - restored == restore_batch || (err == io.EOF && read > restored) {
+      if _, err := runTransaction(req.Context(), n, batch, nil); err != nil {
+        fail(errors.New("records " + strconv.Itoa(restored + 1) + " to " + strconv.Itoa(read) + ": " + err.Error()))
+        return
+      }
+      restored, batch = read, nil
+    }
+    if err == io.EOF {
+      break
+    }
+  }
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(map[string]int{"restored": restored})
+}
@@ -0,0 +1,104 @@
+// Tests of the bulk operations: MSET and MGET, and /dump and /restore giving
+//   back the same keys in JSON Lines and CSV.
+// go test -run Bulk mini_redis*.go
+
+package main
+import (
+  "context"
+  "errors"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+)
+
+// dumpDB returns the body of /dump for database n
+func dumpDB(t *testing.T, n int, query string) string {
+  t.Helper()
+  req := httptest.NewRequest("GET", "/dump" + query, nil)
+  w := httptest.NewRecorder()
+  serveDump(w, req.WithContext(context.WithValue(req.Context(), dbKey{}, n)))
+  if w.Code != http.StatusOK {
+    t.Fatalf("/dump%s got %d %s", query, w.Code, w.Body)
+  }
+  return w.Body.String()
+}
+
+// restoreDB posts the body to /restore for database n
+func restoreDB(n int, query, body string) *httptest.ResponseRecorder {
+  req := httptest.NewRequest("POST", "/restore" + query, strings.NewReader(body))
+  w := httptest.NewRecorder()
+  serveRestore(w, req.WithContext(context.WithValue(req.Context(), dbKey{}, n)))
+  return w
+}
+
+func TestBulkMsetMget(t *testing.T) {
+  resetDatabases()
+  runSteps(t, 0, []step{
+    {[]string{"MSET", "a", "1", "b", "2"}, Status("OK")},
+    {[]string{"MSET", "a", "1", "b"}, errors.New("ERR wrong number of arguments for 'mset' command")},
+    {[]string{"LPUSH", "l", "x"}, 1},
+    {[]string{"MGET", "a", "missing", "l", "b"}, []interface{}{"1", nil, nil, "2"}},
+  })
+}
+
+func TestBulkDumpRestore(t *testing.T) {
+  resetDatabases()
+  setClock(t, 1000000)
+  runSteps(t, 0, []step{
+    {[]string{"SET", "str", "plain"}, Status("OK")},
+    {[]string{"SET", "bin", "\xff\x00binary"}, Status("OK")},
+    {[]string{"SET", "typed", "{}", "CONTENTTYPE", "application/json"}, Status("OK")},
+    {[]string{"SET", "ttl", "v", "PXAT", "5000000"}, Status("OK")},
+    {[]string{"SET", "big", strings.Repeat("compressible ", 500)}, Status("OK")},
+    {[]string{"RPUSH", "list", "a", "b", "a"}, 3},
+    {[]string{"HSET", "hash", "f", "v", "g", "w"}, 2},
+    {[]string{"SADD", "set", "x", "y"}, 2},
+    {[]string{"ZADD", "zset", "1.5", "m", "-2", "n"}, 2},
+    {[]string{"XADD", "stream", "1-1", "f", "v"}, "1-1"},
+    {[]string{"XADD", "stream", "2-0", "f", "w", "g", "x"}, "2-0"},
+  })
+  // CSV has no column for the content type
+  content_types := map[string]interface{}{"": "application/json", "?format=csv": nil}
+  for _, format := range []string{"", "?format=csv"} {
+    dump := dumpDB(t, 0, format)
+    w := restoreDB(2, format, dump)
+    if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"restored":10}` {
+      t.Fatalf("/restore%s got %d %s", format, w.Code, w.Body)
+    }
+    if again := dumpDB(t, 2, format); again != dump {
+      t.Fatalf("the restored keys dump as\n%s\nwant\n%s", again, dump)
+    }
+    runSteps(t, 2, []step{
+      {[]string{"GET", "bin"}, "\xff\x00binary"},
+      {[]string{"PTTL", "ttl"}, int64(4000000)},
+      {[]string{"XRANGE", "stream", "-", "+"}, execute(0, []string{"XRANGE", "stream", "-", "+"})},
+      {[]string{"CONTENTTYPE", "typed"}, content_types[format]},
+      {[]string{"FLUSHDB"}, Status("OK")},
+    })
+  }
+
+  if dump := dumpDB(t, 0, "?match=s*"); strings.Count(dump, "\n") != 3 {
+    t.Fatalf("/dump?match=s* got\n%s", dump)
+  }
+}
+
+func TestBulkRestoreErrors(t *testing.T) {
+  resetDatabases()
+  body := `{"key": "a", "type": "string", "value": "1"}
+{"key": "b", "type": "list", "value": 5}
+`
+  w := restoreDB(0, "", body)
+  if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "record 2") {
+    t.Fatalf("a bad record got %d %s", w.Code, w.Body)
+  }
+  // the records are applied by batches, the batch with the bad record is not
+  runSteps(t, 0, []step{{[]string{"EXISTS", "a"}, 0}})
+
+  if w = restoreDB(0, "?format=csv", "key,type,value,expires\nk,string,v,soon\n"); w.Code != http.StatusBadRequest {
+    t.Fatalf("a bad expiration time got %d %s", w.Code, w.Body)
+  }
+  if w = restoreDB(0, "?format=xml", ""); w.Code != http.StatusBadRequest {
+    t.Fatalf("an unknown format got %d", w.Code)
+  }
+}
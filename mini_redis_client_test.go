@@ -0,0 +1,172 @@
+// Tests of the client package against the HTTP API of the server: serve() and
+//   the other handlers run behind an httptest server, on empty databases.
+// go test -run Client mini_redis*.go
+
+package main
+import (
+  "context"
+  "errors"
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "sort"
+  "sync"
+  "testing"
+
+  "mini_redis/redisclient"
+)
+
+var test_routes sync.Once
+
+// newTestServer starts the HTTP API and returns a client of it; serveDB
+//   dispatches through the default mux, so the routes are registered there
+func newTestServer(t *testing.T, opts *redisclient.ClientOptions) *redisclient.MiniRedisClient {
+  test_routes.Do(func() {
+    http.HandleFunc("/", withAuth(serve))
+    http.HandleFunc("/keys/", withAuth(serveKey))
+    http.HandleFunc("/scan", withAuth(serveScan))
+    http.HandleFunc("/db/", serveDB)
+  })
+  mu.Lock()
+  initDatabases(16)
+  mu.Unlock()
+  server := httptest.NewServer(http.DefaultServeMux)
+  t.Cleanup(server.Close)
+  return redisclient.NewClient(server.URL, opts)
+}
+
+func TestClientPutGetDelete(t *testing.T) {
+  c := newTestServer(t, nil)
+  ctx := context.Background()
+  if _, err := c.Get(ctx, "config/a"); err != redisclient.ErrNotFound {
+    t.Fatalf("Get of a missing key: %v, want ErrNotFound", err)
+  }
+  if err := c.Put(ctx, "config/a", "hello, world"); err != nil {
+    t.Fatal(err)
+  }
+  value, version, err := c.GetVersion(ctx, "config/a")
+  if err != nil || value != "hello, world" || version <= 0 {
+    t.Fatalf("GetVersion: %q %d %v, want \"hello, world\" at a version above 0", value, version, err)
+  }
+  if err := c.Put(ctx, "config/a", "2"); err != nil {
+    t.Fatal(err)
+  }
+  if value, err := c.Get(ctx, "config/a"); err != nil || value != "2" {
+    t.Fatalf("Get after a second Put: %q %v, want \"2\"", value, err)
+  }
+  if err := c.Delete(ctx, "config/a"); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := c.Get(ctx, "config/a"); err != redisclient.ErrNotFound {
+    t.Fatalf("Get after Delete: %v, want ErrNotFound", err)
+  }
+  if err := c.Delete(ctx, "config/a"); err != redisclient.ErrNotFound {
+    t.Fatalf("Delete of a missing key: %v, want ErrNotFound", err)
+  }
+}
+
+func TestClientCountScan(t *testing.T) {
+  c := newTestServer(t, nil)
+  ctx := context.Background()
+  want := []string{}
+  for i := 0; i < 25; i++ {
+    key := fmt.Sprintf("user:%02d", i)
+    want = append(want, key)
+    if err := c.Put(ctx, key, "x"); err != nil {
+      t.Fatal(err)
+    }
+  }
+  for _, key := range []string{"other", "users", "a:user:1"} {
+    if err := c.Put(ctx, key, "x"); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if n, err := c.Count(ctx, "user:*"); err != nil || n != 25 {
+    t.Fatalf("Count(user:*): %d %v, want 25", n, err)
+  }
+  if n, err := c.Count(ctx, ""); err != nil || n != 28 {
+    t.Fatalf("Count of every key: %d %v, want 28", n, err)
+  }
+  got := []string{}
+  cursor, pages := "0", 0
+  for {
+    keys, next, err := c.Scan(ctx, cursor, "user:*", 10)
+    if err != nil {
+      t.Fatal(err)
+    }
+    got = append(got, keys...)
+    pages++
+    if cursor = next; cursor == "0" {
+      break
+    }
+    if pages > 10 {
+      t.Fatal("the scan does not end")
+    }
+  }
+  if !sort.StringsAreSorted(got) || fmt.Sprint(got) != fmt.Sprint(want) {
+    t.Fatalf("Scan(user:*) returned %v, want %v", got, want)
+  }
+  if pages < 3 {
+    t.Fatalf("25 keys came in %d pages of 10", pages)
+  }
+}
+
+func TestClientIncr(t *testing.T) {
+  c := newTestServer(t, nil)
+  ctx := context.Background()
+  if n, err := c.Incr(ctx, "hits"); err != nil || n != 1 {
+    t.Fatalf("Incr of a missing key: %d %v, want 1", n, err)
+  }
+  if n, err := c.IncrBy(ctx, "hits", 41); err != nil || n != 42 {
+    t.Fatalf("IncrBy 41: %d %v, want 42", n, err)
+  }
+  if value, err := c.Get(ctx, "hits"); err != nil || value != "42" {
+    t.Fatalf("Get after Incr: %q %v, want \"42\"", value, err)
+  }
+  c.Put(ctx, "name", "bob")
+  _, err := c.Incr(ctx, "name")
+  var server_err *redisclient.ServerError
+  if !errors.As(err, &server_err) || server_err.Code != "ERR" {
+    t.Fatalf("Incr of a string: %v, want a *ServerError with code ERR", err)
+  }
+  if _, err := c.Do(ctx, "LPUSH", "list", "a"); err != nil {
+    t.Fatal(err)
+  }
+  _, err = c.Incr(ctx, "list")
+  if !errors.As(err, &server_err) || server_err.Code != "WRONGTYPE" {
+    t.Fatalf("Incr of a list: %v, want a *ServerError with code WRONGTYPE", err)
+  }
+}
+
+func TestClientConditions(t *testing.T) {
+  c := newTestServer(t, nil)
+  ctx := context.Background()
+  if err := c.PutNX(ctx, "leader", "w1"); err != nil {
+    t.Fatal(err)
+  }
+  if err := c.PutNX(ctx, "leader", "w2"); err != redisclient.ErrConflict {
+    t.Fatalf("PutNX of an existing key: %v, want ErrConflict", err)
+  }
+  _, version, _ := c.GetVersion(ctx, "leader")
+  if err := c.DeleteIfVersion(ctx, "leader", version + 1); err != redisclient.ErrConflict {
+    t.Fatalf("DeleteIfVersion at another version: %v, want ErrConflict", err)
+  }
+  if err := c.DeleteIfVersion(ctx, "leader", version); err != nil {
+    t.Fatal(err)
+  }
+}
+
+func TestClientDatabases(t *testing.T) {
+  c := newTestServer(t, nil)
+  ctx := context.Background()
+  db3 := newTestServer(t, &redisclient.ClientOptions{DB: 3})
+  if err := db3.Put(ctx, "k", "in 3"); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := c.Get(ctx, "k"); err != redisclient.ErrNotFound {
+    t.Fatalf("a key of database 3 is seen in database 0: %v", err)
+  }
+  if value, err := db3.Get(ctx, "k"); err != nil || value != "in 3" {
+    t.Fatalf("Get in database 3: %q %v", value, err)
+  }
+}
@@ -0,0 +1,717 @@
+// Proxy mode of mini_redis: with -proxy host:port,host:port... the server keeps
+//   no data itself and spreads the keys over backend mini_redis instances,
+//   which it talks to over RESP (their -resp address).
+// A key belongs to the node that follows its hash on a consistent hash ring
+//   where every node has -vnodes virtual nodes, so adding a node only moves
+//   about 1/N of the keys.
+// Commands on one key go to its node; DEL and EXISTS are split by node;
+//   DBSIZE, COUNT, KEYS, SCAN and PUBLISH are fanned out to every node and the
+//   results merged. Other commands on several keys must have all of them on the
+//   same node. Transactions, subscriptions, /watch and replication are not
+//   available through the proxy.
+// Adding a node (CLUSTER ADDNODE host:port, or POST /cluster/nodes) switches to
+//   the new ring at once and moves the keys in the background with DUMP/RESTORE;
+//   until it is done a key that has not moved yet is moved first when it is used.
+//   Moves lock the key's stripe of move_stripes locks, so the commands on
+//   other keys go on, and a key is only looked for on its old node once.
+// When a node can not be scanned after a few tries the migration stops and
+//   CLUSTER NODES reports it failed, with the error; keys left behind still
+//   move when they are used, and CLUSTER MIGRATE starts the migration again.
+
+package main
+import (
+  "bufio"
+  "errors"
+  "hash/crc32"
+  "io"
+  "log"
+  "net"
+  "net/http"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
+)
+
+type Ring struct {
+  hashes []uint32 // sorted hashes of the virtual nodes
+  owners map[uint32]*Node
+  nodes []*Node // in the order they were added, the order SCAN goes through them
+}
+
+type Node struct {
+  addr string
+  pool chan *RespConn // idle connections
+}
+
+type Cluster struct {
+  mu sync.Mutex // guards ring, old_ring and nodes
+  ring *Ring
+  old_ring *Ring // the ring before a node was added, nil once every key moved
+  migrating bool // the background migration runs
+  migrate_err error // why it stopped before every key moved
+  vnodes int
+  stripes [move_stripes]MoveStripe
+  moved int64 // keys moved by the running migration, atomic
+}
+
+// the keys of a stripe are moved one at a time
+type MoveStripe struct {
+  mu sync.Mutex
+  settled map[string]bool // keys known to be on their node of the new ring
+}
+
+// cluster is set in proxy mode
+var cluster *Cluster
+
+const node_pool_size = 16
+const move_stripes = 256
+const node_timeout = 5 * time.Second
+const migrate_attempts = 5 // scans of a page before the migration gives up
+
+func init() {
+  register("CLUSTER", -2, "admin", 0, 0, 0, cmdCluster)
+}
+
+func newCluster(addrs []string, vnodes int) *Cluster {
+  c := &Cluster{vnodes: vnodes}
+  nodes := []*Node{}
+  for _, addr := range addrs {
+    nodes = append(nodes, newNode(addr))
+  }
+  c.ring = newRing(nodes, vnodes)
+  return c
+}
+
+func newNode(addr string) *Node {
+  return &Node{addr: addr, pool: make(chan *RespConn, node_pool_size)}
+}
+
+func newRing(nodes []*Node, vnodes int) *Ring {
+  r := &Ring{owners: make(map[uint32]*Node), nodes: nodes}
+  for _, node := range nodes {
+    for i := 0; i < vnodes; i++ {
+      h := crc32.ChecksumIEEE([]byte(node.addr + "#" + strconv.Itoa(i)))
+      if _, taken := r.owners[h]; taken {
+        continue // a collision, the node has one virtual node less
+      }
+      r.owners[h] = node
+      r.hashes = append(r.hashes, h)
+    }
+  }
+  sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+  return r
+}
+
+// owner returns the node of the first virtual node at or after the hash of key
+func (r *Ring) owner(key string) *Node {
+  h := crc32.ChecksumIEEE([]byte(key))
+  i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+  if i == len(r.hashes) {
+    i = 0
+  }
+  return r.owners[r.hashes[i]]
+}
+
+func (c *Cluster) rings() (*Ring, *Ring) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return c.ring, c.old_ring
+}
+
+// a RESP connection to a backend node
+type RespConn struct {
+  conn net.Conn
+  r *bufio.Reader
+  w *bufio.Writer
+}
+
+// get takes an idle connection to the node or opens a new one
+func (n *Node) get() (*RespConn, error) {
+  select {
+  case c := <-n.pool:
+    return c, nil
+  default:
+    conn, err := net.DialTimeout("tcp", n.addr, node_timeout)
+    if err != nil {
+      return nil, err
+    }
+    c := &RespConn{conn, bufio.NewReader(conn), bufio.NewWriter(conn)}
+    if i := strings.IndexByte(node_auth, ':'); i >= 0 {
+      reply, err := c.do("AUTH", node_auth[:i], node_auth[i+1:])
+      if err != nil {
+        return nil, err
+      }
+      if err, ok := reply.(error); ok {
+        conn.Close()
+        return nil, err
+      }
+    }
+    return c, nil
+  }
+}
+
+// put gives back a connection that is in a clean state
+func (n *Node) put(c *RespConn) {
+  select {
+  case n.pool <- c:
+  default:
+    c.conn.Close()
+  }
+}
+
+// do sends a command and reads its reply; a reply error (-ERR...) is returned
+//   as the reply, err is for network and protocol errors
+func (n *Node) do(args ...string) (interface{}, error) {
+  c, err := n.get()
+  if err != nil {
+    return nil, err
+  }
+  reply, err := c.do(args...)
+  if err != nil {
+    return nil, err
+  }
+  n.put(c)
+  return reply, nil
+}
+
+func (c *RespConn) do(args ...string) (interface{}, error) {
+  c.conn.SetDeadline(time.Now().Add(node_timeout))
+  writeCommand(c.w, args)
+  err := c.w.Flush()
+  var reply interface{}
+  if err == nil {
+    reply, err = readReply(c.r)
+  }
+  if err != nil {
+    c.conn.Close()
+    return nil, err
+  }
+  return reply, nil
+}
+
+func writeCommand(w *bufio.Writer, args []string) {
+  w.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+  for _, arg := range args {
+    w.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+  }
+}
+
+// readReply reads one RESP reply: integers come back as int64, arrays as []interface{}
+func readReply(r *bufio.Reader) (interface{}, error) {
+  line, err := readLine(r)
+  if err != nil {
+    return nil, err
+  }
+  if len(line) == 0 {
+    return nil, errors.New("empty reply")
+  }
+  switch line[0] {
+  case '+':
+    return Status(line[1:]), nil
+  case '-':
+    return errors.New(line[1:]), nil
+  case ':':
+    return strconv.ParseInt(line[1:], 10, 64)
+  case '$':
+    size, err := strconv.Atoi(line[1:])
+    if err != nil || size > max_bulk_len {
+      return nil, errors.New("invalid bulk length")
+    }
+    if size < 0 {
+      return nil, nil
+    }
+    return readBulk(r, size)
+  case '*':
+    n, err := strconv.Atoi(line[1:])
+    if err != nil || n > max_multibulk {
+      return nil, errors.New("invalid multibulk length")
+    }
+    if n < 0 {
+      return nil, nil
+    }
+    items := make([]interface{}, n)
+    for i := range items {
+      if items[i], err = readReply(r); err != nil {
+        return nil, err
+      }
+    }
+    return items, nil
+  }
+  return nil, errors.New("unknown reply type '" + line[:1] + "'")
+}
+
+// forward runs a command on a node, network errors become error replies
+func (n *Node) forward(args []string) interface{} {
+  reply, err := n.do(args...)
+  if err != nil {
+    return errors.New("ERR node " + n.addr + ": " + err.Error())
+  }
+  return reply
+}
+
+// execute is the proxy side of execute(): it routes the command to the nodes
+func (c *Cluster) execute(args []string) interface{} {
+  if err := checkCommand(args); err != nil {
+    return err
+  }
+  name := strings.ToUpper(args[0])
+  cmd := commands[name]
+  ring, _ := c.rings()
+  switch name {
+  case "PING", "ECHO", "CLUSTER":
+    return cmd.run(args)
+  case "INFO", "SLOWLOG":
+    mu.Lock() // about the proxy itself
+    defer mu.Unlock()
+    return cmd.run(args)
+  case "DBSIZE", "COUNT", "PUBLISH":
+    total := int64(0)
+    for _, node := range ring.nodes {
+      reply := node.forward(args)
+      n, ok := reply.(int64)
+      if !ok {
+        return reply
+      }
+      total += n
+    }
+    return total
+  case "KEYS":
+    seen := make(map[string]bool) // a key being moved can be on two nodes for a moment
+    keys := []string{}
+    for _, node := range ring.nodes {
+      reply := node.forward(args)
+      items, ok := reply.([]interface{})
+      if !ok {
+        return reply
+      }
+      for _, item := range items {
+        if key, ok := item.(string); ok && !seen[key] {
+          seen[key] = true
+          keys = append(keys, key)
+        }
+      }
+    }
+    sort.Strings(keys)
+    return keys
+  case "SCAN":
+    return c.scan(ring, args)
+  case "DEL", "EXISTS":
+    byNode := make(map[*Node][]string)
+    for _, key := range args[1:] {
+      node := c.route(key)
+      byNode[node] = append(byNode[node], key)
+    }
+    total := int64(0)
+    for node, keys := range byNode {
+      reply := node.forward(append([]string{name}, keys...))
+      n, ok := reply.(int64)
+      if !ok {
+        return reply
+      }
+      total += n
+    }
+    return total
+  case "MGET":
+    byNode := make(map[*Node][]int) // positions of the keys of each node
+    for i, key := range args[1:] {
+      node := c.route(key)
+      byNode[node] = append(byNode[node], i)
+    }
+    values := make([]interface{}, len(args) - 1)
+    for node, positions := range byNode {
+      keys := []string{name}
+      for _, i := range positions {
+        keys = append(keys, args[1+i])
+      }
+      reply := node.forward(keys)
+      items, ok := reply.([]interface{})
+      if !ok {
+        return reply
+      }
+      for j, i := range positions {
+        values[i] = items[j]
+      }
+    }
+    return values
+  case "MSET":
+    // atomic on each node, not across them
+    if len(args) % 2 != 1 {
+      return errors.New("ERR wrong number of arguments for 'mset' command")
+    }
+    byNode := make(map[*Node][]string)
+    for i := 1; i < len(args); i += 2 {
+      node := c.route(args[i])
+      byNode[node] = append(byNode[node], args[i], args[i+1])
+    }
+    for node, pairs := range byNode {
+      if reply := node.forward(append([]string{name}, pairs...)); reply != Status("OK") {
+        return reply
+      }
+    }
+    return Status("OK")
+  }
+  keys := cmd.keys(args)
+  if len(keys) == 0 {
+    return errors.New("ERR command '" + strings.ToLower(name) + "' is not supported by the proxy")
+  }
+  node := c.route(keys[0])
+  for _, key := range keys[1:] {
+    if c.route(key) != node {
+      return errors.New("CROSSSLOT Keys in request don't hash to the same node")
+    }
+  }
+  return node.forward(args)
+}
+
+// route returns the node of key, moving the key there first if a migration
+//   is running and it is still on the node of the old ring
+func (c *Cluster) route(key string) *Node {
+  ring, old_ring := c.rings()
+  node := ring.owner(key)
+  if old_ring != nil {
+    if from := old_ring.owner(key); from != node {
+      if err := c.moveKey(key, from, node); err != nil {
+        log.Println("moving", key, "from", from.addr, "to", node.addr, "failed:", err)
+      }
+    }
+  }
+  return node
+}
+
+// moveKey copies key from one node to another, unless it is already there,
+//   and deletes it from the first one
+func (c *Cluster) moveKey(key string, from, to *Node) error {
+  stripe := &c.stripes[crc32.ChecksumIEEE([]byte(key)) % move_stripes]
+  stripe.mu.Lock()
+  defer stripe.mu.Unlock()
+  if stripe.settled[key] {
+    return nil
+  }
+  dump, err := from.do("DUMP", key)
+  if err != nil {
+    return err
+  }
+  if dump == nil {
+    stripe.settle(key)
+    return nil
+  }
+  payload, ok := dump.(string)
+  if !ok {
+    return errors.New("unexpected DUMP reply")
+  }
+  pttl, err := from.do("PTTL", key)
+  if err != nil {
+    return err
+  }
+  ttl := "0"
+  if n, ok := pttl.(int64); ok && n > 0 {
+    ttl = strconv.FormatInt(n, 10)
+  }
+  reply, err := to.do("RESTORE", key, ttl, payload)
+  if err != nil {
+    return err
+  }
+  if e, ok := reply.(error); ok && !strings.HasPrefix(e.Error(), "BUSYKEY") {
+    return e // BUSYKEY: the key was written on the new node already, that copy wins
+  }
+  if _, err := from.do("DEL", key); err != nil {
+    return err
+  }
+  stripe.settle(key)
+  atomic.AddInt64(&c.moved, 1)
+  return nil
+}
+
+// settle records that the key is on its new node; the caller holds s.mu
+func (s *MoveStripe) settle(key string) {
+  if s.settled == nil {
+    s.settled = make(map[string]bool)
+  }
+  s.settled[key] = true
+}
+
+// unsettle forgets the settled keys, when a migration starts or is done
+func (c *Cluster) unsettle() {
+  for i := range c.stripes {
+    c.stripes[i].mu.Lock()
+    c.stripes[i].settled = nil
+    c.stripes[i].mu.Unlock()
+  }
+}
+
+// a key used by serveKey through the proxy: reads run on the node of the key
+//   with the key watched, and a write is applied with MULTI/EXEC, so it fails
+//   when the key changed since it was read
+type KeySession struct {
+  node *Node
+  c *RespConn
+  broken bool
+}
+
+func (c *Cluster) openKey(key string) (*KeySession, error) {
+  node := c.route(key)
+  conn, err := node.get()
+  if err != nil {
+    return nil, err
+  }
+  s := &KeySession{node: node, c: conn}
+  if _, err := s.c.do("WATCH", key); err != nil {
+    return nil, err
+  }
+  return s, nil
+}
+
+func (s *KeySession) read(args []string) interface{} {
+  reply, err := s.c.do(args...)
+  if err != nil {
+    s.broken = true
+    return errors.New("ERR node " + s.node.addr + ": " + err.Error())
+  }
+  return reply
+}
+
+func (s *KeySession) write(args []string) interface{} {
+  s.read([]string{"MULTI"})
+  s.read(args)
+  reply := s.read([]string{"EXEC"})
+  if reply == nil {
+    return errWatch
+  }
+  if replies, ok := reply.([]interface{}); ok && len(replies) == 1 {
+    return replies[0]
+  }
+  return reply
+}
+
+func (s *KeySession) close() {
+  if s.broken {
+    return
+  }
+  if _, err := s.c.do("UNWATCH"); err == nil {
+    s.node.put(s.c)
+  }
+}
+
+// scan goes through the nodes one after the other; the proxy cursor is
+//   the index of the node and the cursor on that node: "index.cursor"
+func (c *Cluster) scan(ring *Ring, args []string) interface{} {
+  index, cursor := 0, "0"
+  if args[1] != "0" {
+    i := strings.IndexByte(args[1], '.')
+    if i < 0 {
+      return errors.New("ERR invalid cursor")
+    }
+    n, err := strconv.Atoi(args[1][:i])
+    if err != nil || n < 0 || n >= len(ring.nodes) {
+      return errors.New("ERR invalid cursor")
+    }
+    index, cursor = n, args[1][i+1:]
+  }
+  node_args := append([]string{"SCAN", cursor}, args[2:]...)
+  reply := ring.nodes[index].forward(node_args)
+  page, ok := reply.([]interface{})
+  if !ok || len(page) != 2 {
+    return reply
+  }
+  next, _ := page[0].(string)
+  if next == "0" {
+    index++
+    if index == len(ring.nodes) {
+      return []interface{}{"0", page[1]}
+    }
+  }
+  return []interface{}{strconv.Itoa(index) + "." + next, page[1]}
+}
+
+// addNode puts a node on the ring and starts moving its keys to it
+func (c *Cluster) addNode(addr string) error {
+  // before taking mu, which every proxied command needs, since an unreachable
+  //   node only answers with the timeout
+  node := newNode(addr)
+  if _, err := node.do("PING"); err != nil {
+    return errors.New("ERR node " + addr + " is not reachable: " + err.Error())
+  }
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  if c.migrating {
+    return errors.New("ERR a migration is already running")
+  }
+  if c.old_ring != nil {
+    return errors.New("ERR the last migration failed (" + c.migrate_err.Error() + "), finish it first with CLUSTER MIGRATE")
+  }
+  for _, n := range c.ring.nodes {
+    if n.addr == addr {
+      return errors.New("ERR node " + addr + " is already in the cluster")
+    }
+  }
+  c.old_ring = c.ring
+  c.ring = newRing(append(append([]*Node{}, c.ring.nodes...), node), c.vnodes)
+  atomic.StoreInt64(&c.moved, 0)
+  c.unsettle()
+  c.migrating, c.migrate_err = true, nil
+  go c.migrate(c.old_ring, c.ring)
+  return nil
+}
+
+// retryMigration starts again a migration that failed
+func (c *Cluster) retryMigration() error {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  if c.migrating {
+    return errors.New("ERR a migration is already running")
+  }
+  if c.old_ring == nil {
+    return errors.New("ERR no migration to finish")
+  }
+  c.migrating, c.migrate_err = true, nil
+  go c.migrate(c.old_ring, c.ring)
+  return nil
+}
+
+// migrate moves, in the background, the keys of every node that belong to
+//   another node on the new ring
+func (c *Cluster) migrate(old_ring, ring *Ring) {
+  log.Println("migration started")
+  err := c.moveKeys(old_ring, ring)
+  c.mu.Lock()
+  c.migrating = false
+  if err == nil {
+    c.old_ring = nil
+  } else {
+    c.migrate_err = err
+  }
+  c.mu.Unlock()
+  moved := atomic.LoadInt64(&c.moved)
+  if err != nil {
+    log.Println("migration failed after", moved, "keys moved:", err)
+    return
+  }
+  c.unsettle()
+  log.Println("migration done,", moved, "keys moved")
+}
+
+func (c *Cluster) moveKeys(old_ring, ring *Ring) error {
+  for _, node := range old_ring.nodes {
+    cursor := "0"
+    for {
+      page, err := scanPage(node, cursor)
+      for attempt := 1; err != nil && attempt < migrate_attempts; attempt++ {
+        log.Println("migration: scan of", node.addr, "failed:", err)
+        time.Sleep(time.Second)
+        page, err = scanPage(node, cursor)
+      }
+      if err != nil {
+        return errors.New("scan of " + node.addr + " failed: " + err.Error())
+      }
+      keys, _ := page[1].([]interface{})
+      for _, item := range keys {
+        key, _ := item.(string)
+        if to := ring.owner(key); to != node {
+          if err := c.moveKey(key, node, to); err != nil {
+            log.Println("migration: moving", key, "failed:", err)
+          }
+        }
+      }
+      cursor, _ = page[0].(string)
+      if cursor == "0" {
+        break
+      }
+    }
+  }
+  return nil
+}
+
+// scanPage returns the reply of a SCAN of the node: the next cursor and the keys
+func scanPage(node *Node, cursor string) ([]interface{}, error) {
+  reply, err := node.do("SCAN", cursor, "COUNT", "100")
+  if err != nil {
+    return nil, err
+  }
+  if e, ok := reply.(error); ok {
+    return nil, e
+  }
+  page, ok := reply.([]interface{})
+  if !ok || len(page) != 2 {
+    return nil, errors.New("unexpected SCAN reply")
+  }
+  return page, nil
+}
+
+// status returns the node addresses, the state of the migration (stable,
+//   migrating or failed) and the error of a failed one
+func (c *Cluster) status() ([]string, string, error) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  addrs := []string{}
+  for _, node := range c.ring.nodes {
+    addrs = append(addrs, node.addr)
+  }
+  switch {
+  case c.migrating:
+    return addrs, "migrating", nil
+  case c.old_ring != nil:
+    return addrs, "failed", c.migrate_err
+  }
+  return addrs, "stable", nil
+}
+
+// CLUSTER NODES | CLUSTER ADDNODE host:port | CLUSTER MIGRATE, in proxy mode only;
+//   NODES replies with the state, the nodes and, for a failed migration, its error
+func cmdCluster(args []string) interface{} {
+  if cluster == nil {
+    return errors.New("ERR this instance is not a proxy")
+  }
+  switch strings.ToUpper(args[1]) {
+  case "NODES":
+    addrs, state, err := cluster.status()
+    if err != nil {
+      return []interface{}{state, addrs, err.Error()}
+    }
+    return []interface{}{state, addrs}
+  case "ADDNODE":
+    if len(args) != 3 {
+      return errors.New("ERR wrong number of arguments for 'cluster addnode' command")
+    }
+    if err := cluster.addNode(args[2]); err != nil {
+      return err
+    }
+    return Status("OK")
+  case "MIGRATE":
+    if err := cluster.retryMigration(); err != nil {
+      return err
+    }
+    return Status("OK")
+  }
+  return errors.New("ERR unknown subcommand '" + args[1] + "', use NODES, ADDNODE or MIGRATE")
+}
+
+// serveClusterNodes lists the nodes (GET) or adds one (POST, body host:port)
+func serveClusterNodes(w http.ResponseWriter, req *http.Request) {
+  if cluster == nil {
+    http.Error(w, "this instance is not a proxy", http.StatusNotFound)
+    return
+  }
+  switch req.Method {
+  case "GET":
+    if !allowed(w, req, []string{"CLUSTER", "NODES"}) {
+      return
+    }
+    writeHTTPReply(w, cmdCluster([]string{"CLUSTER", "NODES"}))
+  case "POST":
+    body, err := io.ReadAll(req.Body)
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusBadRequest)
+      return
+    }
+    if !allowed(w, req, []string{"CLUSTER", "ADDNODE"}) {
+      return
+    }
+    writeHTTPReply(w, cmdCluster([]string{"CLUSTER", "ADDNODE", strings.TrimSpace(string(body))}))
+  default:
+    w.Header().Set("Allow", "GET, POST")
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+  }
+}
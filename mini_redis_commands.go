@@ -0,0 +1,742 @@
+// Command table of mini_redis. Every front-end turns a request into a list of
+//   arguments (command name first) and runs it with execute(), so all of them
+//   see the same storage with the same semantics.
+
+// A command returns one of the following replies:
+//   Status       simple string, e.g. OK or PONG
+//   error        error reply, its message starts with the error code (ERR, WRONGTYPE...)
+//   int, int64   integer reply
+//   string       bulk string reply
+//   nil          nil bulk reply (missing key)
+//   []string     array of bulk strings
+//   []interface{} array of arbitrary replies
+
+package main
+import (
+  "context"
+  "encoding/base64"
+  "errors"
+  "math"
+  "regexp"
+  "strconv"
+  "strings"
+  "time"
+)
+
+type Status string
+
+// Unchanged is the reply of a write command that wrote nothing, e.g. a SET
+//   whose condition failed: call() returns the reply inside without counting a write
+type Unchanged struct {
+  reply interface{}
+}
+
+type Command struct {
+  name string
+  arity int // number of arguments including the name, negative means at least -arity
+  flags string // space separated: write (modifies storage), keyspace (covers every key), admin (manages the server),
+    // movablekeys (the other arguments tell the keys, see keys), script (runs other commands)
+  first_key, last_key, key_step int // positions of the key arguments as in Redis, last -1 means up to the end
+  run func(args []string) interface{}
+}
+
+var commands = make(map[string]*Command)
+
+func register(name string, arity int, flags string, first_key, last_key, key_step int,
+    run func(args []string) interface{}) {
+  commands[name] = &Command{name, arity, flags, first_key, last_key, key_step, run}
+}
+
+// keys returns the key arguments of a call of the command
+func (cmd *Command) keys(args []string) []string {
+  if cmd.has("movablekeys") {
+    if cmd.name == "XREAD" || cmd.name == "XREADGROUP" {
+      return streamKeys(args) // the keys after STREAMS
+    }
+    // EVAL script numkeys key [key ...] arg [arg ...]
+    n, err := strconv.Atoi(args[2])
+    if err != nil || n < 0 || 3 + n > len(args) {
+      return nil
+    }
+    return args[3:3+n]
+  }
+  if cmd.first_key == 0 {
+    return nil
+  }
+  last := cmd.last_key
+  if last < 0 {
+    last += len(args)
+  }
+  keys := []string{}
+  for i := cmd.first_key; i <= last && i < len(args); i += cmd.key_step {
+    keys = append(keys, args[i])
+  }
+  return keys
+}
+
+func (cmd *Command) has(flag string) bool {
+  for _, f := range strings.Fields(cmd.flags) {
+    if f == flag {
+      return true
+    }
+  }
+  return false
+}
+
+var errWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+var errNotInteger = errors.New("ERR value is not an integer or out of range")
+
+func init() {
+  register("PING", -1, "", 0, 0, 0, cmdPing)
+  register("ECHO", 2, "", 0, 0, 0, cmdEcho)
+  register("GET", 2, "", 1, 1, 1, cmdGet)
+  register("SET", -3, "write", 1, 1, 1, cmdSet)
+  register("DEL", -2, "write", 1, -1, 1, cmdDel)
+  register("EXISTS", -2, "", 1, -1, 1, cmdExists)
+  register("DBSIZE", 1, "keyspace", 0, 0, 0, cmdDbsize)
+  register("KEYS", 2, "keyspace", 0, 0, 0, cmdKeys)
+  register("SCAN", -2, "keyspace", 0, 0, 0, cmdScan)
+  register("COUNT", -1, "keyspace", 0, 0, 0, cmdCount)
+  register("INCR", 2, "write", 1, 1, 1, cmdIncr)
+  register("DECR", 2, "write", 1, 1, 1, cmdIncr)
+  register("INCRBY", 3, "write", 1, 1, 1, cmdIncr)
+  register("DECRBY", 3, "write", 1, 1, 1, cmdIncr)
+  register("INCRBYFLOAT", 3, "write", 1, 1, 1, cmdIncrbyfloat)
+  register("APPEND", 3, "write", 1, 1, 1, cmdAppend)
+  register("TYPE", 2, "", 1, 1, 1, cmdType)
+  register("VERSION", 2, "", 1, 1, 1, cmdVersion)
+}
+
+// look up the command and run it in database n while holding the storage lock
+//   (or, in proxy mode, on the node that has the key, and in raft mode,
+//   for a write, through the log)
+func execute(n int, args []string) interface{} {
+  return executeContext(context.Background(), n, args)
+}
+
+// executeContext is execute for a client, whose user ctx tells (see userOf),
+//   that can give up: the commands that wait (LOCK ... WAIT, XREAD ... BLOCK)
+//   wait without mu, until ctx is done
+func executeContext(ctx context.Context, n int, args []string) interface{} {
+  if wait, ok := lockWait(args); ok {
+    return acquireLock(ctx, n, args[:4], wait)
+  }
+  if block, stripped, ok := streamBlock(args); ok {
+    return readStreams(ctx, n, stripped, block)
+  }
+  if cluster != nil {
+    defer track(args, time.Now())
+    return cluster.execute(args) // only database 0 there
+  }
+  if cmd, ok := commands[strings.ToUpper(args[0])]; ok && raft != nil && cmd.has("write") {
+    if err := checkCommand(args); err != nil {
+      return err
+    }
+    return raftPropose(RaftEntry{Db: n, Batch: [][]string{args}, User: userOf(ctx)})
+  }
+  mu.Lock()
+  defer mu.Unlock()
+  selectDB(n)
+  caller = userOf(ctx)
+  return call(args)
+}
+
+// same as execute, for callers that already hold mu and selected the database
+func call(args []string) interface{} {
+  if len(args) == 0 {
+    return errors.New("ERR empty command")
+  }
+  name := strings.ToUpper(args[0])
+  cmd, ok := commands[name]
+  if !ok {
+    return errors.New("ERR unknown command '" + args[0] + "'")
+  }
+  if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+    return errors.New("ERR wrong number of arguments for '" + strings.ToLower(name) + "' command")
+  }
+  defer track(args, time.Now())
+  // the values the command got are given back when the outermost call is done
+  //   (EXEC and EVAL run their commands through call too)
+  call_depth++
+  defer func() {
+    if call_depth--; call_depth == 0 {
+      storage.release()
+    }
+  }()
+  if !cmd.has("write") {
+    countLookups(cmd.keys(args))
+    return cmd.run(args)
+  }
+  if replica_of != "" && !applying {
+    return errors.New("READONLY You can't write against a read only replica")
+  }
+  if raft != nil && raft_time == 0 {
+    return errors.New("ERR writes of a raft node go through its log")
+  }
+  if cmd.has("script") {
+    return cmd.run(args) // the commands it runs account for their own writes
+  }
+  keys := cmd.keys(args)
+  if max_key_len > 0 {
+    for _, key := range keys {
+      if len(key) > max_key_len {
+        return errors.New("ERR key is longer than " + strconv.Itoa(max_key_len) + " bytes, the limit of the " + engine + " engine")
+      }
+    }
+  }
+  existed := make([]bool, len(keys))
+  for i, key := range keys {
+    existed[i] = get(key) != nil
+  }
+  reply := cmd.run(args)
+  if _, failed := reply.(error); failed {
+    return reply
+  }
+  if u, ok := reply.(Unchanged); ok {
+    return u.reply
+  }
+  db.dirty++
+  revision++
+  if cmd.has("keyspace") {
+    notify(strings.ToLower(name), "", nil, name) // flushdb or flushall: every key is gone
+  }
+  for i, key := range keys {
+    if v := get(key); v != nil {
+      v.Version = revision
+      storage.put(key, v) // a store on disk writes it back
+      notify("put", key, v, name)
+    } else if existed[i] {
+      notify("delete", key, nil, name)
+    }
+  }
+  propagate(propagatedArgs(name, args, keys, reply))
+  return reply
+}
+
+// get returns the value of key, nil when it is missing or expired
+func get(key string) *Value {
+  v, ok := storage.get(key)
+  if !ok {
+    return nil
+  }
+  if v.Expires != 0 && v.Expires <= now() {
+    if applying {
+      return v // a replica leaves expiration to its primary, whose DEL comes next
+    }
+    if replica_of != "" || (raft != nil && raft_time == 0) {
+      return nil // raft nodes expire keys when they apply the log
+    }
+    expireKey(key)
+    return nil
+  }
+  return v
+}
+
+// keyVersion returns the revision of the last write to key, 0 when it does not exist
+func keyVersion(key string) int64 {
+  if v := get(key); v != nil {
+    return v.Version
+  }
+  return 0
+}
+
+func cmdPing(args []string) interface{} {
+  if len(args) > 2 {
+    return errors.New("ERR wrong number of arguments for 'ping' command")
+  }
+  if len(args) == 2 {
+    return args[1]
+  }
+  return Status("PONG")
+}
+
+func cmdEcho(args []string) interface{} {
+  return args[1]
+}
+
+// lookup returns the value of key, nil when the key is missing,
+//   or errWrongType when it holds a value of another kind
+func lookup(key, kind string) (*Value, error) {
+  v := get(key)
+  if v == nil {
+    return nil, nil
+  }
+  if v.Kind != kind {
+    return nil, errWrongType
+  }
+  return v, nil
+}
+
+// lookupOrCreate is lookup that creates an empty value of the kind when the key is missing
+func lookupOrCreate(key, kind string) (*Value, error) {
+  v, err := lookup(key, kind)
+  if v != nil || err != nil {
+    return v, err
+  }
+  v = &Value{Kind: kind}
+  switch kind {
+  case "hash":
+    v.Hash = make(map[string]string)
+  case "set":
+    v.Set = make(map[string]bool)
+  case "zset":
+    v.ZSet = newZSet()
+  case "stream":
+    v.Stream = newStream()
+  }
+  storage.put(key, v)
+  return v, nil
+}
+
+// setString stores a string, keeping the expiration time of a string that is
+//   already there (INCR or APPEND do not make a key persistent, SET does)
+func setString(key, s string) {
+  if v := get(key); v != nil && v.Kind == "string" {
+    v.setStr(s)
+    return
+  }
+  storage.put(key, newString(s, ""))
+}
+
+func cmdGet(args []string) interface{} {
+  v, err := lookup(args[1], "string")
+  if err != nil {
+    return err
+  }
+  if v == nil {
+    return nil
+  }
+  s, err := v.str()
+  if err != nil {
+    return err
+  }
+  return s
+}
+
+// SET key value [NX | XX | IFEQ value | IFVERSION version]
+//     [EX seconds | PX milliseconds | PXAT unix-time-milliseconds] [CONTENTTYPE type]
+// NX sets only a missing key, XX only an existing one, IFEQ only a string holding
+//   that value and IFVERSION only a key at that version (0 for a missing key);
+//   when the condition is not met nothing is written and the reply is nil
+func cmdSet(args []string) interface{} {
+  var expires int64
+  condition, expected := "", ""
+  content_type, typed := "", false
+  for i := 3; i < len(args); i++ {
+    opt := strings.ToUpper(args[i])
+    switch {
+    case opt == "CONTENTTYPE" && !typed && i+1 < len(args):
+      content_type, typed = args[i+1], true
+      i++
+    case (opt == "NX" || opt == "XX") && condition == "":
+      condition = opt
+    case (opt == "IFEQ" || opt == "IFVERSION") && condition == "" && i+1 < len(args):
+      condition, expected = opt, args[i+1]
+      i++
+    case (opt == "EX" || opt == "PX" || opt == "PXAT") && expires == 0 && i+1 < len(args):
+      n, err := strconv.ParseInt(args[i+1], 10, 64)
+      if err != nil || n <= 0 {
+        return errors.New("ERR invalid expire time in 'set' command")
+      }
+      switch opt {
+      case "EX":
+        expires = now() + n * 1000
+      case "PX":
+        expires = now() + n
+      case "PXAT":
+        expires = n
+      }
+      i++
+    default:
+      return errors.New("ERR syntax error")
+    }
+  }
+  v := get(args[1])
+  switch condition {
+  case "NX":
+    if v != nil {
+      return Unchanged{nil}
+    }
+  case "XX":
+    if v == nil {
+      return Unchanged{nil}
+    }
+  case "IFEQ":
+    if v != nil && v.Kind != "string" {
+      return errWrongType
+    }
+    if v == nil {
+      return Unchanged{nil}
+    }
+    if s, err := v.str(); err != nil {
+      return err
+    } else if s != expected {
+      return Unchanged{nil}
+    }
+  case "IFVERSION":
+    version, err := strconv.ParseInt(expected, 10, 64)
+    if err != nil {
+      return errNotInteger
+    }
+    if keyVersion(args[1]) != version {
+      return Unchanged{nil}
+    }
+  }
+  storage.put(args[1], newString(args[2], content_type))
+  if expires != 0 {
+    setExpires(args[1], expires)
+  }
+  return Status("OK")
+}
+
+// VERSION key: the revision of the last write to the key, 0 when it is missing;
+//   it only grows, so it serves SET ... IFVERSION and transactions
+func cmdVersion(args []string) interface{} {
+  return keyVersion(args[1])
+}
+
+func cmdType(args []string) interface{} {
+  v := get(args[1])
+  if v == nil {
+    return Status("none")
+  }
+  return Status(v.Kind)
+}
+
+func cmdDel(args []string) interface{} {
+  count := 0
+  for _, key := range args[1:] {
+    if get(key) != nil {
+      storage.delete(key)
+      count++
+    }
+  }
+  return count
+}
+
+func cmdExists(args []string) interface{} {
+  count := 0
+  for _, key := range args[1:] {
+    if get(key) != nil {
+      count++
+    }
+  }
+  return count
+}
+
+// DBSIZE may count keys that expired but were not removed yet, as in Redis
+func cmdDbsize(args []string) interface{} {
+  return storage.count()
+}
+
+func cmdKeys(args []string) interface{} {
+  keys := []string{}
+  t := now()
+  prefix := keyPrefix("glob", args[1])
+  storage.ascend(prefix, func(key string, expires int64) bool {
+    if !strings.HasPrefix(key, prefix) {
+      return false
+    }
+    if (expires == 0 || expires > t) && globMatch(args[1], key) {
+      keys = append(keys, key)
+    }
+    return true
+  })
+  return keys
+}
+
+// INCR key, DECR key, INCRBY key n, DECRBY key n: a missing key counts as 0
+func cmdIncr(args []string) interface{} {
+  name := strings.ToUpper(args[0])
+  var by int64 = 1
+  if len(args) == 3 {
+    n, err := strconv.ParseInt(args[2], 10, 64)
+    if err != nil {
+      return errNotInteger
+    }
+    by = n
+  }
+  if name == "DECR" || name == "DECRBY" {
+    if by == math.MinInt64 {
+      return errors.New("ERR decrement would overflow")
+    }
+    by = -by
+  }
+  v, err := lookup(args[1], "string")
+  if err != nil {
+    return err
+  }
+  var current int64
+  if v != nil {
+    s, err := v.str()
+    if err != nil {
+      return err
+    }
+    if current, err = strconv.ParseInt(s, 10, 64); err != nil {
+      return errNotInteger
+    }
+  }
+  if (by > 0 && current > math.MaxInt64 - by) || (by < 0 && current < math.MinInt64 - by) {
+    return errors.New("ERR increment or decrement would overflow")
+  }
+  current += by
+  setString(args[1], strconv.FormatInt(current, 10))
+  return current
+}
+
+// INCRBYFLOAT key increment: replies with the new value as a bulk string
+func cmdIncrbyfloat(args []string) interface{} {
+  by, err := strconv.ParseFloat(args[2], 64)
+  if err != nil || math.IsNaN(by) || math.IsInf(by, 0) {
+    return errors.New("ERR value is not a valid float")
+  }
+  v, err := lookup(args[1], "string")
+  if err != nil {
+    return err
+  }
+  var current float64
+  if v != nil {
+    s, err := v.str()
+    if err != nil {
+      return err
+    }
+    current, err = strconv.ParseFloat(s, 64)
+    if err != nil || math.IsNaN(current) || math.IsInf(current, 0) {
+      return errors.New("ERR value is not a valid float")
+    }
+  }
+  current += by
+  if math.IsNaN(current) || math.IsInf(current, 0) {
+    return errors.New("ERR increment would produce NaN or Infinity")
+  }
+  value := strconv.FormatFloat(current, 'f', -1, 64)
+  setString(args[1], value)
+  return value
+}
+
+// APPEND key value: replies with the new length; the value is left uncompressed,
+//   see mini_redis_compress.go
+func cmdAppend(args []string) interface{} {
+  v, err := lookup(args[1], "string")
+  if err != nil {
+    return err
+  }
+  if v == nil {
+    v = &Value{Kind: "string"}
+    storage.put(args[1], v)
+  }
+  value, err := v.str()
+  if err != nil {
+    return err
+  }
+  v.setPlain(value + args[2])
+  return len(v.Str)
+}
+
+// COUNT [pattern [MODE glob|prefix|regex]]: number of keys matching the pattern
+func cmdCount(args []string) interface{} {
+  pattern, mode := "", ""
+  if len(args) > 1 {
+    pattern = args[1]
+  }
+  if len(args) == 4 && strings.ToUpper(args[2]) == "MODE" {
+    mode = args[3]
+  } else if len(args) > 2 {
+    return errors.New("ERR syntax error")
+  }
+  match, err := newMatcher(mode, pattern)
+  if err != nil {
+    return errors.New("ERR " + err.Error())
+  }
+  count := 0
+  t := now()
+  prefix := keyPrefix(mode, pattern)
+  storage.ascend(prefix, func(key string, expires int64) bool {
+    if !strings.HasPrefix(key, prefix) {
+      return false
+    }
+    if (expires == 0 || expires > t) && match(key) {
+      count++
+    }
+    return true
+  })
+  return count
+}
+
+// SCAN cursor [MATCH pattern] [MODE glob|prefix|regex] [COUNT count]
+func cmdScan(args []string) interface{} {
+  pattern, mode := "", ""
+  count := 10
+  for i := 2; i < len(args); i += 2 {
+    if i+1 == len(args) {
+      return errors.New("ERR syntax error")
+    }
+    switch strings.ToUpper(args[i]) {
+    case "MATCH":
+      pattern = args[i+1]
+    case "MODE":
+      mode = args[i+1]
+    case "COUNT":
+      n, err := strconv.Atoi(args[i+1])
+      if err != nil || n <= 0 {
+        return errNotInteger
+      }
+      count = n
+    default:
+      return errors.New("ERR syntax error")
+    }
+  }
+  match, err := newMatcher(mode, pattern)
+  if err != nil {
+    return errors.New("ERR " + err.Error())
+  }
+  next, keys, err := scanKeys(args[1], count, keyPrefix(mode, pattern), match)
+  if err != nil {
+    return err
+  }
+  return []interface{}{next, keys}
+}
+
+// scanKeys returns the matching keys among the next count keys after cursor that
+//   start with prefix, in key order, and the cursor to continue from ("0" when the
+//   scan is complete).
+// The cursor is the last key looked at, so every key present during the whole scan
+//   is returned exactly once no matter what is written between two pages.
+// The store seeks the cursor in its ordered index: a page costs a lookup and
+//   count keys, not a walk of the whole keyspace.
+func scanKeys(cursor string, count int, prefix string, match func(string) bool) (string, []string, error) {
+  after := ""
+  if cursor != "0" {
+    last, err := base64.RawURLEncoding.DecodeString(cursor)
+    if err != nil || len(last) == 0 {
+      return "", nil, errors.New("ERR invalid cursor")
+    }
+    after = string(last)
+  }
+  start := prefix
+  if cursor != "0" && after + "\x00" > start {
+    start = after + "\x00" // the first key after it
+  }
+  page := []string{}
+  t := now()
+  storage.ascend(start, func(key string, expires int64) bool {
+    if !strings.HasPrefix(key, prefix) {
+      return false
+    }
+    if expires == 0 || expires > t {
+      page = append(page, key)
+    }
+    return len(page) <= count // one more tells whether the scan is complete
+  })
+  next := "0"
+  if len(page) > count {
+    page = page[:count]
+    next = base64.RawURLEncoding.EncodeToString([]byte(page[count-1]))
+  }
+  keys := []string{}
+  for _, key := range page {
+    if match(key) {
+      keys = append(keys, key)
+    }
+  }
+  return next, keys, nil
+}
+
+// newMatcher builds the key filter used by COUNT and SCAN. The mode is
+//   glob (default, Redis KEYS semantics), prefix or regex; an empty pattern matches everything
+func newMatcher(mode, pattern string) (func(string) bool, error) {
+  if pattern == "" {
+    return func(string) bool { return true }, nil
+  }
+  switch mode {
+  case "", "glob":
+    return func(key string) bool { return globMatch(pattern, key) }, nil
+  case "prefix":
+    return func(key string) bool { return strings.HasPrefix(key, pattern) }, nil
+  case "regex":
+    r, err := regexp.Compile(pattern)
+    if err != nil {
+      return nil, errors.New("invalid regex pattern: " + err.Error())
+    }
+    return r.MatchString, nil
+  }
+  return nil, errors.New("unknown match mode '" + mode + "', use glob, prefix or regex")
+}
+
+// globMatch reports whether s matches the Redis glob pattern:
+//   * any sequence, ? any single char, [abc] [^abc] [a-z] classes, \x escapes x.
+// On a mismatch it only goes back to the last *, which then takes one more
+//   character: whatever the earlier stars took, the rest of the pattern has to
+//   match after the last one, so a pattern costs O(len(pattern) * len(s))
+func globMatch(pattern, s string) bool {
+  p, i := 0, 0
+  star, star_i := -1, 0 // after the last * and where the text it takes ends
+  for i < len(s) {
+    if p < len(pattern) && pattern[p] == '*' {
+      for p < len(pattern) && pattern[p] == '*' {
+        p++
+      }
+      if p == len(pattern) {
+        return true
+      }
+      star, star_i = p, i
+      continue
+    }
+    if p < len(pattern) {
+      if n, ok := globChar(pattern[p:], s[i]); ok {
+        p, i = p + n, i + 1
+        continue
+      }
+    }
+    if star < 0 {
+      return false
+    }
+    star_i++
+    p, i = star, star_i
+  }
+  for p < len(pattern) && pattern[p] == '*' {
+    p++
+  }
+  return p == len(pattern)
+}
+
+// globChar matches c against the element the pattern starts with, which is
+//   not a *, and returns the length of the element
+func globChar(pattern string, c byte) (int, bool) {
+  switch pattern[0] {
+  case '?':
+    return 1, true
+  case '\\':
+    if len(pattern) > 1 {
+      return 2, pattern[1] == c
+    }
+  case '[':
+    i := 1
+    negate := i < len(pattern) && pattern[i] == '^'
+    if negate {
+      i++
+    }
+    match := false
+    for i < len(pattern) && pattern[i] != ']' {
+      if pattern[i] == '\\' && i + 1 < len(pattern) {
+        match = match || pattern[i+1] == c
+        i += 2
+      } else if i + 2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']' {
+        lo, hi := pattern[i], pattern[i+2]
+        if lo > hi {
+          lo, hi = hi, lo
+        }
+        match = match || (c >= lo && c <= hi)
+        i += 3
+      } else {
+        match = match || pattern[i] == c
+        i++
+      }
+    }
+    if i < len(pattern) {
+      i++ // the closing ]
+    }
+    return i, match != negate
+  }
+  return 1, pattern[0] == c
+}
@@ -0,0 +1,205 @@
+// Tests of the key and string commands: glob patterns of COUNT, KEYS and SCAN,
+//   the counters of INCR and INCRBYFLOAT, APPEND, and the conditions of SET.
+// go test -run 'Glob|Incr|Append|Set' mini_redis*.go
+
+package main
+import (
+  "errors"
+  "math"
+  "reflect"
+  "strconv"
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestGlobMatch(t *testing.T) {
+  tests := []struct {
+    pattern, s string
+    want bool
+  }{
+    {"*", "", true},
+    {"user:*", "user:42", true},
+    {"user:*", "users", false},
+    {"h?llo", "hello", true},
+    {"h?llo", "hllo", false},
+    {"h[ae]llo", "hallo", true},
+    {"h[^e]llo", "hello", false},
+    {"h[a-b]llo", "hbllo", true},
+    {"h[b-a]llo", "hallo", true},
+    {"h\\*llo", "h*llo", true},
+    {"h\\*llo", "hello", false},
+    {"*a*b", "xaxxb", true},
+    {"*a*b", "xaxxbx", false},
+    {"a**b", "ab", true},
+    {"*.log", "app.log.1", false},
+  }
+  for _, test := range tests {
+    if got := globMatch(test.pattern, test.s); got != test.want {
+      t.Errorf("globMatch(%q, %q) = %v, want %v", test.pattern, test.s, got, test.want)
+    }
+  }
+}
+
+func TestGlobMatchManyStars(t *testing.T) {
+  // a matcher trying every split between the stars takes minutes on this
+  pattern := strings.Repeat("*a", 12) + "*b"
+  key := strings.Repeat("a", 40)
+  start := time.Now()
+  if globMatch(pattern, key) {
+    t.Fatalf("%q matches %q", pattern, key)
+  }
+  if !globMatch(pattern, key + "b") {
+    t.Fatalf("%q does not match %q", pattern, key + "b")
+  }
+  if d := time.Since(start); d > 100 * time.Millisecond {
+    t.Fatalf("matching took %v", d)
+  }
+}
+
+// step is a command and its reply; an error reply only has to start with the
+//   text of want
+type step struct {
+  args []string
+  want interface{}
+}
+
+// runSteps runs the commands in database n of fresh databases
+func runSteps(t *testing.T, n int, steps []step) {
+  t.Helper()
+  for _, s := range steps {
+    got := execute(n, s.args)
+    if want, ok := s.want.(error); ok {
+      if err, ok := got.(error); !ok || !strings.HasPrefix(err.Error(), want.Error()) {
+        t.Fatalf("%v: got %#v, want the error %q", s.args, got, want)
+      }
+    } else if !reflect.DeepEqual(got, s.want) {
+      t.Fatalf("%v: got %#v, want %#v", s.args, got, s.want)
+    }
+  }
+}
+
+func resetDatabases() {
+  mu.Lock()
+  initDatabases(16)
+  mu.Unlock()
+}
+
+func TestIncr(t *testing.T) {
+  resetDatabases()
+  runSteps(t, 0, []step{
+    {[]string{"INCR", "n"}, int64(1)},
+    {[]string{"INCRBY", "n", "41"}, int64(42)},
+    {[]string{"DECRBY", "n", "50"}, int64(-8)},
+    {[]string{"DECR", "n"}, int64(-9)},
+    {[]string{"GET", "n"}, "-9"},
+    {[]string{"INCRBY", "n", "1.5"}, errNotInteger},
+    {[]string{"SET", "s", "12abc"}, Status("OK")},
+    {[]string{"INCR", "s"}, errNotInteger},
+    {[]string{"SET", "s", " 12"}, Status("OK")},
+    {[]string{"INCR", "s"}, errNotInteger},
+    {[]string{"GET", "s"}, " 12"},
+  })
+}
+
+func TestIncrOverflow(t *testing.T) {
+  resetDatabases()
+  runSteps(t, 0, []step{
+    {[]string{"SET", "n", strconv.FormatInt(math.MaxInt64 - 1, 10)}, Status("OK")},
+    {[]string{"INCR", "n"}, int64(math.MaxInt64)},
+    {[]string{"INCR", "n"}, errors.New("ERR increment or decrement would overflow")},
+    {[]string{"GET", "n"}, strconv.FormatInt(math.MaxInt64, 10)},
+    {[]string{"SET", "m", strconv.FormatInt(math.MinInt64, 10)}, Status("OK")},
+    {[]string{"DECR", "m"}, errors.New("ERR increment or decrement would overflow")},
+    {[]string{"DECRBY", "z", strconv.FormatInt(math.MinInt64, 10)}, errors.New("ERR decrement would overflow")},
+    {[]string{"INCRBY", "z", strconv.FormatInt(math.MinInt64, 10)}, int64(math.MinInt64)},
+    {[]string{"INCRBY", "big", "9223372036854775808"}, errNotInteger},
+  })
+}
+
+func TestIncrbyfloat(t *testing.T) {
+  resetDatabases()
+  runSteps(t, 0, []step{
+    {[]string{"INCRBYFLOAT", "f", "10.5"}, "10.5"},
+    {[]string{"INCRBYFLOAT", "f", "-0.25"}, "10.25"},
+    {[]string{"INCRBYFLOAT", "f", "5e2"}, "510.25"},
+    {[]string{"INCR", "f"}, errNotInteger},
+    {[]string{"SET", "i", "3"}, Status("OK")},
+    {[]string{"INCRBYFLOAT", "i", "0.5"}, "3.5"},
+    {[]string{"INCRBYFLOAT", "f", "abc"}, errors.New("ERR value is not a valid float")},
+    {[]string{"INCRBYFLOAT", "f", "inf"}, errors.New("ERR value is not a valid float")},
+    {[]string{"INCRBYFLOAT", "f", "NaN"}, errors.New("ERR value is not a valid float")},
+    {[]string{"SET", "huge", "1.7e308"}, Status("OK")},
+    {[]string{"INCRBYFLOAT", "huge", "1.7e308"}, errors.New("ERR increment would produce NaN or Infinity")},
+    {[]string{"SET", "s", "one"}, Status("OK")},
+    {[]string{"INCRBYFLOAT", "s", "1"}, errors.New("ERR value is not a valid float")},
+    {[]string{"GET", "f"}, "510.25"},
+  })
+}
+
+func TestAppend(t *testing.T) {
+  resetDatabases()
+  runSteps(t, 0, []step{
+    {[]string{"APPEND", "a", "Hello"}, 5},
+    {[]string{"APPEND", "a", ", world"}, 12},
+    {[]string{"GET", "a"}, "Hello, world"},
+    {[]string{"LPUSH", "l", "x"}, 1},
+    {[]string{"APPEND", "l", "y"}, errWrongType},
+    {[]string{"INCR", "l"}, errWrongType},
+  })
+}
+
+func TestSetConditions(t *testing.T) {
+  resetDatabases()
+  runSteps(t, 0, []step{
+    {[]string{"SET", "k", "a", "XX"}, nil},
+    {[]string{"SET", "k", "a", "NX"}, Status("OK")},
+    {[]string{"SET", "k", "b", "NX"}, nil},
+    {[]string{"SET", "k", "b", "XX"}, Status("OK")},
+    {[]string{"SET", "k", "c", "IFEQ", "a"}, nil},
+    {[]string{"SET", "k", "c", "IFEQ", "b"}, Status("OK")},
+    {[]string{"SET", "missing", "c", "IFEQ", ""}, nil},
+    {[]string{"SET", "k", "d", "NX", "XX"}, errors.New("ERR syntax error")},
+    {[]string{"SET", "k", "d", "IFEQ"}, errors.New("ERR syntax error")},
+    {[]string{"GET", "k"}, "c"},
+    {[]string{"LPUSH", "l", "x"}, 1},
+    {[]string{"SET", "l", "v", "IFEQ", "x"}, errWrongType},
+  })
+}
+
+func TestSetIfVersion(t *testing.T) {
+  resetDatabases()
+  runSteps(t, 0, []step{
+    {[]string{"VERSION", "k"}, int64(0)},
+    {[]string{"SET", "k", "v1", "IFVERSION", "1"}, nil},
+    {[]string{"SET", "k", "v1", "IFVERSION", "0"}, Status("OK")},
+    {[]string{"SET", "k", "v2", "IFVERSION", "0"}, nil},
+    {[]string{"SET", "k", "v2", "IFVERSION", "x"}, errNotInteger},
+  })
+  first := execute(0, []string{"VERSION", "k"}).(int64)
+  // two workers read the same version, only the first write wins
+  runSteps(t, 0, []step{
+    {[]string{"SET", "k", "worker1", "IFVERSION", strconv.FormatInt(first, 10)}, Status("OK")},
+    {[]string{"SET", "k", "worker2", "IFVERSION", strconv.FormatInt(first, 10)}, nil},
+    {[]string{"GET", "k"}, "worker1"},
+  })
+  second := execute(0, []string{"VERSION", "k"}).(int64)
+  if second <= first {
+    t.Fatalf("the version went from %d to %d", first, second)
+  }
+  // any write moves the version, a refused one does not
+  execute(0, []string{"SET", "k", "x", "NX"})
+  if v := execute(0, []string{"VERSION", "k"}); v != second {
+    t.Fatalf("a refused SET moved the version from %d to %v", second, v)
+  }
+  execute(0, []string{"APPEND", "k", "!"})
+  if v := execute(0, []string{"VERSION", "k"}).(int64); v <= second {
+    t.Fatalf("APPEND left the version at %d", v)
+  }
+  // a key deleted and created again does not get an old version back
+  execute(0, []string{"DEL", "k"})
+  execute(0, []string{"SET", "k", "again"})
+  if v := execute(0, []string{"VERSION", "k"}).(int64); v <= second {
+    t.Fatalf("the key created again has the version %d", v)
+  }
+}
@@ -0,0 +1,129 @@
+// Values of string keys in mini_redis: they are the bytes that came in (Go
+//   strings need not be UTF-8, so images and the like are stored as is), with
+//   an optional content type.
+// Values of at least -compress bytes are kept gzip compressed when that saves
+//   an eighth of them or more. Commands always see the original value, only the
+//   memory (see INFO) and the snapshots shrink. Replicas, raft nodes and the
+//   nodes behind a proxy get writes as commands and compress on their own.
+// The text of the compressed values used last stays in a cache of up to
+//   unpacked_cache_size bytes, so a hot key is not decompressed at every GET.
+//   APPEND leaves a value uncompressed, as compressing it again at every APPEND
+//   would cost as much as the whole value each time; the next SET compresses it.
+// A value that can not be decompressed (a damaged snapshot) fails the commands
+//   reading it instead of looking empty.
+// SET key value CONTENTTYPE type stores the content type, which PUT /keys/{key}
+//   takes from the Content-Type header and GET /keys/{key} gives back; a SET
+//   without it clears it, while APPEND, INCR and the like keep it.
+// CONTENTTYPE key: the content type of a string key, nil when it has none
+// curl -X PUT -H "Content-Type: image/jpeg" --data-binary @photo.jpg localhost:8082/keys/photo
+// curl -i localhost:8082/keys/photo
+// curl -X CONTENTTYPE -d photo localhost:8082
+
+package main
+import (
+  "bytes"
+  "compress/gzip"
+  "errors"
+  "io/ioutil"
+  "sync"
+)
+
+var compress_threshold = 1024
+
+const unpacked_cache_size = 32 * 1024 * 1024
+
+// unpacked caches the text of compressed values by their compressed bytes, which
+//   also finds it for the copies of a value (the btree engine decodes a new one
+//   for each command); values are read under mu, but also by the snapshot
+//   writer, so the cache has a lock of its own
+var unpacked = make(map[string]string)
+var unpacked_bytes int
+var unpacked_mu sync.Mutex
+
+// gzip writers are large, they are reused
+var gzip_writers = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+
+func init() {
+  register("CONTENTTYPE", 2, "", 1, 1, 1, cmdContentType)
+}
+
+func cmdContentType(args []string) interface{} {
+  v, err := lookup(args[1], "string")
+  if err != nil {
+    return err
+  }
+  if v == nil || v.ContentType == "" {
+    return nil
+  }
+  return v.ContentType
+}
+
+// newString returns a string value holding s
+func newString(s, content_type string) *Value {
+  v := &Value{Kind: "string", ContentType: content_type}
+  v.setStr(s)
+  return v
+}
+
+// str returns the value of a string
+func (v *Value) str() (string, error) {
+  if v.Packed == nil {
+    return v.Str, nil
+  }
+  unpacked_mu.Lock()
+  s, ok := unpacked[string(v.Packed)]
+  unpacked_mu.Unlock()
+  if ok {
+    return s, nil
+  }
+  r, err := gzip.NewReader(bytes.NewReader(v.Packed))
+  if err == nil {
+    var data []byte
+    if data, err = ioutil.ReadAll(r); err == nil {
+      s = string(data)
+      cacheUnpacked(v.Packed, s)
+      return s, nil
+    }
+  }
+  // only setStr packs values, so this is a snapshot damaged on disk
+  return "", errors.New("ERR the value can not be decompressed: " + err.Error())
+}
+
+// cacheUnpacked keeps the text of a compressed value; a full cache is emptied
+//   rather than kept in order, the values used again come back soon
+func cacheUnpacked(packed []byte, s string) {
+  size := len(packed) + len(s)
+  unpacked_mu.Lock()
+  defer unpacked_mu.Unlock()
+  if _, ok := unpacked[string(packed)]; ok || size > unpacked_cache_size / 4 {
+    return
+  }
+  if unpacked_bytes + size > unpacked_cache_size {
+    unpacked, unpacked_bytes = make(map[string]string), 0
+  }
+  unpacked[string(packed)] = s
+  unpacked_bytes += size
+}
+
+// setPlain sets the value of a string, uncompressed
+func (v *Value) setPlain(s string) {
+  v.Str, v.Packed = s, nil
+}
+
+// setStr sets the value of a string, compressed if it is large and compresses well
+func (v *Value) setStr(s string) {
+  v.setPlain(s)
+  if compress_threshold <= 0 || len(s) < compress_threshold {
+    return
+  }
+  var buf bytes.Buffer
+  w := gzip_writers.Get().(*gzip.Writer)
+  w.Reset(&buf)
+  w.Write([]byte(s))
+  w.Close()
+  gzip_writers.Put(w)
+  if buf.Len() <= len(s) - len(s) / 8 {
+    v.Str, v.Packed = "", buf.Bytes()
+    cacheUnpacked(v.Packed, s) // the event of the write reads it right away
+  }
+}
@@ -0,0 +1,80 @@
+// Tests of compressed values: GET and APPEND see the original value, APPEND
+//   does not compress again, and a damaged value is an error.
+// go test -run Compress mini_redis*.go
+
+package main
+import (
+  "strings"
+  "testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+  mu.Lock()
+  initDatabases(16)
+  mu.Unlock()
+  value := strings.Repeat("compressible ", 1000)
+  execute(0, []string{"SET", "k", value})
+  mu.Lock()
+  v := get("k")
+  packed := v.Packed != nil && v.Str == ""
+  mu.Unlock()
+  if !packed {
+    t.Fatal("a large repetitive value is not compressed")
+  }
+  for i := 0; i < 2; i++ { // the second GET reads the cache
+    if reply := execute(0, []string{"GET", "k"}); reply != value {
+      t.Fatalf("GET returned %d bytes, want %d", len(reply.(string)), len(value))
+    }
+  }
+  if reply := execute(0, []string{"MGET", "k", "missing"}).([]interface{}); reply[0] != value || reply[1] != nil {
+    t.Fatalf("MGET did not return the value")
+  }
+}
+
+func TestCompressAppendLeavesPlain(t *testing.T) {
+  mu.Lock()
+  initDatabases(16)
+  mu.Unlock()
+  value := strings.Repeat("compressible ", 1000)
+  execute(0, []string{"SET", "k", value})
+  for i := 0; i < 3; i++ {
+    value += "tail"
+    if reply := execute(0, []string{"APPEND", "k", "tail"}); reply != len(value) {
+      t.Fatalf("APPEND returned %v, want %d", reply, len(value))
+    }
+  }
+  mu.Lock()
+  v := get("k")
+  plain := v.Packed == nil && v.Str == value
+  mu.Unlock()
+  if !plain {
+    t.Fatal("an appended value is compressed again")
+  }
+  if reply := execute(0, []string{"APPEND", "new", "abc"}); reply != 3 {
+    t.Fatalf("APPEND to a missing key returned %v", reply)
+  }
+  if reply := execute(0, []string{"GET", "new"}); reply != "abc" {
+    t.Fatalf("GET after APPEND returned %v", reply)
+  }
+  execute(0, []string{"SET", "k", value})
+  mu.Lock()
+  packed := get("k").Packed != nil
+  mu.Unlock()
+  if !packed {
+    t.Fatal("SET does not compress the value again")
+  }
+}
+
+func TestCompressDamagedValue(t *testing.T) {
+  mu.Lock()
+  initDatabases(16)
+  v := &Value{Kind: "string", Packed: []byte("not gzip data")}
+  storage.put("k", v)
+  mu.Unlock()
+  for _, args := range [][]string{{"GET", "k"}, {"MGET", "k"}, {"APPEND", "k", "x"}, {"INCR", "k"}} {
+    err, ok := execute(0, args).(error)
+    if !ok || !strings.Contains(err.Error(), "decompressed") {
+      t.Fatalf("%s of a damaged value returned %v, want an error", args[0], err)
+    }
+  }
+}
@@ -0,0 +1,120 @@
+// Logical databases of mini_redis: -databases (16 by default) separate key
+//   spaces numbered from 0, so several teams can share one instance.
+// A RESP connection picks one with SELECT n; an HTTP request with a /db/{n}
+//   path prefix (/db/3/keys/k, /db/3/scan, /db/3/watch...), and without one
+//   it uses database 0 as before.
+// A command only sees the database of its client: COUNT, DBSIZE, KEYS, SCAN,
+//   FLUSHDB and /watch are scoped to it. FLUSHALL empties every database.
+// Each database has its own snapshot file, -dbfile for database 0 and
+//   -dbfile.n for database n, written when that database changed.
+// Pub/sub channels and the revision counter are shared by all databases.
+
+package main
+import (
+  "context"
+  "errors"
+  "net/http"
+  "strconv"
+  "strings"
+)
+
+type Database struct {
+  storage Store
+  expires map[string]bool
+  dirty int // number of write commands since the last snapshot
+}
+
+// guarded by mu; storage and expires are those of the selected database
+var databases []*Database
+var db *Database
+var db_index int
+
+func init() {
+  initDatabases(16)
+  register("FLUSHDB", 1, "write keyspace", 0, 0, 0, cmdFlushdb)
+  register("FLUSHALL", 1, "write keyspace admin", 0, 0, 0, cmdFlushall)
+}
+
+func initDatabases(n int) {
+  databases = make([]*Database, n)
+  for i := range databases {
+    databases[i] = &Database{newMemoryStore(make(map[string]*Value)), make(map[string]bool), 0}
+  }
+  selectDB(0)
+}
+
+// selectDB makes database n the one commands run in; whoever takes mu to
+//   use storage selects the database first
+func selectDB(n int) {
+  db, db_index = databases[n], n
+  storage, expires = db.storage, db.expires
+}
+
+func parseDB(s string) (int, error) {
+  n, err := strconv.Atoi(s)
+  if err != nil || n < 0 || n >= len(databases) {
+    return 0, errors.New("ERR DB index is out of range")
+  }
+  return n, nil
+}
+
+// FLUSHDB: delete every key of the database
+func cmdFlushdb(args []string) interface{} {
+  storage.clear()
+  for key := range expires {
+    delete(expires, key)
+  }
+  return Status("OK")
+}
+
+// FLUSHALL: delete every key of every database
+func cmdFlushall(args []string) interface{} {
+  current := db_index
+  for i := range databases {
+    selectDB(i)
+    cmdFlushdb(args)
+  }
+  selectDB(current)
+  return Status("OK")
+}
+
+// snapshot returns the data of every database, to send or save it whole
+func snapshot() []map[string]*Value {
+  data := make([]map[string]*Value, len(databases))
+  for i, d := range databases {
+    data[i] = storeMap(d.storage)
+  }
+  return data
+}
+
+type dbKey struct{}
+
+// dbOf returns the database of an HTTP request
+func dbOf(req *http.Request) int {
+  n, _ := req.Context().Value(dbKey{}).(int)
+  return n
+}
+
+// serveDB serves /db/{n}/... like /..., in database n
+func serveDB(w http.ResponseWriter, req *http.Request) {
+  rest := strings.TrimPrefix(req.URL.Path, "/db/")
+  i := strings.IndexByte(rest, '/')
+  if i < 0 {
+    rest += "/"
+    i = len(rest) - 1
+  }
+  n, err := parseDB(rest[:i])
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusNotFound)
+    return
+  }
+  if cluster != nil && n != 0 {
+    http.Error(w, "only database 0 is available in proxy mode", http.StatusNotImplemented)
+    return
+  }
+  inner := req.WithContext(context.WithValue(req.Context(), dbKey{}, n))
+  url := *req.URL
+  url.Path, url.RawPath = rest[i:], ""
+  inner.URL = &url
+  http.DefaultServeMux.ServeHTTP(w, inner)
+}
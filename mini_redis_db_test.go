@@ -0,0 +1,104 @@
+// Tests of logical databases: keys, FLUSHDB and snapshots scoped to a
+//   database, FLUSHALL, and FLUSHDB/FLUSHALL refused in transactions.
+// go test -run DB mini_redis*.go
+
+package main
+import (
+  "context"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+func TestDBScoped(t *testing.T) {
+  resetDatabases()
+  runSteps(t, 0, []step{
+    {[]string{"SET", "k", "zero"}, Status("OK")},
+    {[]string{"SET", "only0", "x"}, Status("OK")},
+  })
+  runSteps(t, 3, []step{
+    {[]string{"GET", "k"}, nil},
+    {[]string{"SET", "k", "three"}, Status("OK")},
+    {[]string{"DBSIZE"}, 1},
+    {[]string{"KEYS", "*"}, []string{"k"}},
+  })
+  runSteps(t, 0, []step{
+    {[]string{"GET", "k"}, "zero"},
+    {[]string{"DBSIZE"}, 2},
+  })
+  runSteps(t, 3, []step{
+    {[]string{"FLUSHDB"}, Status("OK")},
+    {[]string{"DBSIZE"}, 0},
+  })
+  runSteps(t, 0, []step{
+    {[]string{"GET", "k"}, "zero"},
+    {[]string{"SET", "k", "v", "EX", "100"}, Status("OK")},
+  })
+  runSteps(t, 5, []step{
+    {[]string{"SET", "k", "five"}, Status("OK")},
+    {[]string{"FLUSHALL"}, Status("OK")},
+    {[]string{"DBSIZE"}, 0},
+  })
+  runSteps(t, 0, []step{{[]string{"DBSIZE"}, 0}})
+  mu.Lock()
+  selectDB(0)
+  left := len(expires)
+  mu.Unlock()
+  if left != 0 {
+    t.Fatalf("FLUSHALL left %d keys with a TTL", left)
+  }
+}
+
+func TestDBFlushInTransaction(t *testing.T) {
+  resetDatabases()
+  execute(0, []string{"SET", "k", "v"})
+  for _, name := range []string{"FLUSHDB", "FLUSHALL"} {
+    var tx Transaction
+    reply := handleAll(t, &tx, []string{"MULTI"}, []string{"SET", "a", "1"}, []string{name})
+    if !isError(reply, "ERR '" + strings.ToLower(name) + "' can not be rolled back") {
+      t.Fatalf("%s in MULTI got %#v", name, reply)
+    }
+    if reply = handleAll(t, &tx, []string{"EXEC"}); !isError(reply, "EXECABORT") {
+      t.Fatalf("EXEC after %s got %#v", name, reply)
+    }
+    _, err := runTransaction(context.Background(), 0, [][]string{{"SET", "a", "1"}, {name}}, nil)
+    if err == nil || !strings.HasPrefix(err.Error(), "EXECABORT command 1: ERR '" + strings.ToLower(name) + "'") {
+      t.Fatalf("%s in a batch got %v", name, err)
+    }
+  }
+  runSteps(t, 0, []step{
+    {[]string{"GET", "k"}, "v"},
+    {[]string{"EXISTS", "a"}, 0},
+  })
+}
+
+func TestDBSnapshots(t *testing.T) {
+  old := dbfile
+  dbfile = filepath.Join(t.TempDir(), "dump.db")
+  defer func() { dbfile = old }()
+  resetDatabases()
+  execute(0, []string{"SET", "k", "zero"})
+  execute(3, []string{"SET", "k", "three"})
+  mu.Lock()
+  err := saveSnapshot()
+  mu.Unlock()
+  if err != nil {
+    t.Fatal(err)
+  }
+  for _, file := range []string{dbfile, dbfile + ".3"} {
+    if _, err := os.Stat(file); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if _, err := os.Stat(dbfile + ".1"); !os.IsNotExist(err) {
+    t.Fatalf("an unchanged database was saved: %v", err)
+  }
+
+  resetDatabases()
+  if err := loadSnapshot(); err != nil {
+    t.Fatal(err)
+  }
+  runSteps(t, 0, []step{{[]string{"GET", "k"}, "zero"}, {[]string{"DBSIZE"}, 1}})
+  runSteps(t, 3, []step{{[]string{"GET", "k"}, "three"}, {[]string{"DBSIZE"}, 1}})
+}
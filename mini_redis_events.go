@@ -0,0 +1,114 @@
+// Keyspace change notifications of mini_redis.
+// Every change to a key (put, delete or expire) becomes an Event carrying the
+//   revision of the write. The last history_size events are kept, so a client
+//   that reconnects can resume from the last revision it saw; a client asking for
+//   revisions that were already dropped from the history has to re-read the keys.
+// Watchers are fed the same way as pub/sub subscribers: a bounded buffer,
+//   and a watcher that falls behind is dropped. Everything here is guarded by mu.
+
+package main
+import (
+  "strings"
+)
+
+type Event struct {
+  Revision int64 `json:"revision"`
+  Type string `json:"type"` // put, delete, expire, or flushdb / flushall without a key
+  Db int `json:"db"`
+  Key string `json:"key"`
+  Value *string `json:"value,omitempty"` // new value of a string key on put
+  Command string `json:"command,omitempty"` // command that made the change
+}
+
+type Watcher struct {
+  db int
+  prefix string
+  events chan Event
+  dropped chan struct{} // closed when the watcher was dropped for being too slow
+}
+
+var history_size = 10000
+var history []Event
+var compacted int64 // revision of the last event dropped from history, older revisions can not be resumed
+var watchers = make(map[*Watcher]bool)
+
+// events of a running transaction are held back until it commits (see runTransaction)
+var deferred []Event
+
+// notify records a change of key at the current revision
+func notify(typ, key string, v *Value, command string) {
+  e := Event{Revision: revision, Type: typ, Db: db_index, Key: key, Command: command}
+  if v != nil && v.Kind == "string" {
+    // a value that can not be decompressed has no value in the event
+    if value, err := v.str(); err == nil {
+      e.Value = &value
+    }
+  }
+  if deferring {
+    deferred = append(deferred, e)
+    return
+  }
+  emit(e)
+}
+
+func emit(e Event) {
+  history = append(history, e)
+  if len(history) > 2 * history_size {
+    compacted = history[len(history) - history_size - 1].Revision
+    history = append([]Event{}, history[len(history) - history_size:]...)
+  }
+  for w := range watchers {
+    if !e.matches(w.db, w.prefix) {
+      continue
+    }
+    select {
+    case w.events <- e:
+    default:
+      delete(watchers, w)
+      close(w.dropped)
+    }
+  }
+}
+
+// flushEvents emits the events of a transaction when it committed
+func flushEvents(commit bool) {
+  if commit {
+    for _, e := range deferred {
+      emit(e)
+    }
+  }
+  deferred = nil
+}
+
+// eventsSince returns the events after revision since for keys of database db with the prefix;
+//   ok is false when some of them are no longer in the history
+func eventsSince(db int, prefix string, since int64) ([]Event, bool) {
+  if since < compacted {
+    return nil, false
+  }
+  events := []Event{}
+  for _, e := range history {
+    if e.Revision > since && e.matches(db, prefix) {
+      events = append(events, e)
+    }
+  }
+  return events, true
+}
+
+// matches reports whether the event is about keys of database db with the prefix
+func (e Event) matches(db int, prefix string) bool {
+  if e.Type == "flushall" {
+    return true
+  }
+  return e.Db == db && (e.Type == "flushdb" || strings.HasPrefix(e.Key, prefix))
+}
+
+func newWatcher(db int, prefix string) *Watcher {
+  w := &Watcher{db, prefix, make(chan Event, subscriber_buffer), make(chan struct{})}
+  watchers[w] = true
+  return w
+}
+
+func (w *Watcher) close() {
+  delete(watchers, w)
+}
@@ -0,0 +1,134 @@
+// Key expiration of mini_redis: EXPIRE, PEXPIRE, PEXPIREAT, TTL, PTTL, PERSIST
+//   and SET ... EX/PX/PXAT.
+// A key is expired lazily when it is accessed (see get), and a background
+//   sweeper removes the expired keys nobody asks for. The sweeper only walks
+//   the keys that have a TTL, which are indexed in expires.
+
+package main
+import (
+  "strconv"
+  "strings"
+  "time"
+)
+
+// keys that have (or had) an expiration time; entries for keys that were
+//   deleted or made persistent since are cleaned up by the sweeper
+var expires map[string]bool
+
+func init() {
+  register("EXPIRE", 3, "write", 1, 1, 1, cmdExpire)
+  register("PEXPIRE", 3, "write", 1, 1, 1, cmdExpire)
+  register("PEXPIREAT", 3, "write", 1, 1, 1, cmdExpire)
+  register("TTL", 2, "", 1, 1, 1, cmdTtl)
+  register("PTTL", 2, "", 1, 1, 1, cmdTtl)
+  register("PERSIST", 2, "write", 1, 1, 1, cmdPersist)
+}
+
+// current time in unix milliseconds; while a raft node applies an entry,
+//   the time the leader gave it
+func now() int64 {
+  if raft_time != 0 {
+    return raft_time
+  }
+  return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// live reports whether the value is not expired at time t
+func (v *Value) live(t int64) bool {
+  return v.Expires == 0 || v.Expires > t
+}
+
+func setExpires(key string, at int64) {
+  v, _ := storage.get(key)
+  v.Expires = at
+  expires[key] = true
+}
+
+// expireKey removes an expired key; it counts as a write of its own
+func expireKey(key string) {
+  storage.delete(key)
+  delete(expires, key)
+  db.dirty++
+  revision++
+  notify("expire", key, nil, "")
+  propagate([]string{"DEL", key})
+  countExpired()
+}
+
+// sweepExpired removes expired keys every interval
+func sweepExpired(interval time.Duration) {
+  for range time.Tick(interval) {
+    if raft != nil {
+      sweepRaft()
+      continue
+    }
+    mu.Lock()
+    if replica_of != "" {
+      mu.Unlock()
+      continue
+    }
+    t := now()
+    for i := range databases {
+      selectDB(i)
+      for key := range expires {
+        v, ok := storage.get(key)
+        if !ok || v.Expires == 0 {
+          delete(expires, key)
+        } else if v.Expires <= t {
+          expireKey(key)
+        }
+      }
+      storage.release()
+    }
+    mu.Unlock()
+  }
+}
+
+// EXPIRE key seconds, PEXPIRE key milliseconds, PEXPIREAT key unix-time-milliseconds:
+//   a time in the past deletes the key
+func cmdExpire(args []string) interface{} {
+  n, err := strconv.ParseInt(args[2], 10, 64)
+  if err != nil {
+    return errNotInteger
+  }
+  switch strings.ToUpper(args[0]) {
+  case "EXPIRE":
+    n = now() + n * 1000
+  case "PEXPIRE":
+    n = now() + n
+  }
+  if get(args[1]) == nil {
+    return 0
+  }
+  if n <= now() {
+    storage.delete(args[1])
+    return 1
+  }
+  setExpires(args[1], n)
+  return 1
+}
+
+// TTL key, PTTL key: -2 when the key does not exist, -1 when it has no expiration
+func cmdTtl(args []string) interface{} {
+  v := get(args[1])
+  if v == nil {
+    return -2
+  }
+  if v.Expires == 0 {
+    return -1
+  }
+  left := v.Expires - now()
+  if strings.ToUpper(args[0]) == "TTL" {
+    left = (left + 500) / 1000
+  }
+  return left
+}
+
+func cmdPersist(args []string) interface{} {
+  v := get(args[1])
+  if v == nil || v.Expires == 0 {
+    return 0
+  }
+  v.Expires = 0
+  return 1
+}
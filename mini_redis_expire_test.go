@@ -0,0 +1,108 @@
+// Tests of key expiration and of the change events: TTLs, keys expiring when
+//   read, and the events of /watch resuming from a revision.
+// The clock is set through raft_time, which now() returns when it is not 0.
+// go test -run Expire mini_redis*.go
+
+package main
+import (
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "strconv"
+  "testing"
+)
+
+// setClock makes now() return ms until the end of the test
+func setClock(t *testing.T, ms int64) {
+  mu.Lock()
+  raft_time = ms
+  mu.Unlock()
+  t.Cleanup(func() {
+    mu.Lock()
+    raft_time = 0
+    mu.Unlock()
+  })
+}
+
+func TestExpire(t *testing.T) {
+  resetDatabases()
+  setClock(t, 1000000)
+  runSteps(t, 0, []step{
+    {[]string{"SET", "k", "v", "PX", "1500"}, Status("OK")},
+    {[]string{"PTTL", "k"}, int64(1500)},
+    {[]string{"TTL", "k"}, int64(2)},
+    {[]string{"INCR", "n"}, int64(1)},
+    {[]string{"EXPIRE", "n", "10"}, 1},
+    {[]string{"INCR", "n"}, int64(2)}, // keeps the TTL
+    {[]string{"PTTL", "n"}, int64(10000)},
+    {[]string{"SET", "p", "v", "EX", "10"}, Status("OK")},
+    {[]string{"SET", "p", "w"}, Status("OK")}, // SET makes it persistent
+    {[]string{"TTL", "p"}, -1},
+    {[]string{"TTL", "missing"}, -2},
+    {[]string{"EXPIRE", "missing", "10"}, 0},
+    {[]string{"PEXPIRE", "n", "abc"}, errNotInteger},
+  })
+  setClock(t, 1001499)
+  runSteps(t, 0, []step{{[]string{"GET", "k"}, "v"}})
+  setClock(t, 1001500)
+  runSteps(t, 0, []step{
+    {[]string{"GET", "k"}, nil},
+    {[]string{"EXISTS", "k"}, 0},
+    {[]string{"TTL", "k"}, -2},
+    {[]string{"KEYS", "*"}, []string{"n", "p"}},
+    {[]string{"PERSIST", "n"}, 1},
+    {[]string{"PERSIST", "n"}, 0},
+    {[]string{"PEXPIREAT", "p", "1001500"}, 1}, // a time in the past deletes the key
+    {[]string{"EXISTS", "p"}, 0},
+  })
+  setClock(t, 2000000)
+  runSteps(t, 0, []step{{[]string{"GET", "n"}, "2"}})
+}
+
+func TestExpireEvents(t *testing.T) {
+  resetDatabases()
+  setClock(t, 1000000)
+  mu.Lock()
+  since := revision
+  mu.Unlock()
+  runSteps(t, 0, []step{
+    {[]string{"SET", "cfg/a", "1", "PX", "10"}, Status("OK")},
+    {[]string{"SET", "other", "1"}, Status("OK")},
+    {[]string{"DEL", "cfg/a"}, 1},
+    {[]string{"SET", "cfg/b", "2", "PX", "10"}, Status("OK")},
+  })
+  setClock(t, 1000010)
+  runSteps(t, 0, []step{{[]string{"GET", "cfg/b"}, nil}})
+
+  mu.Lock()
+  events, ok := eventsSince(0, "cfg/", since)
+  mu.Unlock()
+  if !ok || len(events) != 4 {
+    t.Fatalf("got %d events (%v), want 4", len(events), ok)
+  }
+  for i, want := range []struct{ typ, key string }{{"put", "cfg/a"}, {"delete", "cfg/a"}, {"put", "cfg/b"}, {"expire", "cfg/b"}} {
+    if e := events[i]; e.Type != want.typ || e.Key != want.key {
+      t.Fatalf("event %d is %s %s, want %s %s", i, e.Type, e.Key, want.typ, want.key)
+    }
+    if i > 0 && events[i].Revision <= events[i-1].Revision {
+      t.Fatalf("revisions do not grow: %d after %d", events[i].Revision, events[i-1].Revision)
+    }
+  }
+  if events[0].Value == nil || *events[0].Value != "1" {
+    t.Fatalf("the put event has no value")
+  }
+
+  // a client resuming after the second event only gets the last two
+  w := httptest.NewRecorder()
+  serveWatch(w, httptest.NewRequest("GET", "/watch?prefix=cfg/&since=" + strconv.FormatInt(events[1].Revision, 10), nil))
+  var reply struct {
+    Revision int64
+    Events []Event
+  }
+  if err := json.NewDecoder(w.Body).Decode(&reply); err != nil || w.Code != http.StatusOK {
+    t.Fatalf("/watch got %d: %v", w.Code, err)
+  }
+  if len(reply.Events) != 2 || reply.Events[1].Type != "expire" || reply.Revision != events[3].Revision {
+    t.Fatalf("/watch got %+v", reply)
+  }
+}
@@ -0,0 +1,514 @@
+// Introspection of mini_redis: INFO reports the state of the server as
+//   field:value lines in sections, like Redis: server, clients, memory,
+//   persistence, stats (commands, ops/sec, keyspace hits and misses),
+//   replication and keyspace (keys of each type per database); GET /info
+//   answers the same as JSON. Sizes of values are estimates, and in proxy mode
+//   everything but the command stats is about the proxy itself.
+// The stores keep the key counts and the dataset size as keys are written (see
+//   mini_redis_store.go), so INFO does not walk the keys; like in Redis, the
+//   keyspace counts keys that expired but were not deleted yet, and its
+//   expires the keys the expiry sweep watches.
+// SLOWLOG GET [n] / LEN / RESET: the last -slowlog-len commands that ran for
+//   longer than -slowlog, each with an ID, the unix time when it ran, its
+//   duration in microseconds and its arguments. The duration is the time under
+//   mu, without the wait for it (in proxy mode, the round trip to the node).
+// curl localhost:8082/info
+// curl "localhost:8082/info?section=keyspace&section=stats"
+// curl "localhost:8082/slowlog?count=10"
+// curl -X DELETE localhost:8082/slowlog
+
+package main
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "net/http"
+  "os"
+  "runtime"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+type SlowlogEntry struct {
+  ID int64 `json:"id"`
+  Time int64 `json:"time"` // unix seconds
+  Duration int64 `json:"duration_us"`
+  Args []string `json:"command"`
+}
+
+type InfoField struct {
+  name string
+  value interface{}
+}
+
+type InfoSection struct {
+  name string
+  fields []InfoField
+}
+
+var info_sections = []string{"server", "clients", "memory", "persistence", "stats", "replication", "keyspace"}
+
+const size_samples = 64
+
+var started = time.Now()
+var slowlog_threshold = 10 * time.Millisecond
+var slowlog_max_len = 128
+
+// stats_mu guards the counters and the slow log, which the proxy updates without mu
+var stats_mu sync.Mutex
+var total_commands, keyspace_hits, keyspace_misses, expired_keys int64
+var ops_per_sec int64
+var connected_clients int
+var slowlog []SlowlogEntry
+var slowlog_next int64
+
+func init() {
+  register("INFO", -1, "", 0, 0, 0, cmdInfo)
+  register("SLOWLOG", -2, "admin", 0, 0, 0, cmdSlowlog)
+}
+
+// track counts a command that started at start, and logs it when it was slow
+func track(args []string, start time.Time) {
+  d := time.Since(start)
+  stats_mu.Lock()
+  defer stats_mu.Unlock()
+  total_commands++
+  if slowlog_threshold < 0 || d < slowlog_threshold {
+    return
+  }
+  // like Redis, long commands are cut: 32 arguments of up to 128 bytes
+  logged := []string{}
+  for i, arg := range args {
+    if i == 31 && len(args) > 32 {
+      logged = append(logged, "... (" + strconv.Itoa(len(args) - 31) + " more arguments)")
+      break
+    }
+    if len(arg) > 128 {
+      arg = arg[:128] + "... (" + strconv.Itoa(len(arg) - 128) + " more bytes)"
+    }
+    logged = append(logged, arg)
+  }
+  slowlog = append(slowlog, SlowlogEntry{slowlog_next, start.Unix(), int64(d / time.Microsecond), logged})
+  slowlog_next++
+  if len(slowlog) > slowlog_max_len {
+    slowlog = append([]SlowlogEntry{}, slowlog[len(slowlog) - slowlog_max_len:]...)
+  }
+}
+
+// countLookups counts the keys of a read that exist as hits, the others as misses
+func countLookups(keys []string) {
+  hits := int64(0)
+  for _, key := range keys {
+    if get(key) != nil {
+      hits++
+    }
+  }
+  stats_mu.Lock()
+  keyspace_hits += hits
+  keyspace_misses += int64(len(keys)) - hits
+  stats_mu.Unlock()
+}
+
+func countExpired() {
+  stats_mu.Lock()
+  expired_keys++
+  stats_mu.Unlock()
+}
+
+func clientConnected(delta int) {
+  stats_mu.Lock()
+  connected_clients += delta
+  stats_mu.Unlock()
+}
+
+// sampleOps updates the commands per second every second
+func sampleOps() {
+  last := int64(0)
+  for range time.Tick(time.Second) {
+    stats_mu.Lock()
+    ops_per_sec = total_commands - last
+    last = total_commands
+    stats_mu.Unlock()
+  }
+}
+
+// size is a rough count of the bytes a key and its value take; the stores
+//   count it at every put, so of a value with many elements it only looks at
+//   size_samples of them and takes the others to be alike
+func (v *Value) size(key string) int64 {
+  n := int64(len(key) + 64) // the map entry and the Value
+  sampled, seen, total := int64(0), 0, 0
+  switch v.Kind {
+  case "string":
+    return n + int64(len(v.Str) + len(v.Packed) + len(v.ContentType))
+  case "list":
+    total = len(v.List)
+    for _, item := range v.List {
+      if seen == size_samples {
+        break
+      }
+      sampled += int64(len(item) + 16)
+      seen++
+    }
+  case "hash":
+    total = len(v.Hash)
+    for field, value := range v.Hash {
+      if seen == size_samples {
+        break
+      }
+      sampled += int64(len(field) + len(value) + 32)
+      seen++
+    }
+  case "set":
+    total = len(v.Set)
+    for member := range v.Set {
+      if seen == size_samples {
+        break
+      }
+      sampled += int64(len(member) + 16)
+      seen++
+    }
+  case "zset":
+    total = len(v.ZSet.dict)
+    for member := range v.ZSet.dict {
+      if seen == size_samples {
+        break
+      }
+      sampled += int64(2 * len(member) + 80) // in the map and in a skip list node
+      seen++
+    }
+  case "stream":
+    total = len(v.Stream.Entries)
+    for _, e := range v.Stream.Entries {
+      if seen == size_samples {
+        break
+      }
+      sampled += 40
+      for _, field := range e.Fields {
+        sampled += int64(len(field) + 16)
+      }
+      seen++
+    }
+    for name, g := range v.Stream.Groups {
+      n += int64(len(name) + 64 + 64 * len(g.Pending))
+    }
+  }
+  if seen > 0 {
+    n += sampled * int64(total) / int64(seen)
+  }
+  return n
+}
+
+// collectInfo returns the sections asked for, all of them for none or "all";
+//   the caller holds mu
+func collectInfo(names []string) ([]InfoSection, error) {
+  wanted := make(map[string]bool)
+  for _, name := range names {
+    name = strings.ToLower(name)
+    switch name {
+    case "all", "default", "everything":
+      continue
+    }
+    found := false
+    for _, section := range info_sections {
+      found = found || section == name
+    }
+    if !found {
+      return nil, errors.New("ERR unknown INFO section '" + name + "'")
+    }
+    wanted[name] = true
+  }
+  stats_mu.Lock()
+  stats := []InfoField{
+    {"total_commands_processed", total_commands},
+    {"instantaneous_ops_per_sec", ops_per_sec},
+    {"keyspace_hits", keyspace_hits},
+    {"keyspace_misses", keyspace_misses},
+    {"keyspace_hit_ratio", 0.0},
+    {"expired_keys", expired_keys},
+    {"slowlog_len", int64(len(slowlog))},
+  }
+  if keyspace_hits + keyspace_misses > 0 {
+    ratio := float64(keyspace_hits) / float64(keyspace_hits + keyspace_misses)
+    stats[4].value = float64(int(ratio * 10000)) / 10000
+  }
+  clients := int64(connected_clients)
+  stats_mu.Unlock()
+
+  sections := []InfoSection{}
+  for _, name := range info_sections {
+    if len(wanted) > 0 && !wanted[name] {
+      continue
+    }
+    var fields []InfoField
+    switch name {
+    case "server":
+      uptime := int64(time.Since(started) / time.Second)
+      fields = []InfoField{
+        {"process_id", int64(os.Getpid())},
+        {"go_version", runtime.Version()},
+        {"uptime_in_seconds", uptime},
+        {"uptime_in_days", uptime / 86400},
+        {"databases", int64(len(databases))},
+      }
+    case "clients":
+      pubsub_mu.Lock()
+      subscribed := int64(len(subscribers))
+      pubsub_mu.Unlock()
+      fields = []InfoField{
+        {"connected_clients", clients},
+        {"pubsub_clients", subscribed},
+        {"watch_clients", int64(len(watchers))},
+      }
+    case "memory":
+      var m runtime.MemStats
+      runtime.ReadMemStats(&m)
+      dataset := int64(0)
+      for _, d := range databases {
+        // the values of the btree engine are on disk, see persistence
+        if m, ok := d.storage.(*MemoryStore); ok {
+          dataset += m.bytes
+        }
+      }
+      fields = []InfoField{
+        {"used_memory", int64(m.HeapAlloc)},
+        {"used_memory_human", humanBytes(int64(m.HeapAlloc))},
+        {"used_memory_dataset", dataset},
+        {"used_memory_dataset_human", humanBytes(dataset)},
+        {"used_memory_sys", int64(m.Sys)},
+      }
+    case "persistence":
+      changes := int64(0)
+      for _, d := range databases {
+        changes += int64(d.dirty)
+      }
+      status, last := "ok", int64(0)
+      if last_save_err != nil {
+        status = "err"
+      }
+      if !last_save.IsZero() {
+        last = last_save.Unix()
+      }
+      fields = []InfoField{
+        {"persistence", persistence()},
+        {"engine", engine},
+        {"dbfile", dbfile},
+        {"changes_since_last_save", changes},
+        {"last_save_time", last},
+        {"last_save_status", status},
+      }
+      if engine == "btree" {
+        size := int64(0)
+        for _, d := range databases {
+          size += d.storage.(*BTree).fileSize()
+        }
+        fields = append(fields, InfoField{"btree_file_size", size}, InfoField{"btree_file_size_human", humanBytes(size)})
+      }
+    case "stats":
+      fields = stats
+    case "replication":
+      fields = []InfoField{{"role", "master"}}
+      switch {
+      case cluster != nil:
+        fields[0].value = "proxy"
+      case raft != nil:
+        fields[0].value = "raft" // see /raft/status
+      case replica_of != "":
+        fields[0].value = "slave"
+        fields = append(fields, InfoField{"master", replica_of}, InfoField{"master_link_status", repl_state})
+      default:
+        fields = append(fields, InfoField{"connected_slaves", int64(len(replicas))})
+      }
+      fields = append(fields, InfoField{"revision", revision})
+    case "keyspace":
+      for i, d := range databases {
+        keys := int64(d.storage.count())
+        if keys == 0 {
+          continue
+        }
+        counts := d.storage.kinds()
+        space := []InfoField{{"keys", keys}, {"expires", int64(len(d.expires))}}
+        kinds := make([]string, 0, len(counts))
+        for kind := range counts {
+          kinds = append(kinds, kind)
+        }
+        sort.Strings(kinds)
+        for _, kind := range kinds {
+          space = append(space, InfoField{kind, counts[kind]})
+        }
+        fields = append(fields, InfoField{"db" + strconv.Itoa(i), space})
+      }
+    }
+    sections = append(sections, InfoSection{name, fields})
+  }
+  return sections, nil
+}
+
+// persistence tells how the data is kept across restarts
+func persistence() string {
+  switch {
+  case cluster != nil:
+    return "none (proxy)"
+  case raft != nil:
+    return "raft log"
+  case dbfile == "":
+    return "disabled"
+  case engine == "btree":
+    return "btree"
+  }
+  return "snapshots"
+}
+
+func humanBytes(n int64) string {
+  units := []string{"B", "K", "M", "G", "T"}
+  f, i := float64(n), 0
+  for f >= 1024 && i < len(units) - 1 {
+    f /= 1024
+    i++
+  }
+  if i == 0 {
+    return strconv.FormatInt(n, 10) + "B"
+  }
+  return strconv.FormatFloat(f, 'f', 2, 64) + units[i]
+}
+
+// INFO [section ...]: the sections as text, "# Name" then field:value lines
+func cmdInfo(args []string) interface{} {
+  sections, err := collectInfo(args[1:])
+  if err != nil {
+    return err
+  }
+  var b strings.Builder
+  for i, section := range sections {
+    if i > 0 {
+      b.WriteString("\r\n")
+    }
+    b.WriteString("# " + strings.ToUpper(section.name[:1]) + section.name[1:] + "\r\n")
+    for _, field := range section.fields {
+      b.WriteString(field.name + ":" + infoValue(field.value) + "\r\n")
+    }
+  }
+  return b.String()
+}
+
+func infoValue(value interface{}) string {
+  switch v := value.(type) {
+  case string:
+    return v
+  case int64:
+    return strconv.FormatInt(v, 10)
+  case float64:
+    return strconv.FormatFloat(v, 'f', -1, 64)
+  case []InfoField:
+    items := make([]string, len(v))
+    for i, field := range v {
+      items[i] = field.name + "=" + infoValue(field.value)
+    }
+    return strings.Join(items, ",")
+  }
+  return fmt.Sprint(value)
+}
+
+// infoJSON turns the sections into objects for GET /info
+func infoJSON(fields []InfoField) map[string]interface{} {
+  out := make(map[string]interface{}, len(fields))
+  for _, field := range fields {
+    if nested, ok := field.value.([]InfoField); ok {
+      out[field.name] = infoJSON(nested)
+    } else {
+      out[field.name] = field.value
+    }
+  }
+  return out
+}
+
+// SLOWLOG GET [count] | LEN | RESET
+func cmdSlowlog(args []string) interface{} {
+  stats_mu.Lock()
+  defer stats_mu.Unlock()
+  switch sub := strings.ToUpper(args[1]); {
+  case sub == "GET" && len(args) <= 3:
+    count := 10
+    if len(args) == 3 {
+      n, err := strconv.Atoi(args[2])
+      if err != nil || n < -1 {
+        return errNotInteger
+      }
+      count = n
+    }
+    out := []interface{}{}
+    for i := len(slowlog) - 1; i >= 0 && (count < 0 || len(out) < count); i-- {
+      e := slowlog[i]
+      out = append(out, []interface{}{e.ID, e.Time, e.Duration, append([]string{}, e.Args...)})
+    }
+    return out
+  case sub == "LEN" && len(args) == 2:
+    return len(slowlog)
+  case sub == "RESET" && len(args) == 2:
+    slowlog = nil
+    return Status("OK")
+  }
+  return errors.New("ERR unknown subcommand or wrong number of arguments for '" + args[1] + "'. Try SLOWLOG GET, LEN or RESET.")
+}
+
+// serveInfo serves GET /info, see the top of the file
+func serveInfo(w http.ResponseWriter, req *http.Request) {
+  names := req.URL.Query()["section"]
+  if !allowed(w, req, append([]string{"INFO"}, names...)) {
+    return
+  }
+  mu.Lock()
+  sections, err := collectInfo(names)
+  mu.Unlock()
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  out := make(map[string]interface{})
+  for _, section := range sections {
+    out[section.name] = infoJSON(section.fields)
+  }
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(out)
+}
+
+// serveSlowlog serves GET /slowlog?count=n (newest first) and DELETE /slowlog
+func serveSlowlog(w http.ResponseWriter, req *http.Request) {
+  switch req.Method {
+  case "GET":
+    count := 10
+    if s := req.URL.Query().Get("count"); s != "" {
+      n, err := strconv.Atoi(s)
+      if err != nil || n < -1 {
+        http.Error(w, "count must be a number, -1 for all", http.StatusBadRequest)
+        return
+      }
+      count = n
+    }
+    if !allowed(w, req, []string{"SLOWLOG", "GET"}) {
+      return
+    }
+    stats_mu.Lock()
+    entries := []SlowlogEntry{}
+    for i := len(slowlog) - 1; i >= 0 && (count < 0 || len(entries) < count); i-- {
+      entries = append(entries, slowlog[i])
+    }
+    stats_mu.Unlock()
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(entries)
+  case "DELETE":
+    if !allowed(w, req, []string{"SLOWLOG", "RESET"}) {
+      return
+    }
+    stats_mu.Lock()
+    slowlog = nil
+    stats_mu.Unlock()
+    w.Write([]byte("OK"))
+  default:
+    w.Header().Set("Allow", "GET, DELETE")
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+  }
+}
@@ -0,0 +1,277 @@
+// Distributed locks of mini_redis: a lock is a string key holding the token of
+//   its owner, with a TTL so a crashed owner does not hold it forever.
+// LOCK key token ttl-ms takes the lock if it is free or already held with the
+//   same token (which extends it), and replies nil when another owner holds it;
+//   UNLOCK key token and RENEW key token ttl-ms reply 1, or 0 for a lock that is
+//   not held with that token, so an owner whose lock expired can not release or
+//   extend the lock of the next owner.
+// LOCK key token ttl-ms WAIT ms waits up to ms for the lock to be released or to
+//   expire; outside transactions and scripts only, as it runs without mu.
+// Over HTTP, /locks/{key} long-polls the same way:
+//   POST takes the lock (the token is the body, or a random one when the body
+//   is empty) and answers the token, or 423 when it is still held after wait;
+//   PUT renews it and DELETE releases it, both with the token as the body,
+//   and 412 when the lock is not held with that token.
+// curl -X POST "localhost:8082/locks/deploy?ttl=30s&wait=10s"
+// curl -X PUT -d 9f86d081884c7d65 "localhost:8082/locks/deploy?ttl=30s"
+// curl -X DELETE -d 9f86d081884c7d65 localhost:8082/locks/deploy
+
+package main
+import (
+  "context"
+  "crypto/rand"
+  "encoding/hex"
+  "errors"
+  "io/ioutil"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// how often a waiter of the proxy tries again, as it gets no events from the nodes
+const lock_poll = 100 * time.Millisecond
+
+func init() {
+  register("LOCK", -4, "write", 1, 1, 1, cmdLock)
+  register("UNLOCK", 3, "write", 1, 1, 1, cmdUnlock)
+  register("RENEW", 4, "write", 1, 1, 1, cmdRenew)
+}
+
+// LOCK key token ttl-ms: OK, or nil when the lock is held with another token
+func cmdLock(args []string) interface{} {
+  if len(args) != 4 {
+    if _, ok := lockWait(args); ok {
+      return errors.New("ERR LOCK with WAIT is not allowed in transactions and scripts")
+    }
+    if len(args) == 6 && strings.ToUpper(args[4]) == "WAIT" {
+      return errors.New("ERR invalid wait time in 'lock' command")
+    }
+    return errors.New("ERR syntax error")
+  }
+  ttl, err := lockTTL(args[2], args[3])
+  if err != nil {
+    return err
+  }
+  v := get(args[1])
+  if v != nil && v.Kind != "string" {
+    return errWrongType
+  }
+  if v != nil {
+    if s, err := v.str(); err != nil {
+      return err
+    } else if s != args[2] {
+      return Unchanged{nil}
+    }
+  }
+  storage.put(args[1], newString(args[2], ""))
+  setExpires(args[1], now() + ttl)
+  return Status("OK")
+}
+
+// UNLOCK key token: 1 when the lock was held with the token and is now released
+func cmdUnlock(args []string) interface{} {
+  v, err := lockOf(args[1], args[2])
+  if v == nil {
+    return err
+  }
+  storage.delete(args[1])
+  delete(expires, args[1])
+  return 1
+}
+
+// RENEW key token ttl-ms: 1 when the lock is held with the token, now for ttl-ms more
+func cmdRenew(args []string) interface{} {
+  ttl, err := lockTTL(args[2], args[3])
+  if err != nil {
+    return err
+  }
+  v, reply := lockOf(args[1], args[2])
+  if v == nil {
+    return reply
+  }
+  setExpires(args[1], now() + ttl)
+  return 1
+}
+
+// lockOf returns the lock key held with the token, or nil and the reply to give
+func lockOf(key, token string) (*Value, interface{}) {
+  v := get(key)
+  if v != nil && v.Kind != "string" {
+    return nil, errWrongType
+  }
+  if v == nil {
+    return nil, Unchanged{0}
+  }
+  if s, err := v.str(); err != nil {
+    return nil, err
+  } else if s != token {
+    return nil, Unchanged{0}
+  }
+  return v, nil
+}
+
+func lockTTL(token, ttl string) (int64, error) {
+  if token == "" {
+    return 0, errors.New("ERR the token of a lock must not be empty")
+  }
+  n, err := strconv.ParseInt(ttl, 10, 64)
+  if err != nil || n <= 0 {
+    return 0, errors.New("ERR invalid expire time in lock command")
+  }
+  return n, nil
+}
+
+// lockWait returns the wait of LOCK key token ttl-ms WAIT ms
+func lockWait(args []string) (time.Duration, bool) {
+  if len(args) != 6 || strings.ToUpper(args[0]) != "LOCK" || strings.ToUpper(args[4]) != "WAIT" {
+    return 0, false
+  }
+  ms, err := strconv.ParseInt(args[5], 10, 64)
+  if err != nil || ms < 0 || ms > int64(5 * time.Minute / time.Millisecond) {
+    return 0, false
+  }
+  return time.Duration(ms) * time.Millisecond, true
+}
+
+// acquireLock runs LOCK key token ttl-ms in database n until it takes the lock,
+//   waiting for the holder to release it in between, for up to wait
+func acquireLock(ctx context.Context, n int, args []string, wait time.Duration) interface{} {
+  deadline := time.Now().Add(wait)
+  for {
+    reply := execute(n, args)
+    if reply != nil {
+      return reply
+    }
+    left := time.Until(deadline)
+    if left <= 0 || !waitRelease(ctx, n, args[1], left) {
+      return nil
+    }
+  }
+}
+
+// waitRelease waits until the lock key may be free: it was deleted, it expired,
+//   or up to max; false when ctx is done first
+func waitRelease(ctx context.Context, n int, key string, max time.Duration) bool {
+  if cluster != nil {
+    if max > lock_poll {
+      max = lock_poll
+    }
+  } else {
+    mu.Lock()
+    selectDB(n)
+    var watcher *Watcher
+    if v := get(key); v != nil {
+      watcher = newWatcher(n, key)
+      if d := time.Duration(v.Expires - now()) * time.Millisecond; v.Expires != 0 && d < max {
+        max = d // raft nodes expire keys only when the log says so, try then
+      }
+    }
+    mu.Unlock()
+    if watcher == nil {
+      return true // released since LOCK ran
+    }
+    defer func() {
+      mu.Lock()
+      watcher.close()
+      mu.Unlock()
+    }()
+    timer := time.NewTimer(max)
+    defer timer.Stop()
+    for {
+      select {
+      case e := <-watcher.events:
+        if e.Key == key || e.Key == "" {
+          return true
+        }
+      case <-watcher.dropped:
+        return true
+      case <-timer.C:
+        return true
+      case <-ctx.Done():
+        return false
+      }
+    }
+  }
+  select {
+  case <-time.After(max):
+    return true
+  case <-ctx.Done():
+    return false
+  }
+}
+
+// serveLock serves /locks/{key}, see the top of the file
+func serveLock(w http.ResponseWriter, req *http.Request) {
+  key := strings.TrimPrefix(req.URL.Path, "/locks/")
+  if key == "" {
+    http.Error(w, "key must not be empty", http.StatusBadRequest)
+    return
+  }
+  if req.Method != "POST" && req.Method != "PUT" && req.Method != "DELETE" {
+    w.Header().Set("Allow", "POST, PUT, DELETE")
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+  body, err := ioutil.ReadAll(req.Body)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  token := strings.TrimSpace(string(body))
+  query := req.URL.Query()
+  ttl := 30 * time.Second
+  if s := query.Get("ttl"); s != "" {
+    if ttl, err = time.ParseDuration(s); err != nil || ttl < time.Millisecond {
+      http.Error(w, "ttl must be a duration of at least 1ms", http.StatusBadRequest)
+      return
+    }
+  }
+  var wait time.Duration
+  if s := query.Get("wait"); s != "" {
+    if wait, err = time.ParseDuration(s); err != nil || wait < 0 || wait > 5 * time.Minute {
+      http.Error(w, "wait must be a duration up to 5m", http.StatusBadRequest)
+      return
+    }
+  }
+  if token == "" {
+    if req.Method != "POST" {
+      http.Error(w, "the body must be the token of the lock", http.StatusBadRequest)
+      return
+    }
+    b := make([]byte, 16)
+    rand.Read(b)
+    token = hex.EncodeToString(b)
+  }
+  ms := strconv.FormatInt(int64(ttl / time.Millisecond), 10)
+  args := []string{"LOCK", key, token, ms}
+  if req.Method == "PUT" {
+    args = []string{"RENEW", key, token, ms}
+  } else if req.Method == "DELETE" {
+    args = []string{"UNLOCK", key, token}
+  }
+  if !allowed(w, req, args) {
+    return
+  }
+
+  var reply interface{}
+  if req.Method == "POST" {
+    reply = acquireLock(req.Context(), dbOf(req), args, wait)
+  } else {
+    reply = execute(dbOf(req), args)
+  }
+  switch reply {
+  case nil:
+    http.Error(w, "the lock is held by another owner", http.StatusLocked)
+  case 0, int64(0):
+    http.Error(w, "the lock is not held with this token", http.StatusPreconditionFailed)
+  case 1, int64(1):
+    w.Write([]byte("OK"))
+  default:
+    if _, ok := reply.(error); ok {
+      writeHTTPReply(w, reply)
+      return
+    }
+    w.Write([]byte(token))
+  }
+}
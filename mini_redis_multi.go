@@ -0,0 +1,251 @@
+// Transactions of mini_redis: a batch of commands applied all-or-nothing.
+// Over RESP it is the usual MULTI ... EXEC / DISCARD with WATCH / UNWATCH;
+//   over HTTP the whole batch is posted at once to /multi (see serveMulti).
+// WATCH is optimistic locking: it remembers the version of the keys and EXEC
+//   aborts when any of them was written since then. Unlike Redis, a command
+//   that fails while the batch runs rolls back the ones before it.
+// The rollback puts back the keys the commands name, so FLUSHDB and FLUSHALL,
+//   which delete keys they do not name, are refused in a transaction.
+
+package main
+import (
+  "context"
+  "errors"
+  "strconv"
+  "strings"
+)
+
+// set while a transaction runs: its events and replication entries are
+//   held back until it commits, and dropped when it is rolled back
+var deferring bool
+
+// errWatch is returned when a watched key changed, the batch is not applied
+var errWatch = errors.New("EXECABORT Transaction discarded because a watched key changed")
+
+// per connection state of a RESP client between MULTI and EXEC
+type Transaction struct {
+  active bool
+  queued [][]string
+  watched map[string]int64 // key -> version seen by WATCH
+  failed bool // a command could not be queued, EXEC will refuse to run
+}
+
+// watch records the current version of the keys
+func (tx *Transaction) watch(n int, keys []string) {
+  if tx.watched == nil {
+    tx.watched = make(map[string]int64)
+  }
+  mu.Lock()
+  defer mu.Unlock()
+  selectDB(n)
+  for _, key := range keys {
+    if _, ok := tx.watched[key]; !ok {
+      tx.watched[key] = keyVersion(key)
+    }
+  }
+}
+
+func (tx *Transaction) reset() {
+  *tx = Transaction{}
+}
+
+// checkCommand validates name and arity without running the command
+func checkCommand(args []string) error {
+  if len(args) == 0 {
+    return errors.New("ERR empty command")
+  }
+  cmd, ok := commands[strings.ToUpper(args[0])]
+  if !ok {
+    return errors.New("ERR unknown command '" + args[0] + "'")
+  }
+  if (cmd.arity > 0 && len(args) != cmd.arity) || (cmd.arity < 0 && len(args) < -cmd.arity) {
+    return errors.New("ERR wrong number of arguments for '" + strings.ToLower(args[0]) + "' command")
+  }
+  return nil
+}
+
+// checkTransactional is checkCommand for a command of a transaction
+func checkTransactional(args []string) error {
+  if err := checkCommand(args); err != nil {
+    return err
+  }
+  if cmd := commands[strings.ToUpper(args[0])]; cmd.has("write") && cmd.has("keyspace") {
+    return errors.New("ERR '" + strings.ToLower(cmd.name) + "' can not be rolled back, it is not allowed in a transaction")
+  }
+  return nil
+}
+
+// runTransaction applies the batch atomically in database n: either every command succeeds,
+//   or storage is left as it was and the error tells which command failed;
+//   ctx tells the user, as for executeContext.
+func runTransaction(ctx context.Context, n int, batch [][]string, watched map[string]int64) ([]interface{}, error) {
+  if raft != nil {
+    reply := raftPropose(RaftEntry{Db: n, Batch: batch, Multi: true, Watch: watched, User: userOf(ctx)})
+    if err, ok := reply.(error); ok {
+      return nil, err
+    }
+    return reply.([]interface{}), nil
+  }
+  mu.Lock()
+  defer mu.Unlock()
+  selectDB(n)
+  caller = userOf(ctx)
+  return applyTransaction(batch, watched)
+}
+
+// applyTransaction is runTransaction for callers that hold mu
+func applyTransaction(batch [][]string, watched map[string]int64) ([]interface{}, error) {
+  for i, args := range batch {
+    if err := checkTransactional(args); err != nil {
+      return nil, errors.New("EXECABORT command " + strconv.Itoa(i) + ": " + err.Error())
+    }
+  }
+  for key, version := range watched {
+    if keyVersion(key) != version {
+      return nil, errWatch
+    }
+  }
+
+  // keep a copy of every key the batch may touch, to roll back on failure
+  var keys []string
+  for _, args := range batch {
+    if cmd := commands[strings.ToUpper(args[0])]; cmd.has("write") {
+      keys = append(keys, cmd.keys(args)...)
+    }
+  }
+  backup := backupKeys(keys)
+  replies := make([]interface{}, 0, len(batch))
+  deferring = true
+  for i, args := range batch {
+    reply := call(args)
+    if err, ok := reply.(error); ok {
+      restoreKeys(backup)
+      endDeferred(false)
+      return nil, errors.New("EXECABORT command " + strconv.Itoa(i) + " failed, transaction rolled back: " + err.Error())
+    }
+    replies = append(replies, reply)
+  }
+  endDeferred(true)
+  return replies, nil
+}
+
+// backupKeys copies the values of the keys, for restoreKeys to put them back
+func backupKeys(keys []string) map[string]*Value {
+  backup := make(map[string]*Value)
+  for _, key := range keys {
+    if _, ok := backup[key]; !ok {
+      backup[key] = get(key).clone()
+    }
+  }
+  return backup
+}
+
+func restoreKeys(backup map[string]*Value) {
+  for key, v := range backup {
+    if v == nil {
+      storage.delete(key)
+    } else {
+      storage.put(key, v)
+      if v.Expires != 0 {
+        setExpires(key, v.Expires)
+      }
+    }
+  }
+}
+
+func endDeferred(commit bool) {
+  deferring = false
+  flushEvents(commit)
+  flushEntries(commit)
+}
+
+// clone returns a deep copy of the value, nil stays nil
+func (v *Value) clone() *Value {
+  if v == nil {
+    return nil
+  }
+  c := *v
+  if v.List != nil {
+    c.List = append([]string{}, v.List...)
+  }
+  if v.Hash != nil {
+    c.Hash = make(map[string]string, len(v.Hash))
+    for field, value := range v.Hash {
+      c.Hash[field] = value
+    }
+  }
+  if v.Set != nil {
+    c.Set = make(map[string]bool, len(v.Set))
+    for member := range v.Set {
+      c.Set[member] = true
+    }
+  }
+  if v.ZSet != nil {
+    c.ZSet = newZSet()
+    for member, score := range v.ZSet.dict {
+      c.ZSet.add(score, member)
+    }
+  }
+  if v.Stream != nil {
+    c.Stream = v.Stream.clone()
+  }
+  return &c
+}
+
+// transaction commands of a RESP connection; handled reports whether args was one of them
+//   or had to be queued, otherwise the caller runs the command as usual
+func (tx *Transaction) handle(ctx context.Context, n int, args []string) (interface{}, bool) {
+  name := strings.ToUpper(args[0])
+  switch name {
+  case "MULTI":
+    if tx.active {
+      return errors.New("ERR MULTI calls can not be nested"), true
+    }
+    tx.active = true
+    return Status("OK"), true
+  case "DISCARD":
+    if !tx.active {
+      return errors.New("ERR DISCARD without MULTI"), true
+    }
+    tx.reset()
+    return Status("OK"), true
+  case "EXEC":
+    if !tx.active {
+      return errors.New("ERR EXEC without MULTI"), true
+    }
+    batch, watched, failed := tx.queued, tx.watched, tx.failed
+    tx.reset()
+    if failed {
+      return errors.New("EXECABORT Transaction discarded because of previous errors"), true
+    }
+    replies, err := runTransaction(ctx, n, batch, watched)
+    if err == errWatch {
+      return nil, true // like Redis, a nil reply tells the watch failed
+    }
+    if err != nil {
+      return err, true
+    }
+    return replies, true
+  case "WATCH":
+    if tx.active {
+      return errors.New("ERR WATCH inside MULTI is not allowed"), true
+    }
+    if len(args) < 2 {
+      return errors.New("ERR wrong number of arguments for 'watch' command"), true
+    }
+    tx.watch(n, args[1:])
+    return Status("OK"), true
+  case "UNWATCH":
+    tx.watched = nil
+    return Status("OK"), true
+  }
+  if !tx.active {
+    return nil, false
+  }
+  if err := checkTransactional(args); err != nil {
+    tx.failed = true
+    return err, true
+  }
+  tx.queued = append(tx.queued, args)
+  return Status("QUEUED"), true
+}
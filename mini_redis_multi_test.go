@@ -0,0 +1,166 @@
+// Tests of transactions: MULTI/EXEC over a RESP connection, WATCH aborting
+//   EXEC, the rollback of a batch with a failing command, and /multi.
+// go test -run Multi mini_redis*.go
+
+package main
+import (
+  "context"
+  "net/http"
+  "net/http/httptest"
+  "reflect"
+  "strconv"
+  "strings"
+  "testing"
+)
+
+// handleAll runs the commands through the transaction of a connection and
+//   returns the reply of the last one
+func handleAll(t *testing.T, tx *Transaction, commands ...[]string) interface{} {
+  t.Helper()
+  var reply interface{}
+  for _, args := range commands {
+    var handled bool
+    if reply, handled = tx.handle(context.Background(), 0, args); !handled {
+      reply = execute(0, args)
+    }
+  }
+  return reply
+}
+
+func TestMultiExec(t *testing.T) {
+  resetDatabases()
+  var tx Transaction
+  reply := handleAll(t, &tx,
+    []string{"MULTI"},
+    []string{"SET", "a", "1"},
+    []string{"INCR", "a"},
+    []string{"GET", "a"},
+  )
+  if reply != Status("QUEUED") {
+    t.Fatalf("a command in MULTI got %#v, want QUEUED", reply)
+  }
+  if v := execute(0, []string{"GET", "a"}); v != nil {
+    t.Fatalf("a queued command ran before EXEC: a is %#v", v)
+  }
+  reply = handleAll(t, &tx, []string{"EXEC"})
+  if want := []interface{}{Status("OK"), int64(2), "2"}; !reflect.DeepEqual(reply, want) {
+    t.Fatalf("EXEC got %#v, want %#v", reply, want)
+  }
+  if reply = handleAll(t, &tx, []string{"EXEC"}); !isError(reply, "ERR EXEC without MULTI") {
+    t.Fatalf("EXEC after EXEC got %#v", reply)
+  }
+}
+
+func TestMultiWatchAbort(t *testing.T) {
+  resetDatabases()
+  execute(0, []string{"SET", "k", "1"})
+  var tx Transaction
+  handleAll(t, &tx, []string{"WATCH", "k", "missing"})
+  execute(0, []string{"SET", "k", "2"}) // another client
+  reply := handleAll(t, &tx, []string{"MULTI"}, []string{"SET", "k", "3"}, []string{"SET", "other", "x"}, []string{"EXEC"})
+  if reply != nil {
+    t.Fatalf("EXEC with a changed watched key got %#v, want nil", reply)
+  }
+  runSteps(t, 0, []step{
+    {[]string{"GET", "k"}, "2"},
+    {[]string{"EXISTS", "other"}, 0},
+  })
+
+  // EXEC forgets the watched keys, the next transaction runs
+  reply = handleAll(t, &tx, []string{"MULTI"}, []string{"SET", "k", "3"}, []string{"EXEC"})
+  if !reflect.DeepEqual(reply, []interface{}{Status("OK")}) {
+    t.Fatalf("EXEC got %#v", reply)
+  }
+
+  // a missing watched key that is created aborts too
+  handleAll(t, &tx, []string{"WATCH", "missing"})
+  execute(0, []string{"SET", "missing", "now"})
+  if reply = handleAll(t, &tx, []string{"MULTI"}, []string{"DEL", "missing"}, []string{"EXEC"}); reply != nil {
+    t.Fatalf("EXEC with a created watched key got %#v, want nil", reply)
+  }
+}
+
+func TestMultiRollback(t *testing.T) {
+  resetDatabases()
+  execute(0, []string{"SET", "a", "old"})
+  execute(0, []string{"RPUSH", "l", "x"})
+  mu.Lock()
+  version := keyVersion("a")
+  mu.Unlock()
+  _, err := runTransaction(context.Background(), 0, [][]string{
+    {"SET", "a", "new"},
+    {"SET", "created", "1"},
+    {"RPUSH", "l", "y"},
+    {"INCR", "l"}, // WRONGTYPE
+  }, nil)
+  if err == nil || !strings.HasPrefix(err.Error(), "EXECABORT command 3 failed, transaction rolled back: WRONGTYPE") {
+    t.Fatalf("got %v, want the rollback of command 3", err)
+  }
+  runSteps(t, 0, []step{
+    {[]string{"GET", "a"}, "old"},
+    {[]string{"EXISTS", "created"}, 0},
+    {[]string{"LRANGE", "l", "0", "-1"}, []string{"x"}},
+  })
+  mu.Lock()
+  restored := keyVersion("a")
+  mu.Unlock()
+  if restored != version {
+    t.Fatalf("version of a is %d after the rollback, want %d", restored, version)
+  }
+}
+
+func TestMultiQueueErrors(t *testing.T) {
+  resetDatabases()
+  var tx Transaction
+  reply := handleAll(t, &tx, []string{"MULTI"}, []string{"SET", "a", "1"}, []string{"NOSUCH", "a"})
+  if !isError(reply, "ERR unknown command") {
+    t.Fatalf("an unknown command in MULTI got %#v", reply)
+  }
+  if reply = handleAll(t, &tx, []string{"EXEC"}); !isError(reply, "EXECABORT") {
+    t.Fatalf("EXEC after a queueing error got %#v", reply)
+  }
+  if v := execute(0, []string{"GET", "a"}); v != nil {
+    t.Fatalf("a is %#v, the transaction ran", v)
+  }
+  reply = handleAll(t, &tx, []string{"MULTI"}, []string{"MULTI"})
+  if !isError(reply, "ERR MULTI calls can not be nested") {
+    t.Fatalf("nested MULTI got %#v", reply)
+  }
+  if reply = handleAll(t, &tx, []string{"WATCH", "a"}); !isError(reply, "ERR WATCH inside MULTI") {
+    t.Fatalf("WATCH in MULTI got %#v", reply)
+  }
+  handleAll(t, &tx, []string{"DISCARD"})
+  if reply = handleAll(t, &tx, []string{"DISCARD"}); !isError(reply, "ERR DISCARD without MULTI") {
+    t.Fatalf("DISCARD without MULTI got %#v", reply)
+  }
+}
+
+func TestMultiHTTP(t *testing.T) {
+  resetDatabases()
+  execute(0, []string{"SET", "k", "1"})
+  post := func(body string) *httptest.ResponseRecorder {
+    w := httptest.NewRecorder()
+    serveMulti(w, httptest.NewRequest("POST", "/multi", strings.NewReader(body)))
+    return w
+  }
+  mu.Lock()
+  version := keyVersion("k")
+  mu.Unlock()
+  w := post(`{"watch": {"k": ` + strconv.FormatInt(version, 10) + `}, "commands": [["INCR", "k"], ["GET", "k"]]}`)
+  if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"replies":[2,"2"]}` {
+    t.Fatalf("got %d %s", w.Code, w.Body)
+  }
+  w = post(`{"watch": {"k": ` + strconv.FormatInt(version, 10) + `}, "commands": [["SET", "k", "9"]]}`)
+  if w.Code != http.StatusConflict {
+    t.Fatalf("a stale watch got %d %s, want 409", w.Code, w.Body)
+  }
+  if w = post(`{"commands": [["SET", "k", "3"], ["LPUSH", "k", "x"]]}`); w.Code != http.StatusBadRequest {
+    t.Fatalf("a failing batch got %d %s, want 400", w.Code, w.Body)
+  }
+  runSteps(t, 0, []step{{[]string{"GET", "k"}, "2"}})
+}
+
+func isError(reply interface{}, prefix string) bool {
+  err, ok := reply.(error)
+  return ok && strings.HasPrefix(err.Error(), prefix)
+}
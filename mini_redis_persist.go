@@ -0,0 +1,208 @@
+// Persistence of mini_redis: storage is written to a snapshot file (gob encoded,
+//   so values stay binary safe) every -save interval when it changed, on SAVE
+//   and when the server is stopped, and it is loaded back at startup.
+//   Each logical database has a file of its own (see dbFile).
+// The file is written to a temporary name and renamed, so a crash while
+//   saving never leaves a truncated snapshot behind.
+// The keys are followed by the revision counter, so versions and /watch
+//   revisions keep growing after a restart (files saved before it was there
+//   give the highest version of their keys).
+// With -engine btree the files are page files the keys stay in instead, and
+//   saving commits their changed pages (see mini_redis_btree.go).
+
+package main
+import (
+  "bytes"
+  "encoding/gob"
+  "errors"
+  "io"
+  "log"
+  "os"
+  "os/signal"
+  "strconv"
+  "strings"
+  "syscall"
+  "time"
+)
+
+var dbfile string
+var last_save time.Time
+var last_save_err error // of the last snapshot, for INFO
+
+func init() {
+  register("SAVE", 1, "admin", 0, 0, 0, cmdSave)
+  register("DUMP", 2, "", 1, 1, 1, cmdDump)
+  register("RESTORE", -4, "write", 1, 1, 1, cmdRestore)
+}
+
+// dbFile is the snapshot file of database n: -dbfile for 0, -dbfile.n for the others
+func dbFile(n int) string {
+  if n == 0 {
+    return dbfile
+  }
+  return dbfile + "." + strconv.Itoa(n)
+}
+
+func loadSnapshot() error {
+  data := make([]map[string]*Value, len(databases))
+  var rev int64
+  for i := range data {
+    data[i] = make(map[string]*Value)
+    f, err := os.Open(dbFile(i))
+    if os.IsNotExist(err) {
+      continue
+    }
+    if err != nil {
+      return err
+    }
+    dec := gob.NewDecoder(f)
+    err = dec.Decode(&data[i])
+    var saved int64
+    if err == nil {
+      if err = dec.Decode(&saved); err == io.EOF {
+        err = nil
+      }
+    }
+    f.Close()
+    if err != nil {
+      return err
+    }
+    if saved > rev {
+      rev = saved
+    }
+    for _, v := range data[i] {
+      if v.Version > rev {
+        rev = v.Version
+      }
+    }
+    log.Println("loaded", len(data[i]), "keys from", dbFile(i))
+  }
+  mu.Lock()
+  loadStorage(data, rev)
+  mu.Unlock()
+  return nil
+}
+
+// saveSnapshot writes the databases that changed to their snapshot files;
+//   the caller must hold mu
+func saveSnapshot() error {
+  last_save_err = writeSnapshots()
+  if last_save_err == nil {
+    last_save = time.Now()
+  }
+  return last_save_err
+}
+
+func writeSnapshots() error {
+  for i, d := range databases {
+    if d.dirty == 0 {
+      continue
+    }
+    if t, ok := d.storage.(*BTree); ok {
+      if err := t.commit(revision); err != nil {
+        return err
+      }
+      d.dirty = 0
+      continue
+    }
+    var buf bytes.Buffer
+    enc := gob.NewEncoder(&buf)
+    if err := enc.Encode(storeMap(d.storage)); err != nil {
+      return err
+    }
+    if err := enc.Encode(revision); err != nil {
+      return err
+    }
+    tmp := dbFile(i) + ".tmp"
+    if err := os.WriteFile(tmp, buf.Bytes(), 0644); err != nil {
+      return err
+    }
+    if err := os.Rename(tmp, dbFile(i)); err != nil {
+      return err
+    }
+    d.dirty = 0
+  }
+  return nil
+}
+
+func saveLoop(every time.Duration) {
+  for range time.Tick(every) {
+    mu.Lock()
+    if err := saveSnapshot(); err != nil {
+      log.Println("snapshot failed:", err)
+    }
+    mu.Unlock()
+  }
+}
+
+// take a last snapshot when the server is interrupted or terminated
+func saveOnExit() {
+  c := make(chan os.Signal, 1)
+  signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+  <-c
+  mu.Lock()
+  if err := saveSnapshot(); err != nil {
+    log.Println("snapshot failed:", err)
+    os.Exit(1)
+  }
+  os.Exit(0)
+}
+
+// DUMP key: the value serialized like in snapshots, for RESTORE on another node
+func cmdDump(args []string) interface{} {
+  v := get(args[1])
+  if v == nil {
+    return nil
+  }
+  var buf bytes.Buffer
+  if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+    return errors.New("ERR " + err.Error())
+  }
+  return buf.String()
+}
+
+// RESTORE key ttl serialized-value [REPLACE] [ABSTTL]: ttl is in milliseconds,
+//   0 for none, or a unix time in milliseconds with ABSTTL
+func cmdRestore(args []string) interface{} {
+  ttl, err := strconv.ParseInt(args[2], 10, 64)
+  if err != nil || ttl < 0 {
+    return errors.New("ERR Invalid TTL value, must be >= 0")
+  }
+  replace, absttl := false, false
+  for _, opt := range args[4:] {
+    switch strings.ToUpper(opt) {
+    case "REPLACE":
+      replace = true
+    case "ABSTTL":
+      absttl = true
+    default:
+      return errors.New("ERR syntax error")
+    }
+  }
+  if !replace && get(args[1]) != nil {
+    return errors.New("BUSYKEY Target key name already exists.")
+  }
+  var v Value
+  if err := gob.NewDecoder(strings.NewReader(args[3])).Decode(&v); err != nil {
+    return errors.New("ERR DUMP payload version or checksum are wrong")
+  }
+  v.Expires = 0
+  storage.put(args[1], &v)
+  if ttl > 0 {
+    if !absttl {
+      ttl += now()
+    }
+    setExpires(args[1], ttl)
+  }
+  return Status("OK")
+}
+
+func cmdSave(args []string) interface{} {
+  if dbfile == "" {
+    return errors.New("ERR persistence is disabled")
+  }
+  if err := saveSnapshot(); err != nil {
+    return errors.New("ERR " + err.Error())
+  }
+  return Status("OK")
+}
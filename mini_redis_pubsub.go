@@ -0,0 +1,204 @@
+// Publish/subscribe of mini_redis, a lightweight message bus.
+// PUBLISH is a regular command; subscribers are either RESP connections in
+//   subscribe mode (SUBSCRIBE / PSUBSCRIBE) or HTTP clients reading a
+//   Server-Sent Events stream from /subscribe (see serveSubscribe).
+// Every subscriber has a bounded buffer; a subscriber that falls behind by
+//   more than subscriber_buffer messages is dropped instead of slowing down
+//   the publishers.
+
+package main
+import (
+  "errors"
+  "strings"
+  "sync"
+)
+
+const subscriber_buffer = 256
+
+type Message struct {
+  Pattern string `json:"pattern,omitempty"` // the pattern that matched, empty for channel subscriptions
+  Channel string `json:"channel"`
+  Payload string `json:"message"`
+}
+
+type Subscriber struct {
+  messages chan Message
+  dropped chan struct{} // closed when the subscriber was dropped for being too slow
+  channels map[string]bool
+  patterns map[string]bool
+}
+
+// pubsub_mu guards subscribers and the channels/patterns of every subscriber
+var pubsub_mu sync.Mutex
+var subscribers = make(map[*Subscriber]bool)
+
+func init() {
+  register("PUBLISH", 3, "", 0, 0, 0, cmdPublish)
+}
+
+func newSubscriber() *Subscriber {
+  return &Subscriber{
+    messages: make(chan Message, subscriber_buffer),
+    dropped: make(chan struct{}),
+    channels: make(map[string]bool),
+    patterns: make(map[string]bool),
+  }
+}
+
+// subscribe adds channels (or patterns) and returns the total number of subscriptions
+func (s *Subscriber) subscribe(names []string, pattern bool) []int {
+  pubsub_mu.Lock()
+  defer pubsub_mu.Unlock()
+  counts := []int{}
+  for _, name := range names {
+    if pattern {
+      s.patterns[name] = true
+    } else {
+      s.channels[name] = true
+    }
+    counts = append(counts, len(s.channels) + len(s.patterns))
+  }
+  subscribers[s] = true
+  return counts
+}
+
+// unsubscribe removes the channels (or patterns), all of them when names is empty,
+//   and returns the names removed with the number of subscriptions left after each
+func (s *Subscriber) unsubscribe(names []string, pattern bool) ([]string, []int) {
+  pubsub_mu.Lock()
+  defer pubsub_mu.Unlock()
+  set := s.channels
+  if pattern {
+    set = s.patterns
+  }
+  if len(names) == 0 {
+    for name := range set {
+      names = append(names, name)
+    }
+  }
+  counts := []int{}
+  for _, name := range names {
+    delete(set, name)
+    counts = append(counts, len(s.channels) + len(s.patterns))
+  }
+  if len(s.channels) + len(s.patterns) == 0 {
+    delete(subscribers, s)
+  }
+  return names, counts
+}
+
+// close removes every subscription
+func (s *Subscriber) close() {
+  pubsub_mu.Lock()
+  defer pubsub_mu.Unlock()
+  delete(subscribers, s)
+}
+
+// publish delivers payload to every subscriber of channel and returns how many got it;
+//   a pattern is matched in O(len(pattern) * len(channel)) (see globMatch), so
+//   one a client crafted can not hold up the publishers
+func publish(channel, payload string) int {
+  pubsub_mu.Lock()
+  defer pubsub_mu.Unlock()
+  count := 0
+  for s := range subscribers {
+    if s.channels[channel] {
+      if s.deliver(Message{"", channel, payload}) {
+        count++
+      }
+    }
+    for pattern := range s.patterns {
+      if globMatch(pattern, channel) && s.deliver(Message{pattern, channel, payload}) {
+        count++
+      }
+    }
+  }
+  return count
+}
+
+// deliver queues the message without blocking; a full buffer drops the subscriber.
+// The caller must hold pubsub_mu.
+func (s *Subscriber) deliver(m Message) bool {
+  if !subscribers[s] {
+    return false
+  }
+  select {
+  case s.messages <- m:
+    return true
+  default:
+    delete(subscribers, s)
+    close(s.dropped)
+    return false
+  }
+}
+
+func cmdPublish(args []string) interface{} {
+  return publish(args[1], args[2])
+}
+
+// pub/sub commands of a RESP connection, each subscribed or unsubscribed
+//   channel gets its own reply as in Redis
+func (c *Client) pubsubCommand(args []string) interface{} {
+  name := strings.ToLower(args[0])
+  pattern := name == "psubscribe" || name == "punsubscribe"
+  switch name {
+  case "subscribe", "psubscribe":
+    if len(args) < 2 {
+      return errors.New("ERR wrong number of arguments for '" + name + "' command")
+    }
+    if c.sub == nil {
+      c.sub = newSubscriber()
+      go c.forward(c.sub)
+    }
+    replies := Replies{}
+    for i, count := range c.sub.subscribe(args[1:], pattern) {
+      replies = append(replies, []interface{}{name, args[i+1], count})
+    }
+    return replies
+  default: // unsubscribe, punsubscribe
+    if c.sub == nil {
+      return Replies{[]interface{}{name, nil, 0}}
+    }
+    names, counts := c.sub.unsubscribe(args[1:], pattern)
+    if len(names) == 0 {
+      return Replies{[]interface{}{name, nil, 0}}
+    }
+    replies := Replies{}
+    for i, count := range counts {
+      replies = append(replies, []interface{}{name, names[i], count})
+    }
+    return replies
+  }
+}
+
+// forward writes the messages of the subscriber to the connection,
+//   and disconnects the client when it was dropped for being too slow
+func (c *Client) forward(s *Subscriber) {
+  go func() {
+    // closing the connection also unblocks a write stuck on the slow client
+    select {
+    case <-s.dropped:
+      c.conn.Close()
+    case <-c.done:
+    }
+  }()
+  for {
+    select {
+    case m := <-s.messages:
+      c.wmu.Lock()
+      if m.Pattern == "" {
+        writeReply(c.w, []interface{}{"message", m.Channel, m.Payload})
+      } else {
+        writeReply(c.w, []interface{}{"pmessage", m.Pattern, m.Channel, m.Payload})
+      }
+      if len(s.messages) == 0 {
+        c.w.Flush()
+      }
+      c.wmu.Unlock()
+    case <-s.dropped:
+      return
+    case <-c.done:
+      return
+    }
+  }
+}
@@ -0,0 +1,44 @@
+// Tests of publish/subscribe: delivery to channel and pattern subscribers.
+// go test -run Publish mini_redis*.go
+
+package main
+import (
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestPublishPatterns(t *testing.T) {
+  s := newSubscriber()
+  s.subscribe([]string{"news.sport"}, false)
+  s.subscribe([]string{"news.*", "weather.*"}, true)
+  defer s.close()
+  if n := publish("news.sport", "goal"); n != 2 {
+    t.Fatalf("publish to news.sport reached %d subscriptions, want 2", n)
+  }
+  if n := publish("news.art", "show"); n != 1 {
+    t.Fatalf("publish to news.art reached %d subscriptions, want 1", n)
+  }
+  if n := publish("sport", "goal"); n != 0 {
+    t.Fatalf("publish to sport reached %d subscriptions, want 0", n)
+  }
+  want := []Message{{"", "news.sport", "goal"}, {"news.*", "news.sport", "goal"}, {"news.*", "news.art", "show"}}
+  for i := range want {
+    if m := <-s.messages; m != want[i] {
+      t.Fatalf("message %d: %+v, want %+v", i, m, want[i])
+    }
+  }
+}
+
+func TestPublishManyStarPattern(t *testing.T) {
+  s := newSubscriber()
+  s.subscribe([]string{strings.Repeat("*a", 12) + "*b"}, true)
+  defer s.close()
+  start := time.Now()
+  if n := publish(strings.Repeat("a", 40), "x"); n != 0 {
+    t.Fatalf("the pattern matched")
+  }
+  if d := time.Since(start); d > 100 * time.Millisecond {
+    t.Fatalf("publish took %v", d)
+  }
+}
@@ -0,0 +1,747 @@
+// Raft mode of mini_redis: with -raft host:port,host:port,... (the HTTP
+//   addresses of all the members, -raftid being the one of this node) a small
+//   cluster of nodes agrees on the order of every write with Raft: leader
+//   election, log replication and log compaction with snapshots.
+// A write is only applied, on every node, once a majority has it in its log,
+//   so an acknowledged write survives the loss of a minority of the nodes.
+//   Writes sent to a follower are refused with NOTLEADER over RESP and
+//   redirected to the leader (307) over HTTP. Reads are served by the node
+//   that gets them, so a follower may return slightly stale data.
+// Log entries carry the clock of the leader, which is used as the current time
+//   while they are applied, so TTLs and expirations come out the same on every
+//   node; the leader's sweeper expires keys through the log as well.
+// Term, vote and log are saved in -raftdir before any message goes out, the
+//   snapshot next to them. The members are fixed at startup.
+//
+// The algorithm itself (Raft below) does no I/O and takes its randomness from
+//   a seed: it is driven by tick, step and propose, and hands back the messages
+//   to send in outbox, so the tests run it in a simulated network with cut
+//   links and lost messages (see mini_redis_raft_test.go).
+//
+// Try it with three processes:
+//   ./mini_redis -http :8082 -resp :6380 -raft localhost:8082,localhost:8083,localhost:8084 -raftid localhost:8082 -raftdir raft1
+//   (same with :8083/:6381/raft2 and :8084/:6382/raft3)
+//   curl localhost:8082/raft/status
+
+package main
+import (
+  "bytes"
+  "encoding/gob"
+  "encoding/json"
+  "errors"
+  "log"
+  "math/rand"
+  "net/http"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync"
+  "time"
+)
+
+const raft_tick = 50 * time.Millisecond
+const election_ticks = 10 // election timeout is between 1x and 2x this
+const heartbeat_ticks = 2
+const max_append = 256 // entries per append message
+const raft_snapshot_every = 1000 // applied entries kept in the log before compacting
+const raft_commit_timeout = 5 * time.Second
+
+// one entry of the replicated log: a command, a transaction (Multi) or keys to
+//   expire, applied when Watch still holds; an entry with none of them is the
+//   no-op a new leader appends
+type RaftEntry struct {
+  Term int64
+  Index int64
+  Time int64 // clock of the leader in unix milliseconds, now() while applying
+  Db int
+  Batch [][]string
+  User string // who proposed it, for the commands of a script
+  Multi bool
+  Watch map[string]int64
+  Expire []string
+}
+
+// messages between members; they are one-way, a reply is a message of its own
+type RaftMessage struct {
+  Type string // "vote", "vote_reply", "append", "append_reply" or "snapshot"
+  From string
+  To string
+  Term int64
+  Index int64 // vote: last log entry; append: entry before Entries; snapshot: last entry it includes
+  LogTerm int64 // term of the entry at Index
+  Entries []RaftEntry
+  Commit int64
+  Ok bool // vote_reply: vote granted; append_reply: the log matched
+  Match int64 // append_reply: last index known to be in the follower's log
+  Snapshot []byte
+}
+
+// state of a member; log[0] stands for the last entry covered by the snapshot
+type Raft struct {
+  id string
+  peers []string // the other members
+  term int64
+  vote string
+  log []RaftEntry
+  snapshot []byte
+  commit int64
+  applied int64
+  role string // "follower", "candidate" or "leader"
+  leader string
+  elapsed int
+  timeout int
+  rand *rand.Rand
+  votes map[string]bool
+  next map[string]int64
+  match map[string]int64
+  outbox []RaftMessage
+  changed bool // term, vote or log must be saved before the outbox is sent
+  restore bool // snapshot was installed, storage must be loaded from it
+}
+
+func newRaft(id string, peers []string, seed int64) *Raft {
+  r := &Raft{id: id, peers: peers, log: []RaftEntry{{}}, role: "follower", rand: rand.New(rand.NewSource(seed))}
+  r.resetTimer()
+  return r
+}
+
+func (r *Raft) first() int64 {
+  return r.log[0].Index
+}
+
+func (r *Raft) last() int64 {
+  return r.log[len(r.log)-1].Index
+}
+
+// termAt returns the term of entry i, false when it is not in the log
+func (r *Raft) termAt(i int64) (int64, bool) {
+  if i < r.first() || i > r.last() {
+    return 0, false
+  }
+  return r.log[i - r.first()].Term, true
+}
+
+func (r *Raft) quorum() int {
+  return (len(r.peers) + 1) / 2 + 1
+}
+
+func (r *Raft) resetTimer() {
+  r.elapsed = 0
+  r.timeout = election_ticks + r.rand.Intn(election_ticks)
+}
+
+func (r *Raft) send(m RaftMessage) {
+  m.From = r.id
+  m.Term = r.term
+  r.outbox = append(r.outbox, m)
+}
+
+// tick advances the clock by one raft_tick
+func (r *Raft) tick() {
+  r.elapsed++
+  if r.role == "leader" {
+    if r.elapsed >= heartbeat_ticks {
+      r.elapsed = 0
+      r.broadcast()
+    }
+    return
+  }
+  if r.elapsed >= r.timeout {
+    r.campaign()
+  }
+}
+
+func (r *Raft) campaign() {
+  r.term++
+  r.role = "candidate"
+  r.leader = ""
+  r.vote = r.id
+  r.votes = map[string]bool{r.id: true}
+  r.changed = true
+  r.resetTimer()
+  if len(r.votes) >= r.quorum() {
+    r.becomeLeader()
+    return
+  }
+  lastTerm, _ := r.termAt(r.last())
+  for _, peer := range r.peers {
+    r.send(RaftMessage{Type: "vote", To: peer, Index: r.last(), LogTerm: lastTerm})
+  }
+}
+
+func (r *Raft) becomeFollower(term int64, leader string) {
+  if term != r.term {
+    r.term = term
+    r.vote = ""
+    r.changed = true
+  }
+  r.role = "follower"
+  r.leader = leader
+}
+
+func (r *Raft) becomeLeader() {
+  r.role = "leader"
+  r.leader = r.id
+  r.next = make(map[string]int64)
+  r.match = make(map[string]int64)
+  for _, peer := range r.peers {
+    r.next[peer] = r.last() + 1
+  }
+  // entries of earlier terms only commit along with one of the current term
+  r.propose(RaftEntry{})
+}
+
+// propose appends an entry to the log of the leader, returning its index
+func (r *Raft) propose(e RaftEntry) (int64, bool) {
+  if r.role != "leader" {
+    return 0, false
+  }
+  e.Term = r.term
+  e.Index = r.last() + 1
+  r.log = append(r.log, e)
+  r.changed = true
+  r.advanceCommit()
+  r.broadcast()
+  return e.Index, true
+}
+
+func (r *Raft) broadcast() {
+  for _, peer := range r.peers {
+    r.sendAppend(peer)
+  }
+}
+
+// sendAppend sends the entries the peer is missing, or the snapshot when
+//   they were compacted away
+func (r *Raft) sendAppend(peer string) {
+  next := r.next[peer]
+  if next <= r.first() {
+    r.send(RaftMessage{Type: "snapshot", To: peer, Index: r.first(), LogTerm: r.log[0].Term, Snapshot: r.snapshot})
+    return
+  }
+  prevTerm, _ := r.termAt(next - 1)
+  entries := r.log[next - r.first():]
+  if len(entries) > max_append {
+    entries = entries[:max_append]
+  }
+  r.send(RaftMessage{Type: "append", To: peer, Index: next - 1, LogTerm: prevTerm,
+    Entries: append([]RaftEntry{}, entries...), Commit: r.commit})
+}
+
+// advanceCommit commits the last entry of the current term a majority has
+func (r *Raft) advanceCommit() {
+  for n := r.last(); n > r.commit; n-- {
+    if term, _ := r.termAt(n); term != r.term {
+      return
+    }
+    count := 1
+    for _, peer := range r.peers {
+      if r.match[peer] >= n {
+        count++
+      }
+    }
+    if count >= r.quorum() {
+      r.commit = n
+      return
+    }
+  }
+}
+
+// step handles a message from another member
+func (r *Raft) step(m RaftMessage) {
+  if m.Term > r.term {
+    leader := ""
+    if m.Type == "append" || m.Type == "snapshot" {
+      leader = m.From
+    }
+    r.becomeFollower(m.Term, leader)
+  }
+  if m.Term < r.term {
+    // tell a stale leader or candidate about the new term
+    switch m.Type {
+    case "vote":
+      r.send(RaftMessage{Type: "vote_reply", To: m.From})
+    case "append", "snapshot":
+      r.send(RaftMessage{Type: "append_reply", To: m.From, Match: -1})
+    }
+    return
+  }
+  switch m.Type {
+  case "vote":
+    lastTerm, _ := r.termAt(r.last())
+    upToDate := m.LogTerm > lastTerm || (m.LogTerm == lastTerm && m.Index >= r.last())
+    granted := (r.vote == "" || r.vote == m.From) && upToDate
+    if granted {
+      r.vote = m.From
+      r.changed = true
+      r.resetTimer()
+    }
+    r.send(RaftMessage{Type: "vote_reply", To: m.From, Ok: granted})
+  case "vote_reply":
+    if r.role == "candidate" && m.Ok {
+      r.votes[m.From] = true
+      if len(r.votes) >= r.quorum() {
+        r.becomeLeader()
+      }
+    }
+  case "append":
+    r.becomeFollower(m.Term, m.From)
+    r.resetTimer()
+    r.handleAppend(m)
+  case "append_reply":
+    if r.role != "leader" || m.Match < 0 {
+      return
+    }
+    if m.Ok {
+      if m.Match > r.match[m.From] {
+        r.match[m.From] = m.Match
+        r.advanceCommit()
+      }
+      r.next[m.From] = r.match[m.From] + 1
+      if r.next[m.From] <= r.last() {
+        r.sendAppend(m.From)
+      }
+      return
+    }
+    // the follower's log is shorter or diverges: go back to what it has
+    next := m.Match + 1
+    if next >= r.next[m.From] {
+      next = r.next[m.From] - 1
+    }
+    if next < 1 {
+      next = 1
+    }
+    r.next[m.From] = next
+    r.sendAppend(m.From)
+  case "snapshot":
+    r.becomeFollower(m.Term, m.From)
+    r.resetTimer()
+    if m.Index > r.commit {
+      r.log = []RaftEntry{{Term: m.LogTerm, Index: m.Index}}
+      r.snapshot = m.Snapshot
+      r.commit = m.Index
+      r.changed = true
+      r.restore = true
+    }
+    r.send(RaftMessage{Type: "append_reply", To: m.From, Ok: true, Match: r.commit})
+  }
+}
+
+func (r *Raft) handleAppend(m RaftMessage) {
+  prev, prevTerm, entries := m.Index, m.LogTerm, m.Entries
+  // entries up to the snapshot are committed, so they match
+  for len(entries) > 0 && entries[0].Index <= r.first() {
+    prev, prevTerm, entries = entries[0].Index, entries[0].Term, entries[1:]
+  }
+  if prev < r.first() {
+    prev, prevTerm = r.first(), r.log[0].Term
+  }
+  if term, ok := r.termAt(prev); !ok || term != prevTerm {
+    hint := prev - 1
+    if prev > r.last() {
+      hint = r.last()
+    }
+    r.send(RaftMessage{Type: "append_reply", To: m.From, Match: hint})
+    return
+  }
+  for _, e := range entries {
+    if term, ok := r.termAt(e.Index); ok {
+      if term == e.Term {
+        continue
+      }
+      r.log = r.log[:e.Index - r.first()]
+    }
+    r.log = append(r.log, e)
+    r.changed = true
+  }
+  match := prev + int64(len(entries))
+  if m.Commit > r.commit {
+    r.commit = m.Commit
+    if r.commit > match {
+      r.commit = match
+    }
+  }
+  r.send(RaftMessage{Type: "append_reply", To: m.From, Ok: true, Match: match})
+}
+
+// compact drops the log up to index, which the snapshot data now covers
+func (r *Raft) compact(index int64, data []byte) {
+  term, _ := r.termAt(index)
+  r.log = append([]RaftEntry{{Term: term, Index: index}}, r.log[index - r.first() + 1:]...)
+  r.snapshot = data
+  r.changed = true
+}
+
+// what follows runs the algorithm for real: timers, HTTP transport, disk and
+//   applying the committed entries to storage
+
+var raft *Raft
+var raft_mu sync.Mutex // guards raft and raft_waiting; taken before mu
+var raft_dir string
+var raft_outgoing map[string]chan RaftMessage
+
+// set to the time of the entry being applied, 0 otherwise (guarded by mu)
+var raft_time int64
+
+// writes waiting for their entry to be applied, by index
+type RaftProposal struct {
+  term int64
+  done chan interface{}
+}
+var raft_waiting = make(map[int64]*RaftProposal)
+
+// what is saved in -raftdir
+type RaftState struct {
+  Term int64
+  Vote string
+  Log []RaftEntry
+}
+
+type RaftSnapshot struct {
+  Revision int64
+  Databases []map[string]*Value
+}
+
+// startRaft loads the saved state and starts the timers and the transport
+func startRaft(id string, members []string, dir string) error {
+  peers := []string{}
+  for _, member := range members {
+    if member != id {
+      peers = append(peers, member)
+    }
+  }
+  if len(peers) == len(members) {
+    return errors.New("-raftid " + id + " is not one of the -raft members")
+  }
+  if err := os.MkdirAll(dir, 0755); err != nil {
+    return err
+  }
+  raft_dir = dir
+  raft = newRaft(id, peers, time.Now().UnixNano())
+  if err := loadRaft(); err != nil {
+    return err
+  }
+  raft_outgoing = make(map[string]chan RaftMessage)
+  for _, peer := range peers {
+    raft_outgoing[peer] = make(chan RaftMessage, 256)
+    go sendRaftMessages(peer, raft_outgoing[peer])
+  }
+  go func() {
+    for range time.Tick(raft_tick) {
+      raft_mu.Lock()
+      raft.tick()
+      processRaft()
+      raft_mu.Unlock()
+    }
+  }()
+  return nil
+}
+
+func loadRaft() error {
+  var snap RaftSnapshot
+  data, err := os.ReadFile(filepath.Join(raft_dir, "snapshot.gob"))
+  if err == nil {
+    var meta RaftEntry
+    dec := gob.NewDecoder(bytes.NewReader(data))
+    if err := dec.Decode(&meta); err != nil {
+      return err
+    }
+    if err := dec.Decode(&snap); err != nil {
+      return err
+    }
+    raft.log = []RaftEntry{meta}
+    raft.snapshot = data
+    raft.commit, raft.applied = meta.Index, meta.Index
+    mu.Lock()
+    loadStorage(snap.Databases, snap.Revision)
+    mu.Unlock()
+  } else if !os.IsNotExist(err) {
+    return err
+  }
+  f, err := os.Open(filepath.Join(raft_dir, "state.gob"))
+  if os.IsNotExist(err) {
+    return nil
+  }
+  if err != nil {
+    return err
+  }
+  defer f.Close()
+  var state RaftState
+  if err := gob.NewDecoder(f).Decode(&state); err != nil {
+    return err
+  }
+  raft.term, raft.vote = state.Term, state.Vote
+  // the state may be older than the snapshot when we stopped in between
+  for _, e := range state.Log {
+    if e.Index > raft.last() {
+      raft.log = append(raft.log, e)
+    }
+  }
+  log.Println("raft: term", raft.term, "log", raft.first(), "to", raft.last())
+  return nil
+}
+
+// writeFileSync replaces file with data once it is on disk
+func writeFileSync(file string, data []byte) error {
+  tmp := file + ".tmp"
+  f, err := os.Create(tmp)
+  if err != nil {
+    return err
+  }
+  if _, err := f.Write(data); err != nil {
+    f.Close()
+    return err
+  }
+  if err := f.Sync(); err != nil {
+    f.Close()
+    return err
+  }
+  if err := f.Close(); err != nil {
+    return err
+  }
+  return os.Rename(tmp, file)
+}
+
+func saveRaftState() {
+  var buf bytes.Buffer
+  check(gob.NewEncoder(&buf).Encode(RaftState{raft.term, raft.vote, raft.log}))
+  // going on without it could break the promises made to the other members
+  check(writeFileSync(filepath.Join(raft_dir, "state.gob"), buf.Bytes()))
+}
+
+// processRaft does what the last call to the algorithm asks for; the caller holds raft_mu
+func processRaft() {
+  if raft.restore {
+    check(writeFileSync(filepath.Join(raft_dir, "snapshot.gob"), raft.snapshot))
+  }
+  if raft.changed {
+    saveRaftState()
+    raft.changed = false
+  }
+  for _, m := range raft.outbox {
+    select {
+    case raft_outgoing[m.To] <- m:
+    default: // lost messages are resent by the algorithm
+    }
+  }
+  raft.outbox = nil
+
+  if !raft.restore && raft.commit <= raft.applied {
+    return
+  }
+  mu.Lock()
+  defer mu.Unlock()
+  if raft.restore {
+    raft.restore = false
+    var meta RaftEntry
+    var snap RaftSnapshot
+    dec := gob.NewDecoder(bytes.NewReader(raft.snapshot))
+    check(dec.Decode(&meta))
+    check(dec.Decode(&snap))
+    loadStorage(snap.Databases, snap.Revision)
+    raft.applied = meta.Index
+    for index, p := range raft_waiting {
+      if index <= meta.Index {
+        p.done <- errors.New("ERR write lost, the leader changed")
+        delete(raft_waiting, index)
+      }
+    }
+  }
+  for raft.applied < raft.commit {
+    e := raft.log[raft.applied + 1 - raft.first()]
+    reply := applyRaftEntry(e)
+    raft.applied = e.Index
+    if p, ok := raft_waiting[e.Index]; ok {
+      if p.term != e.Term {
+        reply = errors.New("ERR write lost, the leader changed")
+      }
+      p.done <- reply
+      delete(raft_waiting, e.Index)
+    }
+  }
+  if raft.applied - raft.first() >= raft_snapshot_every {
+    term, _ := raft.termAt(raft.applied)
+    var buf bytes.Buffer
+    enc := gob.NewEncoder(&buf)
+    check(enc.Encode(RaftEntry{Term: term, Index: raft.applied}))
+    check(enc.Encode(RaftSnapshot{revision, snapshot()}))
+    check(writeFileSync(filepath.Join(raft_dir, "snapshot.gob"), buf.Bytes()))
+    raft.compact(raft.applied, buf.Bytes())
+    saveRaftState()
+    raft.changed = false
+  }
+}
+
+// applyRaftEntry applies a committed entry to storage; the caller holds mu
+func applyRaftEntry(e RaftEntry) interface{} {
+  selectDB(e.Db)
+  raft_time, caller = e.Time, e.User
+  defer func() { raft_time = 0 }()
+  for _, key := range e.Expire {
+    get(key) // deletes it when it is still expired at the time of the entry
+  }
+  if e.Multi {
+    replies, err := applyTransaction(e.Batch, e.Watch)
+    if err != nil {
+      return err
+    }
+    return replies
+  }
+  for key, version := range e.Watch {
+    if keyVersion(key) != version {
+      return errWatch
+    }
+  }
+  if len(e.Batch) == 0 {
+    return nil
+  }
+  return call(e.Batch[0])
+}
+
+// raftPropose has the leader append the entry to the log and waits until it
+//   is applied, returning the reply of the command
+func raftPropose(e RaftEntry) interface{} {
+  e.Time = time.Now().UnixNano() / int64(time.Millisecond)
+  raft_mu.Lock()
+  index, ok := raft.propose(e)
+  if !ok {
+    leader := raft.leader
+    raft_mu.Unlock()
+    return notLeader(leader)
+  }
+  p := &RaftProposal{raft.term, make(chan interface{}, 1)}
+  raft_waiting[index] = p
+  processRaft()
+  raft_mu.Unlock()
+
+  select {
+  case reply := <-p.done:
+    return reply
+  case <-time.After(raft_commit_timeout):
+    raft_mu.Lock()
+    delete(raft_waiting, index)
+    raft_mu.Unlock()
+    return errors.New("ERR timed out waiting for a majority, the write may or may not be applied")
+  }
+}
+
+func notLeader(leader string) error {
+  if leader == "" {
+    return errors.New("NOTLEADER no leader elected yet")
+  }
+  return errors.New("NOTLEADER the leader is " + leader)
+}
+
+// raftExpire has the leader expire keys of database n through the log, without waiting
+func raftExpire(n int, keys []string) {
+  raft_mu.Lock()
+  defer raft_mu.Unlock()
+  if _, ok := raft.propose(RaftEntry{Time: time.Now().UnixNano() / int64(time.Millisecond), Db: n, Expire: keys}); ok {
+    processRaft()
+  }
+}
+
+// sweepRaft is the sweeper of a raft node: the leader has the expired keys
+//   deleted through the log, the others wait for it
+func sweepRaft() {
+  if _, is_leader := raftLeader(); !is_leader {
+    return
+  }
+  mu.Lock()
+  t := now()
+  expired := make(map[int][]string)
+  for i := range databases {
+    selectDB(i)
+    for key := range expires {
+      v, ok := storage.get(key)
+      if !ok || v.Expires == 0 {
+        delete(expires, key)
+      } else if v.Expires <= t {
+        expired[i] = append(expired[i], key)
+      }
+    }
+    storage.release()
+  }
+  mu.Unlock()
+  for i, keys := range expired {
+    raftExpire(i, keys)
+  }
+}
+
+func raftLeader() (string, bool) {
+  raft_mu.Lock()
+  defer raft_mu.Unlock()
+  return raft.leader, raft.role == "leader"
+}
+
+func sendRaftMessages(peer string, messages chan RaftMessage) {
+  client := &http.Client{Timeout: time.Second}
+  for m := range messages {
+    var buf bytes.Buffer
+    check(gob.NewEncoder(&buf).Encode(m))
+    req, err := http.NewRequest("POST", "http://" + peer + "/raft/message", &buf)
+    check(err)
+    setNodeAuth(req)
+    resp, err := client.Do(req)
+    if err != nil {
+      continue // the peer is down, the algorithm retries
+    }
+    resp.Body.Close()
+  }
+}
+
+// serveRaftMessage takes a message from another member: POST /raft/message
+func serveRaftMessage(w http.ResponseWriter, req *http.Request) {
+  if raft == nil {
+    http.Error(w, "this instance is not in raft mode", http.StatusNotFound)
+    return
+  }
+  if !allowed(w, req, []string{"RAFT"}) {
+    return
+  }
+  var m RaftMessage
+  if err := gob.NewDecoder(req.Body).Decode(&m); err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  raft_mu.Lock()
+  raft.step(m)
+  processRaft()
+  raft_mu.Unlock()
+}
+
+// serveRaftStatus shows the state of this member: GET /raft/status
+func serveRaftStatus(w http.ResponseWriter, req *http.Request) {
+  if raft == nil {
+    http.Error(w, "this instance is not in raft mode", http.StatusNotFound)
+    return
+  }
+  if !allowed(w, req, []string{"ROLE"}) {
+    return
+  }
+  raft_mu.Lock()
+  status := map[string]interface{}{"id": raft.id, "role": raft.role, "term": raft.term, "leader": raft.leader,
+    "commit": raft.commit, "applied": raft.applied, "first": raft.first(), "last": raft.last()}
+  raft_mu.Unlock()
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(status)
+}
+
+// raftRedirect sends the requests that may write to the leader, reads are
+//   served here
+func raftRedirect(handler http.HandlerFunc) http.HandlerFunc {
+  return func(w http.ResponseWriter, req *http.Request) {
+    if cmd, ok := commands[strings.ToUpper(req.Method)]; raft == nil || req.Method == "GET" || req.Method == "HEAD" || (ok && !cmd.has("write")) {
+      handler(w, req)
+      return
+    }
+    leader, is_leader := raftLeader()
+    if is_leader {
+      handler(w, req)
+    } else if leader == "" {
+      http.Error(w, "no leader elected yet", http.StatusServiceUnavailable)
+    } else {
+      http.Redirect(w, req, "http://" + leader + req.RequestURI, http.StatusTemporaryRedirect) // with the /db/{n} prefix
+    }
+  }
+}
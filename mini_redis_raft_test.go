@@ -0,0 +1,402 @@
+// Tests of the Raft algorithm of mini_redis, in a simulated network: the
+//   members run in the test, messages go through a queue delivered in a
+//   random order, and links can be cut or lose messages. All the randomness
+//   comes from the seed, so a failure is replayed by running the test again.
+// go test -run Raft mini_redis*.go
+
+package main
+import (
+  "bytes"
+  "encoding/gob"
+  "math/rand"
+  "sort"
+  "strconv"
+  "strings"
+  "testing"
+)
+
+// raftNetwork is a cluster of members linked by an in-memory network; what
+//   processRaft does for real (applying entries, snapshots) it does with a log
+//   of the applied commands as the state
+type raftNetwork struct {
+  t *testing.T
+  ids []string
+  nodes map[string]*Raft
+  rand *rand.Rand
+  queue []RaftMessage
+  cut map[string]bool // "from>to" links that lose every message
+  drop float64 // probability to lose any message
+  snapshot_every int64 // applied entries kept before compacting, 0 for never
+  applied map[string][]string // commands applied by each member, in order
+  restores map[string]int // snapshots installed by each member
+}
+
+func newRaftNetwork(t *testing.T, n int, seed int64) *raftNetwork {
+  net := &raftNetwork{t: t, nodes: make(map[string]*Raft), rand: rand.New(rand.NewSource(seed)),
+    cut: make(map[string]bool), applied: make(map[string][]string), restores: make(map[string]int)}
+  for i := 1; i <= n; i++ {
+    net.ids = append(net.ids, "n" + strconv.Itoa(i))
+  }
+  for i, id := range net.ids {
+    peers := []string{}
+    for _, peer := range net.ids {
+      if peer != id {
+        peers = append(peers, peer)
+      }
+    }
+    net.nodes[id] = newRaft(id, peers, seed + int64(i))
+  }
+  return net
+}
+
+// process does what processRaft does after each call to the algorithm
+func (net *raftNetwork) process(id string) {
+  r := net.nodes[id]
+  net.queue = append(net.queue, r.outbox...)
+  r.outbox, r.changed = nil, false
+  if r.restore {
+    r.restore = false
+    var applied []string
+    if err := gob.NewDecoder(bytes.NewReader(r.snapshot)).Decode(&applied); err != nil {
+      net.t.Fatalf("%s: bad snapshot: %v", id, err)
+    }
+    net.applied[id] = applied
+    r.applied = r.first()
+    net.restores[id]++
+  }
+  for r.applied < r.commit {
+    e := r.log[r.applied + 1 - r.first()]
+    if len(e.Batch) > 0 {
+      net.applied[id] = append(net.applied[id], strings.Join(e.Batch[0], " "))
+    }
+    r.applied = e.Index
+  }
+  if net.snapshot_every > 0 && r.applied - r.first() >= net.snapshot_every {
+    var buf bytes.Buffer
+    gob.NewEncoder(&buf).Encode(net.applied[id])
+    r.compact(r.applied, buf.Bytes())
+  }
+}
+
+// deliver hands the queued messages over, in a random order, until none is left
+func (net *raftNetwork) deliver() {
+  for steps := 0; len(net.queue) > 0; steps++ {
+    if steps > 100000 {
+      net.t.Fatal("messages keep coming, the members do not settle")
+    }
+    i := net.rand.Intn(len(net.queue))
+    m := net.queue[i]
+    net.queue = append(net.queue[:i], net.queue[i+1:]...)
+    if net.cut[m.From + ">" + m.To] || net.rand.Float64() < net.drop {
+      continue
+    }
+    net.nodes[m.To].step(m)
+    net.process(m.To)
+  }
+}
+
+// run lets ticks raft_ticks go by
+func (net *raftNetwork) run(ticks int) {
+  for ; ticks > 0; ticks-- {
+    for _, id := range net.ids {
+      net.nodes[id].tick()
+      net.process(id)
+    }
+    net.deliver()
+  }
+  net.checkSafety()
+}
+
+// isolate cuts every link to and from the member
+func (net *raftNetwork) isolate(id string) {
+  for _, other := range net.ids {
+    if other != id {
+      net.cut[id + ">" + other] = true
+      net.cut[other + ">" + id] = true
+    }
+  }
+}
+
+func (net *raftNetwork) heal() {
+  net.cut = make(map[string]bool)
+}
+
+// leader returns the leader of the highest term, "" when there is none
+func (net *raftNetwork) leader() string {
+  leader, term := "", int64(-1)
+  for _, id := range net.ids {
+    if r := net.nodes[id]; r.role == "leader" && r.term > term {
+      leader, term = id, r.term
+    }
+  }
+  return leader
+}
+
+// waitLeader runs until a member of those given is leader
+func (net *raftNetwork) waitLeader(among ...string) string {
+  for i := 0; i < 50; i++ {
+    net.run(5)
+    leader := net.leader()
+    for _, id := range among {
+      if id == leader {
+        return leader
+      }
+    }
+    if len(among) == 0 && leader != "" {
+      return leader
+    }
+  }
+  net.t.Fatalf("no leader elected among %v", among)
+  return ""
+}
+
+// propose has the member append a SET of key to its log
+func (net *raftNetwork) propose(id, key string) {
+  if _, ok := net.nodes[id].propose(RaftEntry{Batch: [][]string{{"SET", key, "1"}}}); !ok {
+    net.t.Fatalf("%s refused a proposal, it is not the leader", id)
+  }
+  net.process(id)
+}
+
+// checkSafety fails when two members applied different commands at the same
+//   place, or two leaders share a term
+func (net *raftNetwork) checkSafety() {
+  leaders := make(map[int64]string)
+  for _, id := range net.ids {
+    r := net.nodes[id]
+    if r.role != "leader" {
+      continue
+    }
+    if other, ok := leaders[r.term]; ok {
+      net.t.Fatalf("%s and %s are both leaders of term %d", id, other, r.term)
+    }
+    leaders[r.term] = id
+  }
+  for _, a := range net.ids {
+    for _, b := range net.ids {
+      x, y := net.applied[a], net.applied[b]
+      for i := 0; i < len(x) && i < len(y); i++ {
+        if x[i] != y[i] {
+          net.t.Fatalf("%s applied %q and %s %q as command %d", a, x[i], b, y[i], i)
+        }
+      }
+    }
+  }
+}
+
+// checkApplied fails unless every member given applied the commands
+func (net *raftNetwork) checkApplied(want []string, ids ...string) {
+  for _, id := range ids {
+    if got := strings.Join(net.applied[id], ","); got != strings.Join(want, ",") {
+      net.t.Fatalf("%s applied %v, want %v", id, net.applied[id], want)
+    }
+  }
+}
+
+func setCommands(keys ...string) []string {
+  commands := []string{}
+  for _, key := range keys {
+    commands = append(commands, "SET " + key + " 1")
+  }
+  return commands
+}
+
+func keyRange(prefix string, n int) []string {
+  keys := []string{}
+  for i := 0; i < n; i++ {
+    keys = append(keys, prefix + strconv.Itoa(i))
+  }
+  return keys
+}
+
+func TestRaftElection(t *testing.T) {
+  for seed := int64(1); seed <= 20; seed++ {
+    net := newRaftNetwork(t, 3, seed)
+    leader := net.waitLeader()
+    net.run(50)
+    if net.leader() != leader {
+      t.Fatalf("seed %d: leadership moved from %s to %s without any failure", seed, leader, net.leader())
+    }
+    for _, id := range net.ids {
+      if r := net.nodes[id]; r.leader != leader || r.term != net.nodes[leader].term {
+        t.Fatalf("seed %d: %s follows %q in term %d, want %s in term %d", seed, id, r.leader, r.term,
+          leader, net.nodes[leader].term)
+      }
+    }
+  }
+}
+
+func TestRaftReelection(t *testing.T) {
+  for seed := int64(1); seed <= 20; seed++ {
+    net := newRaftNetwork(t, 5, seed)
+    old := net.waitLeader()
+    net.propose(old, "a")
+    net.run(5)
+    net.checkApplied(setCommands("a"), net.ids...)
+
+    // the old leader goes on alone, what it takes can not commit
+    net.isolate(old)
+    others := []string{}
+    for _, id := range net.ids {
+      if id != old {
+        others = append(others, id)
+      }
+    }
+    leader := net.waitLeader(others...)
+    if net.nodes[leader].term <= net.nodes[old].term {
+      t.Fatalf("seed %d: new leader %s has term %d, not above %d", seed, leader, net.nodes[leader].term, net.nodes[old].term)
+    }
+    net.propose(old, "lost")
+    net.propose(leader, "b")
+    net.run(10)
+    net.checkApplied(setCommands("a", "b"), others...)
+    net.checkApplied(setCommands("a"), old)
+
+    // back in the cluster it follows and drops the entry that never committed
+    net.heal()
+    net.run(30)
+    if r := net.nodes[old]; r.role != "follower" || r.leader != leader {
+      t.Fatalf("seed %d: old leader %s is %s following %q, want a follower of %s", seed, old, r.role, r.leader, leader)
+    }
+    net.checkApplied(setCommands("a", "b"), net.ids...)
+  }
+}
+
+func TestRaftLogRepair(t *testing.T) {
+  for seed := int64(1); seed <= 20; seed++ {
+    net := newRaftNetwork(t, 3, seed)
+    leader := net.waitLeader()
+    lagging := ""
+    for _, id := range net.ids {
+      if id != leader {
+        lagging = id
+        break
+      }
+    }
+
+    // a follower misses many entries, more than one append message holds
+    net.isolate(lagging)
+    keys := keyRange("k", max_append + 50)
+    for _, key := range keys {
+      net.propose(leader, key)
+    }
+    net.run(5)
+    if len(net.applied[lagging]) != 0 {
+      t.Fatalf("seed %d: isolated %s applied %d commands", seed, lagging, len(net.applied[lagging]))
+    }
+
+    // the leader then gets entries of its own that the others never see, while
+    //   they elect the member that has all the committed entries
+    net.heal()
+    net.isolate(leader)
+    net.propose(leader, "lost1")
+    net.propose(leader, "lost2")
+    others := []string{}
+    for _, id := range net.ids {
+      if id != leader {
+        others = append(others, id)
+      }
+    }
+    if current := net.waitLeader(others...); current == lagging {
+      t.Fatalf("seed %d: %s was elected without the committed entries", seed, lagging)
+    }
+    net.heal()
+    net.run(40)
+    net.checkApplied(setCommands(keys...), net.ids...)
+    current := net.leader()
+    net.propose(current, "last")
+    net.run(10)
+    net.checkApplied(setCommands(append(keys, "last")...), net.ids...)
+    for _, id := range net.ids {
+      if r := net.nodes[id]; r.last() != net.nodes[current].last() {
+        t.Fatalf("seed %d: log of %s ends at %d, the leader's at %d", seed, id, r.last(), net.nodes[current].last())
+      }
+    }
+  }
+}
+
+func TestRaftSnapshot(t *testing.T) {
+  for seed := int64(1); seed <= 20; seed++ {
+    net := newRaftNetwork(t, 3, seed)
+    net.snapshot_every = 10
+    leader := net.waitLeader()
+    lagging := ""
+    for _, id := range net.ids {
+      if id != leader {
+        lagging = id
+        break
+      }
+    }
+    net.isolate(lagging)
+    keys := keyRange("k", 35)
+    for _, key := range keys {
+      net.propose(leader, key)
+      net.run(1)
+    }
+    if first := net.nodes[leader].first(); first <= net.nodes[lagging].last() {
+      t.Fatalf("seed %d: the leader compacted up to %d only, %s has up to %d", seed, first, lagging, net.nodes[lagging].last())
+    }
+
+    // what was compacted away can only come as a snapshot
+    net.heal()
+    net.run(20)
+    if net.restores[lagging] == 0 {
+      t.Fatalf("seed %d: %s caught up without installing a snapshot", seed, lagging)
+    }
+    net.checkApplied(setCommands(keys...), net.ids...)
+    net.propose(net.leader(), "after")
+    net.run(5)
+    net.checkApplied(setCommands(append(keys, "after")...), net.ids...)
+  }
+}
+
+func TestRaftLossyNetwork(t *testing.T) {
+  for seed := int64(1); seed <= 10; seed++ {
+    net := newRaftNetwork(t, 5, seed)
+    net.drop = 0.2
+    keys := []string{}
+    for i := 0; i < 30; i++ {
+      leader := net.waitLeader()
+      key := "k" + strconv.Itoa(i)
+      net.propose(leader, key)
+      // a write is acknowledged once a majority applied it; when the leader
+      //   changes first it may be lost, as raftPropose tells its client
+      for tries := 0; tries < 20 && net.leader() == leader; tries++ {
+        net.run(5)
+        applied := 0
+        for _, id := range net.ids {
+          if n := len(net.applied[id]); n > 0 && net.applied[id][n-1] == "SET " + key + " 1" {
+            applied++
+          }
+        }
+        if applied >= 3 {
+          keys = append(keys, key)
+          break
+        }
+      }
+    }
+    if len(keys) < 15 {
+      t.Fatalf("seed %d: only %d of 30 writes were acknowledged", seed, len(keys))
+    }
+    net.drop = 0
+    net.run(50)
+    // every member applied the same commands, and at least those of the
+    //   leaders that stayed in place
+    applied := net.applied[net.ids[0]]
+    net.checkApplied(applied, net.ids...)
+    done := make(map[string]bool)
+    for _, command := range applied {
+      done[command] = true
+    }
+    missing := []string{}
+    for _, key := range keys {
+      if !done["SET " + key + " 1"] {
+        missing = append(missing, key)
+      }
+    }
+    sort.Strings(missing)
+    if len(missing) > 0 {
+      t.Fatalf("seed %d: writes of %v were never applied", seed, missing)
+    }
+  }
+}
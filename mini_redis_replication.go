@@ -0,0 +1,488 @@
+// Primary/replica replication of mini_redis.
+// A replica (-replicaof host:port, the HTTP address of the primary) connects to
+//   GET /replication/sync on its primary. The primary answers with a gob stream:
+//   first a full snapshot of storage, then every write command as it happens,
+//   tagged with its revision, which serves as the replication offset.
+// When a replica reconnects with the replication id and offset it had, and the
+//   primary still has the commands after that offset in its backlog, only those
+//   are sent (partial resync) instead of a new snapshot.
+// The commands of a transaction or a script are marked as one group, which a
+//   replica applies under one lock, so its readers never see half of it.
+// A replica is read only and does not expire keys itself: its primary sends a
+//   DEL when a key expires. REPLICAOF NO ONE (or POST /replication/promote)
+//   turns a replica into a primary.
+//
+// Try it with two processes:
+//   ./mini_redis -http :8082 -resp :6380 -dbfile primary.gob
+//   ./mini_redis -http :8083 -resp :6381 -dbfile replica.gob -replicaof localhost:8082
+
+package main
+import (
+  "context"
+  "crypto/rand"
+  "encoding/gob"
+  "encoding/hex"
+  "errors"
+  "log"
+  "net"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// one message of the replication stream
+type ReplMessage struct {
+  Replid string // set in the first message only
+  Full bool // the first message carries a snapshot of every database in Databases
+  Databases []map[string]*Value
+  Revision int64 // revision of the snapshot or of the command
+  Db int // database of the command
+  Args []string // a write command, nil for a heartbeat
+  More bool // the next command belongs to the same transaction
+}
+
+type ReplEntry struct {
+  Revision int64
+  Db int
+  Args []string
+  More bool // the next entry belongs to the same transaction
+}
+
+// a connected replica, fed like pub/sub subscribers: a slow replica is
+//   dropped and resyncs when it reconnects
+type Replica struct {
+  addr string
+  entries chan ReplEntry
+  dropped chan struct{}
+}
+
+// guarded by mu
+var replid = newReplid()
+var replica_of string // address of the primary, empty on a primary
+var applying bool // set while a replica applies a command from its primary
+var backlog_size = 10000
+var backlog []ReplEntry
+var backlog_floor int64 // entries after this revision are all in the backlog
+var replicas = make(map[*Replica]bool)
+var deferred_entries []ReplEntry
+var repl_state = "connecting" // of a replica: connecting, sync or connected
+var stop_replication context.CancelFunc
+
+const replica_buffer = 4096
+const repl_heartbeat = time.Second
+const repl_timeout = 10 * time.Second
+
+func init() {
+  register("REPLICAOF", 3, "admin", 0, 0, 0, cmdReplicaof)
+  register("ROLE", 1, "admin", 0, 0, 0, cmdRole)
+}
+
+func newReplid() string {
+  b := make([]byte, 20)
+  rand.Read(b)
+  return hex.EncodeToString(b)
+}
+
+// propagatedArgs rewrites relative expiration times to absolute ones, so a
+//   replica applying the command later sets the same expiration, and the
+//   stream commands whose result depends on the time to their result
+func propagatedArgs(name string, args []string, keys []string, reply interface{}) []string {
+  switch name {
+  case "XADD":
+    i, _, _, _, _ := xaddOptions(args, 2)
+    propagated := append([]string{}, args...)
+    propagated[i] = get(args[1]).Stream.LastID.String()
+    return propagated
+  case "XCLAIM", "XAUTOCLAIM":
+    return claimPropagated(args, reply)
+  case "SET":
+    // the condition held here, replicas only apply the result
+    if len(args) > 3 {
+      propagated := args[:3:3]
+      if v := get(args[1]); v != nil {
+        if v.ContentType != "" {
+          propagated = append(propagated, "CONTENTTYPE", v.ContentType)
+        }
+        if v.Expires != 0 {
+          propagated = append(propagated, "PXAT", strconv.FormatInt(v.Expires, 10))
+        }
+      }
+      return propagated
+    }
+  case "LOCK":
+    return []string{"SET", args[1], args[2], "PXAT", strconv.FormatInt(get(args[1]).Expires, 10)}
+  case "UNLOCK":
+    return []string{"DEL", args[1]}
+  case "EXPIRE", "PEXPIRE", "RENEW":
+    if v := get(args[1]); v != nil {
+      return []string{"PEXPIREAT", args[1], strconv.FormatInt(v.Expires, 10)}
+    }
+    return []string{"DEL", args[1]}
+  case "RESTORE":
+    if v := get(args[1]); v != nil {
+      return []string{"RESTORE", args[1], strconv.FormatInt(v.Expires, 10), args[3], "REPLACE", "ABSTTL"}
+    }
+  }
+  return args
+}
+
+// propagate sends a write command, at the current revision, to the replicas
+func propagate(args []string) {
+  e := ReplEntry{Revision: revision, Db: db_index, Args: args}
+  if deferring {
+    deferred_entries = append(deferred_entries, e)
+    return
+  }
+  feed(e)
+}
+
+func feed(e ReplEntry) {
+  backlog = append(backlog, e)
+  if len(backlog) > 2 * backlog_size {
+    backlog_floor = backlog[len(backlog) - backlog_size - 1].Revision
+    backlog = append([]ReplEntry{}, backlog[len(backlog) - backlog_size:]...)
+  }
+  for r := range replicas {
+    select {
+    case r.entries <- e:
+    default:
+      delete(replicas, r)
+      close(r.dropped)
+    }
+  }
+}
+
+// flushEntries sends the commands of a transaction when it committed, as a group
+func flushEntries(commit bool) {
+  if commit {
+    for i, e := range deferred_entries {
+      e.More = i < len(deferred_entries) - 1
+      feed(e)
+    }
+  }
+  deferred_entries = nil
+}
+
+// serveSync streams the replication feed to a replica:
+//   GET /replication/sync?replid=ID&offset=REV
+func serveSync(w http.ResponseWriter, req *http.Request) {
+  if !allowed(w, req, []string{"SYNC"}) {
+    return
+  }
+  offset, err := strconv.ParseInt(req.URL.Query().Get("offset"), 10, 64)
+  if err != nil {
+    offset = -1
+  }
+  flusher, ok := w.(http.Flusher)
+  if !ok {
+    http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+    return
+  }
+  r := &Replica{addr: req.RemoteAddr, entries: make(chan ReplEntry, replica_buffer), dropped: make(chan struct{})}
+
+  mu.Lock()
+  if replica_of != "" && repl_state != "connected" {
+    // a replica can feed other replicas only once it is in sync itself
+    mu.Unlock()
+    http.Error(w, "replica is not in sync with its primary", http.StatusServiceUnavailable)
+    return
+  }
+  first := ReplMessage{Replid: replid, Revision: revision}
+  var pending []ReplEntry
+  if req.URL.Query().Get("replid") == replid && offset >= backlog_floor && offset <= revision {
+    for _, e := range backlog {
+      if e.Revision > offset {
+        pending = append(pending, e)
+      }
+    }
+    first.Revision = offset
+    log.Println("partial resync of", r.addr, "from revision", offset)
+  } else {
+    first.Full = true
+    for _, data := range snapshot() {
+      clone := make(map[string]*Value, len(data))
+      for key, v := range data {
+        clone[key] = v.clone()
+      }
+      first.Databases = append(first.Databases, clone)
+    }
+    log.Println("full resync of", r.addr, "at revision", revision)
+  }
+  replicas[r] = true
+  mu.Unlock()
+  defer func() {
+    mu.Lock()
+    delete(replicas, r)
+    mu.Unlock()
+  }()
+
+  w.Header().Set("Content-Type", "application/octet-stream")
+  enc := gob.NewEncoder(w)
+  if enc.Encode(first) != nil {
+    return
+  }
+  for _, e := range pending {
+    if enc.Encode(ReplMessage{Revision: e.Revision, Db: e.Db, Args: e.Args, More: e.More}) != nil {
+      return
+    }
+  }
+  flusher.Flush()
+  heartbeat := time.NewTicker(repl_heartbeat)
+  defer heartbeat.Stop()
+  for {
+    select {
+    case e := <-r.entries:
+      if enc.Encode(ReplMessage{Revision: e.Revision, Db: e.Db, Args: e.Args, More: e.More}) != nil {
+        return
+      }
+      if len(r.entries) == 0 {
+        flusher.Flush()
+      }
+    case <-heartbeat.C:
+      if enc.Encode(ReplMessage{}) != nil {
+        return
+      }
+      flusher.Flush()
+    case <-r.dropped:
+      log.Println("replica", r.addr, "is too slow, dropped")
+      return
+    case <-req.Context().Done():
+      return
+    }
+  }
+}
+
+// replicate keeps a replica in sync with its primary until ctx is cancelled,
+//   reconnecting with a backoff when the connection is lost
+func replicate(ctx context.Context, primary string) {
+  backoff := 100 * time.Millisecond
+  for ctx.Err() == nil {
+    err := syncOnce(ctx, primary)
+    if ctx.Err() != nil {
+      return
+    }
+    log.Println("replication from", primary, "lost:", err)
+    mu.Lock()
+    repl_state = "connecting"
+    mu.Unlock()
+    select {
+    case <-time.After(backoff):
+    case <-ctx.Done():
+      return
+    }
+    if backoff < 5 * time.Second {
+      backoff *= 2
+    }
+  }
+}
+
+func syncOnce(ctx context.Context, primary string) error {
+  ctx, cancel := context.WithCancel(ctx)
+  defer cancel()
+  mu.Lock()
+  url := "http://" + primary + "/replication/sync?replid=" + replid + "&offset=" + strconv.FormatInt(revision, 10)
+  mu.Unlock()
+  req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+  if err != nil {
+    return err
+  }
+  setNodeAuth(req)
+  resp, err := http.DefaultClient.Do(req)
+  if err != nil {
+    return err
+  }
+  defer resp.Body.Close()
+  if resp.StatusCode != http.StatusOK {
+    return errors.New("primary answered " + resp.Status)
+  }
+
+  // the primary sends a heartbeat every second, give up when it stays silent
+  idle := time.AfterFunc(repl_timeout, cancel)
+  defer idle.Stop()
+  dec := gob.NewDecoder(resp.Body)
+  var first ReplMessage
+  if err := dec.Decode(&first); err != nil {
+    return err
+  }
+  mu.Lock()
+  if first.Full {
+    loadStorage(first.Databases, first.Revision)
+    keys := 0
+    for _, d := range databases {
+      d.dirty++
+      keys += d.storage.count()
+    }
+    log.Println("full sync from", primary, "at revision", first.Revision, "with", keys, "keys")
+  } else {
+    log.Println("partial resync from", primary, "at revision", first.Revision)
+  }
+  replid = first.Replid
+  repl_state = "connected"
+  mu.Unlock()
+
+  // a group cut by a lost connection is never applied; the resync starts
+  //   after the last group applied
+  var group []ReplEntry
+  for {
+    var m ReplMessage
+    if err := dec.Decode(&m); err != nil {
+      return err
+    }
+    idle.Reset(repl_timeout)
+    if m.Args == nil {
+      continue
+    }
+    group = append(group, ReplEntry{Revision: m.Revision, Db: m.Db, Args: m.Args})
+    if m.More {
+      continue
+    }
+    mu.Lock()
+    if ctx.Err() == nil {
+      applyEntries(group)
+    }
+    mu.Unlock()
+    group = nil
+  }
+}
+
+// applyEntries applies a group of entries together, propagating them to the
+//   replicas of this replica as a group too
+func applyEntries(group []ReplEntry) {
+  deferring = len(group) > 1
+  for _, e := range group {
+    applyEntry(e)
+  }
+  if len(group) > 1 {
+    endDeferred(true)
+  }
+}
+
+// applyEntry runs a command from the primary at the revision it had there
+func applyEntry(e ReplEntry) {
+  if e.Db >= len(databases) {
+    log.Println("replicated command", e.Args[0], "is for database", e.Db, "which does not exist here")
+    revision = e.Revision
+    return
+  }
+  selectDB(e.Db)
+  applying = true
+  revision = e.Revision - 1
+  if err, ok := call(e.Args).(error); ok {
+    log.Println("replicated command", e.Args[0], "failed:", err)
+  }
+  revision = e.Revision
+  applying = false
+}
+
+// loadStorage replaces every database with a snapshot taken at revision rev;
+//   the caller must hold mu
+func loadStorage(data []map[string]*Value, rev int64) {
+  for i, d := range databases {
+    values := make(map[string]*Value)
+    if i < len(data) && data[i] != nil {
+      values = data[i]
+    }
+    if _, ok := d.storage.(*BTree); ok {
+      // the page file is rewritten by the next commits
+      d.storage.clear()
+      for key, v := range values {
+        d.storage.put(key, v)
+      }
+      d.storage.release()
+    } else {
+      d.storage = newMemoryStore(values)
+    }
+    d.expires = make(map[string]bool)
+    for key, v := range values {
+      if v.Expires != 0 {
+        d.expires[key] = true
+      }
+    }
+  }
+  selectDB(db_index)
+  revision = rev
+  history = nil
+  compacted = rev
+  backlog = nil
+  backlog_floor = rev
+  // replicas of this node can not follow a history they did not see
+  for r := range replicas {
+    delete(replicas, r)
+    close(r.dropped)
+  }
+}
+
+// startReplication makes this node a replica of primary; the caller must hold mu
+func startReplication(primary string) {
+  if stop_replication != nil {
+    stop_replication()
+  }
+  replica_of = primary
+  repl_state = "connecting"
+  var ctx context.Context
+  ctx, stop_replication = context.WithCancel(context.Background())
+  go replicate(ctx, primary)
+}
+
+// promote turns a replica into a primary; the caller must hold mu
+func promote() {
+  if replica_of == "" {
+    return
+  }
+  stop_replication()
+  stop_replication = nil
+  log.Println("promoted to primary, was replica of", replica_of)
+  replica_of = ""
+  // a new history starts here: replicas that were following the old primary resync fully
+  replid = newReplid()
+  backlog = nil
+  backlog_floor = revision
+}
+
+// REPLICAOF host port, or REPLICAOF NO ONE to promote a replica.
+// The port is the HTTP port of the primary.
+func cmdReplicaof(args []string) interface{} {
+  if raft != nil {
+    return errors.New("ERR REPLICAOF is not available in raft mode")
+  }
+  if strings.ToUpper(args[1]) == "NO" && strings.ToUpper(args[2]) == "ONE" {
+    promote()
+    return Status("OK")
+  }
+  if _, err := strconv.Atoi(args[2]); err != nil {
+    return errors.New("ERR Invalid master port")
+  }
+  startReplication(net.JoinHostPort(args[1], args[2]))
+  return Status("OK")
+}
+
+// ROLE: master, offset, replica addresses  or  slave, primary host, port, state, offset
+func cmdRole(args []string) interface{} {
+  if replica_of == "" {
+    list := []string{}
+    for r := range replicas {
+      list = append(list, r.addr)
+    }
+    return []interface{}{"master", revision, list}
+  }
+  host, port, _ := net.SplitHostPort(replica_of)
+  p, _ := strconv.Atoi(port)
+  return []interface{}{"slave", host, p, repl_state, revision}
+}
+
+// servePromote is the HTTP way to promote a replica: POST /replication/promote
+func servePromote(w http.ResponseWriter, req *http.Request) {
+  if req.Method != "POST" {
+    w.Header().Set("Allow", "POST")
+    http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    return
+  }
+  if !allowed(w, req, []string{"REPLICAOF", "NO", "ONE"}) {
+    return
+  }
+  mu.Lock()
+  promote()
+  mu.Unlock()
+  w.Write([]byte("OK"))
+}
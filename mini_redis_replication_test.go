@@ -0,0 +1,61 @@
+// Tests of the replication feed: the commands of a transaction go to the
+//   replicas as one group, which a replica applies at once.
+// go test -run Replication mini_redis*.go
+
+package main
+import (
+  "context"
+  "testing"
+)
+
+func TestReplicationGroupsTransactions(t *testing.T) {
+  mu.Lock()
+  initDatabases(16)
+  r := &Replica{entries: make(chan ReplEntry, 16), dropped: make(chan struct{})}
+  replicas[r] = true
+  mu.Unlock()
+  defer func() {
+    mu.Lock()
+    delete(replicas, r)
+    mu.Unlock()
+  }()
+
+  execute(0, []string{"SET", "alone", "1"})
+  batch := [][]string{{"INCR", "a"}, {"INCR", "b"}, {"SET", "c", "x"}}
+  if _, err := runTransaction(context.Background(), 0, batch, nil); err != nil {
+    t.Fatal(err)
+  }
+  want := []bool{false, true, true, false}
+  for i, more := range want {
+    e := <-r.entries
+    if e.More != more {
+      t.Fatalf("entry %d %v: More is %v, want %v", i, e.Args, e.More, more)
+    }
+  }
+}
+
+func TestReplicationAppliesGroups(t *testing.T) {
+  mu.Lock()
+  defer mu.Unlock()
+  initDatabases(16)
+  revision = 0
+  applyEntries([]ReplEntry{
+    {Revision: 1, Args: []string{"INCR", "a"}, More: true},
+    {Revision: 2, Args: []string{"INCR", "b"}, More: true},
+    {Revision: 3, Db: 2, Args: []string{"SET", "c", "x"}},
+  })
+  if deferring {
+    t.Fatal("still deferring after the group")
+  }
+  if revision != 3 {
+    t.Fatalf("revision %d after the group, want 3", revision)
+  }
+  selectDB(0)
+  if a, b := call([]string{"GET", "a"}), call([]string{"GET", "b"}); a != "1" || b != "1" {
+    t.Fatalf("a and b are %v and %v, want 1", a, b)
+  }
+  selectDB(2)
+  if c := call([]string{"GET", "c"}); c != "x" {
+    t.Fatalf("c is %v in database 2, want x", c)
+  }
+}
@@ -0,0 +1,310 @@
+// RESP2 front-end of mini_redis: a TCP listener that speaks the Redis
+//   serialization protocol, so redis-cli and Redis client libraries can use
+//   mini_redis as a lightweight local stand-in for Redis.
+// Both multi-bulk requests (what clients send) and inline commands (what
+//   you type in telnet) are accepted. Requests can be pipelined: replies are
+//   buffered and flushed once no more requests are waiting in the input.
+// A command that waits (LOCK ... WAIT, XREAD ... BLOCK) watches the connection
+//   meanwhile, and stops waiting when the client goes away.
+
+package main
+import (
+  "bufio"
+  "bytes"
+  "context"
+  "errors"
+  "io"
+  "log"
+  "net"
+  "os"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+)
+
+// upper bounds, same as Redis defaults, so a bad client can not make us allocate gigabytes
+const max_multibulk = 1024 * 1024
+const max_bulk_len = 512 * 1024 * 1024
+const max_line_len = 64 * 1024 // inline commands and the headers of multibulks
+
+func listenRESP(addr string) error {
+  ln, err := net.Listen("tcp", addr)
+  if err != nil {
+    return err
+  }
+  log.Println("RESP listener on", addr)
+  for {
+    conn, err := ln.Accept()
+    if err != nil {
+      return err
+    }
+    go serveRESP(conn)
+  }
+}
+
+// state of one RESP connection
+type Client struct {
+  conn net.Conn
+  r *bufio.Reader
+  w *bufio.Writer
+  wmu sync.Mutex // replies and pushed pub/sub messages share w
+  done chan struct{} // closed when the connection is over
+  tx Transaction
+  sub *Subscriber // set once the client subscribed to something
+  user string // name of the user given to AUTH, "" for the default user
+  db int // selected logical database
+  ctx context.Context // canceled when the connection is over
+  cancel context.CancelFunc
+}
+
+func serveRESP(conn net.Conn) {
+  c := &Client{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn), done: make(chan struct{})}
+  c.ctx, c.cancel = context.WithCancel(context.Background())
+  defer c.close()
+  clientConnected(1)
+  defer clientConnected(-1)
+  for {
+    args, err := readCommand(c.r)
+    if err != nil {
+      if err != io.EOF {
+        c.reply(errors.New("ERR Protocol error: " + err.Error()), true)
+      }
+      return
+    }
+    if len(args) == 0 {
+      continue
+    }
+    if strings.ToUpper(args[0]) == "QUIT" {
+      c.reply(Status("OK"), true)
+      return
+    }
+    if err := c.reply(c.dispatch(args), c.r.Buffered() == 0); err != nil {
+      return
+    }
+  }
+}
+
+// dispatch checks the permissions of the user, runs the connection level
+//   commands (authentication, transactions, pub/sub) itself and everything
+//   else through execute
+func (c *Client) dispatch(args []string) interface{} {
+  name := strings.ToUpper(args[0])
+  if c.sub != nil && len(c.sub.channels) + len(c.sub.patterns) > 0 {
+    switch name {
+    case "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE", "PING":
+    default:
+      return errors.New("ERR only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context")
+    }
+  }
+  switch name {
+  case "AUTH", "ACL":
+    return c.aclCommand(args)
+  }
+  if err := checkAccess(c.user, args); err != nil {
+    c.tx.failed = c.tx.active // like a command that can not be queued
+    return err
+  }
+  switch name {
+  case "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE", "MULTI", "EXEC", "DISCARD", "WATCH", "UNWATCH":
+    if cluster != nil {
+      return errors.New("ERR " + name + " is not available in proxy mode")
+    }
+  }
+  switch name {
+  case "SUBSCRIBE", "PSUBSCRIBE", "UNSUBSCRIBE", "PUNSUBSCRIBE":
+    return c.pubsubCommand(args)
+  case "SELECT":
+    return c.selectCommand(args)
+  }
+  ctx := c.context()
+  if reply, handled := c.tx.handle(ctx, c.db, args); handled {
+    return reply
+  }
+  _, lock := lockWait(args)
+  _, _, block := streamBlock(args)
+  if lock || block {
+    defer c.watchHangup()()
+  }
+  return executeContext(ctx, c.db, args)
+}
+
+// context returns the context of a command of the client, with its user
+func (c *Client) context() context.Context {
+  return context.WithValue(c.ctx, userKey{}, c.user)
+}
+
+// watchHangup cancels the context of the client when it goes away while a
+//   command waits: the serve loop does not read then, so a goroutine peeks at
+//   the input. The function returned stops it, once the command is done.
+func (c *Client) watchHangup() func() {
+  stopped := make(chan struct{})
+  go func() {
+    defer close(stopped)
+    // data the client pipelined stays buffered for the serve loop
+    if _, err := c.r.Peek(1); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+      c.cancel()
+    }
+  }()
+  return func() {
+    c.conn.SetReadDeadline(time.Now())
+    <-stopped
+    c.conn.SetReadDeadline(time.Time{})
+  }
+}
+
+// SELECT n: use logical database n on this connection
+func (c *Client) selectCommand(args []string) interface{} {
+  if len(args) != 2 {
+    return errors.New("ERR wrong number of arguments for 'select' command")
+  }
+  if c.tx.active {
+    c.tx.failed = true
+    return errors.New("ERR SELECT inside MULTI is not allowed")
+  }
+  n, err := parseDB(args[1])
+  if err != nil {
+    return err
+  }
+  if cluster != nil && n != 0 {
+    return errors.New("ERR SELECT is not allowed in proxy mode")
+  }
+  c.db = n
+  return Status("OK")
+}
+
+// reply writes a reply, flushing the output when asked to
+func (c *Client) reply(reply interface{}, flush bool) error {
+  c.wmu.Lock()
+  defer c.wmu.Unlock()
+  writeReply(c.w, reply)
+  if flush {
+    return c.w.Flush()
+  }
+  return nil
+}
+
+func (c *Client) close() {
+  close(c.done)
+  c.cancel()
+  if c.sub != nil {
+    c.sub.close()
+  }
+  c.conn.Close()
+}
+
+// read one request, either a multi-bulk array or an inline command
+func readCommand(r *bufio.Reader) ([]string, error) {
+  line, err := readLine(r)
+  if err != nil {
+    return nil, err
+  }
+  if len(line) == 0 || line[0] != '*' {
+    return strings.Fields(line), nil
+  }
+  n, err := strconv.Atoi(line[1:])
+  if err != nil || n > max_multibulk {
+    return nil, errors.New("invalid multibulk length")
+  }
+  if n <= 0 {
+    return nil, nil // an empty or null array is no command, as in Redis
+  }
+  // the lengths are what the client claims: memory grows with the data that
+  //   really comes, not with them
+  args := make([]string, 0, 16)
+  for i := 0; i < n; i++ {
+    line, err := readLine(r)
+    if err != nil {
+      return nil, err
+    }
+    if len(line) == 0 || line[0] != '$' {
+      return nil, errors.New("expected '$', got '" + line + "'")
+    }
+    size, err := strconv.Atoi(line[1:])
+    if err != nil || size < 0 || size > max_bulk_len {
+      return nil, errors.New("invalid bulk length")
+    }
+    arg, err := readBulk(r, size)
+    if err != nil {
+      return nil, err
+    }
+    args = append(args, arg)
+  }
+  return args, nil
+}
+
+// readBulk reads a bulk string of size bytes and its CRLF; the buffer grows
+//   with what arrives rather than trusting the size the peer sent
+func readBulk(r *bufio.Reader, size int) (string, error) {
+  var buf bytes.Buffer
+  if _, err := io.CopyN(&buf, r, int64(size) + 2); err != nil {
+    if err == io.EOF {
+      err = io.ErrUnexpectedEOF
+    }
+    return "", err
+  }
+  data := buf.Bytes()
+  if data[size] != '\r' || data[size+1] != '\n' {
+    return "", errors.New("bulk string not terminated by CRLF")
+  }
+  return string(data[:size]), nil
+}
+
+// read a line terminated by CRLF (a bare LF is tolerated for inline commands),
+//   of at most max_line_len bytes
+func readLine(r *bufio.Reader) (string, error) {
+  var line []byte
+  for {
+    chunk, err := r.ReadSlice('\n')
+    if len(line) + len(chunk) > max_line_len {
+      return "", errors.New("too big inline request or header")
+    }
+    line = append(line, chunk...)
+    if err == bufio.ErrBufferFull {
+      continue
+    }
+    if err != nil {
+      if err == io.EOF && len(line) > 0 {
+        return "", io.ErrUnexpectedEOF
+      }
+      return "", err
+    }
+    return strings.TrimSuffix(string(line[:len(line)-1]), "\r"), nil
+  }
+}
+
+// several replies written one after the other, e.g. one per channel for SUBSCRIBE
+type Replies []interface{}
+
+func writeReply(w *bufio.Writer, reply interface{}) {
+  switch v := reply.(type) {
+  case Replies:
+    for _, item := range v {
+      writeReply(w, item)
+    }
+  case nil:
+    w.WriteString("$-1\r\n")
+  case Status:
+    w.WriteString("+" + string(v) + "\r\n")
+  case error:
+    w.WriteString("-" + strings.Replace(v.Error(), "\r\n", " ", -1) + "\r\n")
+  case int:
+    w.WriteString(":" + strconv.Itoa(v) + "\r\n")
+  case int64:
+    w.WriteString(":" + strconv.FormatInt(v, 10) + "\r\n")
+  case string:
+    w.WriteString("$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n")
+  case []string:
+    w.WriteString("*" + strconv.Itoa(len(v)) + "\r\n")
+    for _, s := range v {
+      writeReply(w, s)
+    }
+  case []interface{}:
+    w.WriteString("*" + strconv.Itoa(len(v)) + "\r\n")
+    for _, item := range v {
+      writeReply(w, item)
+    }
+  default:
+    panic("writeReply: unsupported reply type")
+  }
+}
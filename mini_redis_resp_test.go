@@ -0,0 +1,45 @@
+// Tests of the RESP reader: commands as multibulks and inline, and the limits
+//   that keep a bad client from making the server allocate without bound.
+// go test -run ReadCommand mini_redis*.go
+
+package main
+import (
+  "bufio"
+  "fmt"
+  "io"
+  "strings"
+  "testing"
+)
+
+func TestReadCommand(t *testing.T) {
+  r := bufio.NewReader(strings.NewReader("*2\r\n$3\r\nGET\r\n$1\r\nk\r\nSET  a b\r\nPING\n*-1\r\n*0\r\n"))
+  for _, want := range [][]string{{"GET", "k"}, {"SET", "a", "b"}, {"PING"}, nil, nil} {
+    args, err := readCommand(r)
+    if err != nil || fmt.Sprint(args) != fmt.Sprint(want) {
+      t.Fatalf("readCommand: %q %v, want %q", args, err, want)
+    }
+  }
+  if _, err := readCommand(r); err != io.EOF {
+    t.Fatalf("readCommand at the end: %v, want EOF", err)
+  }
+}
+
+func TestReadCommandLimits(t *testing.T) {
+  tests := []struct {
+    input, err string
+  }{
+    {"*2\r\n$3\r\nGET", "unexpected EOF"},
+    {"*1\r\n$-5\r\n", "invalid bulk length"},
+    {"*1\r\n$1\r\nab\r\n", "bulk string not terminated by CRLF"},
+    {"*99999999999\r\n", "invalid multibulk length"},
+    {"*1\r\n$1000000000000\r\n", "invalid bulk length"},
+    {strings.Repeat("a", max_line_len + 1), "too big inline request or header"},
+    {"*1\r\n$" + strings.Repeat("1", max_line_len), "too big inline request or header"},
+  }
+  for _, test := range tests {
+    _, err := readCommand(bufio.NewReader(strings.NewReader(test.input)))
+    if err == nil || err.Error() != test.err {
+      t.Errorf("readCommand(%.20q...): %v, want %q", test.input, err, test.err)
+    }
+  }
+}
@@ -0,0 +1,1017 @@
+// Server side scripts of mini_redis: EVAL runs a small program atomically, so a
+//   read-modify-write (compare-and-set, conditional delete, bounded counter...)
+//   needs neither a round trip nor a WATCH.
+//   EVAL script numkeys key [key ...] arg [arg ...]
+// The language is a small subset of Lua:
+//   local v = call("GET", KEYS[1])
+//   if v == ARGV[1] then
+//     call("SET", KEYS[1], ARGV[2])
+//     return 1
+//   end
+//   return 0
+// - values are nil, true and false, integers, strings, and arrays ({a, b, c},
+//   KEYS, ARGV and replies of commands, indexed from 1); a string holding an
+//   integer counts as one in arithmetic and in < <= > >=, and when compared
+//   to an integer
+// - statements: local x = e, x = e, if ... then ... elseif ... else ... end,
+//   while e do ... end, for i = first, last[, step] do ... end, break, return [e],
+//   and function calls; every variable lives until the end of the script
+// - operators, by increasing precedence: or, and, == ~= != < <= > >=, .. (concat),
+//   + -, * / % (on integers), and the unary not, - and # (length)
+// - functions: call(command, arg ...), tonumber(s) (nil when s is no integer),
+//   tostring(v) and error(message), which fails the script
+// - comments start with --
+// A script may only use the keys it declares, so ACLs, the proxy and raft know
+//   them beforehand, and it can not run the commands that cover every key.
+// ACL rules see EVAL and its keys, and every command the script calls is checked
+//   against the user running it (raft nodes check it from the log, so their
+//   ACL files must be alike).
+// Like a transaction, a script that fails is rolled back; it also fails when
+//   it runs more than -scriptsteps steps (statements and expressions), or
+//   builds more than script_max_built bytes of strings in all.
+// Replicas get the writes of the script rather than the script, raft nodes run it
+//   from the log.
+
+package main
+import (
+  "errors"
+  "math"
+  "strconv"
+  "strings"
+)
+
+var script_max_steps = 100000
+const script_max_string = 16 * 1024 * 1024
+// a step concatenating strings copies them: what a script may copy in all
+const script_max_built = 64 * 1024 * 1024
+const script_max_source = 256 * 1024
+// parsing and running are recursive: deeper nesting would overflow the stack
+const script_max_depth = 200
+
+// compiled scripts by source, guarded by mu
+var scripts = make(map[string][]*scriptStmt)
+const max_scripts = 1000
+
+func init() {
+  register("EVAL", -3, "write movablekeys script", 0, 0, 0, cmdEval)
+}
+
+// EVAL script numkeys key [key ...] arg [arg ...]
+func cmdEval(args []string) interface{} {
+  numkeys, err := strconv.Atoi(args[2])
+  if err != nil || numkeys < 0 {
+    return errNotInteger
+  }
+  if numkeys > len(args) - 3 {
+    return errors.New("ERR Number of keys can't be greater than number of args")
+  }
+  body, err := compileScript(args[1])
+  if err != nil {
+    return err
+  }
+  keys, argv := args[3:3+numkeys], args[3+numkeys:]
+  run := &scriptRun{vars: map[string]interface{}{"KEYS": scriptArray(keys), "ARGV": scriptArray(argv)},
+    keys: make(map[string]bool)}
+  for _, key := range keys {
+    run.keys[key] = true
+  }
+
+  // inside a transaction, the transaction rolls back and commits
+  nested := deferring
+  var backup map[string]*Value
+  if !nested {
+    backup = backupKeys(keys)
+    deferring = true
+  }
+  _, value, err := run.exec(body)
+  if err != nil {
+    if !nested {
+      restoreKeys(backup)
+      endDeferred(false)
+    }
+    return err
+  }
+  if !nested {
+    endDeferred(true)
+  }
+  return scriptReply(value)
+}
+
+func compileScript(src string) ([]*scriptStmt, error) {
+  if body, ok := scripts[src]; ok {
+    return body, nil
+  }
+  if len(src) > script_max_source {
+    return nil, errors.New("ERR script is longer than " + strconv.Itoa(script_max_source) + " bytes")
+  }
+  tokens, err := scanScript(src)
+  if err != nil {
+    return nil, err
+  }
+  p := &scriptParser{tokens: tokens}
+  body, err := p.block()
+  if err != nil {
+    return nil, err
+  }
+  if len(scripts) >= max_scripts {
+    scripts = make(map[string][]*scriptStmt)
+  }
+  scripts[src] = body
+  return body, nil
+}
+
+func scriptError(line int, message string) error {
+  return errors.New("ERR script line " + strconv.Itoa(line) + ": " + message)
+}
+
+type scriptToken struct {
+  kind byte // 'n' name or keyword, 'i' integer, 's' string, 'o' operator, 0 at the end
+  text string
+  line int
+}
+
+var script_keywords = map[string]bool{"and": true, "break": true, "do": true, "else": true,
+  "elseif": true, "end": true, "false": true, "for": true, "if": true, "local": true, "nil": true,
+  "not": true, "or": true, "return": true, "then": true, "true": true, "while": true}
+
+var script_operators = []string{"==", "~=", "!=", "<=", ">=", "..", "<", ">", "+", "-", "*", "/",
+  "%", "#", "(", ")", "[", "]", "{", "}", ",", "="}
+
+var script_functions = map[string]bool{"call": true, "tonumber": true, "tostring": true, "error": true}
+
+func isLetter(c byte) bool {
+  return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+  return c >= '0' && c <= '9'
+}
+
+// scanScript splits a script into tokens
+func scanScript(src string) ([]scriptToken, error) {
+  var tokens []scriptToken
+  line := 1
+  for i := 0; i < len(src); {
+    c := src[i]
+    switch {
+    case c == '\n':
+      line++
+      i++
+    case c == ' ' || c == '\t' || c == '\r':
+      i++
+    case strings.HasPrefix(src[i:], "--"):
+      for i < len(src) && src[i] != '\n' {
+        i++
+      }
+    case isLetter(c):
+      j := i
+      for j < len(src) && (isLetter(src[j]) || isDigit(src[j])) {
+        j++
+      }
+      tokens = append(tokens, scriptToken{'n', src[i:j], line})
+      i = j
+    case isDigit(c):
+      j := i
+      for j < len(src) && isDigit(src[j]) {
+        j++
+      }
+      tokens = append(tokens, scriptToken{'i', src[i:j], line})
+      i = j
+    case c == '"' || c == '\'':
+      var s strings.Builder
+      j := i + 1
+      for ; j < len(src) && src[j] != c && src[j] != '\n'; j++ {
+        if src[j] == '\\' && j + 1 < len(src) {
+          j++
+          switch src[j] {
+          case 'n':
+            s.WriteByte('\n')
+          case 't':
+            s.WriteByte('\t')
+          case 'r':
+            s.WriteByte('\r')
+          default:
+            s.WriteByte(src[j])
+          }
+          continue
+        }
+        s.WriteByte(src[j])
+      }
+      if j == len(src) || src[j] != c {
+        return nil, scriptError(line, "unfinished string")
+      }
+      tokens = append(tokens, scriptToken{'s', s.String(), line})
+      i = j + 1
+    default:
+      op := ""
+      for _, o := range script_operators {
+        if strings.HasPrefix(src[i:], o) {
+          op = o
+          break
+        }
+      }
+      if op == "" {
+        return nil, scriptError(line, "unexpected character '" + string(c) + "'")
+      }
+      tokens = append(tokens, scriptToken{'o', op, line})
+      i += len(op)
+    }
+  }
+  return append(tokens, scriptToken{0, "<eof>", line}), nil
+}
+
+// syntax tree of a script
+type scriptStmt struct {
+  kind string // local, assign, call, if, while, for, return, break
+  name string // of the variable of local, assign and for
+  exprs []*scriptExpr // value; conditions of if; first, last and step of for
+  blocks [][]*scriptStmt // bodies; for if, one per condition and the else block
+  line int
+}
+
+type scriptExpr struct {
+  kind string // const, name, index, call, array, unary, binary
+  op string // operator or function name
+  value interface{} // of a const
+  args []*scriptExpr // operands, or arguments of a call
+  line int
+}
+
+type scriptParser struct {
+  tokens []scriptToken
+  pos int
+  depth int // of the blocks and expressions being parsed
+}
+
+// enter counts one more level of nesting, leave when it is parsed
+func (p *scriptParser) enter() error {
+  if p.depth++; p.depth > script_max_depth {
+    return scriptError(p.peek().line, "more than " + strconv.Itoa(script_max_depth) + " levels of nesting")
+  }
+  return nil
+}
+
+func (p *scriptParser) leave() {
+  p.depth--
+}
+
+func (p *scriptParser) peek() scriptToken {
+  return p.tokens[p.pos]
+}
+
+func (p *scriptParser) next() scriptToken {
+  t := p.tokens[p.pos]
+  if t.kind != 0 {
+    p.pos++
+  }
+  return t
+}
+
+// is tells whether the next token is the keyword or operator
+func (p *scriptParser) is(text string) bool {
+  t := p.peek()
+  return (t.kind == 'n' || t.kind == 'o') && t.text == text
+}
+
+func (p *scriptParser) accept(text string) bool {
+  if p.is(text) {
+    p.pos++
+    return true
+  }
+  return false
+}
+
+func (p *scriptParser) expect(text string) error {
+  if !p.accept(text) {
+    t := p.peek()
+    return scriptError(t.line, "'" + text + "' expected near '" + t.text + "'")
+  }
+  return nil
+}
+
+func (p *scriptParser) name() (string, error) {
+  t := p.next()
+  if t.kind != 'n' || script_keywords[t.text] {
+    return "", scriptError(t.line, "name expected near '" + t.text + "'")
+  }
+  return t.text, nil
+}
+
+// block parses statements up to one of the keywords that end it, or to the
+//   end of the script when there are none
+func (p *scriptParser) block(ends ...string) ([]*scriptStmt, error) {
+  if err := p.enter(); err != nil {
+    return nil, err
+  }
+  defer p.leave()
+  body := []*scriptStmt{}
+  for {
+    if p.peek().kind == 0 {
+      if len(ends) > 0 {
+        return nil, scriptError(p.peek().line, "'" + ends[len(ends)-1] + "' expected at the end of the script")
+      }
+      return body, nil
+    }
+    for _, end := range ends {
+      if p.is(end) {
+        return body, nil
+      }
+    }
+    s, err := p.statement()
+    if err != nil {
+      return nil, err
+    }
+    body = append(body, s)
+  }
+}
+
+func (p *scriptParser) statement() (*scriptStmt, error) {
+  t := p.next()
+  s := &scriptStmt{kind: t.text, line: t.line}
+  keyword := ""
+  if t.kind == 'n' {
+    keyword = t.text
+  }
+  var err error
+  switch keyword {
+  case "local":
+    if s.name, err = p.name(); err != nil {
+      return nil, err
+    }
+    if err := p.expect("="); err != nil {
+      return nil, err
+    }
+    err = p.exprs(s, 1)
+  case "if":
+    for err == nil {
+      if err = p.exprs(s, 1); err != nil {
+        break
+      }
+      if err = p.expect("then"); err != nil {
+        break
+      }
+      err = p.blocks(s, "elseif", "else", "end")
+      if err != nil || !p.accept("elseif") {
+        break
+      }
+    }
+    if err == nil && p.accept("else") {
+      err = p.blocks(s, "end")
+    }
+    if err == nil {
+      err = p.expect("end")
+    }
+  case "while":
+    if err = p.exprs(s, 1); err == nil {
+      if err = p.expect("do"); err == nil {
+        if err = p.blocks(s, "end"); err == nil {
+          err = p.expect("end")
+        }
+      }
+    }
+  case "for":
+    if s.name, err = p.name(); err != nil {
+      return nil, err
+    }
+    if err = p.expect("="); err == nil {
+      if err = p.exprs(s, 2); err == nil && p.accept(",") {
+        err = p.exprs(s, 1)
+      }
+    }
+    if err == nil {
+      if err = p.expect("do"); err == nil {
+        if err = p.blocks(s, "end"); err == nil {
+          err = p.expect("end")
+        }
+      }
+    }
+  case "return":
+    if p.peek().kind != 0 && !p.is("end") && !p.is("else") && !p.is("elseif") {
+      err = p.exprs(s, 1)
+    }
+  case "break":
+  default:
+    // an assignment or a function call
+    p.pos--
+    var e *scriptExpr
+    if e, err = p.expr(0); err != nil {
+      return nil, err
+    }
+    if p.accept("=") {
+      if e.kind != "name" {
+        return nil, scriptError(t.line, "only variables can be assigned")
+      }
+      s = &scriptStmt{kind: "assign", name: e.op, line: t.line}
+      err = p.exprs(s, 1)
+    } else if e.kind == "call" {
+      s = &scriptStmt{kind: "call", exprs: []*scriptExpr{e}, line: t.line}
+    } else {
+      return nil, scriptError(t.line, "syntax error near '" + p.peek().text + "'")
+    }
+  }
+  if err != nil {
+    return nil, err
+  }
+  return s, nil
+}
+
+// exprs parses n expressions separated by commas into s.exprs
+func (p *scriptParser) exprs(s *scriptStmt, n int) error {
+  for i := 0; i < n; i++ {
+    if i > 0 {
+      if err := p.expect(","); err != nil {
+        return err
+      }
+    }
+    e, err := p.expr(0)
+    if err != nil {
+      return err
+    }
+    s.exprs = append(s.exprs, e)
+  }
+  return nil
+}
+
+func (p *scriptParser) blocks(s *scriptStmt, ends ...string) error {
+  body, err := p.block(ends...)
+  if err == nil {
+    s.blocks = append(s.blocks, body)
+  }
+  return err
+}
+
+var script_precedence = map[string]int{"or": 1, "and": 2, "==": 3, "~=": 3, "!=": 3, "<": 3, "<=": 3,
+  ">": 3, ">=": 3, "..": 4, "+": 5, "-": 5, "*": 6, "/": 6, "%": 6}
+const script_unary_precedence = 7
+
+// expr parses an expression whose binary operators bind tighter than min
+func (p *scriptParser) expr(min int) (*scriptExpr, error) {
+  if err := p.enter(); err != nil {
+    return nil, err
+  }
+  defer p.leave()
+  var left *scriptExpr
+  t := p.peek()
+  if (t.kind == 'n' && t.text == "not") || (t.kind == 'o' && (t.text == "-" || t.text == "#")) {
+    p.next()
+    operand, err := p.expr(script_unary_precedence)
+    if err != nil {
+      return nil, err
+    }
+    left = &scriptExpr{kind: "unary", op: t.text, args: []*scriptExpr{operand}, line: t.line}
+  } else {
+    var err error
+    if left, err = p.primary(); err != nil {
+      return nil, err
+    }
+  }
+  for {
+    t := p.peek()
+    precedence, ok := script_precedence[t.text]
+    if !ok || (t.kind != 'n' && t.kind != 'o') || precedence <= min {
+      return left, nil
+    }
+    p.next()
+    if t.text == ".." {
+      precedence-- // right associative
+    }
+    right, err := p.expr(precedence)
+    if err != nil {
+      return nil, err
+    }
+    left = &scriptExpr{kind: "binary", op: t.text, args: []*scriptExpr{left, right}, line: t.line}
+  }
+}
+
+func (p *scriptParser) primary() (*scriptExpr, error) {
+  t := p.next()
+  e := &scriptExpr{kind: "const", line: t.line}
+  switch {
+  case t.kind == 'i':
+    n, err := strconv.ParseInt(t.text, 10, 64)
+    if err != nil {
+      return nil, scriptError(t.line, "integer out of range")
+    }
+    e.value = n
+  case t.kind == 's':
+    e.value = t.text
+  case t.kind == 'n' && t.text == "nil":
+  case t.kind == 'n' && (t.text == "true" || t.text == "false"):
+    e.value = t.text == "true"
+  case t.kind == 'n' && !script_keywords[t.text]:
+    e.kind, e.op = "name", t.text
+    if p.accept("(") {
+      if !script_functions[t.text] {
+        return nil, scriptError(t.line, "unknown function '" + t.text + "'")
+      }
+      e.kind = "call"
+      for !p.accept(")") {
+        if len(e.args) > 0 {
+          if err := p.expect(","); err != nil {
+            return nil, err
+          }
+        }
+        arg, err := p.expr(0)
+        if err != nil {
+          return nil, err
+        }
+        e.args = append(e.args, arg)
+      }
+    }
+  case t.kind == 'o' && t.text == "{":
+    e.kind = "array"
+    for !p.accept("}") {
+      if len(e.args) > 0 {
+        if err := p.expect(","); err != nil {
+          return nil, err
+        }
+      }
+      item, err := p.expr(0)
+      if err != nil {
+        return nil, err
+      }
+      e.args = append(e.args, item)
+    }
+  case t.kind == 'o' && t.text == "(":
+    inner, err := p.expr(0)
+    if err != nil {
+      return nil, err
+    }
+    if err := p.expect(")"); err != nil {
+      return nil, err
+    }
+    e = inner
+  default:
+    return nil, scriptError(t.line, "unexpected '" + t.text + "'")
+  }
+  for p.accept("[") {
+    index, err := p.expr(0)
+    if err != nil {
+      return nil, err
+    }
+    if err := p.expect("]"); err != nil {
+      return nil, err
+    }
+    e = &scriptExpr{kind: "index", args: []*scriptExpr{e, index}, line: t.line}
+  }
+  return e, nil
+}
+
+// one run of a script
+type scriptRun struct {
+  vars map[string]interface{}
+  keys map[string]bool // declared in KEYS
+  steps int
+  built int // bytes of the strings made by concatenation
+}
+
+const (
+  flow_next = iota
+  flow_break
+  flow_return
+)
+
+func (r *scriptRun) step(line int) error {
+  r.steps++
+  if r.steps > script_max_steps {
+    return scriptError(line, "more than " + strconv.Itoa(script_max_steps) + " steps")
+  }
+  return nil
+}
+
+// exec runs statements, returning how the block ended and the returned value
+func (r *scriptRun) exec(body []*scriptStmt) (int, interface{}, error) {
+  for _, s := range body {
+    if err := r.step(s.line); err != nil {
+      return 0, nil, err
+    }
+    switch s.kind {
+    case "local", "assign":
+      v, err := r.eval(s.exprs[0])
+      if err != nil {
+        return 0, nil, err
+      }
+      r.vars[s.name] = v
+    case "call":
+      if _, err := r.eval(s.exprs[0]); err != nil {
+        return 0, nil, err
+      }
+    case "if":
+      branch := -1
+      for i, cond := range s.exprs {
+        v, err := r.eval(cond)
+        if err != nil {
+          return 0, nil, err
+        }
+        if truthy(v) {
+          branch = i
+          break
+        }
+      }
+      if branch < 0 && len(s.blocks) > len(s.exprs) {
+        branch = len(s.exprs)
+      }
+      if branch >= 0 {
+        if flow, v, err := r.exec(s.blocks[branch]); flow != flow_next || err != nil {
+          return flow, v, err
+        }
+      }
+    case "while":
+      for {
+        cond, err := r.eval(s.exprs[0])
+        if err != nil {
+          return 0, nil, err
+        }
+        if !truthy(cond) {
+          break
+        }
+        flow, v, err := r.exec(s.blocks[0])
+        if flow == flow_return || err != nil {
+          return flow, v, err
+        }
+        if flow == flow_break {
+          break
+        }
+      }
+    case "for":
+      limits := make([]int64, 3)
+      limits[2] = 1
+      for i, e := range s.exprs {
+        v, err := r.eval(e)
+        if err != nil {
+          return 0, nil, err
+        }
+        n, ok := toInteger(v)
+        if !ok {
+          return 0, nil, scriptError(s.line, "'for' values must be integers")
+        }
+        limits[i] = n
+      }
+      first, last, step := limits[0], limits[1], limits[2]
+      if step == 0 {
+        return 0, nil, scriptError(s.line, "'for' step is zero")
+      }
+      for i := first; (step > 0 && i <= last) || (step < 0 && i >= last); i += step {
+        r.vars[s.name] = i
+        flow, v, err := r.exec(s.blocks[0])
+        if flow == flow_return || err != nil {
+          return flow, v, err
+        }
+        if flow == flow_break || (step > 0 && i > math.MaxInt64 - step) || (step < 0 && i < math.MinInt64 - step) {
+          break
+        }
+        if err := r.step(s.line); err != nil {
+          return 0, nil, err
+        }
+      }
+    case "return":
+      if len(s.exprs) == 0 {
+        return flow_return, nil, nil
+      }
+      v, err := r.eval(s.exprs[0])
+      return flow_return, v, err
+    case "break":
+      return flow_break, nil, nil
+    }
+  }
+  return flow_next, nil, nil
+}
+
+func (r *scriptRun) eval(e *scriptExpr) (interface{}, error) {
+  if err := r.step(e.line); err != nil {
+    return nil, err
+  }
+  switch e.kind {
+  case "const":
+    return e.value, nil
+  case "name":
+    return r.vars[e.op], nil // nil when it was never assigned
+  case "index":
+    container, err := r.eval(e.args[0])
+    if err != nil {
+      return nil, err
+    }
+    index, err := r.eval(e.args[1])
+    if err != nil {
+      return nil, err
+    }
+    array, ok := container.([]interface{})
+    if !ok {
+      return nil, scriptError(e.line, "attempt to index a " + typeName(container) + " value")
+    }
+    i, ok := toInteger(index)
+    if !ok {
+      return nil, scriptError(e.line, "array index must be an integer")
+    }
+    if i < 1 || i > int64(len(array)) {
+      return nil, nil
+    }
+    return array[i-1], nil
+  case "unary":
+    v, err := r.eval(e.args[0])
+    if err != nil {
+      return nil, err
+    }
+    switch e.op {
+    case "not":
+      return !truthy(v), nil
+    case "#":
+      switch v := v.(type) {
+      case string:
+        return int64(len(v)), nil
+      case []interface{}:
+        return int64(len(v)), nil
+      }
+      return nil, scriptError(e.line, "attempt to get the length of a " + typeName(v) + " value")
+    }
+    return arithmetic(e, int64(0), v)
+  case "binary":
+    left, err := r.eval(e.args[0])
+    if err != nil {
+      return nil, err
+    }
+    if e.op == "and" || e.op == "or" {
+      if truthy(left) == (e.op == "or") {
+        return left, nil
+      }
+      return r.eval(e.args[1])
+    }
+    right, err := r.eval(e.args[1])
+    if err != nil {
+      return nil, err
+    }
+    switch e.op {
+    case "==":
+      return scriptEqual(left, right), nil
+    case "~=", "!=":
+      return !scriptEqual(left, right), nil
+    case "<", "<=", ">", ">=":
+      c, err := scriptCompare(e, left, right)
+      if err != nil {
+        return nil, err
+      }
+      switch e.op {
+      case "<":
+        return c < 0, nil
+      case "<=":
+        return c <= 0, nil
+      case ">":
+        return c > 0, nil
+      }
+      return c >= 0, nil
+    case "..":
+      a, ok1 := toText(left)
+      b, ok2 := toText(right)
+      if !ok1 || !ok2 {
+        if ok1 {
+          left = right
+        }
+        return nil, scriptError(e.line, "attempt to concatenate a " + typeName(left) + " value")
+      }
+      if len(a) + len(b) > script_max_string {
+        return nil, scriptError(e.line, "string longer than " + strconv.Itoa(script_max_string) + " bytes")
+      }
+      if r.built += len(a) + len(b); r.built > script_max_built {
+        return nil, scriptError(e.line, "more than " + strconv.Itoa(script_max_built) + " bytes of strings built")
+      }
+      return a + b, nil
+    }
+    return arithmetic(e, left, right)
+  case "call", "array":
+    args := make([]interface{}, len(e.args))
+    for i, arg := range e.args {
+      v, err := r.eval(arg)
+      if err != nil {
+        return nil, err
+      }
+      args[i] = v
+    }
+    if e.kind == "array" {
+      return args, nil
+    }
+    return r.function(e, args)
+  }
+  return nil, scriptError(e.line, "bad expression")
+}
+
+func (r *scriptRun) function(e *scriptExpr, args []interface{}) (interface{}, error) {
+  if e.op != "call" && len(args) != 1 {
+    return nil, scriptError(e.line, "'" + e.op + "' takes one argument")
+  }
+  switch e.op {
+  case "tonumber":
+    if n, ok := toInteger(args[0]); ok {
+      return n, nil
+    }
+    return nil, nil
+  case "tostring":
+    if s, ok := toText(args[0]); ok {
+      return s, nil
+    }
+    switch v := args[0].(type) {
+    case nil:
+      return "nil", nil
+    case bool:
+      return strconv.FormatBool(v), nil
+    }
+    return nil, scriptError(e.line, "attempt to convert an array to a string")
+  case "error":
+    message, _ := toText(args[0])
+    return nil, errors.New("ERR " + message)
+  }
+
+  // call(command, arg ...)
+  if len(args) == 0 {
+    return nil, scriptError(e.line, "'call' needs a command")
+  }
+  command := make([]string, len(args))
+  for i, arg := range args {
+    s, ok := toText(arg)
+    if !ok {
+      return nil, scriptError(e.line, "arguments of 'call' must be strings or integers, not " + typeName(arg))
+    }
+    command[i] = s
+  }
+  if cmd, ok := commands[strings.ToUpper(command[0])]; ok {
+    if cmd.has("keyspace") || cmd.has("admin") || cmd.has("script") {
+      return nil, scriptError(e.line, "'" + strings.ToLower(cmd.name) + "' can not be called from a script")
+    }
+    if err := checkCommand(command); err != nil {
+      return nil, err
+    }
+    for _, key := range cmd.keys(command) {
+      if !r.keys[key] {
+        return nil, scriptError(e.line, "key '" + key + "' is not declared in KEYS")
+      }
+    }
+    if err := checkAccess(caller, command); err != nil {
+      return nil, err
+    }
+  }
+  reply := call(command)
+  if err, ok := reply.(error); ok {
+    return nil, err
+  }
+  return fromReply(reply), nil
+}
+
+func truthy(v interface{}) bool {
+  return v != nil && v != false
+}
+
+func typeName(v interface{}) string {
+  switch v.(type) {
+  case nil:
+    return "nil"
+  case bool:
+    return "boolean"
+  case int64:
+    return "integer"
+  case string:
+    return "string"
+  }
+  return "array"
+}
+
+func toInteger(v interface{}) (int64, bool) {
+  switch v := v.(type) {
+  case int64:
+    return v, true
+  case string:
+    n, err := strconv.ParseInt(v, 10, 64)
+    return n, err == nil
+  }
+  return 0, false
+}
+
+func toText(v interface{}) (string, bool) {
+  switch v := v.(type) {
+  case string:
+    return v, true
+  case int64:
+    return strconv.FormatInt(v, 10), true
+  }
+  return "", false
+}
+
+// scriptEqual compares values; an integer equals a string holding it
+func scriptEqual(a, b interface{}) bool {
+  _, a_int := a.(int64)
+  _, b_int := b.(int64)
+  if a_int || b_int {
+    x, ok1 := toInteger(a)
+    y, ok2 := toInteger(b)
+    return ok1 && ok2 && x == y
+  }
+  _, a_array := a.([]interface{})
+  _, b_array := b.([]interface{})
+  if a_array || b_array {
+    return false
+  }
+  return a == b
+}
+
+// scriptCompare orders integers (or strings holding them) by value, other strings as bytes
+func scriptCompare(e *scriptExpr, a, b interface{}) (int, error) {
+  x, ok1 := toInteger(a)
+  y, ok2 := toInteger(b)
+  if ok1 && ok2 {
+    switch {
+    case x < y:
+      return -1, nil
+    case x > y:
+      return 1, nil
+    }
+    return 0, nil
+  }
+  s, ok1 := a.(string)
+  t, ok2 := b.(string)
+  if ok1 && ok2 {
+    return strings.Compare(s, t), nil
+  }
+  return 0, scriptError(e.line, "attempt to compare " + typeName(a) + " with " + typeName(b))
+}
+
+func arithmetic(e *scriptExpr, left, right interface{}) (interface{}, error) {
+  a, ok := toInteger(left)
+  if !ok {
+    return nil, scriptError(e.line, "attempt to do arithmetic on a " + typeName(left) + " value")
+  }
+  b, ok := toInteger(right)
+  if !ok {
+    return nil, scriptError(e.line, "attempt to do arithmetic on a " + typeName(right) + " value")
+  }
+  overflow := false
+  var n int64
+  switch e.op {
+  case "+":
+    overflow = (b > 0 && a > math.MaxInt64 - b) || (b < 0 && a < math.MinInt64 - b)
+    n = a + b
+  case "-":
+    overflow = (b < 0 && a > math.MaxInt64 + b) || (b > 0 && a < math.MinInt64 + b)
+    n = a - b
+  case "*":
+    n = a * b
+    overflow = a != 0 && (n / a != b || (a == -1 && b == math.MinInt64))
+  case "/", "%":
+    if b == 0 {
+      return nil, scriptError(e.line, "division by zero")
+    }
+    overflow = a == math.MinInt64 && b == -1
+    if e.op == "/" {
+      n = a / b
+    } else {
+      n = a % b
+    }
+  }
+  if overflow {
+    return nil, scriptError(e.line, "integer overflow")
+  }
+  return n, nil
+}
+
+func scriptArray(items []string) []interface{} {
+  array := make([]interface{}, len(items))
+  for i, item := range items {
+    array[i] = item
+  }
+  return array
+}
+
+// fromReply turns a command reply into a script value
+func fromReply(reply interface{}) interface{} {
+  switch r := reply.(type) {
+  case Status:
+    return string(r)
+  case int:
+    return int64(r)
+  case []string:
+    return scriptArray(r)
+  case []interface{}:
+    array := make([]interface{}, len(r))
+    for i, item := range r {
+      array[i] = fromReply(item)
+    }
+    return array
+  }
+  return reply
+}
+
+// scriptReply turns the value returned by a script into a reply: true is 1
+//   and false nil, as in Redis
+func scriptReply(v interface{}) interface{} {
+  switch v := v.(type) {
+  case bool:
+    if v {
+      return int64(1)
+    }
+    return nil
+  case []interface{}:
+    reply := make([]interface{}, len(v))
+    for i, item := range v {
+      reply[i] = scriptReply(item)
+    }
+    return reply
+  }
+  return v
+}
@@ -0,0 +1,71 @@
+// Tests of scripts: the permissions of the commands a script calls, and the
+//   limits on the work of a script.
+// go test -run Script mini_redis*.go
+
+package main
+import (
+  "context"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+// withUsers loads the ACL rules for the test and restores open access after it
+func withUsers(t *testing.T, rules string) {
+  file := filepath.Join(t.TempDir(), "users.acl")
+  if err := os.WriteFile(file, []byte(rules), 0644); err != nil {
+    t.Fatal(err)
+  }
+  if err := loadACL(file, ""); err != nil {
+    t.Fatal(err)
+  }
+  t.Cleanup(func() {
+    acl_mu.Lock()
+    users, acl_file = nil, ""
+    acl_mu.Unlock()
+  })
+}
+
+func TestScriptCallsCheckedAgainstUser(t *testing.T) {
+  mu.Lock()
+  initDatabases(16)
+  mu.Unlock()
+  withUsers(t, "user reader on nopass allkeys +@read +eval\nuser writer on nopass allkeys allcommands\n")
+  reader := context.WithValue(context.Background(), userKey{}, "reader")
+  writer := context.WithValue(context.Background(), userKey{}, "writer")
+  set := []string{"EVAL", "call('SET', KEYS[1], ARGV[1]) return 1", "1", "k", "v"}
+
+  err, ok := executeContext(reader, 0, set).(error)
+  if !ok || !strings.HasPrefix(err.Error(), "NOPERM") {
+    t.Fatalf("SET from a script of a read only user: %v, want NOPERM", err)
+  }
+  if _, err := runTransaction(reader, 0, [][]string{set}, nil); err == nil || !strings.Contains(err.Error(), "NOPERM") {
+    t.Fatalf("the script in a transaction: %v, want NOPERM", err)
+  }
+  if reply := executeContext(reader, 0, []string{"GET", "k"}); reply != nil {
+    t.Fatalf("k is %v, the scripts of reader wrote it", reply)
+  }
+  if reply := executeContext(writer, 0, set); reply != int64(1) {
+    t.Fatalf("the script of writer: %v", reply)
+  }
+  get := []string{"EVAL", "return call('GET', KEYS[1])", "1", "k"}
+  if reply := executeContext(reader, 0, get); reply != "v" {
+    t.Fatalf("GET from a script of reader: %v, want \"v\"", reply)
+  }
+}
+
+func TestScriptBuildLimit(t *testing.T) {
+  mu.Lock()
+  initDatabases(16)
+  mu.Unlock()
+  // each step copies 8MB: the steps are far from -scriptsteps, the bytes are not
+  script := "local s = ARGV[1] local i = 0 while i < 100 do local t = s .. s i = i + 1 end return 1"
+  err, ok := execute(0, []string{"EVAL", script, "0", strings.Repeat("x", 4 * 1024 * 1024)}).(error)
+  if !ok || !strings.Contains(err.Error(), "bytes of strings built") {
+    t.Fatalf("copying 800MB: %v, want the error of the limit", err)
+  }
+  if reply := execute(0, []string{"EVAL", script, "0", "x"}); reply != int64(1) {
+    t.Fatalf("copying 200 bytes: %v", reply)
+  }
+}
@@ -0,0 +1,147 @@
+// Storage engines of mini_redis: every database keeps its keys in a Store,
+//   picked at startup with -engine:
+//   memory (the default) holds them in a map, with a skip list of the keys in
+//     order, and is saved to snapshot files (see mini_redis_persist.go);
+//   btree keeps them in a B+tree page file per database, -dbfile and -dbfile.n,
+//     caching the pages it reads, so the data may be larger than the memory
+//     (see mini_redis_btree.go).
+// Both walk keys in order, so COUNT, SCAN and KEYS with a prefix, or a glob
+//   pattern that starts with plain characters, only look at the keys in that
+//   range instead of every key.
+// Commands change the values they get in place: call puts back the keys a
+//   write command touched, which a store on disk encodes, and releases the
+//   store when the command is done.
+// Stores count their keys of each type as they are put and deleted, and a
+//   memory store the size of its values, so INFO does not walk the keys.
+// ./mini_redis -engine btree -dbfile data.btree
+
+package main
+import (
+  "strings"
+)
+
+type Store interface {
+  get(key string) (*Value, bool)
+  put(key string, v *Value)
+  delete(key string)
+  count() int
+  // ascend calls fn with the keys from start on, in order, and their expiration
+  //   times, until it returns false; fn must not change the store
+  ascend(start string, fn func(key string, expires int64) bool)
+  clear()
+  // release tells that no command uses the values it got any more
+  release()
+  // kinds returns the number of keys of each type; the caller must not change it
+  kinds() map[string]int64
+}
+
+var engine = "memory"
+var max_key_len = 0 // of the engine, 0 for no limit
+var call_depth = 0 // calls running, guarded by mu
+
+type MemoryStore struct {
+  values map[string]*Value
+  index *ZSet // the keys, all with score 0 so they are in key order
+  types map[string]int64 // keys of each type
+  bytes int64 // the sizes of the values when they were last put
+}
+
+func newMemoryStore(values map[string]*Value) *MemoryStore {
+  s := &MemoryStore{values, newZSet(), make(map[string]int64), 0}
+  for key, v := range values {
+    s.index.insert(0, key)
+    s.add(key, v)
+  }
+  return s
+}
+
+// add counts a value put in the store; the value remembers its size, as a
+//   command changes it in place before it is put again
+func (s *MemoryStore) add(key string, v *Value) {
+  v.counted = v.size(key)
+  s.types[v.Kind]++
+  s.bytes += v.counted
+}
+
+func (s *MemoryStore) remove(v *Value) {
+  if s.types[v.Kind]--; s.types[v.Kind] == 0 {
+    delete(s.types, v.Kind)
+  }
+  s.bytes -= v.counted
+}
+
+func (s *MemoryStore) get(key string) (*Value, bool) {
+  v, ok := s.values[key]
+  return v, ok
+}
+
+func (s *MemoryStore) put(key string, v *Value) {
+  if old, ok := s.values[key]; ok {
+    s.remove(old)
+  } else {
+    s.index.insert(0, key)
+  }
+  s.values[key] = v
+  s.add(key, v)
+}
+
+func (s *MemoryStore) delete(key string) {
+  if v, ok := s.values[key]; ok {
+    s.remove(v)
+    s.index.remove(0, key)
+    delete(s.values, key)
+  }
+}
+
+func (s *MemoryStore) count() int {
+  return len(s.values)
+}
+
+func (s *MemoryStore) ascend(start string, fn func(key string, expires int64) bool) {
+  for x := s.index.seek(0, start); x != nil; x = x.level[0].forward {
+    if !fn(x.member, s.values[x.member].Expires) {
+      return
+    }
+  }
+}
+
+func (s *MemoryStore) clear() {
+  s.values, s.index = make(map[string]*Value), newZSet()
+  s.types, s.bytes = make(map[string]int64), 0
+}
+
+func (s *MemoryStore) release() {}
+
+func (s *MemoryStore) kinds() map[string]int64 {
+  return s.types
+}
+
+// storeMap returns the keys of a store as a map, for snapshots and full syncs;
+//   that of a memory store is its own, the others are read whole
+func storeMap(s Store) map[string]*Value {
+  if m, ok := s.(*MemoryStore); ok {
+    return m.values
+  }
+  values := make(map[string]*Value, s.count())
+  s.ascend("", func(key string, expires int64) bool {
+    values[key], _ = s.get(key)
+    return true
+  })
+  s.release()
+  return values
+}
+
+// keyPrefix returns the plain start of a pattern of COUNT, SCAN or KEYS, which
+//   every key it matches begins with
+func keyPrefix(mode, pattern string) string {
+  switch mode {
+  case "", "glob":
+    if i := strings.IndexAny(pattern, "*?[\\"); i >= 0 {
+      return pattern[:i]
+    }
+    return pattern
+  case "prefix":
+    return pattern
+  }
+  return "" // a regex may match anywhere
+}
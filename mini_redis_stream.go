@@ -0,0 +1,1129 @@
+// Streams of mini_redis: an append-only log of entries, each a list of field
+//   value pairs under an ID ms-seq that only grows (the time of XADD in unix
+//   milliseconds and a sequence number within that millisecond).
+// XADD appends, XRANGE/XREVRANGE read by ID, XREAD reads the entries after an
+//   ID and with BLOCK ms waits for them (0 waits forever, $ means the entries
+//   added from now on). A stream stays when its last entry goes, as in Redis.
+// Consumer groups share a stream among workers: XREADGROUP ... > hands every
+//   entry to one consumer of the group and records it as pending until XACK,
+//   so the entries of a worker that died can be found with XPENDING and taken
+//   over with XCLAIM or XAUTOCLAIM; XREADGROUP with an ID instead of > reads
+//   the entries pending for the consumer again.
+// BLOCK is a wait without mu, like LOCK ... WAIT (see mini_redis_lock.go), and
+//   is ignored in transactions and scripts where nothing can arrive.
+// curl -X XADD -H "Content-Type: application/json" -d '["jobs","*","task","resize","id","42"]' localhost:8082
+// curl -X XGROUP -H "Content-Type: application/json" -d '["CREATE","jobs","workers","$","MKSTREAM"]' localhost:8082
+// curl -X XREADGROUP -H "Content-Type: application/json" -d '["GROUP","workers","w1","BLOCK","5000","STREAMS","jobs",">"]' localhost:8082
+// curl -X XACK -H "Content-Type: application/json" -d '["jobs","workers","1700000000000-0"]' localhost:8082
+
+package main
+import (
+  "context"
+  "errors"
+  "math"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+)
+
+type StreamID struct {
+  Ms, Seq uint64
+}
+
+type StreamEntry struct {
+  ID StreamID
+  Fields []string // field, value, field, value...
+}
+
+// Entries are in ID order; LastID is the greatest ID ever added, entries
+//   deleted since included, so IDs are never given twice
+type Stream struct {
+  Entries []StreamEntry
+  LastID StreamID
+  Groups map[string]*StreamGroup
+}
+
+// LastID is the last entry handed to the group with >, Consumers tells when
+//   each consumer was last seen (unix milliseconds)
+type StreamGroup struct {
+  LastID StreamID
+  Pending map[StreamID]*PendingEntry
+  Consumers map[string]int64
+}
+
+// an entry handed to a consumer and not acknowledged yet
+type PendingEntry struct {
+  Consumer string
+  Delivered int64 // unix milliseconds of the last delivery
+  Count int64 // number of deliveries
+}
+
+var max_stream_id = StreamID{math.MaxUint64, math.MaxUint64}
+
+var errStreamSyntax = errors.New("ERR Invalid stream ID specified as stream command argument")
+
+func init() {
+  register("XADD", -5, "write", 1, 1, 1, cmdXadd)
+  register("XLEN", 2, "", 1, 1, 1, cmdXlen)
+  register("XRANGE", -4, "", 1, 1, 1, cmdXrange)
+  register("XREVRANGE", -4, "", 1, 1, 1, cmdXrange)
+  register("XDEL", -3, "write", 1, 1, 1, cmdXdel)
+  register("XTRIM", -4, "write", 1, 1, 1, cmdXtrim)
+  register("XREAD", -4, "movablekeys", 0, 0, 0, cmdXread)
+  register("XGROUP", -4, "write", 2, 2, 1, cmdXgroup)
+  register("XREADGROUP", -7, "write movablekeys", 0, 0, 0, cmdXreadgroup)
+  register("XACK", -4, "write", 1, 1, 1, cmdXack)
+  register("XPENDING", -3, "", 1, 1, 1, cmdXpending)
+  register("XCLAIM", -6, "write", 1, 1, 1, cmdXclaim)
+  register("XAUTOCLAIM", -6, "write", 1, 1, 1, cmdXautoclaim)
+}
+
+func (id StreamID) String() string {
+  return strconv.FormatUint(id.Ms, 10) + "-" + strconv.FormatUint(id.Seq, 10)
+}
+
+func (id StreamID) less(other StreamID) bool {
+  return id.Ms < other.Ms || (id.Ms == other.Ms && id.Seq < other.Seq)
+}
+
+// next returns the ID right after id, ok is false for the greatest one
+func (id StreamID) next() (StreamID, bool) {
+  if id.Seq < math.MaxUint64 {
+    return StreamID{id.Ms, id.Seq + 1}, true
+  }
+  if id.Ms < math.MaxUint64 {
+    return StreamID{id.Ms + 1, 0}, true
+  }
+  return id, false
+}
+
+// prev returns the ID right before id, ok is false for 0-0
+func (id StreamID) prev() (StreamID, bool) {
+  if id.Seq > 0 {
+    return StreamID{id.Ms, id.Seq - 1}, true
+  }
+  if id.Ms > 0 {
+    return StreamID{id.Ms - 1, math.MaxUint64}, true
+  }
+  return id, false
+}
+
+// parseStreamID parses ms-seq, or ms alone which means ms-seq
+func parseStreamID(s string, seq uint64) (StreamID, error) {
+  ms_part, seq_part := s, ""
+  if i := strings.IndexByte(s, '-'); i >= 0 {
+    ms_part, seq_part = s[:i], s[i+1:]
+  }
+  ms, err := strconv.ParseUint(ms_part, 10, 64)
+  if err != nil {
+    return StreamID{}, errStreamSyntax
+  }
+  if seq_part != "" || strings.HasSuffix(s, "-") {
+    if seq, err = strconv.ParseUint(seq_part, 10, 64); err != nil {
+      return StreamID{}, errStreamSyntax
+    }
+  }
+  return StreamID{ms, seq}, nil
+}
+
+// parseRangeID parses a bound of XRANGE: - and + for the smallest and
+//   greatest IDs, ms for the whole millisecond, and ( in front to exclude the ID
+func parseRangeID(s string, end bool) (StreamID, error) {
+  switch s {
+  case "-":
+    return StreamID{}, nil
+  case "+":
+    return max_stream_id, nil
+  }
+  exclusive := strings.HasPrefix(s, "(")
+  var seq uint64
+  if end {
+    seq = math.MaxUint64
+  }
+  id, err := parseStreamID(strings.TrimPrefix(s, "("), seq)
+  if err != nil || !exclusive {
+    return id, err
+  }
+  ok := false
+  if end {
+    id, ok = id.prev()
+  } else {
+    id, ok = id.next()
+  }
+  if !ok {
+    return id, errors.New("ERR invalid start or end ID, it can not be incremented or decremented")
+  }
+  return id, nil
+}
+
+func newStream() *Stream {
+  return &Stream{Groups: make(map[string]*StreamGroup)}
+}
+
+// search returns the index of the first entry at id or after it
+func (s *Stream) search(id StreamID) int {
+  return sort.Search(len(s.Entries), func(i int) bool { return !s.Entries[i].ID.less(id) })
+}
+
+func (s *Stream) find(id StreamID) *StreamEntry {
+  if i := s.search(id); i < len(s.Entries) && s.Entries[i].ID == id {
+    return &s.Entries[i]
+  }
+  return nil
+}
+
+// after returns up to count entries after id, all of them for count <= 0
+func (s *Stream) after(id StreamID, count int) []StreamEntry {
+  start := sort.Search(len(s.Entries), func(i int) bool { return id.less(s.Entries[i].ID) })
+  entries := s.Entries[start:]
+  if count > 0 && len(entries) > count {
+    entries = entries[:count]
+  }
+  return entries
+}
+
+// nextID is the ID of a new entry: * makes it from the time, ms-* from the
+//   given millisecond, and an explicit one must be greater than the last one
+func (s *Stream) nextID(spec string) (StreamID, error) {
+  errSmall := errors.New("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+  last := s.LastID
+  if spec == "*" || strings.HasSuffix(spec, "-*") {
+    ms := uint64(now())
+    if spec != "*" {
+      var err error
+      if ms, err = strconv.ParseUint(strings.TrimSuffix(spec, "-*"), 10, 64); err != nil {
+        return StreamID{}, errStreamSyntax
+      }
+      if ms < last.Ms {
+        return StreamID{}, errSmall
+      }
+    }
+    if ms > last.Ms {
+      return StreamID{ms, 0}, nil
+    }
+    id, ok := last.next()
+    if !ok || (spec != "*" && id.Ms != ms) {
+      return StreamID{}, errSmall
+    }
+    if id == (StreamID{}) {
+      id.Seq = 1 // 0-0 is not a valid ID
+    }
+    return id, nil
+  }
+  id, err := parseStreamID(spec, 0)
+  if err != nil {
+    return id, err
+  }
+  if id == (StreamID{}) {
+    return id, errors.New("ERR The ID specified in XADD must be greater than 0-0")
+  }
+  if !last.less(id) {
+    return id, errSmall
+  }
+  return id, nil
+}
+
+// trim drops the oldest entries beyond maxlen, or the ones before minid,
+//   and returns how many it dropped
+func (s *Stream) trim(maxlen int64, minid *StreamID) int {
+  n := 0
+  if minid != nil {
+    n = s.search(*minid)
+  } else if int64(len(s.Entries)) > maxlen {
+    n = len(s.Entries) - int(maxlen)
+  }
+  s.Entries = s.Entries[n:]
+  return n
+}
+
+// clone returns a deep copy, for the rollback of transactions
+func (s *Stream) clone() *Stream {
+  c := &Stream{Entries: make([]StreamEntry, len(s.Entries)), LastID: s.LastID, Groups: make(map[string]*StreamGroup)}
+  for i, e := range s.Entries {
+    c.Entries[i] = StreamEntry{e.ID, append([]string{}, e.Fields...)}
+  }
+  for name, g := range s.Groups {
+    cg := &StreamGroup{g.LastID, make(map[StreamID]*PendingEntry), make(map[string]int64)}
+    for id, pe := range g.Pending {
+      p := *pe
+      cg.Pending[id] = &p
+    }
+    for consumer, seen := range g.Consumers {
+      cg.Consumers[consumer] = seen
+    }
+    c.Groups[name] = cg
+  }
+  return c
+}
+
+func (e *StreamEntry) reply() []interface{} {
+  return []interface{}{e.ID.String(), append([]string{}, e.Fields...)}
+}
+
+func entriesReply(entries []StreamEntry) []interface{} {
+  out := make([]interface{}, len(entries))
+  for i := range entries {
+    out[i] = entries[i].reply()
+  }
+  return out
+}
+
+// pendingIDs returns the IDs pending in the group in order, only those of
+//   consumer unless it is ""
+func (g *StreamGroup) pendingIDs(consumer string) []StreamID {
+  ids := make([]StreamID, 0, len(g.Pending))
+  for id, pe := range g.Pending {
+    if consumer == "" || pe.Consumer == consumer {
+      ids = append(ids, id)
+    }
+  }
+  sort.Slice(ids, func(i, j int) bool { return ids[i].less(ids[j]) })
+  return ids
+}
+
+// xaddOptions parses [NOMKSTREAM] [MAXLEN|MINID [=|~] threshold] of XADD and
+//   XTRIM from args[i] on, and returns the position of the first other argument;
+//   maxlen is -1 without a threshold (~ trims exactly here)
+func xaddOptions(args []string, i int) (int, bool, int64, *StreamID, error) {
+  nomkstream, maxlen := false, int64(-1)
+  var minid *StreamID
+  for ; i < len(args); i++ {
+    opt := strings.ToUpper(args[i])
+    if opt == "NOMKSTREAM" && strings.ToUpper(args[0]) == "XADD" {
+      nomkstream = true
+      continue
+    }
+    if (opt != "MAXLEN" && opt != "MINID") || maxlen >= 0 || minid != nil {
+      break
+    }
+    if i + 1 < len(args) && (args[i+1] == "~" || args[i+1] == "=") {
+      i++
+    }
+    if i + 1 >= len(args) {
+      return 0, false, 0, nil, errors.New("ERR syntax error")
+    }
+    i++
+    if opt == "MINID" {
+      id, err := parseStreamID(args[i], 0)
+      if err != nil {
+        return 0, false, 0, nil, err
+      }
+      minid = &id
+    } else {
+      n, err := strconv.ParseInt(args[i], 10, 64)
+      if err != nil || n < 0 {
+        return 0, false, 0, nil, errors.New("ERR The MAXLEN argument must be >= 0.")
+      }
+      maxlen = n
+    }
+  }
+  return i, nomkstream, maxlen, minid, nil
+}
+
+// XADD key [NOMKSTREAM] [MAXLEN|MINID [=|~] threshold] *|id field value [field value ...]
+func cmdXadd(args []string) interface{} {
+  i, nomkstream, maxlen, minid, err := xaddOptions(args, 2)
+  if err != nil {
+    return err
+  }
+  if i >= len(args) || len(args[i+1:]) == 0 || len(args[i+1:]) % 2 != 0 {
+    return errors.New("ERR wrong number of arguments for 'xadd' command")
+  }
+  v, err := lookup(args[1], "stream")
+  if err != nil {
+    return err
+  }
+  if v == nil && nomkstream {
+    return Unchanged{nil}
+  }
+  s := newStream()
+  if v != nil {
+    s = v.Stream
+  }
+  id, err := s.nextID(args[i])
+  if err != nil {
+    return err
+  }
+  if v == nil {
+    v, _ = lookupOrCreate(args[1], "stream")
+    s = v.Stream
+  }
+  s.Entries = append(s.Entries, StreamEntry{id, append([]string{}, args[i+1:]...)})
+  s.LastID = id
+  if maxlen >= 0 || minid != nil {
+    s.trim(maxlen, minid)
+  }
+  return id.String()
+}
+
+func cmdXlen(args []string) interface{} {
+  v, err := lookup(args[1], "stream")
+  if err != nil {
+    return err
+  }
+  if v == nil {
+    return 0
+  }
+  return len(v.Stream.Entries)
+}
+
+// XRANGE key start end [COUNT n], XREVRANGE key end start [COUNT n]
+func cmdXrange(args []string) interface{} {
+  reverse := strings.ToUpper(args[0]) == "XREVRANGE"
+  first, last := args[2], args[3]
+  if reverse {
+    first, last = last, first
+  }
+  start, err := parseRangeID(first, false)
+  if err != nil {
+    return err
+  }
+  end, err := parseRangeID(last, true)
+  if err != nil {
+    return err
+  }
+  count := -1
+  if len(args) == 6 && strings.ToUpper(args[4]) == "COUNT" {
+    if count, err = strconv.Atoi(args[5]); err != nil {
+      return errNotInteger
+    }
+  } else if len(args) != 4 {
+    return errors.New("ERR syntax error")
+  }
+  v, err := lookup(args[1], "stream")
+  if err != nil {
+    return err
+  }
+  out := []interface{}{}
+  if v == nil || count == 0 || end.less(start) {
+    return out
+  }
+  entries := v.Stream.Entries
+  i := v.Stream.search(start)
+  j := sort.Search(len(entries), func(k int) bool { return end.less(entries[k].ID) })
+  for k := i; k < j && (count < 0 || len(out) < count); k++ {
+    if reverse {
+      out = append(out, entries[j-1-(k-i)].reply())
+    } else {
+      out = append(out, entries[k].reply())
+    }
+  }
+  return out
+}
+
+// XDEL key id [id ...]: replies with the number of entries deleted
+func cmdXdel(args []string) interface{} {
+  ids := make([]StreamID, len(args) - 2)
+  for i, arg := range args[2:] {
+    id, err := parseStreamID(arg, 0)
+    if err != nil {
+      return err
+    }
+    ids[i] = id
+  }
+  v, err := lookup(args[1], "stream")
+  if err != nil {
+    return err
+  }
+  deleted := 0
+  for _, id := range ids {
+    if v == nil {
+      break
+    }
+    if i := v.Stream.search(id); i < len(v.Stream.Entries) && v.Stream.Entries[i].ID == id {
+      v.Stream.Entries = append(v.Stream.Entries[:i], v.Stream.Entries[i+1:]...)
+      deleted++
+    }
+  }
+  if deleted == 0 {
+    return Unchanged{0}
+  }
+  return deleted
+}
+
+// XTRIM key MAXLEN|MINID [=|~] threshold: replies with the number of entries dropped
+func cmdXtrim(args []string) interface{} {
+  i, _, maxlen, minid, err := xaddOptions(args, 2)
+  if err != nil {
+    return err
+  }
+  if i != len(args) || (maxlen < 0 && minid == nil) {
+    return errors.New("ERR syntax error")
+  }
+  v, err := lookup(args[1], "stream")
+  if err != nil {
+    return err
+  }
+  if v == nil {
+    return Unchanged{0}
+  }
+  if n := v.Stream.trim(maxlen, minid); n > 0 {
+    return n
+  }
+  return Unchanged{0}
+}
+
+type streamRead struct {
+  group, consumer string
+  count int
+  block time.Duration
+  blocking bool
+  noack bool
+  keys, ids []string
+}
+
+// parseStreamRead parses XREAD [COUNT n] [BLOCK ms] STREAMS key [key ...] id [id ...]
+//   and XREADGROUP GROUP group consumer [COUNT n] [BLOCK ms] [NOACK] STREAMS ...
+func parseStreamRead(args []string) (*streamRead, error) {
+  group := strings.ToUpper(args[0]) == "XREADGROUP"
+  r := &streamRead{}
+  for i := 1; i < len(args); i++ {
+    opt := strings.ToUpper(args[i])
+    switch {
+    case opt == "GROUP" && group && i + 2 < len(args):
+      r.group, r.consumer = args[i+1], args[i+2]
+      i += 2
+    case opt == "COUNT" && i + 1 < len(args):
+      n, err := strconv.Atoi(args[i+1])
+      if err != nil || n < 0 {
+        return nil, errNotInteger
+      }
+      r.count = n
+      i++
+    case opt == "BLOCK" && i + 1 < len(args):
+      ms, err := strconv.ParseInt(args[i+1], 10, 64)
+      if err != nil || ms < 0 {
+        return nil, errors.New("ERR timeout is not an integer or out of range")
+      }
+      r.block, r.blocking = time.Duration(ms) * time.Millisecond, true
+      i++
+    case opt == "NOACK" && group:
+      r.noack = true
+    case opt == "STREAMS":
+      rest := args[i+1:]
+      if len(rest) == 0 || len(rest) % 2 != 0 {
+        return nil, errors.New("ERR Unbalanced '" + strings.ToLower(args[0]) + "' list of streams: for each stream key an ID or '$' must be specified.")
+      }
+      if group && r.group == "" {
+        return nil, errors.New("ERR Missing GROUP option for XREADGROUP")
+      }
+      r.keys, r.ids = rest[:len(rest)/2], rest[len(rest)/2:]
+      return r, nil
+    default:
+      return nil, errors.New("ERR syntax error")
+    }
+  }
+  return nil, errors.New("ERR syntax error")
+}
+
+// streamKeys returns the keys of XREAD and XREADGROUP, see Command.keys
+func streamKeys(args []string) []string {
+  if r, err := parseStreamRead(args); err == nil {
+    return r.keys
+  }
+  return nil
+}
+
+// XREAD [COUNT n] [BLOCK ms] STREAMS key [key ...] id [id ...]: the entries
+//   after the IDs, nil when there are none
+func cmdXread(args []string) interface{} {
+  r, err := parseStreamRead(args)
+  if err != nil {
+    return err
+  }
+  after := make([]StreamID, len(r.keys))
+  for i, id := range r.ids {
+    if id == "$" {
+      after[i] = max_stream_id // only what is added later, for which BLOCK waits
+    } else if after[i], err = parseStreamID(id, 0); err != nil {
+      return err
+    }
+  }
+  out := []interface{}{}
+  for i, key := range r.keys {
+    v, err := lookup(key, "stream")
+    if err != nil {
+      return err
+    }
+    if v == nil {
+      continue
+    }
+    if entries := v.Stream.after(after[i], r.count); len(entries) > 0 {
+      out = append(out, []interface{}{key, entriesReply(entries)})
+    }
+  }
+  if len(out) == 0 {
+    return nil
+  }
+  return out
+}
+
+// groupOf returns the consumer group of a stream key, or the error to reply
+func groupOf(key, group, command string) (*Stream, *StreamGroup, error) {
+  v, err := lookup(key, "stream")
+  if err != nil {
+    return nil, nil, err
+  }
+  if v != nil {
+    if g := v.Stream.Groups[group]; g != nil {
+      return v.Stream, g, nil
+    }
+  }
+  return nil, nil, errors.New("NOGROUP No such key '" + key + "' or consumer group '" + group + "' in " + command)
+}
+
+// XREADGROUP GROUP group consumer [COUNT n] [BLOCK ms] [NOACK] STREAMS key [key ...] id [id ...]:
+//   with the ID >, hands the entries no consumer of the group got yet to this
+//   one (nil when there are none); with another ID, the entries after it that
+//   are pending for this consumer, nil fields for the ones deleted since
+func cmdXreadgroup(args []string) interface{} {
+  r, err := parseStreamRead(args)
+  if err != nil {
+    return err
+  }
+  after := make([]StreamID, len(r.keys))
+  for i, id := range r.ids {
+    if id == ">" {
+      continue
+    }
+    if after[i], err = parseStreamID(id, 0); err != nil {
+      return err
+    }
+  }
+  type read struct {
+    s *Stream
+    g *StreamGroup
+  }
+  reads := make([]read, len(r.keys))
+  for i, key := range r.keys {
+    s, g, err := groupOf(key, r.group, "XREADGROUP with GROUP option")
+    if err != nil {
+      return err
+    }
+    reads[i] = read{s, g}
+  }
+  t := now()
+  out := []interface{}{}
+  delivered := false
+  for i, key := range r.keys {
+    s, g := reads[i].s, reads[i].g
+    if r.ids[i] != ">" {
+      history := []interface{}{}
+      for _, id := range g.pendingIDs(r.consumer) {
+        if !after[i].less(id) {
+          continue
+        }
+        if r.count > 0 && len(history) == r.count {
+          break
+        }
+        if e := s.find(id); e != nil {
+          history = append(history, e.reply())
+        } else {
+          history = append(history, []interface{}{id.String(), nil})
+        }
+      }
+      out = append(out, []interface{}{key, history})
+      continue
+    }
+    entries := s.after(g.LastID, r.count)
+    if len(entries) == 0 {
+      continue
+    }
+    delivered = true
+    g.Consumers[r.consumer] = t
+    g.LastID = entries[len(entries)-1].ID
+    if !r.noack {
+      for _, e := range entries {
+        g.Pending[e.ID] = &PendingEntry{r.consumer, t, 1}
+      }
+    }
+    out = append(out, []interface{}{key, entriesReply(entries)})
+  }
+  switch {
+  case delivered:
+    return out
+  case len(out) == 0:
+    return Unchanged{nil}
+  }
+  return Unchanged{out}
+}
+
+// XGROUP CREATE key group id|$ [MKSTREAM], XGROUP SETID key group id|$,
+//   XGROUP DESTROY key group, XGROUP CREATECONSUMER key group consumer,
+//   XGROUP DELCONSUMER key group consumer
+func cmdXgroup(args []string) interface{} {
+  sub := strings.ToUpper(args[1])
+  key, group := args[2], args[3]
+  switch sub {
+  case "CREATE":
+    if len(args) != 5 && !(len(args) == 6 && strings.ToUpper(args[5]) == "MKSTREAM") {
+      return errors.New("ERR syntax error")
+    }
+    v, err := lookup(key, "stream")
+    if err != nil {
+      return err
+    }
+    if v == nil && len(args) != 6 {
+      return errors.New("ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+    }
+    if v != nil && v.Stream.Groups[group] != nil {
+      return errors.New("BUSYGROUP Consumer Group name already exists")
+    }
+    s := newStream()
+    if v != nil {
+      s = v.Stream
+    }
+    id, err := groupStart(s, args[4])
+    if err != nil {
+      return err
+    }
+    if v == nil {
+      v, _ = lookupOrCreate(key, "stream")
+    }
+    v.Stream.Groups[group] = &StreamGroup{id, make(map[StreamID]*PendingEntry), make(map[string]int64)}
+    return Status("OK")
+  case "SETID":
+    if len(args) != 5 {
+      return errors.New("ERR syntax error")
+    }
+    s, g, err := groupOf(key, group, "XGROUP SETID")
+    if err != nil {
+      return err
+    }
+    if g.LastID, err = groupStart(s, args[4]); err != nil {
+      return err
+    }
+    return Status("OK")
+  case "DESTROY":
+    if len(args) != 4 {
+      return errors.New("ERR syntax error")
+    }
+    s, _, err := groupOf(key, group, "XGROUP DESTROY")
+    if err == errWrongType {
+      return err
+    }
+    if err != nil {
+      return Unchanged{0}
+    }
+    delete(s.Groups, group)
+    return 1
+  case "CREATECONSUMER", "DELCONSUMER":
+    if len(args) != 5 {
+      return errors.New("ERR syntax error")
+    }
+    _, g, err := groupOf(key, group, "XGROUP " + sub)
+    if err != nil {
+      return err
+    }
+    consumer := args[4]
+    _, exists := g.Consumers[consumer]
+    if sub == "CREATECONSUMER" {
+      if exists {
+        return Unchanged{0}
+      }
+      g.Consumers[consumer] = now()
+      return 1
+    }
+    pending := g.pendingIDs(consumer)
+    for _, id := range pending {
+      delete(g.Pending, id)
+    }
+    delete(g.Consumers, consumer)
+    if !exists {
+      return Unchanged{0}
+    }
+    return len(pending)
+  }
+  return errors.New("ERR unknown subcommand '" + args[1] + "' of 'xgroup'")
+}
+
+// groupStart parses where a group starts: an ID, or $ for the last one
+func groupStart(s *Stream, spec string) (StreamID, error) {
+  if spec == "$" {
+    return s.LastID, nil
+  }
+  return parseStreamID(spec, 0)
+}
+
+// XACK key group id [id ...]: replies with the number of entries that were pending
+func cmdXack(args []string) interface{} {
+  ids := make([]StreamID, len(args) - 3)
+  for i, arg := range args[3:] {
+    id, err := parseStreamID(arg, 0)
+    if err != nil {
+      return err
+    }
+    ids[i] = id
+  }
+  _, g, err := groupOf(args[1], args[2], "XACK")
+  if err == errWrongType {
+    return err
+  }
+  acked := 0
+  for _, id := range ids {
+    if g != nil && g.Pending[id] != nil {
+      delete(g.Pending, id)
+      acked++
+    }
+  }
+  if acked == 0 {
+    return Unchanged{0}
+  }
+  return acked
+}
+
+// XPENDING key group: the number of pending entries, the smallest and greatest
+//   of their IDs and the count of each consumer;
+// XPENDING key group [IDLE ms] start end count [consumer]: the pending entries
+//   in the range, as ID, consumer, milliseconds since the last delivery and
+//   number of deliveries
+func cmdXpending(args []string) interface{} {
+  _, g, err := groupOf(args[1], args[2], "XPENDING")
+  if err != nil {
+    return err
+  }
+  if len(args) == 3 {
+    ids := g.pendingIDs("")
+    if len(ids) == 0 {
+      return []interface{}{0, nil, nil, nil}
+    }
+    counts := make(map[string]int)
+    for _, pe := range g.Pending {
+      counts[pe.Consumer]++
+    }
+    consumers := make([]string, 0, len(counts))
+    for consumer := range counts {
+      consumers = append(consumers, consumer)
+    }
+    sort.Strings(consumers)
+    per_consumer := make([]interface{}, len(consumers))
+    for i, consumer := range consumers {
+      per_consumer[i] = []string{consumer, strconv.Itoa(counts[consumer])}
+    }
+    return []interface{}{len(ids), ids[0].String(), ids[len(ids)-1].String(), per_consumer}
+  }
+
+  rest := args[3:]
+  idle := int64(0)
+  if strings.ToUpper(rest[0]) == "IDLE" && len(rest) > 1 {
+    if idle, err = strconv.ParseInt(rest[1], 10, 64); err != nil {
+      return errNotInteger
+    }
+    rest = rest[2:]
+  }
+  if len(rest) != 3 && len(rest) != 4 {
+    return errors.New("ERR syntax error")
+  }
+  start, err := parseRangeID(rest[0], false)
+  if err != nil {
+    return err
+  }
+  end, err := parseRangeID(rest[1], true)
+  if err != nil {
+    return err
+  }
+  count, err := strconv.Atoi(rest[2])
+  if err != nil {
+    return errNotInteger
+  }
+  consumer := ""
+  if len(rest) == 4 {
+    consumer = rest[3]
+  }
+  t := now()
+  out := []interface{}{}
+  for _, id := range g.pendingIDs(consumer) {
+    if len(out) >= count {
+      break
+    }
+    pe := g.Pending[id]
+    if id.less(start) || end.less(id) || t - pe.Delivered < idle {
+      continue
+    }
+    out = append(out, []interface{}{id.String(), pe.Consumer, t - pe.Delivered, pe.Count})
+  }
+  return out
+}
+
+// claim hands the pending entry id over to consumer if it was delivered at
+//   least min_idle ms ago, and returns its reply; nil when it is not claimed,
+//   and when the entry was deleted from the stream, which drops it from the group
+func claim(s *Stream, g *StreamGroup, id StreamID, consumer string, min_idle int64, justid bool) interface{} {
+  pe := g.Pending[id]
+  t := now()
+  if pe == nil || t - pe.Delivered < min_idle {
+    return nil
+  }
+  e := s.find(id)
+  if e == nil {
+    delete(g.Pending, id)
+    return nil
+  }
+  pe.Consumer, pe.Delivered = consumer, t
+  g.Consumers[consumer] = t
+  if justid {
+    return id.String()
+  }
+  pe.Count++
+  return e.reply()
+}
+
+// XCLAIM key group consumer min-idle-time id [id ...] [JUSTID]: takes over the
+//   entries pending for longer than min-idle-time ms, for the entries of a
+//   consumer that died; replies with them, or with their IDs only with JUSTID
+//   (which does not count as a delivery)
+func cmdXclaim(args []string) interface{} {
+  min_idle, err := strconv.ParseInt(args[4], 10, 64)
+  if err != nil {
+    return errors.New("ERR Invalid min-idle-time argument for XCLAIM")
+  }
+  rest := args[5:]
+  justid := strings.ToUpper(rest[len(rest)-1]) == "JUSTID"
+  if justid {
+    rest = rest[:len(rest)-1]
+  }
+  ids := make([]StreamID, len(rest))
+  for i, arg := range rest {
+    if ids[i], err = parseStreamID(arg, 0); err != nil {
+      return err
+    }
+  }
+  s, g, err := groupOf(args[1], args[2], "XCLAIM")
+  if err != nil {
+    return err
+  }
+  pending := len(g.Pending)
+  out := []interface{}{}
+  for _, id := range ids {
+    if reply := claim(s, g, id, args[3], min_idle, justid); reply != nil {
+      out = append(out, reply)
+    }
+  }
+  if len(out) == 0 && len(g.Pending) == pending {
+    return Unchanged{out}
+  }
+  return out
+}
+
+// XAUTOCLAIM key group consumer min-idle-time start [COUNT n] [JUSTID]: XCLAIM
+//   of up to n (100 by default) pending entries from start on; replies with
+//   the ID to start from next time (0-0 at the end), the entries claimed and
+//   the IDs of the entries that were deleted from the stream
+func cmdXautoclaim(args []string) interface{} {
+  min_idle, err := strconv.ParseInt(args[4], 10, 64)
+  if err != nil {
+    return errors.New("ERR Invalid min-idle-time argument for XAUTOCLAIM")
+  }
+  start, err := parseRangeID(args[5], false)
+  if err != nil {
+    return err
+  }
+  count, justid := 100, false
+  for i := 6; i < len(args); i++ {
+    switch opt := strings.ToUpper(args[i]); {
+    case opt == "COUNT" && i + 1 < len(args):
+      if count, err = strconv.Atoi(args[i+1]); err != nil || count < 1 {
+        return errors.New("ERR COUNT must be > 0")
+      }
+      i++
+    case opt == "JUSTID":
+      justid = true
+    default:
+      return errors.New("ERR syntax error")
+    }
+  }
+  s, g, err := groupOf(args[1], args[2], "XAUTOCLAIM")
+  if err != nil {
+    return err
+  }
+  claimed, deleted := []interface{}{}, []string{}
+  next := StreamID{}
+  for _, id := range g.pendingIDs("") {
+    if id.less(start) {
+      continue
+    }
+    if len(claimed) + len(deleted) == count {
+      next = id
+      break
+    }
+    if s.find(id) == nil {
+      deleted = append(deleted, id.String())
+    }
+    if reply := claim(s, g, id, args[3], min_idle, justid); reply != nil {
+      claimed = append(claimed, reply)
+    }
+  }
+  out := []interface{}{next.String(), claimed, deleted}
+  if len(claimed) == 0 && len(deleted) == 0 {
+    return Unchanged{out}
+  }
+  return out
+}
+
+// claimPropagated is the XCLAIM that does on a replica what XCLAIM or
+//   XAUTOCLAIM did here, whatever the clock of the replica says: it claims
+//   with no minimum idle time the entries claimed here, and the entries dropped
+//   here for being deleted from the stream, which the replica drops as well
+func claimPropagated(args []string, reply interface{}) []string {
+  items, _ := reply.([]interface{})
+  var ids []string
+  if strings.ToUpper(args[0]) == "XAUTOCLAIM" {
+    ids = append(ids, items[2].([]string)...)
+    items, _ = items[1].([]interface{})
+  } else {
+    _, g, _ := groupOf(args[1], args[2], "XCLAIM")
+    for _, arg := range args[5:] {
+      if id, err := parseStreamID(arg, 0); err == nil && g.Pending[id] == nil {
+        ids = append(ids, arg)
+      }
+    }
+  }
+  for _, item := range items {
+    switch v := item.(type) {
+    case string:
+      ids = append(ids, v)
+    case []interface{}:
+      ids = append(ids, v[0].(string))
+    }
+  }
+  propagated := append(append([]string{"XCLAIM"}, args[1:4]...), "0")
+  propagated = append(propagated, ids...)
+  if strings.ToUpper(args[len(args)-1]) == "JUSTID" {
+    propagated = append(propagated, "JUSTID")
+  }
+  return propagated
+}
+
+// streamBlock returns the wait of XREAD or XREADGROUP with BLOCK, and the command without it
+func streamBlock(args []string) (time.Duration, []string, bool) {
+  name := strings.ToUpper(args[0])
+  if name != "XREAD" && name != "XREADGROUP" {
+    return 0, nil, false
+  }
+  r, err := parseStreamRead(args)
+  if err != nil || !r.blocking {
+    return 0, nil, false
+  }
+  stripped := []string{}
+  for i := 0; i < len(args); i++ {
+    switch strings.ToUpper(args[i]) {
+    case "STREAMS":
+      return r.block, append(stripped, args[i:]...), true
+    case "BLOCK":
+      i++
+      continue
+    case "GROUP":
+      stripped = append(stripped, args[i:i+2]...)
+      i += 2
+    case "COUNT":
+      stripped = append(stripped, args[i])
+      i++
+    }
+    stripped = append(stripped, args[i])
+  }
+  return r.block, stripped, true
+}
+
+// readStreams runs XREAD or XREADGROUP in database n until it has entries to
+//   reply, waiting for writes to the keys in between, for up to block (0 for
+//   as long as ctx lasts)
+func readStreams(ctx context.Context, n int, args []string, block time.Duration) interface{} {
+  r, _ := parseStreamRead(args)
+  if strings.ToUpper(args[0]) == "XREAD" {
+    // $ is the last entry when the wait starts
+    args = append([]string{}, args...)
+    for i, id := range r.ids {
+      if id == "$" {
+        args[len(args) - len(r.ids) + i] = lastStreamID(n, r.keys[i])
+      }
+    }
+  }
+  var deadline <-chan time.Time
+  if block > 0 {
+    timer := time.NewTimer(block)
+    defer timer.Stop()
+    deadline = timer.C
+  }
+  var watcher *Watcher
+  if cluster == nil {
+    prefix := r.keys[0]
+    for _, key := range r.keys[1:] {
+      for !strings.HasPrefix(key, prefix) {
+        prefix = prefix[:len(prefix)-1]
+      }
+    }
+    // watching before reading, so no write in between is missed
+    mu.Lock()
+    watcher = newWatcher(n, prefix)
+    mu.Unlock()
+    defer func() {
+      mu.Lock()
+      watcher.close()
+      mu.Unlock()
+    }()
+  }
+  for {
+    if watcher != nil {
+      select {
+      case <-watcher.dropped: // fell behind the writes of other keys
+        mu.Lock()
+        watcher = newWatcher(n, watcher.prefix)
+        mu.Unlock()
+      default:
+      }
+    }
+    if reply := execute(n, args); reply != nil {
+      return reply
+    }
+    if !waitStreams(ctx, watcher, r.keys, deadline) {
+      return nil
+    }
+  }
+}
+
+// waitStreams waits for a write to one of the keys; false when the deadline
+//   passed or ctx is done first. The proxy gets no events from the nodes and
+//   tries again every lock_poll.
+func waitStreams(ctx context.Context, watcher *Watcher, keys []string, deadline <-chan time.Time) bool {
+  if watcher == nil {
+    select {
+    case <-time.After(lock_poll):
+      return true
+    case <-deadline:
+    case <-ctx.Done():
+    }
+    return false
+  }
+  for {
+    select {
+    case e := <-watcher.events:
+      if e.Key == "" {
+        return true
+      }
+      for _, key := range keys {
+        if e.Key == key {
+          return true
+        }
+      }
+    case <-watcher.dropped:
+      return true
+    case <-deadline:
+      return false
+    case <-ctx.Done():
+      return false
+    }
+  }
+}
+
+// lastStreamID returns the ID of the last entry of a stream, 0-0 when it is empty
+func lastStreamID(n int, key string) string {
+  if entries, ok := execute(n, []string{"XREVRANGE", key, "+", "-", "COUNT", "1"}).([]interface{}); ok && len(entries) > 0 {
+    if entry, ok := entries[0].([]interface{}); ok && len(entry) > 0 {
+      if id, ok := entry[0].(string); ok {
+        return id
+      }
+    }
+  }
+  return "0-0"
+}
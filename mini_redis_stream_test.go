@@ -0,0 +1,119 @@
+// Tests of streams: IDs and ranges, consumer groups with their pending
+//   entries, XACK and XCLAIM, and XREAD BLOCK woken by XADD.
+// go test -run Stream mini_redis*.go
+
+package main
+import (
+  "context"
+  "errors"
+  "reflect"
+  "testing"
+  "time"
+)
+
+// entry is the reply of a stream entry
+func entry(id string, fields ...string) []interface{} {
+  return []interface{}{id, fields}
+}
+
+func TestStreamIDs(t *testing.T) {
+  resetDatabases()
+  setClock(t, 5000)
+  runSteps(t, 0, []step{
+    {[]string{"XADD", "s", "*", "f", "1"}, "5000-0"},
+    {[]string{"XADD", "s", "*", "f", "2"}, "5000-1"},
+    {[]string{"XADD", "s", "5000-1", "f", "3"}, errors.New("ERR The ID specified in XADD is equal or smaller")},
+    {[]string{"XADD", "s", "6000-*", "f", "3"}, "6000-0"},
+    {[]string{"XADD", "s", "f"}, errors.New("ERR wrong number of arguments")},
+    {[]string{"XLEN", "s"}, 3},
+    {[]string{"XRANGE", "s", "-", "+", "COUNT", "2"}, []interface{}{entry("5000-0", "f", "1"), entry("5000-1", "f", "2")}},
+    {[]string{"XRANGE", "s", "(5000-0", "5000"}, []interface{}{entry("5000-1", "f", "2")}},
+    {[]string{"XREVRANGE", "s", "+", "-", "COUNT", "1"}, []interface{}{entry("6000-0", "f", "3")}},
+    {[]string{"XDEL", "s", "6000-0"}, 1},
+    {[]string{"XADD", "s", "*", "f", "4"}, "6000-1"}, // never an ID given before
+    {[]string{"SET", "str", "v"}, Status("OK")},
+    {[]string{"XADD", "str", "*", "f", "v"}, errWrongType},
+  })
+}
+
+func TestStreamGroupPending(t *testing.T) {
+  resetDatabases()
+  setClock(t, 1000)
+  runSteps(t, 0, []step{
+    {[]string{"XGROUP", "CREATE", "jobs", "workers", "$"}, errors.New("ERR The XGROUP subcommand requires the key to exist")},
+    {[]string{"XGROUP", "CREATE", "jobs", "workers", "$", "MKSTREAM"}, Status("OK")},
+    {[]string{"XADD", "jobs", "1-0", "task", "a"}, "1-0"},
+    {[]string{"XADD", "jobs", "2-0", "task", "b"}, "2-0"},
+    {[]string{"XADD", "jobs", "3-0", "task", "c"}, "3-0"},
+    // every entry goes to one consumer
+    {[]string{"XREADGROUP", "GROUP", "workers", "w1", "COUNT", "2", "STREAMS", "jobs", ">"},
+      []interface{}{[]interface{}{"jobs", []interface{}{entry("1-0", "task", "a"), entry("2-0", "task", "b")}}}},
+    {[]string{"XREADGROUP", "GROUP", "workers", "w2", "STREAMS", "jobs", ">"},
+      []interface{}{[]interface{}{"jobs", []interface{}{entry("3-0", "task", "c")}}}},
+    {[]string{"XREADGROUP", "GROUP", "workers", "w2", "STREAMS", "jobs", ">"}, nil},
+    {[]string{"XPENDING", "jobs", "workers"},
+      []interface{}{3, "1-0", "3-0", []interface{}{[]string{"w1", "2"}, []string{"w2", "1"}}}},
+    // reading from an ID gives the entries pending for the consumer again
+    {[]string{"XREADGROUP", "GROUP", "workers", "w1", "STREAMS", "jobs", "0"},
+      []interface{}{[]interface{}{"jobs", []interface{}{entry("1-0", "task", "a"), entry("2-0", "task", "b")}}}},
+    {[]string{"XACK", "jobs", "workers", "1-0", "9-0"}, 1},
+    {[]string{"XACK", "jobs", "workers", "1-0"}, 0},
+    {[]string{"XREADGROUP", "GROUP", "workers", "w1", "STREAMS", "jobs", "0"},
+      []interface{}{[]interface{}{"jobs", []interface{}{entry("2-0", "task", "b")}}}},
+  })
+
+  // w1 died: after 5 s its entry is claimed by w2
+  setClock(t, 4000)
+  runSteps(t, 0, []step{
+    {[]string{"XCLAIM", "jobs", "workers", "w2", "5000", "2-0"}, []interface{}{}},
+    {[]string{"XPENDING", "jobs", "workers", "-", "+", "10"},
+      []interface{}{[]interface{}{"2-0", "w1", int64(3000), int64(1)}, []interface{}{"3-0", "w2", int64(3000), int64(1)}}},
+  })
+  setClock(t, 6000)
+  runSteps(t, 0, []step{
+    {[]string{"XCLAIM", "jobs", "workers", "w2", "5000", "2-0"}, []interface{}{entry("2-0", "task", "b")}},
+    {[]string{"XPENDING", "jobs", "workers", "-", "+", "10", "w2"},
+      []interface{}{[]interface{}{"2-0", "w2", int64(0), int64(2)}, []interface{}{"3-0", "w2", int64(5000), int64(1)}}},
+    // a pending entry deleted from the stream is read as its ID only
+    {[]string{"XDEL", "jobs", "3-0"}, 1},
+    {[]string{"XREADGROUP", "GROUP", "workers", "w2", "STREAMS", "jobs", "0"},
+      []interface{}{[]interface{}{"jobs", []interface{}{entry("2-0", "task", "b"), []interface{}{"3-0", nil}}}}},
+    {[]string{"XAUTOCLAIM", "jobs", "workers", "w3", "0", "0"},
+      []interface{}{"0-0", []interface{}{entry("2-0", "task", "b")}, []string{"3-0"}}},
+    {[]string{"XPENDING", "jobs", "workers"}, []interface{}{1, "2-0", "2-0", []interface{}{[]string{"w3", "1"}}}},
+    {[]string{"XREADGROUP", "GROUP", "nosuch", "w1", "STREAMS", "jobs", ">"}, errors.New("NOGROUP")},
+  })
+}
+
+func TestStreamBlock(t *testing.T) {
+  resetDatabases()
+  execute(0, []string{"XADD", "s", "1-0", "f", "old"})
+  replies := make(chan interface{}, 1)
+  go func() {
+    replies <- executeContext(context.Background(), 0, []string{"XREAD", "BLOCK", "5000", "STREAMS", "s", "$"})
+  }()
+  time.Sleep(50 * time.Millisecond)
+  select {
+  case reply := <-replies:
+    t.Fatalf("XREAD BLOCK returned %#v before XADD", reply)
+  default:
+  }
+  execute(0, []string{"XADD", "s", "2-0", "f", "new"})
+  select {
+  case reply := <-replies:
+    want := []interface{}{[]interface{}{"s", []interface{}{entry("2-0", "f", "new")}}}
+    if !reflect.DeepEqual(reply, want) {
+      t.Fatalf("XREAD BLOCK got %#v, want %#v", reply, want)
+    }
+  case <-time.After(2 * time.Second):
+    t.Fatal("XREAD BLOCK was not woken by XADD")
+  }
+
+  start := time.Now()
+  if reply := executeContext(context.Background(), 0, []string{"XREAD", "BLOCK", "100", "STREAMS", "s", "$"}); reply != nil {
+    t.Fatalf("XREAD BLOCK without new entries got %#v", reply)
+  }
+  if d := time.Since(start); d < 100 * time.Millisecond {
+    t.Fatalf("XREAD BLOCK 100 returned after %v", d)
+  }
+}
@@ -0,0 +1,61 @@
+// Tests of the HTTP key API: versions and the conditional PUT and DELETE of
+//   X-If-Version.
+// go test -run Key mini_redis*.go
+
+package main
+import (
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+)
+
+// keyRequest serves a request to /keys/key with the headers, name and value pairs
+func keyRequest(method, key, body string, headers ...string) *httptest.ResponseRecorder {
+  req := httptest.NewRequest(method, "/keys/" + key, strings.NewReader(body))
+  for i := 0; i + 1 < len(headers); i += 2 {
+    req.Header.Set(headers[i], headers[i+1])
+  }
+  w := httptest.NewRecorder()
+  serveKey(w, req)
+  return w
+}
+
+func TestKeyIfVersion(t *testing.T) {
+  resetDatabases()
+  w := keyRequest("PUT", "k", "v1", "X-If-Version", "0")
+  if w.Code != http.StatusCreated {
+    t.Fatalf("creating with X-If-Version: 0 got %d %s", w.Code, w.Body)
+  }
+  version := w.Header().Get("X-Version")
+  if w = keyRequest("GET", "k", ""); w.Header().Get("X-Version") != version || w.Body.String() != "v1" {
+    t.Fatalf("GET got version %q and %q, want %q and v1", w.Header().Get("X-Version"), w.Body, version)
+  }
+  if w = keyRequest("PUT", "k", "again", "X-If-Version", "0"); w.Code != http.StatusPreconditionFailed {
+    t.Fatalf("creating an existing key got %d", w.Code)
+  }
+
+  // two writers holding the same version: the second one gets 412
+  if w = keyRequest("PUT", "k", "v2", "X-If-Version", version); w.Code != http.StatusOK {
+    t.Fatalf("PUT at the current version got %d %s", w.Code, w.Body)
+  }
+  if w = keyRequest("PUT", "k", "v3", "X-If-Version", version); w.Code != http.StatusPreconditionFailed {
+    t.Fatalf("PUT at a stale version got %d", w.Code)
+  }
+  if w = keyRequest("DELETE", "k", "", "X-If-Version", version); w.Code != http.StatusPreconditionFailed {
+    t.Fatalf("DELETE at a stale version got %d", w.Code)
+  }
+  if w = keyRequest("GET", "k", ""); w.Body.String() != "v2" {
+    t.Fatalf("the value is %q, want v2", w.Body)
+  }
+  if w = keyRequest("PUT", "k", "v3", "X-If-Version", "-1"); w.Code != http.StatusBadRequest {
+    t.Fatalf("a negative version got %d", w.Code)
+  }
+  current := keyRequest("GET", "k", "").Header().Get("X-Version")
+  if w = keyRequest("DELETE", "k", "", "X-If-Version", current); w.Code != http.StatusOK {
+    t.Fatalf("DELETE at the current version got %d %s", w.Code, w.Body)
+  }
+  if w = keyRequest("GET", "k", ""); w.Code != http.StatusNotFound {
+    t.Fatalf("GET after DELETE got %d", w.Code)
+  }
+}
@@ -0,0 +1,305 @@
+// List, hash and set commands of mini_redis.
+// Containers are created by the first push/add and removed when they become
+//   empty, as in Redis; using a key of another kind gives a WRONGTYPE error.
+
+package main
+import (
+  "errors"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+func init() {
+  register("LPUSH", -3, "write", 1, 1, 1, cmdPush)
+  register("RPUSH", -3, "write", 1, 1, 1, cmdPush)
+  register("LPOP", -2, "write", 1, 1, 1, cmdPop)
+  register("RPOP", -2, "write", 1, 1, 1, cmdPop)
+  register("LRANGE", 4, "", 1, 1, 1, cmdLrange)
+  register("LLEN", 2, "", 1, 1, 1, cmdLlen)
+  register("HSET", -4, "write", 1, 1, 1, cmdHset)
+  register("HGET", 3, "", 1, 1, 1, cmdHget)
+  register("HGETALL", 2, "", 1, 1, 1, cmdHgetall)
+  register("HDEL", -3, "write", 1, 1, 1, cmdHdel)
+  register("HLEN", 2, "", 1, 1, 1, cmdHlen)
+  register("SADD", -3, "write", 1, 1, 1, cmdSadd)
+  register("SREM", -3, "write", 1, 1, 1, cmdSrem)
+  register("SMEMBERS", 2, "", 1, 1, 1, cmdSmembers)
+  register("SISMEMBER", 3, "", 1, 1, 1, cmdSismember)
+  register("SCARD", 2, "", 1, 1, 1, cmdScard)
+}
+
+// LPUSH/RPUSH key element [element ...]: replies with the new length
+func cmdPush(args []string) interface{} {
+  v, err := lookupOrCreate(args[1], "list")
+  if err != nil {
+    return err
+  }
+  for _, elem := range args[2:] {
+    if strings.ToUpper(args[0]) == "LPUSH" {
+      v.List = append([]string{elem}, v.List...)
+    } else {
+      v.List = append(v.List, elem)
+    }
+  }
+  return len(v.List)
+}
+
+// LPOP/RPOP key [count]: without count replies with one element, otherwise with an array
+func cmdPop(args []string) interface{} {
+  if len(args) > 3 {
+    return errors.New("ERR syntax error")
+  }
+  count := 1
+  if len(args) == 3 {
+    n, err := strconv.Atoi(args[2])
+    if err != nil || n < 0 {
+      return errNotInteger
+    }
+    count = n
+  }
+  v, err := lookup(args[1], "list")
+  if err != nil {
+    return err
+  }
+  if v == nil {
+    return nil
+  }
+  if count > len(v.List) {
+    count = len(v.List)
+  }
+  var popped []string
+  if strings.ToUpper(args[0]) == "LPOP" {
+    popped = append(popped, v.List[:count]...)
+    v.List = v.List[count:]
+  } else {
+    for i := 0; i < count; i++ {
+      popped = append(popped, v.List[len(v.List)-1-i])
+    }
+    v.List = v.List[:len(v.List)-count]
+  }
+  if len(v.List) == 0 {
+    storage.delete(args[1])
+  }
+  if len(args) == 2 {
+    return popped[0]
+  }
+  return popped
+}
+
+// LRANGE key start stop: negative indexes count from the end, stop is inclusive
+func cmdLrange(args []string) interface{} {
+  start, err1 := strconv.Atoi(args[2])
+  stop, err2 := strconv.Atoi(args[3])
+  if err1 != nil || err2 != nil {
+    return errNotInteger
+  }
+  v, err := lookup(args[1], "list")
+  if err != nil {
+    return err
+  }
+  if v == nil {
+    return []string{}
+  }
+  start, stop = clampRange(start, stop, len(v.List))
+  if start > stop {
+    return []string{}
+  }
+  return append([]string{}, v.List[start:stop+1]...)
+}
+
+// clampRange turns Redis style start/stop indexes into valid ones for a
+//   sequence of length n; start > stop means the range is empty
+func clampRange(start, stop, n int) (int, int) {
+  if start < 0 {
+    start += n
+  }
+  if stop < 0 {
+    stop += n
+  }
+  if start < 0 {
+    start = 0
+  }
+  if stop >= n {
+    stop = n - 1
+  }
+  return start, stop
+}
+
+func cmdLlen(args []string) interface{} {
+  v, err := lookup(args[1], "list")
+  if err != nil {
+    return err
+  }
+  if v == nil {
+    return 0
+  }
+  return len(v.List)
+}
+
+// HSET key field value [field value ...]: replies with the number of new fields
+func cmdHset(args []string) interface{} {
+  if len(args) % 2 != 0 {
+    return errors.New("ERR wrong number of arguments for 'hset' command")
+  }
+  v, err := lookupOrCreate(args[1], "hash")
+  if err != nil {
+    return err
+  }
+  added := 0
+  for i := 2; i < len(args); i += 2 {
+    if _, ok := v.Hash[args[i]]; !ok {
+      added++
+    }
+    v.Hash[args[i]] = args[i+1]
+  }
+  return added
+}
+
+func cmdHget(args []string) interface{} {
+  v, err := lookup(args[1], "hash")
+  if err != nil {
+    return err
+  }
+  if v == nil {
+    return nil
+  }
+  value, ok := v.Hash[args[2]]
+  if !ok {
+    return nil
+  }
+  return value
+}
+
+// HGETALL key: replies with field, value, field, value... sorted by field
+func cmdHgetall(args []string) interface{} {
+  v, err := lookup(args[1], "hash")
+  if err != nil {
+    return err
+  }
+  out := []string{}
+  if v == nil {
+    return out
+  }
+  for _, field := range sortedKeys(v.Hash) {
+    out = append(out, field, v.Hash[field])
+  }
+  return out
+}
+
+func cmdHdel(args []string) interface{} {
+  v, err := lookup(args[1], "hash")
+  if err != nil {
+    return err
+  }
+  if v == nil {
+    return 0
+  }
+  removed := 0
+  for _, field := range args[2:] {
+    if _, ok := v.Hash[field]; ok {
+      delete(v.Hash, field)
+      removed++
+    }
+  }
+  if len(v.Hash) == 0 {
+    storage.delete(args[1])
+  }
+  return removed
+}
+
+func cmdHlen(args []string) interface{} {
+  v, err := lookup(args[1], "hash")
+  if err != nil {
+    return err
+  }
+  if v == nil {
+    return 0
+  }
+  return len(v.Hash)
+}
+
+// SADD key member [member ...]: replies with the number of new members
+func cmdSadd(args []string) interface{} {
+  v, err := lookupOrCreate(args[1], "set")
+  if err != nil {
+    return err
+  }
+  added := 0
+  for _, member := range args[2:] {
+    if !v.Set[member] {
+      v.Set[member] = true
+      added++
+    }
+  }
+  return added
+}
+
+func cmdSrem(args []string) interface{} {
+  v, err := lookup(args[1], "set")
+  if err != nil {
+    return err
+  }
+  if v == nil {
+    return 0
+  }
+  removed := 0
+  for _, member := range args[2:] {
+    if v.Set[member] {
+      delete(v.Set, member)
+      removed++
+    }
+  }
+  if len(v.Set) == 0 {
+    storage.delete(args[1])
+  }
+  return removed
+}
+
+// SMEMBERS key: members are sorted so the output is stable
+func cmdSmembers(args []string) interface{} {
+  v, err := lookup(args[1], "set")
+  if err != nil {
+    return err
+  }
+  if v == nil {
+    return []string{}
+  }
+  members := []string{}
+  for member := range v.Set {
+    members = append(members, member)
+  }
+  sort.Strings(members)
+  return members
+}
+
+func cmdSismember(args []string) interface{} {
+  v, err := lookup(args[1], "set")
+  if err != nil {
+    return err
+  }
+  if v != nil && v.Set[args[2]] {
+    return 1
+  }
+  return 0
+}
+
+func cmdScard(args []string) interface{} {
+  v, err := lookup(args[1], "set")
+  if err != nil {
+    return err
+  }
+  if v == nil {
+    return 0
+  }
+  return len(v.Set)
+}
+
+func sortedKeys(m map[string]string) []string {
+  keys := make([]string, 0, len(m))
+  for k := range m {
+    keys = append(keys, k)
+  }
+  sort.Strings(keys)
+  return keys
+}
@@ -0,0 +1,83 @@
+// Tests of lists, hashes and sets: the commands, WRONGTYPE when kinds are
+//   mixed, and the values kept by a snapshot.
+// go test -run Types mini_redis*.go
+
+package main
+import (
+  "path/filepath"
+  "testing"
+)
+
+func TestTypesCommands(t *testing.T) {
+  resetDatabases()
+  runSteps(t, 0, []step{
+    {[]string{"RPUSH", "l", "b", "c"}, 2},
+    {[]string{"LPUSH", "l", "a"}, 3},
+    {[]string{"LRANGE", "l", "0", "-1"}, []string{"a", "b", "c"}},
+    {[]string{"LRANGE", "l", "-2", "10"}, []string{"b", "c"}},
+    {[]string{"LPOP", "l"}, "a"},
+    {[]string{"RPOP", "l", "5"}, []string{"c", "b"}},
+    {[]string{"EXISTS", "l"}, 0},
+    {[]string{"LPOP", "l"}, nil},
+    {[]string{"HSET", "h", "f1", "v1", "f2", "v2"}, 2},
+    {[]string{"HSET", "h", "f1", "v3"}, 0},
+    {[]string{"HGET", "h", "f1"}, "v3"},
+    {[]string{"HGET", "h", "f9"}, nil},
+    {[]string{"HGETALL", "h"}, []string{"f1", "v3", "f2", "v2"}},
+    {[]string{"HDEL", "h", "f1", "f9"}, 1},
+    {[]string{"HLEN", "h"}, 1},
+    {[]string{"SADD", "s", "x", "y", "x"}, 2},
+    {[]string{"SISMEMBER", "s", "y"}, 1},
+    {[]string{"SREM", "s", "y", "z"}, 1},
+    {[]string{"SMEMBERS", "s"}, []string{"x"}},
+    {[]string{"SREM", "s", "x"}, 1},
+    {[]string{"EXISTS", "s"}, 0},
+  })
+}
+
+func TestTypesWrongType(t *testing.T) {
+  resetDatabases()
+  runSteps(t, 0, []step{
+    {[]string{"SET", "str", "v"}, Status("OK")},
+    {[]string{"LPUSH", "list", "a"}, 1},
+    {[]string{"HSET", "hash", "f", "v"}, 1},
+    {[]string{"SADD", "set", "m"}, 1},
+    {[]string{"LPUSH", "str", "a"}, errWrongType},
+    {[]string{"LRANGE", "hash", "0", "-1"}, errWrongType},
+    {[]string{"HSET", "list", "f", "v"}, errWrongType},
+    {[]string{"HGET", "set", "f"}, errWrongType},
+    {[]string{"SADD", "hash", "m"}, errWrongType},
+    {[]string{"SMEMBERS", "str"}, errWrongType},
+    {[]string{"GET", "list"}, errWrongType},
+    {[]string{"LRANGE", "list", "0", "-1"}, []string{"a"}}, // a failed command changes nothing
+  })
+}
+
+func TestTypesSnapshot(t *testing.T) {
+  old := dbfile
+  dbfile = filepath.Join(t.TempDir(), "dump.db")
+  defer func() { dbfile = old }()
+  resetDatabases()
+  runSteps(t, 0, []step{
+    {[]string{"RPUSH", "l", "a", "b"}, 2},
+    {[]string{"HSET", "h", "f", "v"}, 1},
+    {[]string{"SADD", "s", "m"}, 1},
+    {[]string{"ZADD", "z", "1.5", "m"}, 1},
+  })
+  mu.Lock()
+  err := saveSnapshot()
+  initDatabases(16)
+  mu.Unlock()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := loadSnapshot(); err != nil {
+    t.Fatal(err)
+  }
+  runSteps(t, 0, []step{
+    {[]string{"LRANGE", "l", "0", "-1"}, []string{"a", "b"}},
+    {[]string{"HGETALL", "h"}, []string{"f", "v"}},
+    {[]string{"SMEMBERS", "s"}, []string{"m"}},
+    {[]string{"ZSCORE", "z", "m"}, "1.5"},
+  })
+}
@@ -0,0 +1,503 @@
+// Sorted sets of mini_redis: ZADD, ZREM, ZSCORE, ZCARD, ZRANK, ZRANGE, ZRANGEBYSCORE.
+// A ZSet is a map member -> score for O(1) lookups plus a skip list ordered by
+//   (score, member), like the one in Redis. Every link of the skip list also keeps
+//   its span (how many nodes it jumps over), so finding a node by rank or the rank
+//   of a node is O(log n), and range queries are O(log n + k).
+
+package main
+import (
+  "bytes"
+  "encoding/gob"
+  "errors"
+  "math"
+  "math/rand"
+  "strconv"
+  "strings"
+)
+
+const zset_max_level = 32
+const zset_p = 0.25 // probability for a node to have one more level
+
+type zsetLevel struct {
+  forward *zsetNode
+  span int
+}
+
+type zsetNode struct {
+  member string
+  score float64
+  backward *zsetNode
+  level []zsetLevel
+}
+
+type ZSet struct {
+  dict map[string]float64
+  head *zsetNode
+  tail *zsetNode
+  length int
+  level int
+}
+
+func newZSet() *ZSet {
+  return &ZSet{
+    dict: make(map[string]float64),
+    head: &zsetNode{level: make([]zsetLevel, zset_max_level)},
+    level: 1,
+  }
+}
+
+func randomLevel() int {
+  level := 1
+  for level < zset_max_level && rand.Float64() < zset_p {
+    level++
+  }
+  return level
+}
+
+// before reports whether the node sorts before (score, member)
+func (n *zsetNode) before(score float64, member string) bool {
+  return n.score < score || (n.score == score && n.member < member)
+}
+
+// insert adds a member that is not in the skip list yet
+func (z *ZSet) insert(score float64, member string) {
+  var update [zset_max_level]*zsetNode
+  var rank [zset_max_level]int
+  x := z.head
+  for i := z.level - 1; i >= 0; i-- {
+    if i < z.level - 1 {
+      rank[i] = rank[i+1]
+    }
+    for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+      rank[i] += x.level[i].span
+      x = x.level[i].forward
+    }
+    update[i] = x
+  }
+  level := randomLevel()
+  if level > z.level {
+    for i := z.level; i < level; i++ {
+      rank[i] = 0
+      update[i] = z.head
+      update[i].level[i].span = z.length
+    }
+    z.level = level
+  }
+  x = &zsetNode{member: member, score: score, level: make([]zsetLevel, level)}
+  for i := 0; i < level; i++ {
+    x.level[i].forward = update[i].level[i].forward
+    update[i].level[i].forward = x
+    x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+    update[i].level[i].span = rank[0] - rank[i] + 1
+  }
+  for i := level; i < z.level; i++ {
+    update[i].level[i].span++
+  }
+  if update[0] != z.head {
+    x.backward = update[0]
+  }
+  if x.level[0].forward != nil {
+    x.level[0].forward.backward = x
+  } else {
+    z.tail = x
+  }
+  z.length++
+}
+
+// remove takes the node (score, member) out of the skip list
+func (z *ZSet) remove(score float64, member string) {
+  var update [zset_max_level]*zsetNode
+  x := z.head
+  for i := z.level - 1; i >= 0; i-- {
+    for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+      x = x.level[i].forward
+    }
+    update[i] = x
+  }
+  x = x.level[0].forward
+  if x == nil || x.score != score || x.member != member {
+    return
+  }
+  for i := 0; i < z.level; i++ {
+    if update[i].level[i].forward == x {
+      update[i].level[i].span += x.level[i].span - 1
+      update[i].level[i].forward = x.level[i].forward
+    } else {
+      update[i].level[i].span--
+    }
+  }
+  if x.level[0].forward != nil {
+    x.level[0].forward.backward = x.backward
+  } else {
+    z.tail = x.backward
+  }
+  for z.level > 1 && z.head.level[z.level-1].forward == nil {
+    z.level--
+  }
+  z.length--
+}
+
+// add sets the score of member, replies true when the member is new
+func (z *ZSet) add(score float64, member string) bool {
+  old, ok := z.dict[member]
+  if ok {
+    if old == score {
+      return false
+    }
+    z.remove(old, member)
+  }
+  z.insert(score, member)
+  z.dict[member] = score
+  return !ok
+}
+
+func (z *ZSet) delete(member string) bool {
+  score, ok := z.dict[member]
+  if !ok {
+    return false
+  }
+  z.remove(score, member)
+  delete(z.dict, member)
+  return true
+}
+
+// rank returns the 0-based rank of member, -1 when it is missing
+func (z *ZSet) rank(member string) int {
+  score, ok := z.dict[member]
+  if !ok {
+    return -1
+  }
+  rank := 0
+  x := z.head
+  for i := z.level - 1; i >= 0; i-- {
+    for x.level[i].forward != nil && !x.level[i].forward.beyond(score, member) {
+      rank += x.level[i].span
+      x = x.level[i].forward
+    }
+    if x != z.head && x.member == member {
+      return rank - 1
+    }
+  }
+  return -1
+}
+
+// beyond reports whether the node sorts after (score, member)
+func (n *zsetNode) beyond(score float64, member string) bool {
+  return n.score > score || (n.score == score && n.member > member)
+}
+
+// byRank returns the node at 0-based rank
+func (z *ZSet) byRank(rank int) *zsetNode {
+  traversed := 0
+  x := z.head
+  for i := z.level - 1; i >= 0; i-- {
+    for x.level[i].forward != nil && traversed + x.level[i].span <= rank + 1 {
+      traversed += x.level[i].span
+      x = x.level[i].forward
+    }
+    if traversed == rank + 1 {
+      return x
+    }
+  }
+  return nil
+}
+
+// a score interval, min and max can be excluded as in ZRANGEBYSCORE key (1 5
+type scoreRange struct {
+  min, max float64
+  minex, maxex bool
+}
+
+func (r scoreRange) aboveMin(score float64) bool {
+  if r.minex {
+    return score > r.min
+  }
+  return score >= r.min
+}
+
+func (r scoreRange) belowMax(score float64) bool {
+  if r.maxex {
+    return score < r.max
+  }
+  return score <= r.max
+}
+
+// firstInRange returns the first node with a score in r
+func (z *ZSet) firstInRange(r scoreRange) *zsetNode {
+  x := z.head
+  for i := z.level - 1; i >= 0; i-- {
+    for x.level[i].forward != nil && !r.aboveMin(x.level[i].forward.score) {
+      x = x.level[i].forward
+    }
+  }
+  x = x.level[0].forward
+  if x == nil || !r.belowMax(x.score) {
+    return nil
+  }
+  return x
+}
+
+// seek returns the first node that does not sort before (score, member)
+func (z *ZSet) seek(score float64, member string) *zsetNode {
+  x := z.head
+  for i := z.level - 1; i >= 0; i-- {
+    for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+      x = x.level[i].forward
+    }
+  }
+  return x.level[0].forward
+}
+
+// snapshots only need the members and their scores, the skip list is rebuilt on load
+func (z *ZSet) GobEncode() ([]byte, error) {
+  var buf bytes.Buffer
+  err := gob.NewEncoder(&buf).Encode(z.dict)
+  return buf.Bytes(), err
+}
+
+func (z *ZSet) GobDecode(data []byte) error {
+  var dict map[string]float64
+  if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&dict); err != nil {
+    return err
+  }
+  *z = *newZSet()
+  for member, score := range dict {
+    z.add(score, member)
+  }
+  return nil
+}
+
+func init() {
+  register("ZADD", -4, "write", 1, 1, 1, cmdZadd)
+  register("ZREM", -3, "write", 1, 1, 1, cmdZrem)
+  register("ZSCORE", 3, "", 1, 1, 1, cmdZscore)
+  register("ZCARD", 2, "", 1, 1, 1, cmdZcard)
+  register("ZRANK", 3, "", 1, 1, 1, cmdZrank)
+  register("ZRANGE", -4, "", 1, 1, 1, cmdZrange)
+  register("ZRANGEBYSCORE", -4, "", 1, 1, 1, cmdZrangebyscore)
+}
+
+func formatScore(score float64) string {
+  return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+func parseScore(s string) (float64, error) {
+  f, err := strconv.ParseFloat(s, 64)
+  if err != nil || math.IsNaN(f) {
+    return 0, errors.New("ERR value is not a valid float")
+  }
+  return f, nil
+}
+
+// parse a ZRANGEBYSCORE bound: a float, -inf/+inf, or ( followed by a float for an open bound
+func parseBound(s string) (float64, bool, error) {
+  exclusive := strings.HasPrefix(s, "(")
+  if exclusive {
+    s = s[1:]
+  }
+  f, err := parseScore(s)
+  if err != nil {
+    return 0, false, errors.New("ERR min or max is not a float")
+  }
+  return f, exclusive, nil
+}
+
+// ZADD key [NX|XX] score member [score member ...]
+func cmdZadd(args []string) interface{} {
+  nx, xx := false, false
+  i := 2
+  for ; i < len(args); i++ {
+    opt := strings.ToUpper(args[i])
+    if opt == "NX" {
+      nx = true
+    } else if opt == "XX" {
+      xx = true
+    } else {
+      break
+    }
+  }
+  pairs := args[i:]
+  if len(pairs) == 0 || len(pairs) % 2 != 0 || (nx && xx) {
+    return errors.New("ERR syntax error")
+  }
+  scores := make([]float64, len(pairs) / 2)
+  for j := range scores {
+    score, err := parseScore(pairs[2*j])
+    if err != nil {
+      return err
+    }
+    scores[j] = score
+  }
+  v, err := lookup(args[1], "zset")
+  if err != nil {
+    return err
+  }
+  if v == nil {
+    if xx {
+      return 0
+    }
+    v, _ = lookupOrCreate(args[1], "zset")
+  }
+  added := 0
+  for j, score := range scores {
+    member := pairs[2*j+1]
+    _, exists := v.ZSet.dict[member]
+    if (nx && exists) || (xx && !exists) {
+      continue
+    }
+    if v.ZSet.add(score, member) {
+      added++
+    }
+  }
+  return added
+}
+
+func cmdZrem(args []string) interface{} {
+  v, err := lookup(args[1], "zset")
+  if err != nil {
+    return err
+  }
+  if v == nil {
+    return 0
+  }
+  removed := 0
+  for _, member := range args[2:] {
+    if v.ZSet.delete(member) {
+      removed++
+    }
+  }
+  if v.ZSet.length == 0 {
+    storage.delete(args[1])
+  }
+  return removed
+}
+
+func cmdZscore(args []string) interface{} {
+  v, err := lookup(args[1], "zset")
+  if err != nil {
+    return err
+  }
+  if v == nil {
+    return nil
+  }
+  score, ok := v.ZSet.dict[args[2]]
+  if !ok {
+    return nil
+  }
+  return formatScore(score)
+}
+
+func cmdZcard(args []string) interface{} {
+  v, err := lookup(args[1], "zset")
+  if err != nil {
+    return err
+  }
+  if v == nil {
+    return 0
+  }
+  return v.ZSet.length
+}
+
+func cmdZrank(args []string) interface{} {
+  v, err := lookup(args[1], "zset")
+  if err != nil {
+    return err
+  }
+  if v == nil {
+    return nil
+  }
+  rank := v.ZSet.rank(args[2])
+  if rank < 0 {
+    return nil
+  }
+  return rank
+}
+
+// ZRANGE key start stop [WITHSCORES]: members by rank, stop is inclusive
+func cmdZrange(args []string) interface{} {
+  start, err1 := strconv.Atoi(args[2])
+  stop, err2 := strconv.Atoi(args[3])
+  if err1 != nil || err2 != nil {
+    return errNotInteger
+  }
+  withscores := false
+  if len(args) == 5 && strings.ToUpper(args[4]) == "WITHSCORES" {
+    withscores = true
+  } else if len(args) > 4 {
+    return errors.New("ERR syntax error")
+  }
+  v, err := lookup(args[1], "zset")
+  if err != nil {
+    return err
+  }
+  out := []string{}
+  if v == nil {
+    return out
+  }
+  start, stop = clampRange(start, stop, v.ZSet.length)
+  if start > stop {
+    return out
+  }
+  x := v.ZSet.byRank(start)
+  for i := start; i <= stop && x != nil; i++ {
+    out = append(out, x.member)
+    if withscores {
+      out = append(out, formatScore(x.score))
+    }
+    x = x.level[0].forward
+  }
+  return out
+}
+
+// ZRANGEBYSCORE key min max [WITHSCORES] [LIMIT offset count]
+func cmdZrangebyscore(args []string) interface{} {
+  var r scoreRange
+  var err error
+  if r.min, r.minex, err = parseBound(args[2]); err != nil {
+    return err
+  }
+  if r.max, r.maxex, err = parseBound(args[3]); err != nil {
+    return err
+  }
+  withscores := false
+  offset, limit := 0, -1
+  for i := 4; i < len(args); i++ {
+    switch strings.ToUpper(args[i]) {
+    case "WITHSCORES":
+      withscores = true
+    case "LIMIT":
+      if i + 2 >= len(args) {
+        return errors.New("ERR syntax error")
+      }
+      o, err1 := strconv.Atoi(args[i+1])
+      c, err2 := strconv.Atoi(args[i+2])
+      if err1 != nil || err2 != nil {
+        return errNotInteger
+      }
+      offset, limit = o, c
+      i += 2
+    default:
+      return errors.New("ERR syntax error")
+    }
+  }
+  v, err := lookup(args[1], "zset")
+  if err != nil {
+    return err
+  }
+  out := []string{}
+  if v == nil || offset < 0 {
+    return out
+  }
+  x := v.ZSet.firstInRange(r)
+  for ; x != nil && offset > 0; offset-- {
+    x = x.level[0].forward
+  }
+  for ; x != nil && limit != 0 && r.belowMax(x.score); x = x.level[0].forward {
+    out = append(out, x.member)
+    if withscores {
+      out = append(out, formatScore(x.score))
+    }
+    limit--
+  }
+  return out
+}
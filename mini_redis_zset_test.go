@@ -0,0 +1,91 @@
+// Tests of sorted sets: the bounds and limits of ZRANGEBYSCORE, and the ranks
+//   of the skip list checked against a sorted slice.
+// go test -run Zset mini_redis*.go
+
+package main
+import (
+  "errors"
+  "math/rand"
+  "sort"
+  "strconv"
+  "testing"
+)
+
+func TestZsetRangeByScore(t *testing.T) {
+  resetDatabases()
+  runSteps(t, 0, []step{
+    {[]string{"ZADD", "z", "1", "a", "2", "b", "2", "c", "3", "d", "-5", "e"}, 5},
+    {[]string{"ZRANGEBYSCORE", "z", "1", "2"}, []string{"a", "b", "c"}},
+    {[]string{"ZRANGEBYSCORE", "z", "(1", "2"}, []string{"b", "c"}},
+    {[]string{"ZRANGEBYSCORE", "z", "1", "(2"}, []string{"a"}},
+    {[]string{"ZRANGEBYSCORE", "z", "(1", "(2"}, []string{}},
+    {[]string{"ZRANGEBYSCORE", "z", "-inf", "+inf"}, []string{"e", "a", "b", "c", "d"}},
+    {[]string{"ZRANGEBYSCORE", "z", "(3", "+inf"}, []string{}},
+    {[]string{"ZRANGEBYSCORE", "z", "3", "1"}, []string{}},
+    {[]string{"ZRANGEBYSCORE", "z", "-inf", "2", "WITHSCORES"}, []string{"e", "-5", "a", "1", "b", "2", "c", "2"}},
+    {[]string{"ZRANGEBYSCORE", "z", "-inf", "+inf", "LIMIT", "1", "2"}, []string{"a", "b"}},
+    {[]string{"ZRANGEBYSCORE", "z", "-inf", "+inf", "LIMIT", "4", "-1"}, []string{"d"}},
+    {[]string{"ZRANGEBYSCORE", "z", "-inf", "+inf", "LIMIT", "9", "1"}, []string{}},
+    {[]string{"ZRANGEBYSCORE", "z", "-inf", "+inf", "LIMIT", "-1", "1"}, []string{}},
+    {[]string{"ZRANGEBYSCORE", "z", "a", "2"}, errors.New("ERR min or max is not a float")},
+    {[]string{"ZRANGEBYSCORE", "z", "1", "(nan"}, errors.New("ERR min or max is not a float")},
+    {[]string{"ZRANGEBYSCORE", "z", "1", "2", "LIMIT", "0"}, errors.New("ERR syntax error")},
+    {[]string{"ZRANGEBYSCORE", "missing", "-inf", "+inf"}, []string{}},
+  })
+}
+
+func TestZsetCommands(t *testing.T) {
+  resetDatabases()
+  runSteps(t, 0, []step{
+    {[]string{"ZADD", "z", "NX", "1", "a", "2", "b"}, 2},
+    {[]string{"ZADD", "z", "NX", "5", "a"}, 0},
+    {[]string{"ZADD", "z", "XX", "3", "a", "1", "new"}, 0},
+    {[]string{"ZSCORE", "z", "a"}, "3"},
+    {[]string{"ZSCORE", "z", "new"}, nil},
+    {[]string{"ZRANK", "z", "a"}, 1},
+    {[]string{"ZRANGE", "z", "0", "-1", "WITHSCORES"}, []string{"b", "2", "a", "3"}},
+    {[]string{"ZADD", "z", "NX", "XX", "1", "c"}, errors.New("ERR syntax error")},
+    {[]string{"ZADD", "z", "one", "c"}, errors.New("ERR value is not a valid float")},
+    {[]string{"ZREM", "z", "a", "b"}, 2},
+    {[]string{"EXISTS", "z"}, 0},
+    {[]string{"SET", "s", "v"}, Status("OK")},
+    {[]string{"ZADD", "s", "1", "a"}, errWrongType},
+    {[]string{"ZRANGEBYSCORE", "s", "0", "1"}, errWrongType},
+  })
+}
+
+func TestZsetRanks(t *testing.T) {
+  z := newZSet()
+  scores := make(map[string]float64)
+  r := rand.New(rand.NewSource(1))
+  for i := 0; i < 5000; i++ {
+    member := "m" + strconv.Itoa(r.Intn(1000))
+    if r.Intn(3) == 0 {
+      z.delete(member)
+      delete(scores, member)
+    } else {
+      score := float64(r.Intn(100))
+      z.add(score, member)
+      scores[member] = score
+    }
+  }
+  members := make([]string, 0, len(scores))
+  for member := range scores {
+    members = append(members, member)
+  }
+  sort.Slice(members, func(i, j int) bool {
+    a, b := members[i], members[j]
+    return scores[a] < scores[b] || (scores[a] == scores[b] && a < b)
+  })
+  if z.length != len(members) {
+    t.Fatalf("length %d, want %d", z.length, len(members))
+  }
+  for i, member := range members {
+    if rank := z.rank(member); rank != i {
+      t.Fatalf("rank of %s is %d, want %d", member, rank, i)
+    }
+    if x := z.byRank(i); x == nil || x.member != member {
+      t.Fatalf("member at rank %d is not %s", i, member)
+    }
+  }
+}
@@ -0,0 +1,590 @@
+// Command line client of mini_redis, like redis-cli, over the HTTP API
+//   (see the redisclient package)
+//
+// Run it with
+// go run redis_cli.go -h localhost:8082
+//
+// Without a command it starts an interactive prompt with history (up/down
+//   arrows, kept in ~/.mini_redis_cli_history) and completion of command
+//   names (tab). Arguments with spaces are quoted: SET greeting "hello, world"
+//   Like redis-cli, commands that carry a password (AUTH, ACL SETUSER...)
+//   are left out of the history.
+// go run redis_cli.go INCR total_records
+// go run redis_cli.go -n 3 -a s3cret LRANGE queue 0 -1
+// printf 'SET a 1\nINCR a\n' | go run redis_cli.go
+//
+// export writes the keys of the database to a file (or stdout), import loads
+//   them back, as JSON Lines or CSV, chosen by -format or the file extension
+// go run redis_cli.go export -match 'config/*' config.jsonl
+// go run redis_cli.go -h staging:8082 import config.jsonl
+//
+// Replies are shown like redis-cli does, "(integer) 2" or "1) ..." for
+//   arrays, on a terminal, and as is, one element per line, when the output
+//   goes to a pipe or with -raw.
+// SELECT and AUTH change the database and the credentials of the next
+//   commands, since HTTP requests do not share a connection.
+
+package main
+import (
+  "bufio"
+  "context"
+  "errors"
+  "flag"
+  "fmt"
+  "io"
+  "os"
+  "os/exec"
+  "path/filepath"
+  "sort"
+  "strconv"
+  "strings"
+
+  "mini_redis/redisclient"
+)
+
+var cli_commands = []string{"APPEND", "AUTH", "CLUSTER", "CONTENTTYPE", "COUNT", "DBSIZE", "DECR",
+  "DECRBY", "DEL", "DUMP", "ECHO", "EVAL", "EXISTS", "EXIT", "EXPIRE", "FLUSHALL", "FLUSHDB", "GET",
+  "HDEL", "HELP", "HGET", "HGETALL", "HLEN", "HSET", "INCR", "INCRBY", "INCRBYFLOAT", "INFO",
+  "KEYS", "LLEN", "LOCK", "LPOP", "LPUSH", "LRANGE", "MGET", "MSET", "PERSIST", "PEXPIRE",
+  "PEXPIREAT", "PING", "PTTL", "PUBLISH", "QUIT", "RENEW", "REPLICAOF", "RESTORE", "ROLE", "RPOP",
+  "RPUSH", "SADD", "SAVE", "SCAN", "SCARD", "SELECT", "SET", "SISMEMBER", "SLOWLOG", "SMEMBERS",
+  "SREM", "TTL", "TYPE", "UNLOCK", "VERSION", "XACK", "XADD", "XAUTOCLAIM", "XCLAIM", "XDEL",
+  "XGROUP", "XLEN", "XPENDING", "XRANGE", "XREAD", "XREADGROUP", "XREVRANGE", "XTRIM", "ZADD",
+  "ZCARD", "ZRANGE", "ZRANGEBYSCORE", "ZRANK", "ZREM", "ZSCORE"}
+
+// commands whose reply is a status, shown without quotes
+var status_commands = map[string]bool{"SET": true, "PING": true, "TYPE": true, "FLUSHDB": true,
+  "FLUSHALL": true, "SAVE": true, "RESTORE": true, "REPLICAOF": true, "HELP": true,
+  "SELECT": true, "AUTH": true, "MSET": true, "LOCK": true, "XGROUP": true,
+  "INFO": true}
+
+type Cli struct {
+  addr string
+  opts redisclient.ClientOptions
+  client *redisclient.MiniRedisClient
+  raw bool
+}
+
+func main() {
+  addr := flag.String("h", "localhost:8082", "address of the HTTP API of the server")
+  n := flag.Int("n", 0, "database number")
+  user := flag.String("u", "", "user name")
+  password := flag.String("a", "", "password")
+  raw := flag.Bool("raw", false, "print replies as is, the default when the output is not a terminal")
+  flag.Parse()
+
+  cli := &Cli{addr: *addr, opts: redisclient.ClientOptions{DB: *n, Username: *user, Password: *password}}
+  cli.raw = *raw || !isTerminal(os.Stdout)
+  cli.client = redisclient.NewClient(cli.addr, &cli.opts)
+
+  if flag.NArg() > 0 && (flag.Arg(0) == "export" || flag.Arg(0) == "import") {
+    if err := cli.transfer(flag.Arg(0), flag.Args()[1:]); err != nil {
+      fmt.Fprintln(os.Stderr, err)
+      os.Exit(1)
+    }
+    return
+  }
+  if flag.NArg() > 0 {
+    if !cli.run(flag.Args()) {
+      os.Exit(1)
+    }
+    return
+  }
+  if !isTerminal(os.Stdin) {
+    // batch: one command per line, the exit status tells if any failed
+    ok := true
+    scanner := bufio.NewScanner(os.Stdin)
+    scanner.Buffer(make([]byte, 64 * 1024), 512 * 1024 * 1024)
+    for scanner.Scan() {
+      args, err := splitArgs(scanner.Text())
+      if err != nil {
+        fmt.Fprintln(os.Stderr, "(error) " + err.Error())
+        ok = false
+        continue
+      }
+      if len(args) > 0 && !cli.run(args) {
+        ok = false
+      }
+    }
+    if !ok {
+      os.Exit(1)
+    }
+    return
+  }
+  cli.repl()
+}
+
+// transfer runs the export and import subcommands
+func (cli *Cli) transfer(command string, args []string) error {
+  flags := flag.NewFlagSet(command, flag.ExitOnError)
+  format := flags.String("format", "", "jsonl or csv, by default from the file extension, else jsonl")
+  match := flags.String("match", "", "glob pattern of the keys to export")
+  flags.Parse(args)
+  file := flags.Arg(0)
+  if *format == "" && strings.HasSuffix(file, ".csv") {
+    *format = "csv"
+  }
+  ctx := context.Background()
+  if command == "export" {
+    out := os.Stdout
+    if file != "" && file != "-" {
+      f, err := os.Create(file)
+      if err != nil {
+        return err
+      }
+      defer f.Close()
+      out = f
+    }
+    return cli.client.Dump(ctx, out, *format, *match)
+  }
+  in := os.Stdin
+  if file != "" && file != "-" {
+    f, err := os.Open(file)
+    if err != nil {
+      return err
+    }
+    defer f.Close()
+    in = f
+  }
+  n, err := cli.client.Restore(ctx, in, *format)
+  if err == nil {
+    fmt.Fprintln(os.Stderr, n, "keys imported")
+  }
+  return err
+}
+
+func isTerminal(f *os.File) bool {
+  info, err := f.Stat()
+  return err == nil && info.Mode() & os.ModeCharDevice != 0
+}
+
+func (cli *Cli) prompt() string {
+  if cli.opts.DB != 0 {
+    return fmt.Sprintf("%s[%d]> ", cli.addr, cli.opts.DB)
+  }
+  return cli.addr + "> "
+}
+
+func (cli *Cli) repl() {
+  home, _ := os.UserHomeDir()
+  history_file := filepath.Join(home, ".mini_redis_cli_history")
+  editor := &LineEditor{in: bufio.NewReader(os.Stdin), complete: completeCommand}
+  editor.loadHistory(history_file)
+  for {
+    line, err := editor.readLine(cli.prompt())
+    if err != nil {
+      return
+    }
+    args, err := splitArgs(line)
+    if err != nil {
+      fmt.Println("(error) " + err.Error())
+      continue
+    }
+    if len(args) == 0 {
+      continue
+    }
+    if !sensitive(args) {
+      editor.addHistory(line, history_file)
+    }
+    if name := strings.ToUpper(args[0]); name == "QUIT" || name == "EXIT" {
+      return
+    }
+    cli.run(args)
+  }
+}
+
+// run executes a command and prints its reply; false if it failed
+func (cli *Cli) run(args []string) bool {
+  name := strings.ToUpper(args[0])
+  var reply interface{}
+  var err error
+  switch name {
+  case "SELECT":
+    if len(args) != 2 {
+      err = errors.New("ERR wrong number of arguments for 'select' command")
+      break
+    }
+    n, e := strconv.Atoi(args[1])
+    if e != nil || n < 0 {
+      err = errors.New("ERR DB index is out of range")
+      break
+    }
+    opts := cli.opts
+    opts.DB = n
+    if err = cli.check(opts); err == nil {
+      cli.opts, cli.client, reply = opts, redisclient.NewClient(cli.addr, &opts), "OK"
+    }
+  case "AUTH":
+    opts := cli.opts
+    switch len(args) {
+    case 2:
+      opts.Username, opts.Password = "", args[1]
+    case 3:
+      opts.Username, opts.Password = args[1], args[2]
+    default:
+      err = errors.New("ERR wrong number of arguments for 'auth' command")
+    }
+    if err == nil {
+      if err = cli.check(opts); err == nil {
+        cli.opts, cli.client, reply = opts, redisclient.NewClient(cli.addr, &opts), "OK"
+      }
+    }
+  case "HELP":
+    reply = "commands: " + strings.Join(cli_commands, " ")
+  case "MULTI", "EXEC", "DISCARD", "WATCH", "UNWATCH", "SUBSCRIBE", "PSUBSCRIBE":
+    err = errors.New("ERR " + name + " needs a connection, use redis-cli on the RESP port")
+  default:
+    reply, err = cli.client.Do(context.Background(), args...)
+  }
+  if err != nil {
+    if cli.raw {
+      fmt.Fprintln(os.Stderr, err.Error())
+    } else {
+      fmt.Println("(error) " + strings.TrimPrefix(err.Error(), "mini_redis: "))
+    }
+    return false
+  }
+  if cli.raw {
+    printRaw(os.Stdout, reply)
+  } else {
+    printHuman(os.Stdout, reply, "", status_commands[name])
+  }
+  return true
+}
+
+// check tries the database and the credentials of opts before they are used
+func (cli *Cli) check(opts redisclient.ClientOptions) error {
+  _, err := redisclient.NewClient(cli.addr, &opts).Count(context.Background(), "")
+  if err == redisclient.ErrNotFound {
+    return errors.New("ERR DB index is out of range")
+  }
+  return err
+}
+
+func printRaw(w io.Writer, reply interface{}) {
+  switch v := reply.(type) {
+  case nil:
+    fmt.Fprintln(w)
+  case []interface{}:
+    for _, item := range v {
+      printRaw(w, item)
+    }
+  case map[string]interface{}:
+    for _, key := range sortedKeys(v) {
+      fmt.Fprintln(w, key)
+      printRaw(w, v[key])
+    }
+  case float64:
+    fmt.Fprintln(w, strconv.FormatFloat(v, 'f', -1, 64))
+  default:
+    fmt.Fprintln(w, v)
+  }
+}
+
+// printHuman prints a reply like redis-cli; indent is the width of the
+//   numbering of the enclosing arrays
+func printHuman(w io.Writer, reply interface{}, indent string, status bool) {
+  switch v := reply.(type) {
+  case nil:
+    fmt.Fprintln(w, "(nil)")
+  case int64:
+    fmt.Fprintf(w, "(integer) %d\n", v)
+  case float64: // a number inside a JSON array
+    fmt.Fprintf(w, "(integer) %s\n", strconv.FormatFloat(v, 'f', -1, 64))
+  case string:
+    if status {
+      fmt.Fprintln(w, v)
+    } else {
+      fmt.Fprintln(w, strconv.Quote(v))
+    }
+  case []interface{}:
+    if len(v) == 0 {
+      fmt.Fprintln(w, "(empty array)")
+    }
+    width := len(strconv.Itoa(len(v)))
+    for i, item := range v {
+      if i > 0 {
+        fmt.Fprint(w, indent)
+      }
+      number := fmt.Sprintf("%*d) ", width, i + 1)
+      fmt.Fprint(w, number)
+      printHuman(w, item, indent + strings.Repeat(" ", len(number)), false)
+    }
+  case map[string]interface{}:
+    items := []interface{}{}
+    for _, key := range sortedKeys(v) {
+      items = append(items, key, v[key])
+    }
+    printHuman(w, items, indent, false)
+  default:
+    fmt.Fprintln(w, v)
+  }
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+  keys := make([]string, 0, len(m))
+  for key := range m {
+    keys = append(keys, key)
+  }
+  sort.Strings(keys)
+  return keys
+}
+
+// splitArgs splits a command line into arguments like redis-cli: by spaces,
+//   with "double quotes" that take \n, \t, \" and \xHH escapes and 'single quotes'
+//   that take none
+func splitArgs(line string) ([]string, error) {
+  var args []string
+  i := 0
+  for {
+    for i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+      i++
+    }
+    if i == len(line) {
+      return args, nil
+    }
+    var arg strings.Builder
+    for i < len(line) && line[i] != ' ' && line[i] != '\t' {
+      switch line[i] {
+      case '"':
+        i++
+        for {
+          if i == len(line) {
+            return nil, errors.New("unbalanced quotes")
+          }
+          c := line[i]
+          if c == '"' {
+            i++
+            break
+          }
+          if c == '\\' && i + 1 < len(line) {
+            i++
+            switch line[i] {
+            case 'n':
+              c = '\n'
+            case 'r':
+              c = '\r'
+            case 't':
+              c = '\t'
+            case 'x':
+              c = 'x'
+              if i + 3 <= len(line) {
+                if n, err := strconv.ParseUint(line[i+1:i+3], 16, 8); err == nil {
+                  c = byte(n)
+                  i += 2
+                }
+              }
+            default:
+              c = line[i]
+            }
+          }
+          arg.WriteByte(c)
+          i++
+        }
+      case '\'':
+        end := strings.IndexByte(line[i+1:], '\'')
+        if end < 0 {
+          return nil, errors.New("unbalanced quotes")
+        }
+        arg.WriteString(line[i+1:i+1+end])
+        i += end + 2
+      default:
+        arg.WriteByte(line[i])
+        i++
+      }
+    }
+    args = append(args, arg.String())
+  }
+}
+
+// completeCommand completes the command name, the first word of the line
+func completeCommand(line string) []string {
+  if strings.ContainsAny(line, " \t") {
+    return nil
+  }
+  var matches []string
+  for _, name := range cli_commands {
+    if strings.HasPrefix(name, strings.ToUpper(line)) {
+      matches = append(matches, name)
+    }
+  }
+  return matches
+}
+
+// LineEditor reads lines from the terminal with editing, history and
+//   completion; the terminal is in raw mode only while a line is read
+type LineEditor struct {
+  in *bufio.Reader
+  history []string
+  complete func(line string) []string
+}
+
+const max_history = 1000
+
+func (e *LineEditor) loadHistory(file string) {
+  data, err := os.ReadFile(file)
+  if err != nil {
+    return
+  }
+  e.history = strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+  if len(e.history) > max_history {
+    e.history = e.history[len(e.history) - max_history:]
+  }
+}
+
+// sensitive reports whether a command may carry a password, which the history
+//   file must not keep
+func sensitive(args []string) bool {
+  sub := ""
+  if len(args) > 1 {
+    sub = strings.ToUpper(args[1])
+  }
+  switch strings.ToUpper(args[0]) {
+  case "AUTH":
+    return true
+  case "ACL":
+    return sub == "SETUSER"
+  case "CONFIG":
+    return sub == "SET" && len(args) > 2 && strings.Contains(strings.ToLower(args[2]), "pass")
+  case "HELLO", "MIGRATE":
+    for _, arg := range args[1:] {
+      if strings.ToUpper(arg) == "AUTH" || strings.ToUpper(arg) == "AUTH2" {
+        return true
+      }
+    }
+  }
+  return false
+}
+
+func (e *LineEditor) addHistory(line, file string) {
+  if len(e.history) > 0 && e.history[len(e.history) - 1] == line {
+    return
+  }
+  e.history = append(e.history, line)
+  if f, err := os.OpenFile(file, os.O_APPEND | os.O_CREATE | os.O_WRONLY, 0600); err == nil {
+    fmt.Fprintln(f, line)
+    f.Close()
+  }
+}
+
+func stty(args ...string) error {
+  cmd := exec.Command("stty", args...)
+  cmd.Stdin = os.Stdin
+  return cmd.Run()
+}
+
+// readLine returns the next line, io.EOF on Ctrl-D on an empty line
+func (e *LineEditor) readLine(prompt string) (string, error) {
+  if err := stty("raw", "-echo"); err != nil {
+    // no line editing without stty, read the line as is
+    fmt.Print(prompt)
+    line, err := e.in.ReadString('\n')
+    return strings.TrimRight(line, "\r\n"), err
+  }
+  defer stty("-raw", "echo")
+
+  line := []rune{}
+  pos := 0 // of the cursor in line
+  current := len(e.history) // position in history, len(history) for the new line
+  saved := "" // the new line while browsing the history
+  redraw := func() {
+    fmt.Print("\r\x1b[K" + prompt + string(line))
+    if back := len(line) - pos; back > 0 {
+      fmt.Printf("\x1b[%dD", back)
+    }
+  }
+  fmt.Print(prompt)
+  in := e.in
+  for {
+    r, _, err := in.ReadRune()
+    if err != nil {
+      return "", err
+    }
+    switch r {
+    case '\r', '\n':
+      fmt.Print("\r\n")
+      return string(line), nil
+    case 3: // Ctrl-C drops the line
+      fmt.Print("^C\r\n" + prompt)
+      line, pos = line[:0], 0
+    case 4: // Ctrl-D
+      if len(line) == 0 {
+        fmt.Print("\r\n")
+        return "", io.EOF
+      }
+    case 127, 8: // backspace
+      if pos > 0 {
+        line = append(line[:pos-1], line[pos:]...)
+        pos--
+        redraw()
+      }
+    case 1: // Ctrl-A
+      pos = 0
+      redraw()
+    case 5: // Ctrl-E
+      pos = len(line)
+      redraw()
+    case 21: // Ctrl-U
+      line, pos = line[pos:], 0
+      redraw()
+    case '\t':
+      matches := e.complete(string(line))
+      if len(matches) == 1 {
+        line, pos = []rune(matches[0] + " "), len(matches[0]) + 1
+        redraw()
+      } else if len(matches) > 1 {
+        line = []rune(commonPrefix(matches))
+        pos = len(line)
+        fmt.Print("\r\n" + strings.Join(matches, "  ") + "\r\n")
+        redraw()
+      }
+    case 27: // escape sequences of the arrow keys
+      if b, _ := in.ReadByte(); b != '[' {
+        continue
+      }
+      b, _ := in.ReadByte()
+      switch b {
+      case 'A', 'B':
+        if current == len(e.history) {
+          saved = string(line)
+        }
+        if b == 'A' && current > 0 {
+          current--
+        } else if b == 'B' && current < len(e.history) {
+          current++
+        }
+        if current == len(e.history) {
+          line = []rune(saved)
+        } else {
+          line = []rune(e.history[current])
+        }
+        pos = len(line)
+      case 'C':
+        if pos < len(line) {
+          pos++
+        }
+      case 'D':
+        if pos > 0 {
+          pos--
+        }
+      }
+      redraw()
+    default:
+      if r >= ' ' {
+        line = append(line[:pos], append([]rune{r}, line[pos:]...)...)
+        pos++
+        redraw()
+      }
+    }
+  }
+}
+
+func commonPrefix(words []string) string {
+  prefix := words[0]
+  for _, word := range words[1:] {
+    for !strings.HasPrefix(word, prefix) {
+      prefix = prefix[:len(prefix) - 1]
+    }
+  }
+  return prefix
+}
@@ -0,0 +1,642 @@
+// Package redisclient is the Go client of mini_redis, over its HTTP API.
+// Services import it as mini_redis/redisclient; the command line client
+//   redis_cli.go is built on it.
+//
+//   c := redisclient.NewClient("localhost:8082", nil)
+//   err := c.Put(ctx, "config/a", "1")
+//   v, err := c.Get(ctx, "config/a")  // redisclient.ErrNotFound when the key does not exist
+//   n, err := c.Incr(ctx, "hits")
+//   err := c.PutNX(ctx, "leader", "worker-1")  // redisclient.ErrConflict when the key exists
+//   reply, err := c.Do(ctx, "HSET", "user:1", "name", "bob")  // any other command
+//   err := c.Dump(ctx, file, "jsonl", "")  // the whole database, Restore loads it back
+//   token, err := c.Lock(ctx, "deploy", 30*time.Second, 10*time.Second)  // redisclient.ErrLocked after the wait
+//   entries, err := c.XReadGroup(ctx, "workers", "w1", "jobs", 10, 5*time.Second)  // then XAck
+//
+// Connections are pooled by the HTTP transport. A request that failed on the
+//   network or got a 502/503/504 is tried again with an exponential backoff,
+//   as long as trying again is safe: always for reads and for Put/Delete,
+//   and only when the connection could not be made for the other commands.
+// A reply that is an error of the server is a *ServerError, except for missing
+//   keys which are ErrNotFound.
+package redisclient
+import (
+  "bytes"
+  "context"
+  crand "crypto/rand"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "io"
+  "math/rand"
+  "net"
+  "net/http"
+  "net/url"
+  "strconv"
+  "strings"
+  "time"
+)
+
+type ClientOptions struct {
+  DB int // logical database
+  Username string // for basic auth, with Password
+  Password string
+  MaxConns int // connections to the server, 16 by default
+  Timeout time.Duration // of one attempt, 10s by default
+  Retries int // attempts after the first one, 3 by default, -1 for none
+  Backoff time.Duration // wait before the first retry, doubled for each next one, 50ms by default
+}
+
+type MiniRedisClient struct {
+  base string
+  opts ClientOptions
+  http *http.Client
+}
+
+// ErrNotFound is returned for a key that does not exist
+var ErrNotFound = errors.New("mini_redis: key not found")
+
+// ErrConflict is returned when the condition of a conditional write is not met
+var ErrConflict = errors.New("mini_redis: condition not met")
+
+// ErrLocked is returned by Lock when another owner still holds the lock
+var ErrLocked = errors.New("mini_redis: lock held by another owner")
+
+// ServerError is an error reply of the server; Code is the first word of the
+//   message, like WRONGTYPE, NOPERM or ERR
+type ServerError struct {
+  StatusCode int
+  Code string
+  Message string
+}
+
+func (e *ServerError) Error() string {
+  return "mini_redis: " + e.Message
+}
+
+// NewClient returns a client of the server at addr (host:port or an http:// URL)
+func NewClient(addr string, opts *ClientOptions) *MiniRedisClient {
+  o := ClientOptions{}
+  if opts != nil {
+    o = *opts
+  }
+  if o.MaxConns <= 0 {
+    o.MaxConns = 16
+  }
+  if o.Timeout <= 0 {
+    o.Timeout = 10 * time.Second
+  }
+  if o.Retries == 0 {
+    o.Retries = 3
+  }
+  if o.Backoff <= 0 {
+    o.Backoff = 50 * time.Millisecond
+  }
+  if !strings.Contains(addr, "://") {
+    addr = "http://" + addr
+  }
+  base := strings.TrimSuffix(addr, "/")
+  if o.DB != 0 {
+    base += "/db/" + strconv.Itoa(o.DB)
+  }
+  transport := &http.Transport{
+    Proxy: http.ProxyFromEnvironment,
+    MaxIdleConnsPerHost: o.MaxConns,
+    MaxConnsPerHost: o.MaxConns,
+    IdleConnTimeout: 90 * time.Second,
+  }
+  return &MiniRedisClient{base, o, &http.Client{Transport: transport, Timeout: o.Timeout}}
+}
+
+// Get returns the value of a string key
+func (c *MiniRedisClient) Get(ctx context.Context, key string) (string, error) {
+  value, _, err := c.GetVersion(ctx, key)
+  return value, err
+}
+
+// GetVersion returns the value of a string key and its version, for PutIfVersion
+func (c *MiniRedisClient) GetVersion(ctx context.Context, key string) (string, int64, error) {
+  reply, header, err := c.request(ctx, "GET", "/keys/" + url.PathEscape(key), nil, nil, true)
+  if err != nil {
+    return "", 0, err
+  }
+  version, _ := strconv.ParseInt(header.Get("X-Version"), 10, 64)
+  return string(reply), version, nil
+}
+
+// Put sets a string key, removing its expiration
+func (c *MiniRedisClient) Put(ctx context.Context, key, value string) error {
+  _, _, err := c.request(ctx, "PUT", "/keys/" + url.PathEscape(key), nil, []byte(value), true)
+  return err
+}
+
+// PutTTL sets a string key that expires after ttl
+func (c *MiniRedisClient) PutTTL(ctx context.Context, key, value string, ttl time.Duration) error {
+  _, _, err := c.request(ctx, "PUT", "/keys/" + url.PathEscape(key) + "?ttl=" + ttl.String(), nil, []byte(value), true)
+  return err
+}
+
+// GetContent returns the value of a string key as bytes, and its content type:
+//   the one it was stored with, or else the one the server guesses from the value
+func (c *MiniRedisClient) GetContent(ctx context.Context, key string) ([]byte, string, error) {
+  reply, header, err := c.request(ctx, "GET", "/keys/" + url.PathEscape(key), nil, nil, true)
+  if err != nil {
+    return nil, "", err
+  }
+  return reply, header.Get("Content-Type"), nil
+}
+
+// PutContent sets a string key to any bytes, stored with their content type
+//   so GetContent gives it back
+func (c *MiniRedisClient) PutContent(ctx context.Context, key string, value []byte, content_type string) error {
+  var header http.Header
+  if content_type != "" {
+    header = http.Header{"Content-Type": {content_type}}
+  }
+  _, _, err := c.request(ctx, "PUT", "/keys/" + url.PathEscape(key), header, value, true)
+  return err
+}
+
+// PutIfVersion sets a string key only if it is at the version, 0 meaning
+//   that it must not exist, and returns the new version; ErrConflict when
+//   the key is at another version
+func (c *MiniRedisClient) PutIfVersion(ctx context.Context, key, value string, version int64) (int64, error) {
+  header := http.Header{"X-If-Version": {strconv.FormatInt(version, 10)}}
+  _, reply_header, err := c.request(ctx, "PUT", "/keys/" + url.PathEscape(key), header, []byte(value), false)
+  if err != nil {
+    return 0, conflict(err)
+  }
+  return strconv.ParseInt(reply_header.Get("X-Version"), 10, 64)
+}
+
+// PutNX sets a string key only if it does not exist, ErrConflict if it does
+func (c *MiniRedisClient) PutNX(ctx context.Context, key, value string) error {
+  return c.setIf(ctx, key, value, "NX")
+}
+
+// PutXX sets a string key only if it exists, ErrConflict if it does not
+func (c *MiniRedisClient) PutXX(ctx context.Context, key, value string) error {
+  return c.setIf(ctx, key, value, "XX")
+}
+
+// CompareAndSwap sets a string key to value only if it holds old, ErrConflict if not
+func (c *MiniRedisClient) CompareAndSwap(ctx context.Context, key, old, value string) error {
+  return c.setIf(ctx, key, value, "IFEQ", old)
+}
+
+func (c *MiniRedisClient) setIf(ctx context.Context, key, value string, condition ...string) error {
+  _, err := c.command(ctx, false, append([]string{"SET", key, value}, condition...))
+  return conflict(err)
+}
+
+// Delete removes a key, ErrNotFound when there was none
+func (c *MiniRedisClient) Delete(ctx context.Context, key string) error {
+  _, _, err := c.request(ctx, "DELETE", "/keys/" + url.PathEscape(key), nil, nil, true)
+  return err
+}
+
+// DeleteIfVersion removes a key only if it is at the version, ErrConflict if not
+func (c *MiniRedisClient) DeleteIfVersion(ctx context.Context, key string, version int64) error {
+  header := http.Header{"X-If-Version": {strconv.FormatInt(version, 10)}}
+  _, _, err := c.request(ctx, "DELETE", "/keys/" + url.PathEscape(key), header, nil, false)
+  return conflict(err)
+}
+
+// conflict turns the error of a failed condition into ErrConflict
+func conflict(err error) error {
+  if e, ok := err.(*ServerError); ok && e.StatusCode == http.StatusPreconditionFailed {
+    return ErrConflict
+  }
+  return err
+}
+
+// Lock takes the lock key for ttl, waiting up to wait while another owner
+//   holds it, and returns the token that Renew and Unlock need. The token is
+//   made here, so a Lock that is tried again after a network failure finds the
+//   lock already its own.
+func (c *MiniRedisClient) Lock(ctx context.Context, key string, ttl, wait time.Duration) (string, error) {
+  b := make([]byte, 16)
+  if _, err := crand.Read(b); err != nil {
+    return "", err
+  }
+  token := hex.EncodeToString(b)
+  path := "/locks/" + url.PathEscape(key) + "?ttl=" + ttl.String() + "&wait=" + wait.String()
+  var err error
+  if wait > 0 {
+    // the wait may be longer than the timeout of a request
+    var resp *http.Response
+    if resp, err = c.stream(ctx, "POST", path, nil, strings.NewReader(token)); err == nil {
+      resp.Body.Close()
+    }
+  } else {
+    _, _, err = c.request(ctx, "POST", path, nil, []byte(token), true)
+  }
+  if e, ok := err.(*ServerError); ok && e.StatusCode == http.StatusLocked {
+    return "", ErrLocked
+  }
+  if err != nil {
+    return "", err
+  }
+  return token, nil
+}
+
+// Renew extends a lock taken with Lock to ttl from now, ErrConflict when it
+//   is no longer held with the token (it expired, and maybe someone else took it)
+func (c *MiniRedisClient) Renew(ctx context.Context, key, token string, ttl time.Duration) error {
+  path := "/locks/" + url.PathEscape(key) + "?ttl=" + ttl.String()
+  _, _, err := c.request(ctx, "PUT", path, nil, []byte(token), true)
+  return conflict(err)
+}
+
+// Unlock releases a lock taken with Lock, ErrConflict when it is no longer held
+//   with the token
+func (c *MiniRedisClient) Unlock(ctx context.Context, key, token string) error {
+  _, _, err := c.request(ctx, "DELETE", "/locks/" + url.PathEscape(key), nil, []byte(token), false)
+  return conflict(err)
+}
+
+// StreamEntry is an entry of a stream; Fields is nil for an entry read again
+//   from the pending ones of a consumer after it was deleted from the stream
+type StreamEntry struct {
+  ID string
+  Fields map[string]string
+}
+
+// XAdd appends an entry of field, value pairs to a stream and returns its ID
+func (c *MiniRedisClient) XAdd(ctx context.Context, key string, fields ...string) (string, error) {
+  body, err := c.command(ctx, false, append([]string{"XADD", key, "*"}, fields...))
+  return string(body), err
+}
+
+// XRead returns up to count entries of a stream after the ID (0 for all of
+//   them, "$" for the ones added from now on), waiting up to block for some
+//   when there are none (0 returns at once)
+func (c *MiniRedisClient) XRead(ctx context.Context, key, after string, count int, block time.Duration) ([]StreamEntry, error) {
+  return c.readStream(ctx, []string{"XREAD"}, key, after, count, block)
+}
+
+// XReadGroup hands up to count entries of a stream that no other consumer of
+//   the group got to this consumer, waiting up to block for some; they stay
+//   pending for the group until XAck
+func (c *MiniRedisClient) XReadGroup(ctx context.Context, group, consumer, key string, count int, block time.Duration) ([]StreamEntry, error) {
+  return c.readStream(ctx, []string{"XREADGROUP", "GROUP", group, consumer}, key, ">", count, block)
+}
+
+func (c *MiniRedisClient) readStream(ctx context.Context, command []string, key, after string, count int, block time.Duration) ([]StreamEntry, error) {
+  if count > 0 {
+    command = append(command, "COUNT", strconv.Itoa(count))
+  }
+  if block > 0 {
+    command = append(command, "BLOCK", strconv.FormatInt(int64(block / time.Millisecond), 10))
+  }
+  body, err := c.command(ctx, false, append(command, "STREAMS", key, after))
+  if err != nil {
+    return nil, err
+  }
+  // [[key, [[id, [field, value, ...]], ...]]], or [] when nothing arrived
+  var streams [][]json.RawMessage
+  if err := json.Unmarshal(body, &streams); err != nil {
+    return nil, err
+  }
+  entries := []StreamEntry{}
+  for _, stream := range streams {
+    var items [][]json.RawMessage
+    if len(stream) != 2 || json.Unmarshal(stream[1], &items) != nil {
+      return nil, errors.New("mini_redis: unexpected reply of " + command[0])
+    }
+    for _, item := range items {
+      var e StreamEntry
+      var fields []string
+      if len(item) != 2 || json.Unmarshal(item[0], &e.ID) != nil || json.Unmarshal(item[1], &fields) != nil {
+        return nil, errors.New("mini_redis: unexpected reply of " + command[0])
+      }
+      if fields != nil {
+        e.Fields = make(map[string]string, len(fields) / 2)
+        for i := 0; i + 1 < len(fields); i += 2 {
+          e.Fields[fields[i]] = fields[i+1]
+        }
+      }
+      entries = append(entries, e)
+    }
+  }
+  return entries, nil
+}
+
+// XAck acknowledges entries handed to a consumer of the group, and returns
+//   how many of them were still pending
+func (c *MiniRedisClient) XAck(ctx context.Context, key, group string, ids ...string) (int64, error) {
+  return c.integer(ctx, true, append([]string{"XACK", key, group}, ids...)...)
+}
+
+// Count returns the number of keys matching a glob pattern, all of them for ""
+func (c *MiniRedisClient) Count(ctx context.Context, pattern string) (int64, error) {
+  return c.integer(ctx, true, "COUNT", pattern)
+}
+
+// Scan returns a page of keys matching a glob pattern ("" for all) and the
+//   cursor of the next page; start with cursor "0", it is "0" again at the end
+func (c *MiniRedisClient) Scan(ctx context.Context, cursor, match string, count int) ([]string, string, error) {
+  query := url.Values{"cursor": {cursor}}
+  if match != "" {
+    query.Set("match", match)
+  }
+  if count > 0 {
+    query.Set("count", strconv.Itoa(count))
+  }
+  body, _, err := c.request(ctx, "GET", "/scan?" + query.Encode(), nil, nil, true)
+  if err != nil {
+    return nil, "", err
+  }
+  var page struct {
+    Cursor string `json:"cursor"`
+    Keys []string `json:"keys"`
+  }
+  if err := json.Unmarshal(body, &page); err != nil {
+    return nil, "", err
+  }
+  return page.Keys, page.Cursor, nil
+}
+
+// Info returns the sections of INFO asked for (all of them for none) as maps
+//   from field to value, see mini_redis_info.go in the server
+func (c *MiniRedisClient) Info(ctx context.Context, sections ...string) (map[string]map[string]interface{}, error) {
+  query := url.Values{"section": sections}
+  body, _, err := c.request(ctx, "GET", "/info?" + query.Encode(), nil, nil, true)
+  if err != nil {
+    return nil, err
+  }
+  var info map[string]map[string]interface{}
+  err = json.Unmarshal(body, &info)
+  return info, err
+}
+
+// MSet sets several string keys at once
+func (c *MiniRedisClient) MSet(ctx context.Context, values map[string]string) error {
+  args := []string{"MSET"}
+  for key, value := range values {
+    args = append(args, key, value)
+  }
+  _, err := c.command(ctx, true, args)
+  return err
+}
+
+// MGet returns the values of several string keys, nil for the missing ones
+func (c *MiniRedisClient) MGet(ctx context.Context, keys ...string) ([]*string, error) {
+  body, err := c.command(ctx, true, append([]string{"MGET"}, keys...))
+  if err != nil {
+    return nil, err
+  }
+  var values []*string
+  err = json.Unmarshal(body, &values)
+  return values, err
+}
+
+// Dump writes the keys matching a glob pattern ("" for all) to w, as JSON
+//   Lines or, with format "csv", as CSV (see mini_redis_bulk.go in the server)
+func (c *MiniRedisClient) Dump(ctx context.Context, w io.Writer, format, match string) error {
+  query := url.Values{}
+  if format != "" {
+    query.Set("format", format)
+  }
+  if match != "" {
+    query.Set("match", match)
+  }
+  resp, err := c.stream(ctx, "GET", "/dump?" + query.Encode(), nil, nil)
+  if err != nil {
+    return err
+  }
+  defer resp.Body.Close()
+  _, err = io.Copy(w, resp.Body)
+  return err
+}
+
+// Restore writes the keys of a dump read from r and returns how many
+func (c *MiniRedisClient) Restore(ctx context.Context, r io.Reader, format string) (int, error) {
+  path := "/restore"
+  if format != "" {
+    path += "?format=" + url.QueryEscape(format)
+  }
+  resp, err := c.stream(ctx, "POST", path, nil, r)
+  if err != nil {
+    return 0, err
+  }
+  defer resp.Body.Close()
+  var result struct {
+    Restored int `json:"restored"`
+  }
+  err = json.NewDecoder(resp.Body).Decode(&result)
+  return result.Restored, err
+}
+
+// Eval runs a script on the server (see mini_redis_script.go in the server) and returns its
+//   reply like Do
+func (c *MiniRedisClient) Eval(ctx context.Context, script string, keys []string, args ...string) (interface{}, error) {
+  command := append([]string{"EVAL", script, strconv.Itoa(len(keys))}, keys...)
+  return c.Do(ctx, append(command, args...)...)
+}
+
+// Incr adds 1 to an integer key and returns the new value
+func (c *MiniRedisClient) Incr(ctx context.Context, key string) (int64, error) {
+  return c.integer(ctx, false, "INCR", key)
+}
+
+// IncrBy adds n to an integer key and returns the new value
+func (c *MiniRedisClient) IncrBy(ctx context.Context, key string, n int64) (int64, error) {
+  return c.integer(ctx, false, "INCRBY", key, strconv.FormatInt(n, 10))
+}
+
+func (c *MiniRedisClient) integer(ctx context.Context, idempotent bool, args ...string) (int64, error) {
+  body, err := c.command(ctx, idempotent, args)
+  if err != nil {
+    return 0, err
+  }
+  return strconv.ParseInt(string(body), 10, 64)
+}
+
+// Do runs any command and returns its reply: nil, a string, an int64 for
+//   integer replies, or a []interface{} for arrays. A missing key is a nil
+//   reply here, not ErrNotFound.
+func (c *MiniRedisClient) Do(ctx context.Context, args ...string) (interface{}, error) {
+  if len(args) == 0 {
+    return nil, errors.New("mini_redis: empty command")
+  }
+  body, err := c.command(ctx, false, args)
+  if err == ErrNotFound {
+    return nil, nil
+  }
+  if err != nil {
+    return nil, err
+  }
+  if json.Valid(body) && len(body) > 0 && (body[0] == '[' || body[0] == '{') {
+    var reply interface{}
+    if err := json.Unmarshal(body, &reply); err == nil {
+      return reply, nil
+    }
+  }
+  if n, err := strconv.ParseInt(string(body), 10, 64); err == nil && integerReply(args[0]) {
+    return n, nil
+  }
+  return string(body), nil
+}
+
+// integerReply tells the commands whose reply is an integer, the HTTP API
+//   sends them as text like strings
+func integerReply(name string) bool {
+  switch strings.ToUpper(name) {
+  case "INCR", "DECR", "INCRBY", "DECRBY", "DEL", "EXISTS", "DBSIZE", "COUNT", "EXPIRE", "PEXPIRE",
+      "PEXPIREAT", "TTL", "PTTL", "PERSIST", "LPUSH", "RPUSH", "LLEN", "HSET", "HDEL", "HLEN",
+      "SADD", "SREM", "SISMEMBER", "SCARD", "ZADD", "ZREM", "ZCARD", "ZRANK", "PUBLISH", "VERSION",
+      "UNLOCK", "RENEW", "XLEN", "XDEL", "XTRIM", "XACK", "SLOWLOG":
+    return true
+  }
+  return false
+}
+
+// command sends a command with the command name as the method and the
+//   arguments as a JSON array, except GET and COUNT which "/" serves itself
+//   and take the key or the pattern as the body
+func (c *MiniRedisClient) command(ctx context.Context, idempotent bool, args []string) ([]byte, error) {
+  name := strings.ToUpper(args[0])
+  switch {
+  case name == "GET" && len(args) == 2:
+    return replyBody(c.request(ctx, "GET", "/", nil, []byte(args[1]), true))
+  case name == "COUNT" && len(args) == 2:
+    return replyBody(c.request(ctx, "COUNT", "/", nil, []byte(args[1]), true))
+  case name == "COUNT" && len(args) == 4 && strings.ToUpper(args[2]) == "MODE":
+    return replyBody(c.request(ctx, "COUNT", "/?mode=" + url.QueryEscape(args[3]), nil, []byte(args[1]), true))
+  }
+  body, err := json.Marshal(args[1:])
+  if err != nil {
+    return nil, err
+  }
+  header := http.Header{"Content-Type": {"application/json"}}
+  if blocks(args) {
+    // the wait may be longer than the timeout of a request
+    resp, err := c.stream(ctx, name, "/", header, bytes.NewReader(body))
+    if err != nil {
+      return nil, err
+    }
+    defer resp.Body.Close()
+    return io.ReadAll(resp.Body)
+  }
+  return replyBody(c.request(ctx, name, "/", header, body, idempotent))
+}
+
+// blocks tells the commands that wait on the server: XREAD and XREADGROUP
+//   with BLOCK, LOCK with WAIT
+func blocks(args []string) bool {
+  switch strings.ToUpper(args[0]) {
+  case "XREAD", "XREADGROUP", "LOCK":
+    for _, arg := range args[1:] {
+      if option := strings.ToUpper(arg); option == "BLOCK" || option == "WAIT" {
+        return true
+      }
+    }
+  }
+  return false
+}
+
+func replyBody(reply []byte, header http.Header, err error) ([]byte, error) {
+  return reply, err
+}
+
+// request sends a request, trying again on the failures that allow it, and
+//   returns the body and the headers of the reply
+func (c *MiniRedisClient) request(ctx context.Context, method, path string, header http.Header, body []byte, idempotent bool) ([]byte, http.Header, error) {
+  backoff := c.opts.Backoff
+  for attempt := 0; ; attempt++ {
+    reply, reply_header, err, retry := c.attempt(ctx, method, path, header, body, idempotent)
+    if err == nil || !retry || attempt >= c.opts.Retries || ctx.Err() != nil {
+      return reply, reply_header, err
+    }
+    // full jitter, so clients that failed together do not retry together
+    wait := time.Duration(rand.Int63n(int64(backoff)) + 1)
+    select {
+    case <-time.After(wait):
+    case <-ctx.Done():
+      return nil, nil, ctx.Err()
+    }
+    if backoff < 2 * time.Second {
+      backoff *= 2
+    }
+  }
+}
+
+func (c *MiniRedisClient) attempt(ctx context.Context, method, path string, header http.Header, body []byte, idempotent bool) ([]byte, http.Header, error, bool) {
+  req, err := http.NewRequestWithContext(ctx, method, c.base + path, bytes.NewReader(body))
+  if err != nil {
+    return nil, nil, err, false
+  }
+  for name, values := range header {
+    req.Header[name] = values
+  }
+  if c.opts.Username != "" || c.opts.Password != "" {
+    req.SetBasicAuth(c.opts.Username, c.opts.Password)
+  }
+  resp, err := c.http.Do(req)
+  if err != nil {
+    var op *net.OpError
+    refused := errors.As(err, &op) && op.Op == "dial"
+    return nil, nil, err, idempotent || refused
+  }
+  defer resp.Body.Close()
+  reply, err := io.ReadAll(resp.Body)
+  if err != nil {
+    return nil, nil, err, idempotent
+  }
+  if err = replyError(resp.StatusCode, reply); err == nil {
+    return reply, resp.Header, nil, false
+  }
+  switch resp.StatusCode {
+  case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+    return nil, nil, err, idempotent
+  }
+  return nil, nil, err, false
+}
+
+// replyError returns the error of a reply, nil for a success
+func replyError(status int, reply []byte) error {
+  switch {
+  case status < 300:
+    return nil
+  case status == http.StatusNotFound:
+    return ErrNotFound
+  }
+  message := strings.TrimSpace(string(reply))
+  code := message
+  if i := strings.IndexByte(message, ' '); i >= 0 {
+    code = message[:i]
+  }
+  if code != strings.ToUpper(code) {
+    code = "ERR" // not an error reply of a command, e.g. "method not allowed"
+  }
+  return &ServerError{status, code, message}
+}
+
+// stream sends a request whose body or reply may be too large to hold in
+//   memory, so it is tried once and without the timeout of the other requests;
+//   the caller closes the body of the response
+func (c *MiniRedisClient) stream(ctx context.Context, method, path string, header http.Header, body io.Reader) (*http.Response, error) {
+  req, err := http.NewRequestWithContext(ctx, method, c.base + path, body)
+  if err != nil {
+    return nil, err
+  }
+  for name, values := range header {
+    req.Header[name] = values
+  }
+  if c.opts.Username != "" || c.opts.Password != "" {
+    req.SetBasicAuth(c.opts.Username, c.opts.Password)
+  }
+  resp, err := (&http.Client{Transport: c.http.Transport}).Do(req)
+  if err != nil {
+    return nil, err
+  }
+  if resp.StatusCode >= 300 {
+    defer resp.Body.Close()
+    reply, _ := io.ReadAll(resp.Body)
+    if err := replyError(resp.StatusCode, reply); err != ErrNotFound {
+      return nil, err
+    }
+    return nil, &ServerError{resp.StatusCode, "ERR", strings.TrimSpace(string(reply))}
+  }
+  return resp, nil
+}
@@ -0,0 +1,130 @@
+// Tests of how the client handles the replies of a server, with handlers that
+//   fail on purpose; mini_redis_client_test.go tests it against the server.
+
+package redisclient
+import (
+  "context"
+  "errors"
+  "net/http"
+  "net/http/httptest"
+  "sync/atomic"
+  "testing"
+  "time"
+)
+
+// newFailingServer answers with status and message for the first failures
+//   requests, then with 200 and "ok"; calls counts the requests
+func newFailingServer(t *testing.T, failures int32, status int, message string) (*MiniRedisClient, *int32) {
+  calls := new(int32)
+  server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+    if atomic.AddInt32(calls, 1) <= failures {
+      http.Error(w, message, status)
+      return
+    }
+    w.Write([]byte("ok"))
+  }))
+  t.Cleanup(server.Close)
+  return NewClient(server.URL, &ClientOptions{Backoff: time.Millisecond}), calls
+}
+
+func TestRetryWithBackoff(t *testing.T) {
+  c, calls := newFailingServer(t, 2, http.StatusServiceUnavailable, "ERR the node is loading")
+  value, err := c.Get(context.Background(), "k")
+  if err != nil || value != "ok" {
+    t.Fatalf("Get: %q %v, want \"ok\" after two retries", value, err)
+  }
+  if *calls != 3 {
+    t.Fatalf("%d requests, want 3", *calls)
+  }
+}
+
+func TestRetryGivesUp(t *testing.T) {
+  c, calls := newFailingServer(t, 100, http.StatusBadGateway, "ERR node localhost:6381: connection refused")
+  _, err := c.Get(context.Background(), "k")
+  var server_err *ServerError
+  if !errors.As(err, &server_err) || server_err.StatusCode != http.StatusBadGateway {
+    t.Fatalf("Get: %v, want the 502 as a *ServerError", err)
+  }
+  if *calls != 4 {
+    t.Fatalf("%d requests, want the first one and 3 retries", *calls)
+  }
+
+  c.opts.Retries = -1
+  atomic.StoreInt32(calls, 0)
+  c.Get(context.Background(), "k")
+  if *calls != 1 {
+    t.Fatalf("%d requests with Retries -1, want 1", *calls)
+  }
+}
+
+func TestNoRetryOfWrites(t *testing.T) {
+  // the INCR may have been applied before the reply was lost
+  c, calls := newFailingServer(t, 2, http.StatusGatewayTimeout, "ERR timed out")
+  if _, err := c.Incr(context.Background(), "k"); err == nil {
+    t.Fatal("Incr succeeded on a 504")
+  }
+  if *calls != 1 {
+    t.Fatalf("%d requests for an Incr, want 1", *calls)
+  }
+}
+
+func TestNoRetryOfCommandErrors(t *testing.T) {
+  c, calls := newFailingServer(t, 2, http.StatusBadRequest, "ERR syntax error")
+  if _, err := c.Get(context.Background(), "k"); err == nil {
+    t.Fatal("Get succeeded on a 400")
+  }
+  if *calls != 1 {
+    t.Fatalf("%d requests after a 400, want 1", *calls)
+  }
+}
+
+func TestBackoffStopsWithTheContext(t *testing.T) {
+  c, _ := newFailingServer(t, 100, http.StatusServiceUnavailable, "ERR loading")
+  c.opts.Backoff, c.opts.Retries = time.Minute, 5
+  ctx, cancel := context.WithTimeout(context.Background(), 100 * time.Millisecond)
+  defer cancel()
+  start := time.Now()
+  _, err := c.Get(ctx, "k")
+  if err == nil || time.Since(start) > 5 * time.Second {
+    t.Fatalf("Get: %v after %v, want the error of the context right away", err, time.Since(start))
+  }
+}
+
+func TestErrorMapping(t *testing.T) {
+  tests := []struct {
+    status int
+    message string
+    want error
+    code string
+  }{
+    {http.StatusNotFound, "key not found", ErrNotFound, ""},
+    {http.StatusBadRequest, "WRONGTYPE Operation against a key holding the wrong kind of value", nil, "WRONGTYPE"},
+    {http.StatusForbidden, "NOPERM this user has no permissions to run the 'get' command", nil, "NOPERM"},
+    {http.StatusMethodNotAllowed, "method not allowed", nil, "ERR"},
+    {http.StatusInternalServerError, "ERR something broke", nil, "ERR"},
+  }
+  for _, test := range tests {
+    c, _ := newFailingServer(t, 1, test.status, test.message)
+    c.opts.Retries = -1
+    _, err := c.Get(context.Background(), "k")
+    if test.want != nil {
+      if err != test.want {
+        t.Errorf("%d %q: %v, want %v", test.status, test.message, err, test.want)
+      }
+      continue
+    }
+    var server_err *ServerError
+    if !errors.As(err, &server_err) {
+      t.Errorf("%d %q: %v, want a *ServerError", test.status, test.message, err)
+      continue
+    }
+    if server_err.StatusCode != test.status || server_err.Code != test.code || server_err.Message != test.message {
+      t.Errorf("%d %q: got %+v, want code %s", test.status, test.message, *server_err, test.code)
+    }
+  }
+
+  c, _ := newFailingServer(t, 1, http.StatusPreconditionFailed, "the condition of SET is not met")
+  if err := c.PutNX(context.Background(), "k", "v"); err != ErrConflict {
+    t.Errorf("412 for PutNX: %v, want ErrConflict", err)
+  }
+}